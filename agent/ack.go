@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+)
+
+// seenTaskLimit bounds how many acknowledged task IDs are remembered for
+// dropping redeliveries.
+const seenTaskLimit = 1024
+
+type AckPayload struct {
+	Seq uint64 `json:"seq"`
+}
+
+type pendingResult struct {
+	ts      int64
+	encoded []byte
+}
+
+// ackTracker numbers the task results sent in protocol 2 sessions and keeps
+// each one until the admin acks its seq. Whatever is unacked when the
+// session ends goes to the outbox and is replayed after the next
+// registration, so a result written just before a disconnect is not lost.
+// It also remembers task IDs delivered with a seq, so a task the admin
+// redelivers after a reconnect runs only once.
+type ackTracker struct {
+	mu        sync.Mutex
+	seq       uint64
+	pending   map[uint64]pendingResult
+	seenTasks map[string]struct{}
+	seenOrder []string
+}
+
+func (a *ackTracker) track(encoded []byte) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending == nil {
+		a.pending = make(map[uint64]pendingResult)
+	}
+	a.seq++
+	a.pending[a.seq] = pendingResult{ts: nowMS(), encoded: encoded}
+	return a.seq
+}
+
+func (a *ackTracker) ack(seq uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, seq)
+}
+
+// takePending removes and returns the unacked results, oldest first.
+func (a *ackTracker) takePending() []pendingResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	results := make([]pendingResult, 0, len(a.pending))
+	for seq := uint64(1); seq <= a.seq && len(results) < len(a.pending); seq++ {
+		if result, ok := a.pending[seq]; ok {
+			results = append(results, result)
+		}
+	}
+	a.pending = nil
+	return results
+}
+
+// firstDelivery records taskID and reports whether it is new.
+func (a *ackTracker) firstDelivery(taskID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seenTasks == nil {
+		a.seenTasks = make(map[string]struct{})
+	}
+	if _, ok := a.seenTasks[taskID]; ok {
+		return false
+	}
+	a.seenTasks[taskID] = struct{}{}
+	a.seenOrder = append(a.seenOrder, taskID)
+	if len(a.seenOrder) > seenTaskLimit {
+		delete(a.seenTasks, a.seenOrder[0])
+		a.seenOrder = a.seenOrder[1:]
+	}
+	return true
+}
+
+// peerAcks reports whether the current session's admin acks task results.
+func (c *AgentClient) peerAcks() bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return c.protocol >= 2
+}
+
+// requeueUnacked moves results the admin never acked into the outbox.
+func (c *AgentClient) requeueUnacked() {
+	pending := c.acks.takePending()
+	if len(pending) == 0 {
+		return
+	}
+	c.logger().Info("requeueing unacknowledged results", "count", len(pending))
+	for _, result := range pending {
+		c.outbox.add("task_result", result.ts, result.encoded)
+	}
+}
+
+func (c *AgentClient) sendAck(seq uint64) {
+	if seq != 0 {
+		_ = c.send("ack", AckPayload{Seq: seq})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import "math"
+
+const (
+	anomalyAlpha       = 0.1
+	anomalyWarmup      = 10
+	anomalyEnterZ      = 3.0
+	anomalyExitZ       = 1.5
+	anomalyEnterCount  = 3
+	anomalyExitCount   = 3
+	anomalyMinStddevMS = 2.0
+)
+
+type EventPayload struct {
+	Kind     string                 `json:"kind"`
+	Severity string                 `json:"severity"`
+	Message  string                 `json:"message"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// latencyDetector tracks an EWMA baseline of probe latency and flags
+// sustained deviations. Samples taken while an anomaly is active do not move
+// the baseline, so a long outage cannot become the new normal.
+type latencyDetector struct {
+	mean     float64
+	variance float64
+	samples  int
+	active   bool
+	above    int
+	below    int
+}
+
+type anomalyTransition struct {
+	raised    bool
+	latencyMS float64
+	mean      float64
+	stddev    float64
+	zScore    float64
+}
+
+func (d *latencyDetector) observe(latencyMS float64) *anomalyTransition {
+	if d.samples < anomalyWarmup {
+		d.update(latencyMS)
+		return nil
+	}
+
+	stddev := math.Max(math.Sqrt(d.variance), anomalyMinStddevMS)
+	z := (latencyMS - d.mean) / stddev
+	transition := &anomalyTransition{latencyMS: latencyMS, mean: d.mean, stddev: stddev, zScore: z}
+
+	if !d.active {
+		if z >= anomalyEnterZ {
+			d.above++
+		} else {
+			d.above = 0
+			d.update(latencyMS)
+		}
+		if d.above >= anomalyEnterCount {
+			d.active = true
+			d.above = 0
+			d.below = 0
+			transition.raised = true
+			return transition
+		}
+		return nil
+	}
+
+	if z <= anomalyExitZ {
+		d.below++
+	} else {
+		d.below = 0
+	}
+	if d.below >= anomalyExitCount {
+		d.active = false
+		d.below = 0
+		d.update(latencyMS)
+		return transition
+	}
+	return nil
+}
+
+func (d *latencyDetector) update(latencyMS float64) {
+	if d.samples == 0 {
+		d.mean = latencyMS
+		d.variance = 0
+		d.samples = 1
+		return
+	}
+	diff := latencyMS - d.mean
+	incr := anomalyAlpha * diff
+	d.mean += incr
+	d.variance = (1 - anomalyAlpha) * (d.variance + diff*incr)
+	d.samples++
+}
+
+func (t *anomalyTransition) event() EventPayload {
+	data := map[string]interface{}{
+		"latency_ms":         t.latencyMS,
+		"baseline_mean_ms":   t.mean,
+		"baseline_stddev_ms": t.stddev,
+		"z_score":            t.zScore,
+	}
+	if t.raised {
+		return EventPayload{
+			Kind:     "latency_anomaly",
+			Severity: "warning",
+			Message:  "probe latency is significantly above baseline",
+			Data:     data,
+		}
+	}
+	return EventPayload{
+		Kind:     "latency_anomaly_cleared",
+		Severity: "info",
+		Message:  "probe latency returned to baseline",
+		Data:     data,
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	arpWatchInterval = 30 * time.Second
+	arpGoneAfter     = 3
+)
+
+// arpWatcher diffs successive ARP/neighbor table reads by MAC. The first
+// read only sets the baseline, so a restart does not announce every host on
+// the segment. It lives on the client, so reconnects keep the baseline.
+type arpWatcher struct {
+	mu     sync.Mutex
+	primed bool
+	hosts  map[string]*arpHost
+}
+
+type arpHost struct {
+	ip     string
+	missed int
+}
+
+func (w *arpWatcher) observe(entries []ArpEntry) []EventPayload {
+	// A failed read looks like an empty table; never treat it as every
+	// device leaving at once.
+	if len(entries) == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.hosts == nil {
+		w.hosts = make(map[string]*arpHost)
+	}
+	present := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		present[entry.MAC] = entry.IP
+	}
+
+	var events []EventPayload
+	for mac, ip := range present {
+		host, known := w.hosts[mac]
+		if !known {
+			w.hosts[mac] = &arpHost{ip: ip}
+			if w.primed {
+				events = append(events, arpEvent("arp_new_device", "info", "new device on the network", mac, ip))
+			}
+			continue
+		}
+		host.ip, host.missed = ip, 0
+	}
+	for mac, host := range w.hosts {
+		if _, ok := present[mac]; ok {
+			continue
+		}
+		host.missed++
+		if host.missed >= arpGoneAfter {
+			delete(w.hosts, mac)
+			events = append(events, arpEvent("arp_device_gone", "info", "device left the network", mac, host.ip))
+		}
+	}
+	w.primed = true
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Data["mac"].(string) < events[j].Data["mac"].(string)
+	})
+	return events
+}
+
+func arpEvent(kind, severity, message, mac, ip string) EventPayload {
+	return EventPayload{
+		Kind:     kind,
+		Severity: severity,
+		Message:  message,
+		Data:     map[string]interface{}{"mac": mac, "ip": ip},
+	}
+}
+
+// arpWatchLoop polls the neighbor table every arpWatchInterval and sends an
+// event for each device that appears or disappears. Fake agents skip it:
+// they share the host's table and would all report the same devices.
+func (c *AgentClient) arpWatchLoop(ctx context.Context) {
+	if c.profile.IsFake || arpWatchInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(arpWatchInterval)
+	defer ticker.Stop()
+	for {
+		for _, event := range c.arpWatch.observe(readARPSnapshot()) {
+			c.logger().Info("neighbor table changed", "kind", event.Kind, "mac", event.Data["mac"], "ip", event.Data["ip"])
+			if err := c.send("event", event); err != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
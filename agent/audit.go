@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+const (
+	auditPath         = "agent_audit.jsonl"
+	auditMaxBytes     = 5 << 20
+	auditKeepFiles    = 5
+	auditMemEntries   = 1000
+	auditDefaultLimit = 500
+	auditMaxLimit     = 5000
+)
+
+type auditEntry struct {
+	TS           int64  `json:"ts"`
+	TaskID       string `json:"task_id"`
+	ScheduleID   string `json:"schedule_id,omitempty"`
+	GroupID      string `json:"group_id,omitempty"`
+	Kind         string `json:"kind"`
+	ParamsSHA256 string `json:"params_sha256"`
+	Admin        string `json:"admin"`
+	Signed       bool   `json:"signed"`
+	Status       string `json:"status"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	DurationMS   int64  `json:"duration_ms"`
+}
+
+// auditLog is an append-only JSON-lines record of every task the agent was
+// asked to run. The active file rolls over to .1 … .auditKeepFiles once it
+// passes auditMaxBytes; fake agents keep the newest entries in memory.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	entries []auditEntry
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		a.entries = append(a.entries, entry)
+		if len(a.entries) > auditMemEntries {
+			a.entries = a.entries[len(a.entries)-auditMemEntries:]
+		}
+		return
+	}
+	if err := a.appendLocked(entry); err != nil {
+		slog.Warn("failed to write audit log", "err", err)
+	}
+}
+
+func (a *auditLog) appendLocked(entry auditEntry) error {
+	if info, err := os.Stat(a.path); err == nil && info.Size() >= auditMaxBytes {
+		a.rotateLocked()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func (a *auditLog) rotateLocked() {
+	_ = os.Remove(fmt.Sprintf("%s.%d", a.path, auditKeepFiles))
+	for i := auditKeepFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		slog.Warn("failed to rotate audit log", "err", err)
+	}
+}
+
+// read returns up to limit entries with ts >= since, oldest first, across
+// the rotated files.
+func (a *auditLog) read(since int64, limit int) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var all []auditEntry
+	if a.path == "" {
+		all = append(all, a.entries...)
+	} else {
+		for i := auditKeepFiles; i >= 0; i-- {
+			path := a.path
+			if i > 0 {
+				path = fmt.Sprintf("%s.%d", a.path, i)
+			}
+			entries, err := readAuditFile(path)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, entries...)
+		}
+	}
+	out := make([]auditEntry, 0, len(all))
+	for _, entry := range all {
+		if entry.TS >= since {
+			out = append(out, entry)
+		}
+	}
+	if len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out, nil
+}
+
+func readAuditFile(path string) ([]auditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("audit log partially unreadable", "path", path, "err", err)
+	}
+	return entries, nil
+}
+
+// runAuditLog serves the audit_log task: params since (unix ms) and limit
+// (newest entries kept, default 500).
+func runAuditLog(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	if env.Audit == nil {
+		return nil, fmt.Errorf("audit log is not available")
+	}
+	limit := asInt(params["limit"], auditDefaultLimit)
+	if limit < 1 || limit > auditMaxLimit {
+		limit = auditMaxLimit
+	}
+	entries, err := env.Audit.read(int64(asInt(params["since"], 0)), limit)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"entries": entries, "count": len(entries)}, nil
+}
+
+func paramsDigest(params map[string]interface{}) string {
+	raw, _ := json.Marshal(params)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+var (
+	reconnectMin    = time.Second
+	reconnectMax    = time.Minute
+	reconnectGiveUp = 15 * time.Minute
+)
+
+// reconnectBackoff doubles the wait after each failed dial or registration,
+// up to reconnectMax, and picks a random point in the upper half of it so a
+// fleet that lost the admin together does not come back in lockstep.
+type reconnectBackoff struct {
+	attempt      int
+	failingSince time.Time
+}
+
+func (b *reconnectBackoff) reset() {
+	b.attempt = 0
+	b.failingSince = time.Time{}
+}
+
+func (b *reconnectBackoff) next() time.Duration {
+	if b.failingSince.IsZero() {
+		b.failingSince = time.Now()
+	}
+	delay := reconnectMax
+	if b.attempt < 30 && reconnectMin<<b.attempt < reconnectMax {
+		delay = reconnectMin << b.attempt
+	}
+	b.attempt++
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// exhausted reports whether the admin has been unreachable for longer than
+// reconnectGiveUp. Zero means never give up.
+func (b *reconnectBackoff) exhausted() bool {
+	return reconnectGiveUp > 0 && !b.failingSince.IsZero() && time.Since(b.failingSince) >= reconnectGiveUp
+}
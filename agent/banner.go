@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxBannerBytes = 512
+
+type bannerResult struct {
+	Target string `json:"target"`
+	Port   int    `json:"port"`
+	Probe  string `json:"probe,omitempty"`
+	Banner string `json:"banner,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func runBannerGrab(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	endpoints, err := bannerEndpoints(params)
+	if err != nil {
+		return nil, err
+	}
+	kept := endpoints[:0]
+	for _, endpoint := range endpoints {
+		if !env.Exclude.excludesPort(endpoint.port) {
+			kept = append(kept, endpoint)
+		}
+	}
+	excluded := len(endpoints) - len(kept)
+	endpoints = kept
+	timeout := time.Duration(asInt(params["timeout_ms"], 2000)) * time.Millisecond
+	probe := true
+	if v, ok := params["probe"].(bool); ok {
+		probe = v
+	}
+
+	env.Progress.setTotal(len(endpoints))
+	results := make([]bannerResult, len(endpoints))
+	sem := make(chan struct{}, 16)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		if env.cancelled() {
+			results[i] = bannerResult{Target: endpoint.host, Port: endpoint.port, Error: "cancelled"}
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, host string, port int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = grabBanner(host, port, timeout, probe)
+			env.Progress.step(net.JoinHostPort(host, strconv.Itoa(port)))
+		}(i, endpoint.host, endpoint.port)
+	}
+	wg.Wait()
+
+	result := map[string]interface{}{"banners": results, "count": len(results)}
+	if excluded > 0 {
+		result["excluded"] = excluded
+	}
+	return result, nil
+}
+
+type hostPort struct {
+	host string
+	port int
+}
+
+func bannerEndpoints(params map[string]interface{}) ([]hostPort, error) {
+	endpoints := make([]hostPort, 0)
+	if list, ok := params["targets"].([]interface{}); ok {
+		for _, raw := range list {
+			text, _ := raw.(string)
+			host, portText, err := net.SplitHostPort(strings.TrimSpace(text))
+			if err != nil {
+				return nil, fmt.Errorf("invalid banner target %q: expected host:port", text)
+			}
+			port, err := strconv.Atoi(portText)
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port in banner target %q", text)
+			}
+			endpoints = append(endpoints, hostPort{host: host, port: port})
+		}
+	}
+	if target := asString(params["target"], ""); target != "" {
+		ports, err := parsePorts(params["ports"], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range ports {
+			endpoints = append(endpoints, hostPort{host: target, port: port})
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("banner_grab requires targets or target+ports")
+	}
+	return endpoints, nil
+}
+
+func grabBanner(host string, port int, timeout time.Duration, probe bool) bannerResult {
+	result := bannerResult{Target: host, Port: port}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, maxBannerBytes)
+
+	probeKind := ""
+	if probe {
+		probeKind = bannerProbeForPort(port)
+	}
+
+	switch probeKind {
+	case "http":
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		_, _ = fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\nUser-Agent: labscan-agent/%s\r\n\r\n", host, agentVersion)
+		result.Banner = readBannerLine(conn, reader, timeout)
+	case "smtp":
+		greeting := readBannerLine(conn, reader, timeout)
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		_, _ = conn.Write([]byte("EHLO labscan\r\n"))
+		ehlo := readBannerLine(conn, reader, timeout)
+		result.Banner = strings.TrimSpace(greeting + " " + ehlo)
+	default:
+		result.Banner = readBannerLine(conn, reader, timeout)
+		if result.Banner == "" && probe {
+			probeKind = "newline"
+			_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+			_, _ = conn.Write([]byte("\r\n"))
+			result.Banner = readBannerLine(conn, reader, timeout)
+		}
+	}
+	result.Probe = probeKind
+	return result
+}
+
+func bannerProbeForPort(port int) string {
+	switch port {
+	case 80, 81, 591, 3000, 5000, 8000, 8008, 8080, 8081, 8888:
+		return "http"
+	case 25, 587, 2525:
+		return "smtp"
+	default:
+		return ""
+	}
+}
+
+func readBannerLine(conn net.Conn, reader *bufio.Reader, timeout time.Duration) string {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := reader.ReadSlice('\n')
+	if err != nil && len(line) == 0 {
+		return ""
+	}
+	return sanitizeBanner(string(line))
+}
+
+func sanitizeBanner(raw string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '\t' || (r >= 32 && r < 127) {
+			return r
+		}
+		return -1
+	}, raw)
+	return strings.TrimSpace(cleaned)
+}
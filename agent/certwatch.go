@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -cert-watch lists host:port endpoints whose certificates the agent checks
+// every -cert-watch-interval, raising an event as expiry passes each of
+// -cert-warn-days.
+var (
+	certWatchEndpoints string
+	certWatchInterval  = 6 * time.Hour
+	certWarnDays       = "30,14,7"
+	certCheckTimeout   = 10 * time.Second
+)
+
+// certInfo is the leaf certificate an endpoint presented.
+type certInfo struct {
+	Endpoint    string    `json:"endpoint"`
+	ServerName  string    `json:"server_name,omitempty"`
+	Address     string    `json:"address"`
+	TLSVersion  string    `json:"tls_version"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	Serial      string    `json:"serial"`
+	SHA256      string    `json:"sha256"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DaysLeft    float64   `json:"days_left"`
+	Expired     bool      `json:"expired"`
+	Verified    bool      `json:"verified"`
+	VerifyError string    `json:"verify_error,omitempty"`
+}
+
+// fetchCertificate connects to endpoint (host or host:port, default port
+// 443) at addr, or endpoint itself when addr is empty, and returns the
+// certificate it presents. The handshake accepts any certificate so an
+// expired or untrusted one can still be reported; Verified says whether it
+// chains to the system roots and matches serverName.
+func fetchCertificate(ctx context.Context, endpoint, addr, serverName string, timeout time.Duration) (certInfo, error) {
+	endpoint = withDefaultPort(strings.TrimSpace(endpoint), "443")
+	if addr == "" {
+		addr = endpoint
+	}
+	addr = withDefaultPort(addr, "443")
+	if serverName == "" {
+		host, _, _ := net.SplitHostPort(endpoint)
+		if _, err := netip.ParseAddr(host); err != nil {
+			serverName = host
+		}
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout},
+		Config:    &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return certInfo{}, err
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return certInfo{}, errors.New("server presented no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	sum := sha256.Sum256(leaf.Raw)
+	info := certInfo{
+		Endpoint:   endpoint,
+		ServerName: serverName,
+		Address:    conn.RemoteAddr().String(),
+		TLSVersion: tls.VersionName(state.Version),
+		Subject:    leaf.Subject.String(),
+		Issuer:     leaf.Issuer.String(),
+		DNSNames:   leaf.DNSNames,
+		Serial:     leaf.SerialNumber.Text(16),
+		SHA256:     hex.EncodeToString(sum[:]),
+		NotBefore:  leaf.NotBefore.UTC(),
+		NotAfter:   leaf.NotAfter.UTC(),
+	}
+	info.setExpiry(time.Now())
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates}); err != nil {
+		info.VerifyError = err.Error()
+	} else {
+		info.Verified = true
+	}
+	return info, nil
+}
+
+func (info *certInfo) setExpiry(now time.Time) {
+	info.DaysLeft = math.Round(info.NotAfter.Sub(now).Hours()/24*10) / 10
+	info.Expired = !now.Before(info.NotAfter)
+}
+
+func withDefaultPort(endpoint, port string) string {
+	if _, _, err := net.SplitHostPort(endpoint); err == nil {
+		return endpoint
+	}
+	return net.JoinHostPort(unbracket(endpoint), port)
+}
+
+// runTLSInfo serves tls_info: the certificate target presents, checked
+// once. server_name overrides the SNI name, which defaults to target's host.
+func runTLSInfo(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	target := asString(params["target"], "")
+	if target == "" {
+		return nil, errors.New("tls_info requires target")
+	}
+	timeout := time.Duration(asInt(params["timeout_ms"], 5000)) * time.Millisecond
+	info, err := fetchCertificate(env.context(), target, "", asString(params["server_name"], ""), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// runFakeTLSInfo answers tls_info for fake agents with a certificate that
+// has two months left.
+func runFakeTLSInfo(params map[string]interface{}) (interface{}, error) {
+	target := asString(params["target"], "")
+	if target == "" {
+		return nil, errors.New("tls_info requires target")
+	}
+	target = withDefaultPort(target, "443")
+	host, _, _ := net.SplitHostPort(target)
+	now := time.Now().UTC().Truncate(time.Second)
+	sum := sha256.Sum256([]byte(target))
+	info := certInfo{
+		Endpoint:   target,
+		ServerName: asString(params["server_name"], host),
+		Address:    target,
+		TLSVersion: "TLS 1.3",
+		Subject:    "CN=" + host,
+		Issuer:     "CN=LabScan Simulated CA",
+		DNSNames:   []string{host},
+		Serial:     hex.EncodeToString(sum[:8]),
+		SHA256:     hex.EncodeToString(sum[:]),
+		NotBefore:  now.AddDate(0, 0, -30),
+		NotAfter:   now.AddDate(0, 0, 60),
+		Verified:   true,
+	}
+	info.setExpiry(now)
+	return info, nil
+}
+
+// parseWarnDays reads -cert-warn-days, returning the thresholds from the
+// longest to the shortest.
+func parseWarnDays(spec string) ([]int, error) {
+	var days []int
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid certificate warning threshold %q", field)
+		}
+		days = append(days, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	return days, nil
+}
+
+// certWatcher remembers, per endpoint, how far its certificate has run
+// down, so each threshold raises one event rather than one per check. It
+// lives on the client, so reconnects do not repeat events.
+type certWatcher struct {
+	mu     sync.Mutex
+	levels map[string]int
+	failed map[string]bool
+}
+
+// certLevel counts the thresholds daysLeft is under; an expired
+// certificate is one past the last.
+func certLevel(info certInfo, thresholds []int) int {
+	if info.Expired {
+		return len(thresholds) + 1
+	}
+	level := 0
+	for _, days := range thresholds {
+		if info.DaysLeft < float64(days) {
+			level++
+		}
+	}
+	return level
+}
+
+// observe records one check of endpoint and returns the event it warrants,
+// if any: cert_expiring on passing a threshold, cert_expired once expired,
+// cert_renewed when a certificate that had raised one is replaced, and
+// cert_check_failed the first time a check fails in a row.
+func (w *certWatcher) observe(endpoint string, info certInfo, err error, thresholds []int) *EventPayload {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.levels == nil {
+		w.levels = make(map[string]int)
+		w.failed = make(map[string]bool)
+	}
+	if err != nil {
+		if w.failed[endpoint] {
+			return nil
+		}
+		w.failed[endpoint] = true
+		return &EventPayload{
+			Kind:     "cert_check_failed",
+			Severity: "warning",
+			Message:  "cannot check the certificate of " + endpoint,
+			Data:     map[string]interface{}{"endpoint": endpoint, "error": err.Error()},
+		}
+	}
+	w.failed[endpoint] = false
+
+	level := certLevel(info, thresholds)
+	previous := w.levels[endpoint]
+	w.levels[endpoint] = level
+	if level == previous {
+		return nil
+	}
+	data := map[string]interface{}{
+		"endpoint":  endpoint,
+		"subject":   info.Subject,
+		"not_after": info.NotAfter,
+		"days_left": info.DaysLeft,
+		"sha256":    info.SHA256,
+	}
+	switch {
+	case level > len(thresholds):
+		return &EventPayload{Kind: "cert_expired", Severity: "critical", Message: "certificate of " + endpoint + " has expired", Data: data}
+	case level > previous:
+		data["threshold_days"] = thresholds[level-1]
+		return &EventPayload{Kind: "cert_expiring", Severity: "warning", Message: fmt.Sprintf("certificate of %s expires in under %d days", endpoint, thresholds[level-1]), Data: data}
+	case level == 0:
+		return &EventPayload{Kind: "cert_renewed", Severity: "info", Message: "certificate of " + endpoint + " was renewed", Data: data}
+	}
+	// Replaced, but by one that is still short-lived: report where it
+	// stands now so the next threshold is announced again.
+	data["threshold_days"] = thresholds[level-1]
+	return &EventPayload{Kind: "cert_expiring", Severity: "warning", Message: fmt.Sprintf("certificate of %s was replaced but expires in under %d days", endpoint, thresholds[level-1]), Data: data}
+}
+
+// certWatchLoop checks the -cert-watch endpoints every certWatchInterval.
+// Endpoints outside the scan allowlist are skipped. Fake agents skip it.
+func (c *AgentClient) certWatchLoop(ctx context.Context) {
+	endpoints := splitList(certWatchEndpoints)
+	if c.profile.IsFake || certWatchInterval <= 0 || len(endpoints) == 0 {
+		return
+	}
+	thresholds, err := parseWarnDays(certWarnDays)
+	if err != nil {
+		c.logger().Warn("certificate watch disabled", "err", err)
+		return
+	}
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+	for {
+		for _, endpoint := range endpoints {
+			var info certInfo
+			addr, err := c.policy.checkEndpoints(ctx, []string{withDefaultPort(endpoint, "443")})
+			if err == nil {
+				info, err = fetchCertificate(ctx, endpoint, addr[0], "", certCheckTimeout)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				c.logger().Debug("certificate check failed", "endpoint", endpoint, "err", err)
+			}
+			event := c.certWatch.observe(endpoint, info, err, thresholds)
+			if event == nil {
+				continue
+			}
+			c.logger().Info("certificate watch", "kind", event.Kind, "endpoint", endpoint)
+			if err := c.send("event", *event); err != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
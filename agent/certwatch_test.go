@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	endpoint := strings.TrimPrefix(server.URL, "https://")
+
+	info, err := fetchCertificate(context.Background(), endpoint, "", "example.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := server.Certificate()
+	if info.Endpoint != endpoint || info.ServerName != "example.com" || !info.NotAfter.Equal(leaf.NotAfter) || info.Expired {
+		t.Fatalf("info = %+v", info)
+	}
+	// The test server's certificate is self-signed.
+	if info.Verified || info.VerifyError == "" {
+		t.Fatalf("verified = %v, verify_error = %q", info.Verified, info.VerifyError)
+	}
+
+	if _, err := fetchCertificate(context.Background(), server.Listener.Addr().String()+"0", "", "", 200*time.Millisecond); err == nil {
+		t.Fatal("fetchCertificate to a bad port succeeded")
+	}
+}
+
+func TestParseWarnDays(t *testing.T) {
+	days, err := parseWarnDays(" 7, 30,14 ")
+	if err != nil || len(days) != 3 || days[0] != 30 || days[2] != 7 {
+		t.Fatalf("parseWarnDays = %v, %v", days, err)
+	}
+	for _, spec := range []string{"30,x", "0", "-5"} {
+		if _, err := parseWarnDays(spec); err == nil {
+			t.Errorf("parseWarnDays(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestCertWatcher(t *testing.T) {
+	thresholds := []int{30, 14, 7}
+	cert := func(days float64) certInfo {
+		return certInfo{DaysLeft: days, Expired: days <= 0}
+	}
+	var w certWatcher
+	steps := []struct {
+		info certInfo
+		err  error
+		want string
+	}{
+		{cert(90), nil, ""},
+		{cert(45), nil, ""},
+		{cert(29.5), nil, "cert_expiring"},
+		{cert(20), nil, ""},
+		{certInfo{}, errors.New("connection refused"), "cert_check_failed"},
+		{certInfo{}, errors.New("connection refused"), ""},
+		{cert(6), nil, "cert_expiring"},
+		{cert(0), nil, "cert_expired"},
+		{cert(-3), nil, ""},
+		{cert(10), nil, "cert_expiring"},
+		{cert(365), nil, "cert_renewed"},
+		{cert(300), nil, ""},
+	}
+	for i, step := range steps {
+		event := w.observe("wiki.lab:443", step.info, step.err, thresholds)
+		got := ""
+		if event != nil {
+			got = event.Kind
+		}
+		if got != step.want {
+			t.Fatalf("step %d: event %q, want %q", i, got, step.want)
+		}
+	}
+
+	event := w.observe("nas.lab:443", cert(3), nil, thresholds)
+	if event == nil || event.Kind != "cert_expiring" || event.Data["threshold_days"] != 7 {
+		t.Fatalf("first check under the last threshold = %+v", event)
+	}
+}
+
+func TestTLSInfoServerNameDefault(t *testing.T) {
+	params := withTargetDefaults("tls_info", map[string]interface{}{"target": "wiki.lab:8443"})
+	if params["server_name"] != "wiki.lab" {
+		t.Fatalf("server_name = %v", params["server_name"])
+	}
+	params = withTargetDefaults("tls_info", map[string]interface{}{"target": "10.0.0.5"})
+	if _, ok := params["server_name"]; ok {
+		t.Fatalf("server_name set for an address target: %v", params)
+	}
+}
+
+func TestFakeTLSInfo(t *testing.T) {
+	out, err := runTask(true, taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}, "tls_info", map[string]interface{}{"target": "wiki.lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := out.(certInfo)
+	if info.Endpoint != "wiki.lab:443" || info.DaysLeft != 60 || !info.Verified {
+		t.Fatalf("info = %+v", info)
+	}
+}
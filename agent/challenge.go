@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// registerChallengeWait is how long the agent waits after connecting for the
+// admin's challenge before falling back to sending the secret in register,
+// or with -require-challenge, giving up.
+const registerChallengeWait = 3 * time.Second
+
+// The fallback stays on by default while the admin bundled with LabScan
+// sends no challenges.
+var (
+	legacySecretAuth = true
+	requireChallenge bool
+)
+
+// allowSecretFallback reports whether register may carry the raw secret
+// when the admin sends no challenge: never with -require-challenge or
+// -legacy-secret-auth=false, and never once the admin has answered a
+// challenge.
+func (c *AgentClient) allowSecretFallback() bool {
+	return legacySecretAuth && !requireChallenge && !c.configSnapshot().ChallengeAuth
+}
+
+type ChallengePayload struct {
+	Nonce string `json:"nonce"`
+}
+
+// registerProof answers a registration challenge with
+// hex(HMAC-SHA256(secret, nonce || agent_id)).
+func registerProof(secret, nonce, agentID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(agentID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
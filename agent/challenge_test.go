@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestAllowSecretFallback(t *testing.T) {
+	defer func(legacy, require bool) { legacySecretAuth, requireChallenge = legacy, require }(legacySecretAuth, requireChallenge)
+
+	c := &AgentClient{config: &PersistedConfig{}}
+	if !c.allowSecretFallback() {
+		t.Error("fallback is off by default; the bundled admin sends no challenges")
+	}
+	requireChallenge = true
+	if c.allowSecretFallback() {
+		t.Error("fallback allowed with -require-challenge")
+	}
+	requireChallenge = false
+	c.config.ChallengeAuth = true
+	if c.allowSecretFallback() {
+		t.Error("fallback allowed after a challenge-response registration")
+	}
+}
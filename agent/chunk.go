@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// resultChunkSize is the largest task_result payload sent as one frame;
+// bigger results are split into task_result_chunk messages of this size.
+const resultChunkSize = 256 * 1024
+
+type TaskResultChunkPayload struct {
+	ResultID string `json:"result_id"`
+	TaskID   string `json:"task_id"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+	Final    bool   `json:"final"`
+	Encoding string `json:"encoding,omitempty"`
+	Data     string `json:"data"`
+}
+
+// sendTaskResult sends the result as a single task_result when it is small
+// enough (after compression, if negotiated). Otherwise the encoded
+// TaskResultPayload is split into task_result_chunk messages; concatenating
+// their data fields in index order yields that JSON, or its gzip+base64 form
+// when the chunks carry encoding "gzip".
+func (c *AgentClient) sendTaskResult(result TaskResultPayload) error {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if !result.Replayed {
+		c.results.add(result.TaskID, nowMS(), encoded)
+	}
+	queue := c.currentOutbound()
+	if queue == nil {
+		c.outbox.add("task_result", nowMS(), encoded)
+		return errors.New("connection unavailable")
+	}
+	var seq uint64
+	if c.peerAcks() {
+		seq = c.acks.track(encoded)
+	}
+	body, encoding := c.encodePayload(encoded)
+	data := encoded
+	if packed, ok := body.(string); ok {
+		data = []byte(packed)
+	}
+	if len(data) <= resultChunkSize {
+		if err := c.sendWire(queue, "task_result", nowMS(), seq, encoding, body); err != nil {
+			c.acks.ack(seq)
+			c.outbox.add("task_result", nowMS(), encoded)
+			return err
+		}
+		return nil
+	}
+
+	chunks := splitUTF8(data, resultChunkSize)
+	resultID := uuid.NewString()
+	for i, chunk := range chunks {
+		err := c.sendWire(queue, "task_result_chunk", nowMS(), seq, "", TaskResultChunkPayload{
+			ResultID: resultID,
+			TaskID:   result.TaskID,
+			Index:    i,
+			Total:    len(chunks),
+			Final:    i == len(chunks)-1,
+			Encoding: encoding,
+			Data:     string(chunk),
+		})
+		if err != nil {
+			c.acks.ack(seq)
+			c.outbox.add("task_result", nowMS(), encoded)
+			return err
+		}
+	}
+	return nil
+}
+
+// splitUTF8 cuts data into pieces of at most size bytes without splitting a
+// multi-byte rune, so each piece survives being sent as a JSON string.
+func splitUTF8(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = size
+		}
+		chunks = append(chunks, data[:cut])
+		data = data[cut:]
+	}
+	return append(chunks, data)
+}
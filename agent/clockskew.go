@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clockSkewThreshold is how far the agent's clock may be from the admin's
+// before heartbeats flag it and the agent raises a clock_skew event.
+var clockSkewThreshold = 2 * time.Second
+
+// clockSkew is the agent's clock offset from the admin's, measured once
+// per session from the admin_time in registered. The admin stamps its
+// reply somewhere between register leaving and registered arriving, so the
+// estimate assumes the midpoint and is off by at most half that round trip.
+type clockSkew struct {
+	mu      sync.Mutex
+	sentAt  time.Time
+	known   bool
+	skew    time.Duration
+	maxErr  time.Duration
+	flagged bool
+}
+
+// registerSent records when register left, for the next measurement.
+func (s *clockSkew) registerSent(at time.Time) {
+	s.mu.Lock()
+	s.sentAt = at
+	s.known = false
+	s.mu.Unlock()
+}
+
+// observe measures the skew from the admin's timestamp in registered,
+// received at receivedAt. An admin that sends no timestamp leaves it
+// unknown.
+func (s *clockSkew) observe(adminMS int64, receivedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if adminMS <= 0 || s.sentAt.IsZero() || receivedAt.Before(s.sentAt) {
+		s.known = false
+		return
+	}
+	roundTrip := receivedAt.Sub(s.sentAt)
+	midpoint := s.sentAt.Add(roundTrip / 2)
+	s.skew = midpoint.Sub(time.UnixMilli(adminMS))
+	s.maxErr = roundTrip / 2
+	s.known = true
+}
+
+// current returns the last measured skew, positive when the agent's clock
+// is ahead of the admin's, and its error bound.
+func (s *clockSkew) current() (skew, maxErr time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skew, s.maxErr, s.known
+}
+
+// exceeded reports whether the skew is beyond clockSkewThreshold by more
+// than the measurement error.
+func (s *clockSkew) exceeded() bool {
+	skew, maxErr, ok := s.current()
+	return ok && max(skew, -skew)-maxErr > clockSkewThreshold
+}
+
+// changed reports whether exceeded flipped since the last call, and its
+// new value.
+func (s *clockSkew) changed() (exceeded, changed bool) {
+	exceeded = s.exceeded()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed = exceeded != s.flagged
+	s.flagged = exceeded
+	return exceeded, changed
+}
+
+// addMetrics adds clock_skew_ms, clock_skew_error_ms, and clock_skewed to
+// heartbeat metrics once the skew is known.
+func (s *clockSkew) addMetrics(metrics map[string]interface{}) {
+	skew, maxErr, ok := s.current()
+	if !ok {
+		return
+	}
+	metrics["clock_skew_ms"] = skew.Milliseconds()
+	metrics["clock_skew_error_ms"] = maxErr.Milliseconds()
+	metrics["clock_skewed"] = s.exceeded()
+}
+
+// reportClockSkew logs the skew measured at registration and raises a
+// clock_skew event when it crosses clockSkewThreshold, or
+// clock_skew_cleared when it comes back within it.
+func (c *AgentClient) reportClockSkew() {
+	skew, maxErr, ok := c.clock.current()
+	if !ok {
+		c.logger().Debug("admin sent no time; clock skew unknown")
+		return
+	}
+	exceeded, changed := c.clock.changed()
+	if exceeded {
+		c.logger().Warn("clock skew with admin", "skew", skew, "error", maxErr, "threshold", clockSkewThreshold)
+	} else {
+		c.logger().Debug("clock skew with admin", "skew", skew, "error", maxErr)
+	}
+	if !changed {
+		return
+	}
+	data := map[string]interface{}{
+		"skew_ms":      skew.Milliseconds(),
+		"error_ms":     maxErr.Milliseconds(),
+		"threshold_ms": clockSkewThreshold.Milliseconds(),
+	}
+	event := EventPayload{Kind: "clock_skew", Severity: "warning", Message: "agent clock is off from the admin's by " + skew.Round(time.Millisecond).String(), Data: data}
+	if !exceeded {
+		event = EventPayload{Kind: "clock_skew_cleared", Severity: "info", Message: "agent clock agrees with the admin's again", Data: data}
+	}
+	_ = c.send("event", event)
+}
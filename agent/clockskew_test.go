@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSkewObserve(t *testing.T) {
+	var clock clockSkew
+	sent := time.UnixMilli(1_700_000_000_000)
+	clock.registerSent(sent)
+	// The admin is 10s behind and answered 200ms after register left.
+	clock.observe(sent.Add(100*time.Millisecond-10*time.Second).UnixMilli(), sent.Add(200*time.Millisecond))
+	skew, maxErr, ok := clock.current()
+	if !ok || skew != 10*time.Second || maxErr != 100*time.Millisecond {
+		t.Fatalf("current() = %v, %v, %v, want 10s, 100ms", skew, maxErr, ok)
+	}
+	metrics := map[string]interface{}{}
+	clock.addMetrics(metrics)
+	if metrics["clock_skew_ms"] != int64(10000) || metrics["clock_skew_error_ms"] != int64(100) || metrics["clock_skewed"] != true {
+		t.Fatalf("metrics = %v", metrics)
+	}
+
+	clock.registerSent(sent)
+	clock.observe(0, sent.Add(time.Millisecond))
+	if _, _, ok := clock.current(); ok {
+		t.Fatal("skew known without an admin time")
+	}
+	metrics = map[string]interface{}{}
+	clock.addMetrics(metrics)
+	if len(metrics) != 0 {
+		t.Fatalf("metrics = %v, want none while the skew is unknown", metrics)
+	}
+}
+
+func TestClockSkewThreshold(t *testing.T) {
+	sent := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		name      string
+		adminMS   int64
+		roundTrip time.Duration
+		exceeded  bool
+	}{
+		{"in sync", sent.UnixMilli(), 0, false},
+		{"agent ahead", sent.Add(-3 * time.Second).UnixMilli(), 0, true},
+		{"agent behind", sent.Add(3 * time.Second).UnixMilli(), 0, true},
+		// 3s off, but a 4s round trip leaves room for only 1s.
+		{"within the error", sent.Add(2 * time.Second).Add(-3 * time.Second).UnixMilli(), 4 * time.Second, false},
+	}
+	for _, tt := range tests {
+		var clock clockSkew
+		clock.registerSent(sent)
+		clock.observe(tt.adminMS, sent.Add(tt.roundTrip))
+		if got := clock.exceeded(); got != tt.exceeded {
+			skew, maxErr, _ := clock.current()
+			t.Errorf("%s: exceeded() = %v (skew %v ± %v), want %v", tt.name, got, skew, maxErr, tt.exceeded)
+		}
+	}
+}
+
+func TestClockSkewChanged(t *testing.T) {
+	var clock clockSkew
+	sent := time.UnixMilli(1_700_000_000_000)
+	steps := []struct {
+		skew              time.Duration
+		exceeded, changed bool
+	}{
+		{0, false, false},
+		{time.Minute, true, true},
+		{time.Minute, true, false},
+		{time.Second, false, true},
+	}
+	for i, step := range steps {
+		clock.registerSent(sent)
+		clock.observe(sent.Add(-step.skew).UnixMilli(), sent)
+		if exceeded, changed := clock.changed(); exceeded != step.exceeded || changed != step.changed {
+			t.Errorf("step %d: changed() = %v, %v, want %v, %v", i, exceeded, changed, step.exceeded, step.changed)
+		}
+	}
+}
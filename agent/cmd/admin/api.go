@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// api is the HTTP interface for the CLI subcommands and external tools.
+// With a token every request must carry it as a bearer token; without one
+// only loopback clients are served.
+type api struct {
+	hub         *hub
+	provisioner *provisioner
+	token       string
+}
+
+type dispatchRequest struct {
+	Agents []string               `json:"agents"`
+	Kind   string                 `json:"kind"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type taskRequest struct {
+	Kind   string                 `json:"kind"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type dispatchResponse struct {
+	Tasks  []TaskRecord      `json:"tasks"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type groupRequest struct {
+	Tags           string                 `json:"tags"`
+	Kind           string                 `json:"kind"`
+	Params         map[string]interface{} `json:"params"`
+	IncludeOffline bool                   `json:"include_offline"`
+}
+
+// groupView is a group with its tasks and how many are in each status.
+type groupView struct {
+	GroupRecord
+	Tasks    []TaskRecord   `json:"tasks"`
+	Counts   map[string]int `json:"counts"`
+	Finished bool           `json:"finished"`
+}
+
+type provisionRequest struct {
+	Subnet  string `json:"subnet"`
+	AdminIP string `json:"admin_ip"`
+}
+
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/agents", a.authorized(a.listAgents))
+	mux.HandleFunc("GET /api/agents/{id}", a.authorized(a.getAgent))
+	mux.HandleFunc("GET /api/agents/{id}/tasks", a.authorized(a.agentTasks))
+	mux.HandleFunc("POST /api/agents/{id}/tasks", a.authorized(a.createAgentTask))
+	mux.HandleFunc("GET /api/tasks", a.authorized(a.listTasks))
+	mux.HandleFunc("POST /api/tasks", a.authorized(a.createTasks))
+	mux.HandleFunc("GET /api/tasks/{id}", a.authorized(a.getTask))
+	mux.HandleFunc("GET /api/groups", a.authorized(a.listGroups))
+	mux.HandleFunc("POST /api/groups", a.authorized(a.createGroup))
+	mux.HandleFunc("GET /api/groups/{id}", a.authorized(a.getGroup))
+	mux.HandleFunc("POST /api/provision", a.authorized(a.provision))
+}
+
+func (a *api) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("missing or wrong API token"))
+				return
+			}
+		} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+			writeError(w, http.StatusForbidden, errors.New("the API is loopback-only without -api-token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// listAgents returns every agent, or with tags=<selector> the ones whose
+// tags match it.
+func (a *api) listAgents(w http.ResponseWriter, r *http.Request) {
+	agents, err := a.hub.store.agents()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if query := r.URL.Query().Get("tags"); query != "" {
+		selector, err := parseTagSelector(query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		matching := agents[:0]
+		for _, agent := range agents {
+			if selector.matches(agent.Tags) {
+				matching = append(matching, agent)
+			}
+		}
+		agents = matching
+	}
+	writeJSON(w, http.StatusOK, nonNil(agents))
+}
+
+func (a *api) getAgent(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.lookupAgent(w, r.PathValue("id"))
+	if ok {
+		writeJSON(w, http.StatusOK, agent)
+	}
+}
+
+func (a *api) agentTasks(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.lookupAgent(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	tasks, err := a.hub.store.tasks(agent.AgentID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nonNil(tasks))
+}
+
+// createAgentTask queues one task for the agent and answers 201 with the
+// task record; GET /api/tasks/{id} follows it to its result.
+func (a *api) createAgentTask(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.lookupAgent(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	var request taskRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Kind == "" {
+		writeError(w, http.StatusBadRequest, errors.New("kind is required"))
+		return
+	}
+	task, err := a.hub.dispatch(agent.AgentID, request.Kind, request.Params)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Location", "/api/tasks/"+task.TaskID)
+	writeJSON(w, http.StatusCreated, task)
+}
+
+func (a *api) getTask(w http.ResponseWriter, r *http.Request) {
+	task, ok, err := a.hub.store.task(r.PathValue("id"))
+	switch {
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case !ok:
+		writeError(w, http.StatusNotFound, errors.New("no such task"))
+	default:
+		writeJSON(w, http.StatusOK, task)
+	}
+}
+
+// lookupAgent writes the 404 or 500 itself when it returns false.
+func (a *api) lookupAgent(w http.ResponseWriter, id string) (AgentRecord, bool) {
+	agent, ok, err := a.hub.store.agent(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return agent, false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such agent"))
+	}
+	return agent, ok
+}
+
+// listTasks filters by agent_id and group_id, and with finished_since returns only
+// tasks finished after that Unix millisecond time, which is how tail
+// polls.
+func (a *api) listTasks(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if value := r.URL.Query().Get("finished_since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("finished_since must be Unix milliseconds"))
+			return
+		}
+	}
+	tasks, err := a.hub.store.tasks(r.URL.Query().Get("agent_id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	groupID := r.URL.Query().Get("group_id")
+	if since > 0 || groupID != "" {
+		matching := tasks[:0]
+		for _, task := range tasks {
+			if task.FinishedAt > since && (groupID == "" || task.GroupID == groupID) {
+				matching = append(matching, task)
+			}
+		}
+		tasks = matching
+	}
+	writeJSON(w, http.StatusOK, nonNil(tasks))
+}
+
+// createTasks dispatches one task to each listed agent. An agent that
+// cannot take it is reported in errors without failing the others.
+func (a *api) createTasks(w http.ResponseWriter, r *http.Request) {
+	var request dispatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Kind == "" || len(request.Agents) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("kind and agents are required"))
+		return
+	}
+	response := dispatchResponse{Tasks: []TaskRecord{}}
+	for _, agentID := range request.Agents {
+		task, err := a.hub.dispatch(agentID, request.Kind, request.Params)
+		if err != nil {
+			if response.Errors == nil {
+				response.Errors = make(map[string]string)
+			}
+			response.Errors[agentID] = err.Error()
+			continue
+		}
+		response.Tasks = append(response.Tasks, task)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *api) listGroups(w http.ResponseWriter, _ *http.Request) {
+	groups, err := a.hub.store.groups()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nonNil(groups))
+}
+
+// createGroup fans a task out to the agents matching a tag selector and
+// answers 201 with the group and its tasks.
+func (a *api) createGroup(w http.ResponseWriter, r *http.Request) {
+	var request groupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Kind == "" {
+		writeError(w, http.StatusBadRequest, errors.New("kind is required"))
+		return
+	}
+	selector, err := parseTagSelector(request.Tags)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	group, tasks, err := a.hub.dispatchGroup(selector, request.Kind, request.Params, request.IncludeOffline)
+	if err != nil && len(tasks) == 0 {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	view := newGroupView(group, tasks)
+	w.Header().Set("Location", "/api/groups/"+group.GroupID)
+	writeJSON(w, http.StatusCreated, view)
+}
+
+func (a *api) getGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok, err := a.hub.store.group(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such group"))
+		return
+	}
+	var tasks []TaskRecord
+	for _, agentID := range group.AgentIDs {
+		agentTasks, err := a.hub.store.tasks(agentID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, task := range agentTasks {
+			if task.GroupID == group.GroupID {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, newGroupView(group, tasks))
+}
+
+func newGroupView(group GroupRecord, tasks []TaskRecord) groupView {
+	view := groupView{GroupRecord: group, Tasks: nonNil(tasks), Counts: map[string]int{}, Finished: true}
+	for _, task := range tasks {
+		view.Counts[task.Status]++
+		view.Finished = view.Finished && task.finished()
+	}
+	return view
+}
+
+func (a *api) provision(w http.ResponseWriter, r *http.Request) {
+	var request provisionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	target, err := subnetTarget(request.Subnet, request.AdminIP)
+	if err == nil && target.adminIP == "" {
+		err = errors.New("no local address routes to the subnet; give admin_ip")
+	}
+	if err == nil {
+		err = a.provisioner.provisionNow(target)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"broadcast": target.broadcast.String(), "admin_ip": target.adminIP})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// nonNil keeps empty lists as [] rather than null.
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
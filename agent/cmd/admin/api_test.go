@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIAuthorized(t *testing.T) {
+	for _, tt := range []struct {
+		name, token, remote, authz string
+		want                       int
+	}{
+		{"token", "t0ken", "10.0.0.5:4000", "Bearer t0ken", http.StatusOK},
+		{"wrong token", "t0ken", "127.0.0.1:4000", "Bearer guess", http.StatusUnauthorized},
+		{"no token sent", "t0ken", "127.0.0.1:4000", "", http.StatusUnauthorized},
+		{"not bearer", "t0ken", "127.0.0.1:4000", "t0ken", http.StatusUnauthorized},
+		{"loopback without token", "", "127.0.0.1:4000", "", http.StatusOK},
+		{"ipv6 loopback without token", "", "[::1]:4000", "", http.StatusOK},
+		{"remote without token", "", "10.0.0.5:4000", "", http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			(&api{hub: newHub("s", nil, newMemoryStore()), token: tt.token}).register(mux)
+			req := httptest.NewRequest(http.MethodGet, "/api/agents", nil)
+			req.RemoteAddr = tt.remote
+			if tt.authz != "" {
+				req.Header.Set("Authorization", tt.authz)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const clientUsage = `usage:
+  labscan-admin [serve] [flags]
+  labscan-admin agents [-json] [-tags selector]
+  labscan-admin run [-agents a,b | -tags selector [-offline] | -all] [-params json] [-wait 30s] kind [key=value ...]
+  labscan-admin group [-json] group_id
+  labscan-admin tail [-agent id] [-json]
+  labscan-admin export [-format json|csv] [-o file]
+  labscan-admin provision -subnet 10.0.5.0/24 [-advertise ip]
+
+serve runs the admin server. The other commands talk to a running server:
+-server (or LABSCAN_ADMIN_URL, default http://127.0.0.1:8148) and -token (or
+LABSCAN_API_TOKEN).
+`
+
+// apiClient calls a running admin server's /api.
+type apiClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func clientFlags(fs *flag.FlagSet) *apiClient {
+	c := &apiClient{http: &http.Client{Timeout: 30 * time.Second}}
+	base := os.Getenv("LABSCAN_ADMIN_URL")
+	if base == "" {
+		base = "http://127.0.0.1:8148"
+	}
+	fs.StringVar(&c.base, "server", base, "Admin server URL (or LABSCAN_ADMIN_URL)")
+	fs.StringVar(&c.token, "token", os.Getenv("LABSCAN_API_TOKEN"), "API token (or LABSCAN_API_TOKEN)")
+	return c
+}
+
+func (c *apiClient) do(method, path string, body, into interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.base, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&failure) != nil || failure.Error == "" {
+			failure.Error = resp.Status
+		}
+		return errors.New(failure.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+func (c *apiClient) agents() ([]AgentRecord, error) {
+	return c.agentsTagged("")
+}
+
+func (c *apiClient) agentsTagged(selector string) ([]AgentRecord, error) {
+	path := "/api/agents"
+	if selector != "" {
+		path += "?" + url.Values{"tags": {selector}}.Encode()
+	}
+	var agents []AgentRecord
+	return agents, c.do(http.MethodGet, path, nil, &agents)
+}
+
+func (c *apiClient) finishedSince(agentID string, since int64) ([]TaskRecord, error) {
+	query := url.Values{"finished_since": {strconv.FormatInt(since, 10)}}
+	if agentID != "" {
+		query.Set("agent_id", agentID)
+	}
+	var tasks []TaskRecord
+	return tasks, c.do(http.MethodGet, "/api/tasks?"+query.Encode(), nil, &tasks)
+}
+
+func runClientCommand(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	c := clientFlags(fs)
+	var err error
+	switch command {
+	case "agents":
+		err = agentsCommand(fs, c, args)
+	case "run":
+		err = runCommand(fs, c, args)
+	case "tail":
+		err = tailCommand(fs, c, args)
+	case "export":
+		err = exportCommand(fs, c, args)
+	case "provision":
+		err = provisionCommand(fs, c, args)
+	case "group":
+		err = groupCommand(fs, c, args)
+	default:
+		fmt.Fprint(os.Stderr, clientUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
+func agentsCommand(fs *flag.FlagSet, c *apiClient, args []string) error {
+	asJSON := fs.Bool("json", false, "Print the agent records as JSON")
+	tags := fs.String("tags", "", "Only agents matching this tag selector, e.g. room=lab-b,role")
+	_ = fs.Parse(args)
+	agents, err := c.agentsTagged(*tags)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(os.Stdout, agents)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AGENT ID\tHOSTNAME\tSTATE\tSTATUS\tIPS\tVERSION\tLAST SEEN\tTAGS")
+	for _, agent := range agents {
+		state := "offline"
+		if agent.Connected {
+			state = "online"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", agent.AgentID, agent.Hostname, state, dash(agent.Status),
+			dash(strings.Join(agent.IPs, ",")), dash(agent.Version), ago(agent.LastSeen), dash(formatTags(agent.Tags)))
+	}
+	return w.Flush()
+}
+
+func runCommand(fs *flag.FlagSet, c *apiClient, args []string) error {
+	targets := fs.String("agents", "", "Comma-separated agent IDs or hostnames")
+	all := fs.Bool("all", false, "Run on every connected agent")
+	tags := fs.String("tags", "", "Run as a group task on every connected agent matching this tag selector, e.g. room=lab-b")
+	offline := fs.Bool("offline", false, "With -tags, also queue the task for matching agents that are offline")
+	paramsJSON := fs.String("params", "", "Task params as a JSON object; key=value arguments are merged into it")
+	wait := fs.Duration("wait", 0, "Wait this long for the results and print them; 0 returns once the tasks are queued")
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		return errors.New("missing task kind")
+	}
+	params, err := taskParams(*paramsJSON, fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	agents, err := c.agents()
+	if err != nil {
+		return err
+	}
+
+	var tasks []TaskRecord
+	if *tags != "" {
+		var group groupView
+		request := groupRequest{Tags: *tags, Kind: fs.Arg(0), Params: params, IncludeOffline: *offline}
+		if err := c.do(http.MethodPost, "/api/groups", request, &group); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "group %s: %d agent(s) match %s\n", group.GroupID, len(group.Tasks), group.Selector)
+		tasks = group.Tasks
+	} else {
+		ids, err := selectAgents(agents, *targets, *all)
+		if err != nil {
+			return err
+		}
+		var response dispatchResponse
+		request := dispatchRequest{Agents: ids, Kind: fs.Arg(0), Params: params}
+		if err := c.do(http.MethodPost, "/api/tasks", request, &response); err != nil {
+			return err
+		}
+		for agentID, message := range response.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", agentID, message)
+		}
+		tasks = response.Tasks
+	}
+	hostnames := hostnameIndex(agents)
+	if *wait <= 0 {
+		for _, task := range tasks {
+			fmt.Printf("%s\t%s\t%s\t%s\n", task.TaskID, hostnames[task.AgentID], task.Kind, task.Status)
+		}
+		return nil
+	}
+
+	// Poll from the server's own creation time, not this host's clock.
+	waiting := make(map[string]bool, len(tasks))
+	started := int64(0)
+	for _, task := range tasks {
+		waiting[task.TaskID] = true
+		if started == 0 || task.CreatedAt < started {
+			started = task.CreatedAt
+		}
+	}
+	deadline := time.Now().Add(*wait)
+	for len(waiting) > 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		finished, err := c.finishedSince("", started-1)
+		if err != nil {
+			return err
+		}
+		for _, task := range finished {
+			if waiting[task.TaskID] {
+				delete(waiting, task.TaskID)
+				printResult(os.Stdout, task, hostnames)
+			}
+		}
+	}
+	if len(waiting) > 0 {
+		return fmt.Errorf("%d task(s) did not finish within %s", len(waiting), *wait)
+	}
+	return nil
+}
+
+func tailCommand(fs *flag.FlagSet, c *apiClient, args []string) error {
+	agent := fs.String("agent", "", "Only results from this agent ID")
+	interval := fs.Duration("interval", 2*time.Second, "Poll interval")
+	asJSON := fs.Bool("json", false, "Print each task record as a JSON line")
+	_ = fs.Parse(args)
+
+	agents, err := c.agents()
+	if err != nil {
+		return err
+	}
+	hostnames := hostnameIndex(agents)
+	// Start from the newest result the server has, so its clock is the
+	// only one that matters.
+	var cursor int64
+	existing, err := c.finishedSince(*agent, 0)
+	if err != nil {
+		return err
+	}
+	for _, task := range existing {
+		cursor = max(cursor, task.FinishedAt)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		tasks, err := c.finishedSince(*agent, cursor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tail: %v\n", err)
+			continue
+		}
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].FinishedAt < tasks[j].FinishedAt })
+		for _, task := range tasks {
+			cursor = max(cursor, task.FinishedAt)
+			if _, ok := hostnames[task.AgentID]; !ok {
+				if agents, err := c.agents(); err == nil {
+					hostnames = hostnameIndex(agents)
+				}
+			}
+			if *asJSON {
+				_ = json.NewEncoder(os.Stdout).Encode(task)
+			} else {
+				printResult(os.Stdout, task, hostnames)
+			}
+		}
+	}
+}
+
+// exportColumns are the CSV columns; the network ones come from the
+// agent's latest network facts.
+var exportColumns = []string{"agent_id", "hostname", "connected", "status", "ips", "macs", "os", "arch", "version",
+	"remote_addr", "subnet_cidr", "default_gateway_ip", "interface_type", "tags", "first_seen", "last_seen"}
+
+func exportCommand(fs *flag.FlagSet, c *apiClient, args []string) error {
+	format := fs.String("format", "json", "json or csv")
+	output := fs.String("o", "", "Write to this file instead of stdout")
+	_ = fs.Parse(args)
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	agents, err := c.agents()
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "json" {
+		return printJSON(w, agents)
+	}
+
+	out := csv.NewWriter(w)
+	_ = out.Write(exportColumns)
+	for _, agent := range agents {
+		var network struct {
+			SubnetCIDR       string `json:"subnet_cidr"`
+			DefaultGatewayIP string `json:"default_gateway_ip"`
+			InterfaceType    string `json:"interface_type"`
+		}
+		if len(agent.Network) > 0 {
+			_ = json.Unmarshal(agent.Network, &network)
+		}
+		_ = out.Write([]string{agent.AgentID, agent.Hostname, strconv.FormatBool(agent.Connected), agent.Status,
+			strings.Join(agent.IPs, " "), strings.Join(agent.MACs, " "), agent.OS, agent.Arch, agent.Version,
+			agent.RemoteAddr, network.SubnetCIDR, network.DefaultGatewayIP, network.InterfaceType, formatTags(agent.Tags),
+			timestamp(agent.FirstSeen), timestamp(agent.LastSeen)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// groupCommand prints a group task's results, one line per agent, and a
+// count per status.
+func groupCommand(fs *flag.FlagSet, c *apiClient, args []string) error {
+	asJSON := fs.Bool("json", false, "Print the group and its task records as JSON")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: group <group_id>")
+	}
+	var group groupView
+	if err := c.do(http.MethodGet, "/api/groups/"+url.PathEscape(fs.Arg(0)), nil, &group); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(os.Stdout, group)
+	}
+	agents, err := c.agents()
+	if err != nil {
+		return err
+	}
+	hostnames := hostnameIndex(agents)
+	fmt.Printf("group %s: %s on %s\n", group.GroupID, group.Kind, group.Selector)
+	for _, task := range group.Tasks {
+		if task.finished() {
+			printResult(os.Stdout, task, hostnames)
+		} else {
+			fmt.Printf("-\t%s\t%s\t%s\n", hostnames[task.AgentID], task.Kind, task.Status)
+		}
+	}
+	statuses := make([]string, 0, len(group.Counts))
+	for status, count := range group.Counts {
+		statuses = append(statuses, fmt.Sprintf("%s=%d", status, count))
+	}
+	sort.Strings(statuses)
+	fmt.Println(strings.Join(statuses, " "))
+	return nil
+}
+
+func provisionCommand(fs *flag.FlagSet, c *apiClient, args []string) error {
+	subnet := fs.String("subnet", "", "IPv4 CIDR to broadcast provisioning into")
+	advertise := fs.String("advertise", "", "Admin IP agents should connect to (default: the server's address toward the subnet)")
+	_ = fs.Parse(args)
+	if *subnet == "" {
+		return errors.New("-subnet is required")
+	}
+	var response map[string]string
+	if err := c.do(http.MethodPost, "/api/provision", provisionRequest{Subnet: *subnet, AdminIP: *advertise}, &response); err != nil {
+		return err
+	}
+	fmt.Printf("provisioning sent to %s (admin %s); run `labscan-admin agents` to see who answered\n", response["broadcast"], response["admin_ip"])
+	return nil
+}
+
+// selectAgents resolves -agents entries by ID or hostname, or with all
+// takes every connected agent.
+func selectAgents(agents []AgentRecord, list string, all bool) ([]string, error) {
+	var ids []string
+	if all {
+		for _, agent := range agents {
+			if agent.Connected {
+				ids = append(ids, agent.AgentID)
+			}
+		}
+		if len(ids) == 0 {
+			return nil, errors.New("no agents are connected")
+		}
+		return ids, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		found := false
+		for _, agent := range agents {
+			if agent.AgentID == name || strings.EqualFold(agent.Hostname, name) {
+				ids = append(ids, agent.AgentID)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no agent %q", name)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("give -agents, -tags, or -all")
+	}
+	return ids, nil
+}
+
+// taskParams merges key=value arguments into the -params object. Values
+// that parse as JSON (numbers, booleans, lists) keep their type; anything
+// else is a string.
+func taskParams(paramsJSON string, pairs []string) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	if paramsJSON != "" {
+		if err := json.Unmarshal([]byte(paramsJSON), &params); err != nil {
+			return nil, fmt.Errorf("-params: %w", err)
+		}
+	}
+	for _, pair := range pairs {
+		key, raw, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		var value interface{}
+		if json.Unmarshal([]byte(raw), &value) != nil {
+			value = raw
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+func printResult(w io.Writer, task TaskRecord, hostnames map[string]string) {
+	detail := string(task.Result)
+	if task.Error != "" {
+		detail = task.Error
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", time.UnixMilli(task.FinishedAt).Format(time.TimeOnly),
+		hostnames[task.AgentID], task.Kind, task.Status, detail)
+}
+
+func hostnameIndex(agents []AgentRecord) map[string]string {
+	hostnames := make(map[string]string, len(agents))
+	for _, agent := range agents {
+		hostnames[agent.AgentID] = firstNonEmpty(agent.Hostname, agent.AgentID)
+	}
+	return hostnames
+}
+
+func printJSON(w io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func ago(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.Since(time.UnixMilli(ms)).Round(time.Second).String() + " ago"
+}
+
+func timestamp(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+func dash(value string) string {
+	return firstNonEmpty(value, "-")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	protocolVersion = 2
+	registerTimeout = 15 * time.Second
+	// readTimeout drops an agent that has sent nothing, not even a ping,
+	// for this long. Agents ping every 30s by default.
+	readTimeout  = 90 * time.Second
+	writeTimeout = 10 * time.Second
+	maxMessage   = 8 << 20
+	// signedTTL is how long a signed task stays valid; a task that waits
+	// longer, e.g. for a reconnect, is signed again when it is resent.
+	signedTTL = 10 * time.Minute
+)
+
+// wireMessage is the envelope of every websocket message in both
+// directions.
+type wireMessage struct {
+	Type      string          `json:"type"`
+	TS        int64           `json:"ts,omitempty"`
+	AgentID   string          `json:"agent_id,omitempty"`
+	Encoding  string          `json:"encoding,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"sig,omitempty"`
+	IssuedAt  int64           `json:"issued_at,omitempty"`
+	ExpiresAt int64           `json:"expires_at,omitempty"`
+	Nonce     string          `json:"nonce,omitempty"`
+}
+
+type registerPayload struct {
+	AgentID  string            `json:"agent_id"`
+	Secret   string            `json:"secret"`
+	Proof    string            `json:"proof"`
+	Hostname string            `json:"hostname"`
+	IPs      []string          `json:"ips"`
+	MACs     []string          `json:"macs"`
+	OS       string            `json:"os"`
+	Arch     string            `json:"arch"`
+	Version  string            `json:"version"`
+	Protocol int               `json:"protocol"`
+	Network  json.RawMessage   `json:"network"`
+	Tags     map[string]string `json:"tags"`
+
+	Interfaces json.RawMessage `json:"interfaces"`
+}
+
+type heartbeatPayload struct {
+	Status  string                 `json:"status"`
+	Full    bool                   `json:"full"`
+	Metrics map[string]interface{} `json:"metrics"`
+	Network json.RawMessage        `json:"network"`
+}
+
+type taskResultPayload struct {
+	TaskID    string          `json:"task_id"`
+	GroupID   string          `json:"group_id"`
+	OK        bool            `json:"ok"`
+	Status    string          `json:"status"`
+	Result    json.RawMessage `json:"result"`
+	Error     *string         `json:"error"`
+	ErrorCode string          `json:"error_code"`
+}
+
+type taskResultChunk struct {
+	ResultID string `json:"result_id"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+}
+
+// hub accepts agent connections on /ws/agent, keeps the store current
+// from what they send, and delivers tasks to them.
+type hub struct {
+	secret string
+	key    ed25519.PrivateKey
+	store  store
+	// legacySecret accepts register with the raw secret instead of a
+	// proof for the challenge.
+	legacySecret bool
+
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	agentID string
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	seq     uint64
+	// chunks buffers task_result_chunk data by result_id.
+	chunks map[string]*chunkBuffer
+}
+
+// Chunked results are buffered per session within these bounds, so an
+// agent cannot hold the admin's memory with results it never finishes.
+const (
+	maxPendingResults = 8
+	maxChunkedBytes   = 128 << 20
+	chunkIdleTimeout  = 2 * time.Minute
+)
+
+type chunkBuffer struct {
+	parts    []string
+	received int
+	bytes    int
+	updated  time.Time
+}
+
+func newHub(secret string, key ed25519.PrivateKey, st store) *hub {
+	return &hub{secret: secret, key: key, store: st, sessions: make(map[string]*session)}
+}
+
+func (h *hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxMessage)
+	s := &session{conn: conn, chunks: make(map[string]*chunkBuffer)}
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	challenge := hex.EncodeToString(nonce)
+	if err := s.write("challenge", map[string]string{"nonce": challenge}); err != nil {
+		return
+	}
+	register, err := h.awaitRegister(s, challenge)
+	if err != nil {
+		slog.Warn("agent rejected", "remote", r.RemoteAddr, "err", err)
+		_ = s.write("registered", map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	s.agentID = register.AgentID
+	protocol := min(max(register.Protocol, 1), protocolVersion)
+	if err := s.write("registered", map[string]interface{}{"ok": true, "protocol": protocol, "admin_time": time.Now().UnixMilli()}); err != nil {
+		return
+	}
+	h.connected(s, register, protocol, r.RemoteAddr)
+	defer h.disconnected(s)
+	if protocol >= 2 {
+		h.requestHistory(s)
+	}
+	h.deliverPending(s)
+
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		return s.control(websocket.PongMessage, []byte(data))
+	})
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		message, err := readMessage(conn)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Info("agent connection closed", "agent_id", s.agentID, "err", err)
+			}
+			return
+		}
+		h.handle(s, message)
+		if message.Seq != 0 && message.Type != "ack" {
+			_ = s.write("ack", map[string]uint64{"seq": message.Seq})
+		}
+	}
+}
+
+// awaitRegister reads the agent's register and checks its proof for the
+// challenge. The plain secret is only taken with -legacy-secret-auth, from
+// agents that predate challenges.
+func (h *hub) awaitRegister(s *session, challenge string) (registerPayload, error) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(registerTimeout))
+	var register registerPayload
+	message, err := readMessage(s.conn)
+	if err != nil {
+		return register, err
+	}
+	if message.Type != "register" {
+		return register, fmt.Errorf("expected register, got %q", message.Type)
+	}
+	if err := json.Unmarshal(message.Payload, &register); err != nil {
+		return register, err
+	}
+	if strings.TrimSpace(register.AgentID) == "" {
+		return register, errors.New("register without agent_id")
+	}
+	switch {
+	case register.Proof != "":
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write([]byte(challenge))
+		mac.Write([]byte(register.AgentID))
+		if !hmac.Equal([]byte(register.Proof), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			return register, errors.New("invalid register proof")
+		}
+	case !h.legacySecret:
+		return register, errors.New("register without proof")
+	case subtle.ConstantTimeCompare([]byte(register.Secret), []byte(h.secret)) != 1:
+		return register, errors.New("invalid secret")
+	}
+	return register, nil
+}
+
+func (h *hub) connected(s *session, register registerPayload, protocol int, remote string) {
+	h.mu.Lock()
+	previous := h.sessions[s.agentID]
+	h.sessions[s.agentID] = s
+	h.mu.Unlock()
+	if previous != nil {
+		_ = previous.conn.Close()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UnixMilli()
+	agent, ok, err := h.store.agent(s.agentID)
+	if err != nil {
+		slog.Warn("cannot load agent", "agent_id", s.agentID, "err", err)
+		return
+	}
+	if !ok {
+		agent.FirstSeen = now
+	}
+	agent.AgentID = register.AgentID
+	agent.Hostname = register.Hostname
+	agent.IPs = register.IPs
+	agent.MACs = register.MACs
+	agent.OS, agent.Arch, agent.Version = register.OS, register.Arch, register.Version
+	agent.Tags = register.Tags
+	agent.Protocol = protocol
+	agent.RemoteAddr = remote
+	agent.Connected, agent.Offline = true, ""
+	agent.LastSeen = now
+	if len(register.Network) > 0 {
+		agent.Network = register.Network
+	}
+	if len(register.Interfaces) > 0 {
+		agent.Interfaces = register.Interfaces
+	}
+	if err := h.store.putAgent(agent); err != nil {
+		slog.Warn("cannot store agent", "agent_id", agent.AgentID, "err", err)
+		return
+	}
+	slog.Info("agent registered", "agent_id", agent.AgentID, "hostname", agent.Hostname, "version", agent.Version, "remote", remote)
+}
+
+func (h *hub) disconnected(s *session) {
+	h.mu.Lock()
+	current := h.sessions[s.agentID] == s
+	if current {
+		delete(h.sessions, s.agentID)
+	}
+	h.mu.Unlock()
+	if !current {
+		return
+	}
+	h.updateAgent(s.agentID, func(agent *AgentRecord) {
+		agent.Connected = false
+		agent.LastSeen = time.Now().UnixMilli()
+	})
+	slog.Info("agent disconnected", "agent_id", s.agentID)
+}
+
+// provisioned records a provisioning ack, so agents show up before they
+// connect.
+func (h *hub) provisioned(ack ProvisionAck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UnixMilli()
+	agent, ok, err := h.store.agent(ack.AgentID)
+	if err != nil {
+		return
+	}
+	if !ok {
+		agent = AgentRecord{AgentID: ack.AgentID, Hostname: ack.Host, FirstSeen: now, LastSeen: now}
+	}
+	agent.Provisioned = now
+	if err := h.store.putAgent(agent); err != nil {
+		slog.Warn("cannot store agent", "agent_id", ack.AgentID, "err", err)
+	}
+}
+
+func (h *hub) handle(s *session, message wireMessage) {
+	payload, err := decodePayload(message.Encoding, message.Payload)
+	if err != nil {
+		slog.Warn("dropping message", "agent_id", s.agentID, "type", message.Type, "err", err)
+		return
+	}
+	switch message.Type {
+	case "heartbeat":
+		var beat heartbeatPayload
+		if json.Unmarshal(payload, &beat) != nil {
+			return
+		}
+		h.updateAgent(s.agentID, func(agent *AgentRecord) {
+			now := time.Now().UnixMilli()
+			agent.LastSeen, agent.LastBeat = now, now
+			if beat.Status != "" {
+				agent.Status = beat.Status
+			}
+			if beat.Full || agent.Metrics == nil {
+				agent.Metrics = make(map[string]interface{}, len(beat.Metrics))
+			}
+			for key, value := range beat.Metrics {
+				agent.Metrics[key] = value
+			}
+			if len(beat.Network) > 0 && string(beat.Network) != "null" {
+				agent.Network = beat.Network
+			}
+		})
+
+	case "task_result":
+		var result taskResultPayload
+		if json.Unmarshal(payload, &result) == nil {
+			h.finishTask(s.agentID, result)
+		}
+
+	case "task_result_chunk":
+		var chunk taskResultChunk
+		if json.Unmarshal(payload, &chunk) != nil || chunk.Total < 1 || chunk.Total > 4096 || chunk.Index < 0 || chunk.Index >= chunk.Total {
+			return
+		}
+		parts, err := s.addChunk(chunk, time.Now())
+		if err != nil {
+			slog.Warn("dropping result chunk", "agent_id", s.agentID, "result_id", chunk.ResultID, "err", err)
+			return
+		}
+		if parts == nil {
+			return
+		}
+		// The joined data is the result's JSON, or with an encoding the
+		// base64 string decodePayload expects as a JSON string.
+		data := strings.Join(parts, "")
+		raw := json.RawMessage(data)
+		if chunk.Encoding != "" {
+			raw, _ = json.Marshal(data)
+		}
+		if raw, err = decodePayload(chunk.Encoding, raw); err != nil {
+			slog.Warn("dropping chunked result", "agent_id", s.agentID, "err", err)
+			return
+		}
+		var result taskResultPayload
+		if json.Unmarshal(raw, &result) == nil {
+			h.finishTask(s.agentID, result)
+		}
+
+	case "task_queued", "task_progress":
+		var progress struct {
+			TaskID string `json:"task_id"`
+		}
+		if json.Unmarshal(payload, &progress) != nil {
+			return
+		}
+		status := taskRunning
+		if message.Type == "task_queued" {
+			status = taskQueued
+		}
+		h.updateTask(progress.TaskID, func(task *TaskRecord) {
+			task.Status = status
+			if message.Type == "task_progress" {
+				task.Progress = payload
+			}
+		})
+
+	case "update_register":
+		var update registerPayload
+		if json.Unmarshal(payload, &update) != nil {
+			return
+		}
+		h.updateAgent(s.agentID, func(agent *AgentRecord) {
+			agent.Hostname, agent.IPs, agent.MACs = update.Hostname, update.IPs, update.MACs
+			if len(update.Network) > 0 && string(update.Network) != "null" {
+				agent.Network = update.Network
+			}
+			if len(update.Interfaces) > 0 {
+				agent.Interfaces = update.Interfaces
+			}
+		})
+		slog.Info("agent host changed", "agent_id", s.agentID, "hostname", update.Hostname, "ips", strings.Join(update.IPs, ","))
+
+	case "going_offline":
+		var offline struct {
+			Reason string `json:"reason"`
+		}
+		_ = json.Unmarshal(payload, &offline)
+		h.updateAgent(s.agentID, func(agent *AgentRecord) { agent.Offline = offline.Reason })
+		slog.Info("agent going offline", "agent_id", s.agentID, "reason", offline.Reason)
+
+	case "event":
+		var event struct {
+			Kind string `json:"kind"`
+			Data struct {
+				Tags map[string]string `json:"tags"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(payload, &event) == nil && event.Kind == "tags_changed" {
+			h.updateAgent(s.agentID, func(agent *AgentRecord) { agent.Tags = event.Data.Tags })
+		}
+		slog.Info("agent event", "agent_id", s.agentID, "payload", string(payload))
+
+	case "log", "update_result", "config_applied", "policy_applied", "reprovisioned", "task_update", "history_result":
+		slog.Info("agent "+message.Type, "agent_id", s.agentID, "payload", string(payload))
+	}
+}
+
+// addChunk buffers a task_result_chunk and returns every part once the
+// last one has arrived. Buffers idle for chunkIdleTimeout are dropped, and
+// so is the oldest buffer when a new result would exceed the limits.
+func (s *session) addChunk(chunk taskResultChunk, now time.Time) ([]string, error) {
+	total := 0
+	for id, buffer := range s.chunks {
+		if now.Sub(buffer.updated) > chunkIdleTimeout {
+			delete(s.chunks, id)
+			continue
+		}
+		total += buffer.bytes
+	}
+	buffer := s.chunks[chunk.ResultID]
+	if buffer == nil {
+		for len(s.chunks) >= maxPendingResults {
+			total -= s.dropOldestChunks()
+		}
+		buffer = &chunkBuffer{parts: make([]string, chunk.Total)}
+		s.chunks[chunk.ResultID] = buffer
+	}
+	if len(buffer.parts) != chunk.Total {
+		delete(s.chunks, chunk.ResultID)
+		return nil, fmt.Errorf("chunk total changed from %d to %d", len(buffer.parts), chunk.Total)
+	}
+	if total+len(chunk.Data) > maxChunkedBytes {
+		delete(s.chunks, chunk.ResultID)
+		return nil, fmt.Errorf("chunked results exceed %d bytes", maxChunkedBytes)
+	}
+	if buffer.parts[chunk.Index] == "" && chunk.Data != "" {
+		buffer.received++
+	}
+	buffer.bytes += len(chunk.Data) - len(buffer.parts[chunk.Index])
+	buffer.parts[chunk.Index] = chunk.Data
+	buffer.updated = now
+	if buffer.received < len(buffer.parts) {
+		return nil, nil
+	}
+	delete(s.chunks, chunk.ResultID)
+	return buffer.parts, nil
+}
+
+// dropOldestChunks discards the least recently updated buffer and returns
+// its size.
+func (s *session) dropOldestChunks() int {
+	var oldest string
+	for id, buffer := range s.chunks {
+		if oldest == "" || buffer.updated.Before(s.chunks[oldest].updated) {
+			oldest = id
+		}
+	}
+	size := s.chunks[oldest].bytes
+	slog.Warn("dropping incomplete chunked result", "agent_id", s.agentID, "result_id", oldest)
+	delete(s.chunks, oldest)
+	return size
+}
+
+// finishTask records a task_result. A second result for the same task,
+// such as one replayed from the agent's outbox, is ignored.
+func (h *hub) finishTask(agentID string, result taskResultPayload) {
+	task, ok, err := h.store.task(result.TaskID)
+	if err != nil || (ok && task.finished()) {
+		return
+	}
+	if !ok {
+		task = TaskRecord{TaskID: result.TaskID, AgentID: agentID, GroupID: result.GroupID, Kind: "unknown", CreatedAt: time.Now().UnixMilli()}
+	}
+	task.Result = result.Result
+	task.ErrorCode = result.ErrorCode
+	task.FinishedAt = time.Now().UnixMilli()
+	switch {
+	case result.Status == taskCancelled:
+		task.Status = taskCancelled
+	case result.OK:
+		task.Status = taskDone
+	default:
+		task.Status = taskFailed
+	}
+	if result.Error != nil {
+		task.Error = *result.Error
+	}
+	if err := h.store.putTask(task); err != nil {
+		slog.Warn("cannot store task result", "task_id", task.TaskID, "err", err)
+	}
+	slog.Info("task finished", "agent_id", agentID, "task_id", task.TaskID, "group_id", task.GroupID, "kind", task.Kind, "status", task.Status)
+}
+
+// dispatch records a task for agentID and sends it right away if the agent
+// is connected; otherwise it goes out when the agent next registers.
+func (h *hub) dispatch(agentID, kind string, params map[string]interface{}) (TaskRecord, error) {
+	if _, ok, err := h.store.agent(agentID); err != nil || !ok {
+		return TaskRecord{}, fmt.Errorf("unknown agent %s", agentID)
+	}
+	return h.enqueue(TaskRecord{AgentID: agentID, Kind: kind, Params: params})
+}
+
+// dispatchGroup fans one task out to the agents whose tags match selector:
+// the connected ones, or with includeOffline every known one.
+func (h *hub) dispatchGroup(selector tagSelector, kind string, params map[string]interface{}, includeOffline bool) (GroupRecord, []TaskRecord, error) {
+	agents, err := h.store.agents()
+	if err != nil {
+		return GroupRecord{}, nil, err
+	}
+	group := GroupRecord{GroupID: uuid.NewString(), Selector: selector.String(), Kind: kind, Params: params, AgentIDs: []string{}, CreatedAt: time.Now().UnixMilli()}
+	for _, agent := range agents {
+		if selector.matches(agent.Tags) && (agent.Connected || includeOffline) {
+			group.AgentIDs = append(group.AgentIDs, agent.AgentID)
+		}
+	}
+	if len(group.AgentIDs) == 0 {
+		return group, nil, fmt.Errorf("no agents match %s", group.Selector)
+	}
+	if err := h.store.putGroup(group); err != nil {
+		return group, nil, err
+	}
+	tasks := make([]TaskRecord, 0, len(group.AgentIDs))
+	for _, agentID := range group.AgentIDs {
+		task, err := h.enqueue(TaskRecord{AgentID: agentID, GroupID: group.GroupID, Kind: kind, Params: params})
+		if err != nil {
+			return group, tasks, err
+		}
+		tasks = append(tasks, task)
+	}
+	slog.Info("group dispatched", "group_id", group.GroupID, "selector", group.Selector, "kind", kind, "agents", len(tasks))
+	return group, tasks, nil
+}
+
+// enqueue stores a new task and sends it if its agent is connected.
+func (h *hub) enqueue(task TaskRecord) (TaskRecord, error) {
+	if task.Params == nil {
+		task.Params = map[string]interface{}{}
+	}
+	task.TaskID, task.Status, task.CreatedAt = uuid.NewString(), taskPending, time.Now().UnixMilli()
+	if err := h.store.putTask(task); err != nil {
+		return task, err
+	}
+	h.mu.Lock()
+	s := h.sessions[task.AgentID]
+	h.mu.Unlock()
+	if s != nil {
+		if err := h.send(s, &task); err != nil {
+			slog.Warn("task not delivered, will retry on reconnect", "task_id", task.TaskID, "err", err)
+		}
+	}
+	return task, nil
+}
+
+// deliverPending sends the agent every task it has not returned a result
+// for. Tasks are numbered, so one the agent already got is acked but not
+// run twice.
+func (h *hub) deliverPending(s *session) {
+	tasks, err := h.store.tasks(s.agentID)
+	if err != nil {
+		return
+	}
+	for i := range tasks {
+		if !tasks[i].finished() {
+			if err := h.send(s, &tasks[i]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// requestHistory asks the agent to resend the results of tasks it was sent
+// but never reported back, for example while the admin was restarting.
+// deliverPending still sends those tasks; the agent answers one it has a
+// cached result for with that result instead of running it again.
+func (h *hub) requestHistory(s *session) {
+	tasks, err := h.store.tasks(s.agentID)
+	if err != nil {
+		return
+	}
+	var ids []string
+	for _, task := range tasks {
+		if !task.finished() && task.Status != taskPending {
+			ids = append(ids, task.TaskID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{"request_id": uuid.NewString(), "task_ids": ids})
+	if err != nil {
+		return
+	}
+	message := wireMessage{Type: "history", Payload: payload}
+	if h.key != nil {
+		h.sign(s.agentID, &message)
+	}
+	_ = s.writeMessage(message)
+}
+
+// send writes a task, signed with the admin key when there is one, and
+// marks it sent.
+func (h *hub) send(s *session, task *TaskRecord) error {
+	body := map[string]interface{}{"task_id": task.TaskID, "kind": task.Kind, "params": task.Params}
+	if task.GroupID != "" {
+		body["group_id"] = task.GroupID
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	message := wireMessage{Type: "task", Payload: payload}
+	if h.key != nil {
+		h.sign(s.agentID, &message)
+	}
+	if err := s.writeMessage(message); err != nil {
+		return err
+	}
+	h.updateTask(task.TaskID, func(stored *TaskRecord) {
+		if stored.Status == taskPending {
+			stored.Status = taskSent
+		}
+		stored.SentAt = time.Now().UnixMilli()
+		*task = *stored
+	})
+	return nil
+}
+
+// updateAgent and updateTask serialize read-modify-write on a record; the
+// hub is the only writer.
+func (h *hub) updateAgent(agentID string, update func(*AgentRecord)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	agent, ok, err := h.store.agent(agentID)
+	if err != nil || !ok {
+		return
+	}
+	update(&agent)
+	if err := h.store.putAgent(agent); err != nil {
+		slog.Warn("cannot store agent", "agent_id", agentID, "err", err)
+	}
+}
+
+func (h *hub) updateTask(taskID string, update func(*TaskRecord)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	task, ok, err := h.store.task(taskID)
+	if err != nil || !ok || task.finished() {
+		return
+	}
+	update(&task)
+	if err := h.store.putTask(task); err != nil {
+		slog.Warn("cannot store task", "task_id", taskID, "err", err)
+	}
+}
+
+// sign signs message for agentID over "type|agent_id|issued_at|expires_at|
+// nonce|payload", valid for signedTTL with a fresh nonce, so the agent can
+// refuse it as another message type, after it expires, or a second time.
+func (h *hub) sign(agentID string, message *wireMessage) {
+	now := time.Now()
+	message.IssuedAt = now.UnixMilli()
+	message.ExpiresAt = now.Add(signedTTL).UnixMilli()
+	message.Nonce = uuid.NewString()
+	signing := fmt.Sprintf("%s|%s|%d|%d|%s|", message.Type, agentID, message.IssuedAt, message.ExpiresAt, message.Nonce)
+	message.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(h.key, append([]byte(signing), message.Payload...)))
+}
+
+func (s *session) write(messageType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.writeMessage(wireMessage{Type: messageType, Payload: raw})
+}
+
+// writeMessage numbers tasks so the agent acks them and drops redeliveries.
+func (s *session) writeMessage(message wireMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	message.TS = time.Now().UnixMilli()
+	if message.Type == "task" {
+		s.seq++
+		message.Seq = s.seq
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return s.conn.WriteJSON(message)
+}
+
+func (s *session) control(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteControl(messageType, data, time.Now().Add(writeTimeout))
+}
+
+func readMessage(conn *websocket.Conn) (wireMessage, error) {
+	var message wireMessage
+	frameType, raw, err := conn.ReadMessage()
+	if err != nil {
+		return message, err
+	}
+	if frameType != websocket.TextMessage {
+		return message, errors.New("binary frames were not negotiated")
+	}
+	return message, json.Unmarshal(raw, &message)
+}
+
+// decodePayload undoes the agent's gzip+base64 payload encoding.
+func decodePayload(encoding string, payload json.RawMessage) (json.RawMessage, error) {
+	switch encoding {
+	case "":
+		return payload, nil
+	case "gzip":
+		var packed string
+		if err := json.Unmarshal(payload, &packed); err != nil {
+			return nil, err
+		}
+		compressed, err := base64.StdEncoding.DecodeString(packed)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(io.LimitReader(zr, 64<<20))
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// registerAgent connects to h as agentID and answers the challenge with
+// answer, returning the registered payload the hub sent back.
+func registerAgent(t *testing.T, h *hub, agentID string, answer func(nonce string) registerPayload) map[string]interface{} {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	challenge, err := readMessage(conn)
+	if err != nil || challenge.Type != "challenge" {
+		t.Fatalf("first message = %+v, %v; want challenge", challenge, err)
+	}
+	var nonce struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(challenge.Payload, &nonce); err != nil || nonce.Nonce == "" {
+		t.Fatalf("challenge payload %s", challenge.Payload)
+	}
+	register := answer(nonce.Nonce)
+	register.AgentID, register.Hostname, register.Protocol = agentID, "lab-1", protocolVersion
+	payload, _ := json.Marshal(register)
+	if err := conn.WriteJSON(wireMessage{Type: "register", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := readMessage(conn)
+	if err != nil || reply.Type != "registered" {
+		t.Fatalf("reply = %+v, %v; want registered", reply, err)
+	}
+	var registered map[string]interface{}
+	_ = json.Unmarshal(reply.Payload, &registered)
+	return registered
+}
+
+func proofFor(secret, nonce, agentID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(agentID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHubRegister(t *testing.T) {
+	const secret = "s3cret"
+	for _, tt := range []struct {
+		name   string
+		legacy bool
+		answer func(nonce string) registerPayload
+		ok     bool
+	}{
+		{"valid proof", false, func(nonce string) registerPayload {
+			return registerPayload{Proof: proofFor(secret, nonce, "a-1")}
+		}, true},
+		{"proof for another agent", false, func(nonce string) registerPayload {
+			return registerPayload{Proof: proofFor(secret, nonce, "a-2")}
+		}, false},
+		{"proof with the wrong secret", false, func(nonce string) registerPayload {
+			return registerPayload{Proof: proofFor("guess", nonce, "a-1")}
+		}, false},
+		{"raw secret", false, func(string) registerPayload {
+			return registerPayload{Secret: secret}
+		}, false},
+		{"raw secret with -legacy-secret-auth", true, func(string) registerPayload {
+			return registerPayload{Secret: secret}
+		}, true},
+		{"wrong raw secret with -legacy-secret-auth", true, func(string) registerPayload {
+			return registerPayload{Secret: "guess"}
+		}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHub(secret, nil, newMemoryStore())
+			h.legacySecret = tt.legacy
+			registered := registerAgent(t, h, "a-1", tt.answer)
+			if ok, _ := registered["ok"].(bool); ok != tt.ok {
+				t.Fatalf("registered = %v, want ok %v", registered, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHubRegisterKeepsRecord(t *testing.T) {
+	h := newHub("s3cret", nil, newMemoryStore())
+	h.provisioned(ProvisionAck{AgentID: "a-1", Host: "lab-1"})
+	before, _, _ := h.store.agent("a-1")
+
+	registerAgent(t, h, "a-1", func(nonce string) registerPayload {
+		return registerPayload{Proof: proofFor("s3cret", nonce, "a-1")}
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		agent, _, _ := h.store.agent("a-1")
+		if agent.Connected {
+			if agent.Provisioned != before.Provisioned || agent.FirstSeen != before.FirstSeen {
+				t.Errorf("registration lost provisioned_at or first_seen: %+v, was %+v", agent, before)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("agent never marked connected: %+v", agent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
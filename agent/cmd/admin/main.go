@@ -0,0 +1,172 @@
+// Command admin is a LabScan admin server: it broadcasts provisioning so
+// agents in sleep mode find it, accepts their websocket connections,
+// tracks registrations and heartbeats, dispatches tasks, and collects
+// results.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type serverOptions struct {
+	listen            string
+	secret            string
+	keyPath           string
+	dbPath            string
+	provisionPort     int
+	provisionInterval time.Duration
+	advertise         string
+	subnets           string
+	apiToken          string
+	legacySecret      bool
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		runClientCommand(args[0], args[1:])
+		return
+	}
+
+	var opts serverOptions
+	flag.StringVar(&opts.listen, "listen", ":8148", "Address for the agent websocket (/ws/agent)")
+	flag.StringVar(&opts.secret, "secret", os.Getenv("LABSCAN_SECRET"), "Shared secret agents register with (or LABSCAN_SECRET)")
+	flag.StringVar(&opts.keyPath, "key", "", "Ed25519 key file used to sign provisioning and tasks; created if missing. Empty disables signing")
+	flag.StringVar(&opts.dbPath, "db", "", "SQLite database for agents and tasks (builds with -tags sqlite); empty keeps them in memory")
+	flag.IntVar(&opts.provisionPort, "provision-port", 8870, "UDP port agents listen on for provisioning")
+	flag.DurationVar(&opts.provisionInterval, "provision-interval", 10*time.Second, "How often provisioning is broadcast; 0 only broadcasts on request (provision command)")
+	flag.StringVar(&opts.advertise, "advertise", "", "Admin address announced in provisioning (default: the address of each interface broadcast from)")
+	flag.StringVar(&opts.subnets, "subnets", "", "Comma-separated CIDRs to broadcast into instead of the local interfaces' subnets")
+	flag.BoolVar(&opts.legacySecret, "legacy-secret-auth", false, "Also accept agents that register with the raw secret instead of answering the challenge")
+	flag.StringVar(&opts.apiToken, "api-token", os.Getenv("LABSCAN_API_TOKEN"), "Bearer token for /api (or LABSCAN_API_TOKEN); without one /api is loopback-only")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, clientUsage)
+		flag.PrintDefaults()
+	}
+	_ = flag.CommandLine.Parse(args)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx, opts); err != nil {
+		slog.Error("admin failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func serve(ctx context.Context, opts serverOptions) error {
+	if opts.secret == "" {
+		return errors.New("-secret is required")
+	}
+	key, err := loadOrCreateKey(opts.keyPath)
+	if err != nil {
+		return err
+	}
+	st := store(newMemoryStore())
+	if opts.dbPath != "" {
+		if st, err = openSQLiteStore(opts.dbPath); err != nil {
+			return fmt.Errorf("open %s: %w", opts.dbPath, err)
+		}
+	}
+	defer st.close()
+
+	h := newHub(opts.secret, key, st)
+	h.legacySecret = opts.legacySecret
+	mux := http.NewServeMux()
+	mux.Handle("/ws/agent", h)
+	server := &http.Server{Addr: opts.listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	listener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+	}()
+
+	p := &provisioner{secret: opts.secret, key: key, port: opts.provisionPort, interval: opts.provisionInterval, adminIP: opts.advertise,
+		onAck: func(ack ProvisionAck, _ net.Addr) { h.provisioned(ack) }, once: make(chan provisionTarget, 1)}
+	for _, cidr := range strings.Split(opts.subnets, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		target, err := subnetTarget(cidr, opts.advertise)
+		if err == nil && target.adminIP == "" {
+			err = fmt.Errorf("no local address routes to %s; give -advertise", cidr)
+		}
+		if err != nil {
+			return fmt.Errorf("-subnets: %w", err)
+		}
+		p.targets = append(p.targets, target)
+	}
+	go func() {
+		if err := p.run(ctx); err != nil {
+			slog.Error("provisioning stopped", "err", err)
+		}
+	}()
+	(&api{hub: h, provisioner: p, token: opts.apiToken}).register(mux)
+
+	slog.Info("admin listening", "addr", listener.Addr().String(), "signed", key != nil, "provision_interval", opts.provisionInterval, "api_token", opts.apiToken != "")
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// loadOrCreateKey reads a base64 Ed25519 private key, generating and saving
+// one the first time. Agents bind to the first key that signs their
+// provisioning, so the file must be kept.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		slog.Info("created admin key", "path", path, "fingerprint", keyFingerprint(key))
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s: not a base64 Ed25519 private key", path)
+	}
+	key := ed25519.PrivateKey(raw)
+	slog.Info("loaded admin key", "path", path, "fingerprint", keyFingerprint(key))
+	return key, nil
+}
+
+// keyFingerprint is the SHA-256 of the public key, as agents log it when
+// they bind to the admin.
+func keyFingerprint(key ed25519.PrivateKey) string {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProvisionMessage is the LABSCAN_PROVISION packet agents in sleep mode
+// listen for.
+type ProvisionMessage struct {
+	Type           string   `json:"type"`
+	V              int      `json:"v"`
+	AdminIP        string   `json:"admin_ip"`
+	Secret         string   `json:"secret"`
+	Nonce          string   `json:"nonce"`
+	TS             int64    `json:"ts,omitempty"`
+	AdminPublicKey string   `json:"admin_public_key,omitempty"`
+	TLS            bool     `json:"tls,omitempty"`
+	TLSCAPEM       string   `json:"tls_ca_pem,omitempty"`
+	TLSCertSHA256  string   `json:"tls_cert_sha256,omitempty"`
+	TLSClientCSR   bool     `json:"tls_client_csr,omitempty"`
+	TLSClientCert  string   `json:"tls_client_cert_pem,omitempty"`
+	TLSClientKey   string   `json:"tls_client_key_pem,omitempty"`
+	ScanAllow      []string `json:"scan_allow,omitempty"`
+	DenyKinds      []string `json:"deny_kinds,omitempty"`
+	Signature      string   `json:"sig,omitempty"`
+}
+
+// signingString matches the agent's provisionSigningString: every field
+// that steers the agent, one per line, in a fixed order.
+func (m ProvisionMessage) signingString() string {
+	return strings.Join([]string{
+		m.Type,
+		strconv.Itoa(m.V),
+		m.Nonce,
+		strconv.FormatInt(m.TS, 10),
+		m.AdminIP,
+		m.Secret,
+		m.AdminPublicKey,
+		strconv.FormatBool(m.TLS),
+		m.TLSCAPEM,
+		m.TLSCertSHA256,
+		strconv.FormatBool(m.TLSClientCSR),
+		m.TLSClientCert,
+		m.TLSClientKey,
+		strings.Join(m.ScanAllow, ","),
+		strings.Join(m.DenyKinds, ","),
+	}, "\n")
+}
+
+// ProvisionAck is what an agent answers a provisioning packet with.
+type ProvisionAck struct {
+	Type    string `json:"type"`
+	AgentID string `json:"agent_id"`
+	Host    string `json:"hostname"`
+	Nonce   string `json:"nonce"`
+}
+
+// provisionTarget is one broadcast address and the admin address agents
+// behind it should connect to.
+type provisionTarget struct {
+	adminIP   string
+	broadcast net.IP
+}
+
+type provisioner struct {
+	secret   string
+	key      ed25519.PrivateKey
+	port     int
+	interval time.Duration
+	// adminIP, when set, is announced on the local subnets instead of the
+	// address of the interface the broadcast leaves from.
+	adminIP string
+	targets []provisionTarget
+	// onAck is called for every acknowledgement.
+	onAck func(ProvisionAck, net.Addr)
+	// once queues one-off broadcasts, such as the CLI's provision command.
+	once chan provisionTarget
+}
+
+// localTargets returns the directed broadcast address of every up IPv4
+// interface, paired with the interface's own address.
+func localTargets() []provisionTarget {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var targets []provisionTarget
+	for _, intf := range interfaces {
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagLoopback != 0 || intf.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, _ := intf.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for i := range broadcast {
+				broadcast[i] = ip[i] | ^mask[i]
+			}
+			targets = append(targets, provisionTarget{adminIP: ip.String(), broadcast: broadcast})
+		}
+	}
+	return targets
+}
+
+// subnetTarget broadcasts into cidr, announcing adminIP; agents in a
+// routed subnet are only reached this way if the router forwards directed
+// broadcasts.
+func subnetTarget(cidr, adminIP string) (provisionTarget, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return provisionTarget{}, err
+	}
+	ip := subnet.IP.To4()
+	if ip == nil {
+		return provisionTarget{}, &net.ParseError{Type: "IPv4 CIDR", Text: cidr}
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = ip[i] | ^subnet.Mask[i]
+	}
+	if adminIP == "" {
+		adminIP = localIPFor(broadcast)
+	}
+	return provisionTarget{adminIP: adminIP, broadcast: broadcast}, nil
+}
+
+// localIPFor is the local address the route to ip leaves from. Connecting
+// a UDP socket sends nothing.
+func localIPFor(ip net.IP) string {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// run broadcasts provisioning every interval (never, for 0) and whenever
+// one is queued, until ctx is done, and logs the acknowledgements that
+// come back.
+func (p *provisioner) run(ctx context.Context) error {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	go p.readAcks(conn)
+
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		p.broadcast(conn, p.targets)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+			p.broadcast(conn, p.targets)
+		case target := <-p.once:
+			p.broadcast(conn, []provisionTarget{target})
+		}
+	}
+}
+
+// provisionNow queues a single broadcast to target.
+func (p *provisioner) provisionNow(target provisionTarget) error {
+	select {
+	case p.once <- target:
+		return nil
+	default:
+		return errors.New("a provisioning broadcast is already queued")
+	}
+}
+
+func (p *provisioner) broadcast(conn *net.UDPConn, targets []provisionTarget) {
+	if len(targets) == 0 {
+		targets = localTargets()
+		for i := range targets {
+			if p.adminIP != "" {
+				targets[i].adminIP = p.adminIP
+			}
+		}
+	}
+	for _, target := range targets {
+		raw, err := json.Marshal(p.message(target.adminIP))
+		if err != nil {
+			continue
+		}
+		addr := &net.UDPAddr{IP: target.broadcast, Port: p.port}
+		if _, err := conn.WriteToUDP(raw, addr); err != nil {
+			slog.Debug("provisioning broadcast failed", "to", addr.String(), "err", err)
+		}
+	}
+}
+
+// message builds one packet with a fresh nonce, signed when the admin has
+// a key.
+func (p *provisioner) message(adminIP string) ProvisionMessage {
+	message := ProvisionMessage{
+		Type:    "LABSCAN_PROVISION",
+		V:       1,
+		AdminIP: adminIP,
+		Secret:  p.secret,
+		Nonce:   uuid.NewString(),
+		TS:      time.Now().UnixMilli(),
+	}
+	if p.key != nil {
+		message.AdminPublicKey = base64.StdEncoding.EncodeToString(p.key.Public().(ed25519.PublicKey))
+		message.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, []byte(message.signingString())))
+	}
+	return message
+}
+
+func (p *provisioner) readAcks(conn *net.UDPConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, sender, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var ack ProvisionAck
+		if json.Unmarshal(buf[:n], &ack) != nil || ack.Type != "LABSCAN_PROVISION_ACK" || ack.AgentID == "" {
+			continue
+		}
+		slog.Info("agent provisioned", "agent_id", ack.AgentID, "hostname", ack.Host, "from", sender.IP.String())
+		if p.onAck != nil {
+			p.onAck(ack, sender)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// AgentRecord is what the admin knows about an agent: its registration,
+// whether it is connected, and its latest heartbeat.
+type AgentRecord struct {
+	AgentID     string                 `json:"agent_id"`
+	Hostname    string                 `json:"hostname"`
+	IPs         []string               `json:"ips"`
+	MACs        []string               `json:"macs,omitempty"`
+	OS          string                 `json:"os"`
+	Arch        string                 `json:"arch"`
+	Version     string                 `json:"version"`
+	Protocol    int                    `json:"protocol"`
+	RemoteAddr  string                 `json:"remote_addr,omitempty"`
+	Connected   bool                   `json:"connected"`
+	Status      string                 `json:"status,omitempty"`
+	FirstSeen   int64                  `json:"first_seen"`
+	LastSeen    int64                  `json:"last_seen"`
+	LastBeat    int64                  `json:"last_heartbeat,omitempty"`
+	Offline     string                 `json:"offline_reason,omitempty"`
+	Network     json.RawMessage        `json:"network,omitempty"`
+	Metrics     map[string]interface{} `json:"metrics,omitempty"`
+	Provisioned int64                  `json:"provisioned_at,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+
+	Interfaces json.RawMessage `json:"interfaces,omitempty"`
+}
+
+// Task states. A task is pending until it is written to a connected agent,
+// and stays sent, queued, or running until its task_result arrives.
+const (
+	taskPending   = "pending"
+	taskSent      = "sent"
+	taskQueued    = "queued"
+	taskRunning   = "running"
+	taskDone      = "done"
+	taskFailed    = "failed"
+	taskCancelled = "cancelled"
+)
+
+type TaskRecord struct {
+	TaskID     string                 `json:"task_id"`
+	AgentID    string                 `json:"agent_id"`
+	GroupID    string                 `json:"group_id,omitempty"`
+	Kind       string                 `json:"kind"`
+	Params     map[string]interface{} `json:"params"`
+	Status     string                 `json:"status"`
+	Result     json.RawMessage        `json:"result,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	ErrorCode  string                 `json:"error_code,omitempty"`
+	Progress   json.RawMessage        `json:"progress,omitempty"`
+	CreatedAt  int64                  `json:"created_at"`
+	SentAt     int64                  `json:"sent_at,omitempty"`
+	FinishedAt int64                  `json:"finished_at,omitempty"`
+}
+
+// GroupRecord is one task fanned out to every agent a tag selector matched
+// when it was dispatched. Its tasks carry the group_id, and so do their
+// results.
+type GroupRecord struct {
+	GroupID   string                 `json:"group_id"`
+	Selector  string                 `json:"selector"`
+	Kind      string                 `json:"kind"`
+	Params    map[string]interface{} `json:"params"`
+	AgentIDs  []string               `json:"agent_ids"`
+	CreatedAt int64                  `json:"created_at"`
+}
+
+func (t TaskRecord) finished() bool {
+	return t.Status == taskDone || t.Status == taskFailed || t.Status == taskCancelled
+}
+
+// store keeps agents and tasks. memoryStore is the default; -db keeps them
+// in SQLite in builds with the sqlite tag.
+type store interface {
+	putAgent(AgentRecord) error
+	agent(id string) (AgentRecord, bool, error)
+	agents() ([]AgentRecord, error)
+	putTask(TaskRecord) error
+	task(id string) (TaskRecord, bool, error)
+	// tasks returns an agent's tasks, or every task for "", oldest first.
+	tasks(agentID string) ([]TaskRecord, error)
+	putGroup(GroupRecord) error
+	group(id string) (GroupRecord, bool, error)
+	// groups returns every group, newest first.
+	groups() ([]GroupRecord, error)
+	close() error
+}
+
+type memoryStore struct {
+	mu         sync.Mutex
+	agentsByID map[string]AgentRecord
+	tasksByID  map[string]TaskRecord
+	groupsByID map[string]GroupRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{agentsByID: make(map[string]AgentRecord), tasksByID: make(map[string]TaskRecord), groupsByID: make(map[string]GroupRecord)}
+}
+
+func (m *memoryStore) putAgent(agent AgentRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.agentsByID[agent.AgentID] = agent
+	return nil
+}
+
+func (m *memoryStore) agent(id string) (AgentRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, ok := m.agentsByID[id]
+	return agent, ok, nil
+}
+
+func (m *memoryStore) agents() ([]AgentRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agents := make([]AgentRecord, 0, len(m.agentsByID))
+	for _, agent := range m.agentsByID {
+		agents = append(agents, agent)
+	}
+	sortAgents(agents)
+	return agents, nil
+}
+
+func (m *memoryStore) putTask(task TaskRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tasksByID[task.TaskID] = task
+	return nil
+}
+
+func (m *memoryStore) task(id string) (TaskRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	task, ok := m.tasksByID[id]
+	return task, ok, nil
+}
+
+func (m *memoryStore) tasks(agentID string) ([]TaskRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tasks []TaskRecord
+	for _, task := range m.tasksByID {
+		if agentID == "" || task.AgentID == agentID {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].CreatedAt != tasks[j].CreatedAt {
+			return tasks[i].CreatedAt < tasks[j].CreatedAt
+		}
+		return tasks[i].TaskID < tasks[j].TaskID
+	})
+	return tasks, nil
+}
+
+func (m *memoryStore) putGroup(group GroupRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groupsByID[group.GroupID] = group
+	return nil
+}
+
+func (m *memoryStore) group(id string) (GroupRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	group, ok := m.groupsByID[id]
+	return group, ok, nil
+}
+
+func (m *memoryStore) groups() ([]GroupRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	groups := make([]GroupRecord, 0, len(m.groupsByID))
+	for _, group := range m.groupsByID {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].CreatedAt != groups[j].CreatedAt {
+			return groups[i].CreatedAt > groups[j].CreatedAt
+		}
+		return groups[i].GroupID < groups[j].GroupID
+	})
+	return groups, nil
+}
+
+func (m *memoryStore) close() error { return nil }
+
+func sortAgents(agents []AgentRecord) {
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Hostname != agents[j].Hostname {
+			return agents[i].Hostname < agents[j].Hostname
+		}
+		return agents[i].AgentID < agents[j].AgentID
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !sqlite
+
+package main
+
+import "errors"
+
+func openSQLiteStore(string) (store, error) {
+	return nil, errors.New("this build has no SQLite support; rebuild with -tags sqlite")
+}
@@ -0,0 +1,153 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps each record as a JSON document, with the columns the
+// queries need next to it.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (store, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS agents (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+		CREATE TABLE IF NOT EXISTS tasks (id TEXT PRIMARY KEY, agent_id TEXT NOT NULL, created_at INTEGER NOT NULL, data TEXT NOT NULL);
+		CREATE INDEX IF NOT EXISTS tasks_agent ON tasks (agent_id, created_at);
+		CREATE TABLE IF NOT EXISTS task_groups (id TEXT PRIMARY KEY, created_at INTEGER NOT NULL, data TEXT NOT NULL);
+		UPDATE agents SET data = json_set(data, '$.connected', json('false'));`)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) putAgent(agent AgentRecord) error {
+	data, err := json.Marshal(agent)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO agents (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, agent.AgentID, string(data))
+	return err
+}
+
+func (s *sqliteStore) agent(id string) (AgentRecord, bool, error) {
+	var agent AgentRecord
+	ok, err := s.get(`SELECT data FROM agents WHERE id = ?`, id, &agent)
+	return agent, ok, err
+}
+
+func (s *sqliteStore) agents() ([]AgentRecord, error) {
+	rows, err := s.db.Query(`SELECT data FROM agents`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var agents []AgentRecord
+	for rows.Next() {
+		var agent AgentRecord
+		if err := scanJSON(rows, &agent); err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+	sortAgents(agents)
+	return agents, rows.Err()
+}
+
+func (s *sqliteStore) putTask(task TaskRecord) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO tasks (id, agent_id, created_at, data) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`,
+		task.TaskID, task.AgentID, task.CreatedAt, string(data))
+	return err
+}
+
+func (s *sqliteStore) task(id string) (TaskRecord, bool, error) {
+	var task TaskRecord
+	ok, err := s.get(`SELECT data FROM tasks WHERE id = ?`, id, &task)
+	return task, ok, err
+}
+
+func (s *sqliteStore) tasks(agentID string) ([]TaskRecord, error) {
+	rows, err := s.db.Query(`SELECT data FROM tasks WHERE ? = '' OR agent_id = ? ORDER BY created_at, id`, agentID, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tasks []TaskRecord
+	for rows.Next() {
+		var task TaskRecord
+		if err := scanJSON(rows, &task); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (s *sqliteStore) putGroup(group GroupRecord) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO task_groups (id, created_at, data) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`,
+		group.GroupID, group.CreatedAt, string(data))
+	return err
+}
+
+func (s *sqliteStore) group(id string) (GroupRecord, bool, error) {
+	var group GroupRecord
+	ok, err := s.get(`SELECT data FROM task_groups WHERE id = ?`, id, &group)
+	return group, ok, err
+}
+
+func (s *sqliteStore) groups() ([]GroupRecord, error) {
+	rows, err := s.db.Query(`SELECT data FROM task_groups ORDER BY created_at DESC, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []GroupRecord
+	for rows.Next() {
+		var group GroupRecord
+		if err := scanJSON(rows, &group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+func (s *sqliteStore) close() error { return s.db.Close() }
+
+func (s *sqliteStore) get(query, id string, into interface{}) (bool, error) {
+	err := scanJSON(s.db.QueryRow(query, id), into)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func scanJSON(row interface{ Scan(...interface{}) error }, into interface{}) error {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), into)
+}
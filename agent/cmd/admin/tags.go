@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tagSelector picks agents by tag: every key=value pair must match, and a
+// bare key only has to be present. "room=lab-b,role" is every lab-b agent
+// that has a role.
+type tagSelector map[string]*string
+
+func parseTagSelector(s string) (tagSelector, error) {
+	selector := tagSelector{}
+	for _, term := range strings.Split(s, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(term, "=")
+		if key = strings.TrimSpace(key); key == "" {
+			return nil, fmt.Errorf("tag selector %q has no key", term)
+		}
+		selector[key] = nil
+		if hasValue {
+			value = strings.TrimSpace(value)
+			selector[key] = &value
+		}
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("empty tag selector")
+	}
+	return selector, nil
+}
+
+func (sel tagSelector) matches(tags map[string]string) bool {
+	for key, want := range sel {
+		have, ok := tags[key]
+		if !ok || (want != nil && have != *want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel tagSelector) String() string {
+	terms := make([]string, 0, len(sel))
+	for key, value := range sel {
+		if value == nil {
+			terms = append(terms, key)
+		} else {
+			terms = append(terms, key+"="+*value)
+		}
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
+
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
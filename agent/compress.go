@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	encodingGzip = "gzip"
+	// compressThreshold is the payload size below which gzip is not worth
+	// the base64 overhead.
+	compressThreshold = 4 * 1024
+	// maxDecodedPayload bounds inflated incoming payloads.
+	maxDecodedPayload = 16 * 1024 * 1024
+)
+
+var supportedEncodings = []string{encodingGzip}
+
+// encodePayload gzips and base64-encodes a marshalled payload when the admin
+// accepted gzip for this session and it actually saves space.
+func (c *AgentClient) encodePayload(raw []byte) (interface{}, string) {
+	if c.payloadEncoding() != encodingGzip || len(raw) < compressThreshold {
+		return json.RawMessage(raw), ""
+	}
+	packed, err := gzipBase64(raw)
+	if err != nil || len(packed) >= len(raw) {
+		return json.RawMessage(raw), ""
+	}
+	return packed, encodingGzip
+}
+
+func gzipBase64(raw []byte) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodePayload reverses encodePayload for incoming messages.
+func decodePayload(encoding string, payload json.RawMessage) (json.RawMessage, error) {
+	switch encoding {
+	case "":
+		return payload, nil
+	case encodingGzip:
+		var packed string
+		if err := json.Unmarshal(payload, &packed); err != nil {
+			return nil, err
+		}
+		compressed, err := base64.StdEncoding.DecodeString(packed)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := io.ReadAll(io.LimitReader(zr, maxDecodedPayload+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > maxDecodedPayload {
+			return nil, errors.New("decoded payload too large")
+		}
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("unsupported payload encoding %q", encoding)
+	}
+}
+
+func negotiateEncoding(offered string) string {
+	for _, encoding := range supportedEncodings {
+		if offered == encoding {
+			return encoding
+		}
+	}
+	return ""
+}
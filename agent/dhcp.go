@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	dhcpOptSubnetMask   = 1
+	dhcpOptRouter       = 3
+	dhcpOptDNS          = 6
+	dhcpOptDomainName   = 15
+	dhcpOptLeaseTime    = 51
+	dhcpOptMessageType  = 53
+	dhcpOptServerID     = 54
+	dhcpOptParamRequest = 55
+	dhcpOptEnd          = 255
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+)
+
+var dhcpMagicCookie = []byte{0x63, 0x82, 0x53, 0x63}
+
+type dhcpOfferInfo struct {
+	ServerID   string   `json:"server_id"`
+	Source     string   `json:"source"`
+	OfferedIP  string   `json:"offered_ip"`
+	SubnetMask string   `json:"subnet_mask,omitempty"`
+	SubnetCIDR string   `json:"subnet_cidr,omitempty"`
+	Gateways   []string `json:"gateways,omitempty"`
+	DNSServers []string `json:"dns_servers,omitempty"`
+	Domain     string   `json:"domain,omitempty"`
+	LeaseTimeS uint32   `json:"lease_time_s,omitempty"`
+	RelayIP    string   `json:"relay_ip,omitempty"`
+}
+
+func runDHCPDiscover(params map[string]interface{}) (interface{}, error) {
+	timeout := time.Duration(asInt(params["timeout_ms"], 5000)) * time.Millisecond
+	mac, err := dhcpClientMAC(asString(params["mac"], ""))
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: reuseAddrControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":68")
+	if err != nil {
+		return nil, fmt.Errorf("dhcp client port unavailable (needs admin/root): %w", err)
+	}
+	defer conn.Close()
+
+	xid := make([]byte, 4)
+	_, _ = rand.Read(xid)
+	packet := buildDHCPDiscover(xid, mac)
+	if _, err := conn.WriteTo(packet, &net.UDPAddr{IP: net.IPv4bcast, Port: 67}); err != nil {
+		return nil, fmt.Errorf("dhcp discover send failed: %w", err)
+	}
+
+	offers := make([]dhcpOfferInfo, 0)
+	seen := make(map[string]struct{})
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		offer, ok := parseDHCPOffer(buf[:n], xid)
+		if !ok {
+			continue
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			offer.Source = udpAddr.IP.String()
+		}
+		key := offer.ServerID + "|" + offer.OfferedIP
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		offers = append(offers, offer)
+	}
+
+	return map[string]interface{}{
+		"mac":         mac.String(),
+		"offers":      offers,
+		"servers":     len(offers),
+		"duplicate":   len(offers) > 1,
+		"listened_ms": timeout.Milliseconds(),
+	}, nil
+}
+
+func dhcpClientMAC(override string) (net.HardwareAddr, error) {
+	if override != "" {
+		mac, err := net.ParseMAC(normalizeMAC(override))
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid mac %q", override)
+		}
+		return mac, nil
+	}
+	if primary := primaryStableMAC(); primary != "" {
+		if mac, err := net.ParseMAC(primary); err == nil && len(mac) == 6 {
+			return mac, nil
+		}
+	}
+	mac := make(net.HardwareAddr, 6)
+	_, _ = rand.Read(mac)
+	mac[0] = (mac[0] | 0x02) & 0xFE
+	return mac, nil
+}
+
+func buildDHCPDiscover(xid []byte, mac net.HardwareAddr) []byte {
+	packet := make([]byte, 240)
+	packet[0] = 1
+	packet[1] = 1
+	packet[2] = 6
+	copy(packet[4:8], xid)
+	binary.BigEndian.PutUint16(packet[10:12], 0x8000)
+	copy(packet[28:34], mac)
+	copy(packet[236:240], dhcpMagicCookie)
+	packet = append(packet,
+		dhcpOptMessageType, 1, dhcpDiscover,
+		dhcpOptParamRequest, 5, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS, dhcpOptDomainName, dhcpOptLeaseTime,
+		dhcpOptEnd,
+	)
+	return packet
+}
+
+func parseDHCPOffer(packet []byte, xid []byte) (dhcpOfferInfo, bool) {
+	var offer dhcpOfferInfo
+	if len(packet) < 240 || packet[0] != 2 || string(packet[4:8]) != string(xid) {
+		return offer, false
+	}
+	if string(packet[236:240]) != string(dhcpMagicCookie) {
+		return offer, false
+	}
+	offer.OfferedIP = net.IP(packet[16:20]).String()
+	if relay := net.IP(packet[24:28]); !relay.IsUnspecified() {
+		offer.RelayIP = relay.String()
+	}
+
+	messageType := byte(0)
+	for i := 240; i < len(packet); {
+		code := packet[i]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == 0 {
+			i++
+			continue
+		}
+		if i+1 >= len(packet) {
+			break
+		}
+		size := int(packet[i+1])
+		if i+2+size > len(packet) {
+			break
+		}
+		value := packet[i+2 : i+2+size]
+		switch code {
+		case dhcpOptMessageType:
+			if size == 1 {
+				messageType = value[0]
+			}
+		case dhcpOptServerID:
+			if size == 4 {
+				offer.ServerID = net.IP(value).String()
+			}
+		case dhcpOptSubnetMask:
+			if size == 4 {
+				offer.SubnetMask = net.IP(value).String()
+			}
+		case dhcpOptRouter:
+			offer.Gateways = ipv4List(value)
+		case dhcpOptDNS:
+			offer.DNSServers = ipv4List(value)
+		case dhcpOptDomainName:
+			offer.Domain = sanitizeBanner(string(value))
+		case dhcpOptLeaseTime:
+			if size == 4 {
+				offer.LeaseTimeS = binary.BigEndian.Uint32(value)
+			}
+		}
+		i += 2 + size
+	}
+	if messageType != dhcpOffer {
+		return offer, false
+	}
+	if offer.SubnetMask != "" {
+		mask := net.IPMask(net.ParseIP(offer.SubnetMask).To4())
+		ip := net.ParseIP(offer.OfferedIP).To4()
+		offer.SubnetCIDR = (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+	}
+	return offer, true
+}
+
+func ipv4List(value []byte) []string {
+	ips := make([]string, 0, len(value)/4)
+	for i := 0; i+4 <= len(value); i += 4 {
+		ips = append(ips, net.IP(value[i:i+4]).String())
+	}
+	return ips
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+// diffableKinds are the scans a diff param can compare with their last run.
+var diffableKinds = map[string]bool{
+	"ping":           true,
+	"port_scan":      true,
+	"host_discovery": true,
+	"rdns_sweep":     true,
+	"smb_enum":       true,
+}
+
+// scanKeyParams are the params that define a scan's target set; two runs
+// are compared only when they agree on all of them.
+var scanKeyParams = []string{"target", "targets", "cidr", "ports", "preset"}
+
+// scanDiff is what changed since the last completed run of the same scan.
+// OpenedPorts and ClosedPorts are keyed by host and only set for port_scan.
+type scanDiff struct {
+	PreviousTaskID string           `json:"previous_task_id,omitempty"`
+	PreviousTS     int64            `json:"previous_ts,omitempty"`
+	First          bool             `json:"first,omitempty"`
+	AddedHosts     []string         `json:"added_hosts"`
+	RemovedHosts   []string         `json:"removed_hosts"`
+	OpenedPorts    map[string][]int `json:"opened_ports,omitempty"`
+	ClosedPorts    map[string][]int `json:"closed_ports,omitempty"`
+}
+
+// scanKey identifies the target set of a diffable scan, or is empty for
+// other kinds.
+func scanKey(kind string, params map[string]interface{}) string {
+	if !diffableKinds[kind] {
+		return ""
+	}
+	scope := map[string]interface{}{"kind": kind}
+	for _, key := range scanKeyParams {
+		if value, ok := params[key]; ok {
+			scope[key] = value
+		}
+	}
+	return paramsDigest(scope)
+}
+
+// addScanDiff adds a diff to result when the task asked for one, comparing
+// it with the newest completed run in history that has the same scan key.
+func addScanDiff(history historyStore, task TaskPayload, result interface{}) {
+	if want, _ := task.Params["diff"].(bool); !want || !diffableKinds[task.Kind] {
+		return
+	}
+	fields, ok := result.(map[string]interface{})
+	if !ok {
+		return
+	}
+	diff, err := diffWithPrevious(history, task, result)
+	if err != nil {
+		fields["diff_error"] = err.Error()
+		return
+	}
+	fields["diff"] = diff
+}
+
+func diffWithPrevious(history historyStore, task TaskPayload, result interface{}) (*scanDiff, error) {
+	if history == nil {
+		return nil, errors.New("history is not enabled; start the agent with -history-db")
+	}
+	rows, err := history.query("tasks", 0, time.Now().UnixMilli()+1, task.Kind, historyMaxLimit)
+	if err != nil {
+		return nil, err
+	}
+	current := scanHosts(task.Kind, task.Params, result)
+	key := scanKey(task.Kind, task.Params)
+	for i := len(rows) - 1; i >= 0; i-- {
+		var row historyTask
+		if json.Unmarshal(rows[i], &row) != nil || row.ScanKey != key || row.Status != taskStatusCompleted || row.Result == nil {
+			continue
+		}
+		diff := compareScans(scanHosts(task.Kind, task.Params, row.Result), current, task.Kind == "port_scan")
+		diff.PreviousTaskID, diff.PreviousTS = row.TaskID, row.TS
+		return diff, nil
+	}
+	diff := compareScans(nil, current, task.Kind == "port_scan")
+	diff.First = true
+	return diff, nil
+}
+
+// scanHosts reads the hosts a scan found from its result, which may be the
+// task's own value or JSON from history, with the open ports of each for
+// port_scan. A port_scan host counts once it has an open port; a ping host
+// once it answers.
+func scanHosts(kind string, params map[string]interface{}, result interface{}) map[string][]int {
+	raw, ok := result.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(result); err != nil {
+			return nil
+		}
+	}
+	var fields struct {
+		Target    string          `json:"target"`
+		OK        bool            `json:"ok"`
+		OpenPorts []int           `json:"open_ports"`
+		Results   []targetResult  `json:"results"`
+		Hosts     json.RawMessage `json:"hosts"`
+	}
+	if json.Unmarshal(raw, &fields) != nil {
+		return nil
+	}
+
+	hosts := make(map[string][]int)
+	if fields.Results != nil {
+		for _, sub := range fields.Results {
+			if !sub.OK {
+				continue
+			}
+			for host, ports := range scanHosts(kind, map[string]interface{}{"target": sub.Target}, sub.Result) {
+				hosts[host] = ports
+			}
+		}
+		return hosts
+	}
+	target := fields.Target
+	if target == "" {
+		target = asString(params["target"], "")
+	}
+	switch kind {
+	case "port_scan":
+		if len(fields.OpenPorts) > 0 {
+			hosts[target] = fields.OpenPorts
+		}
+	case "ping":
+		if fields.OK {
+			hosts[target] = nil
+		}
+	case "rdns_sweep":
+		var names map[string]string
+		_ = json.Unmarshal(fields.Hosts, &names)
+		for ip := range names {
+			hosts[ip] = nil
+		}
+	default:
+		var list []struct {
+			IP string `json:"ip"`
+		}
+		_ = json.Unmarshal(fields.Hosts, &list)
+		for _, host := range list {
+			hosts[host.IP] = nil
+		}
+	}
+	return hosts
+}
+
+func compareScans(previous, current map[string][]int, withPorts bool) *scanDiff {
+	diff := &scanDiff{AddedHosts: []string{}, RemovedHosts: []string{}}
+	if withPorts {
+		diff.OpenedPorts = make(map[string][]int)
+		diff.ClosedPorts = make(map[string][]int)
+	}
+	for host, ports := range current {
+		if _, ok := previous[host]; !ok {
+			diff.AddedHosts = append(diff.AddedHosts, host)
+		}
+		if opened := missingPorts(ports, previous[host]); withPorts && len(opened) > 0 {
+			diff.OpenedPorts[host] = opened
+		}
+	}
+	for host, ports := range previous {
+		if _, ok := current[host]; !ok {
+			diff.RemovedHosts = append(diff.RemovedHosts, host)
+		}
+		if closed := missingPorts(ports, current[host]); withPorts && len(closed) > 0 {
+			diff.ClosedPorts[host] = closed
+		}
+	}
+	sort.Slice(diff.AddedHosts, func(i, j int) bool { return ipLess(diff.AddedHosts[i], diff.AddedHosts[j]) })
+	sort.Slice(diff.RemovedHosts, func(i, j int) bool { return ipLess(diff.RemovedHosts[i], diff.RemovedHosts[j]) })
+	return diff
+}
+
+// missingPorts returns the ports in ports that are not in other, sorted.
+func missingPorts(ports, other []int) []int {
+	var missing []int
+	for _, port := range ports {
+		if !slices.Contains(other, port) {
+			missing = append(missing, port)
+		}
+	}
+	slices.Sort(missing)
+	return missing
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// memHistory is an in-memory historyStore for tasks.
+type memHistory struct {
+	rows []json.RawMessage
+}
+
+func (h *memHistory) record(table string, ts int64, row interface{}) error {
+	data, err := json.Marshal(row)
+	h.rows = append(h.rows, data)
+	return err
+}
+
+func (h *memHistory) query(table string, since, until int64, kind string, limit int) ([]json.RawMessage, error) {
+	var out []json.RawMessage
+	for _, raw := range h.rows {
+		var row historyTask
+		if json.Unmarshal(raw, &row) == nil && row.Kind == kind {
+			out = append(out, raw)
+		}
+	}
+	return out, nil
+}
+
+func (h *memHistory) prune(int64, int) error { return nil }
+func (h *memHistory) close() error           { return nil }
+
+func TestScanKey(t *testing.T) {
+	params := map[string]interface{}{"target": "10.0.0.0/24", "ports": "22,80", "diff": true, "concurrency": 8.0}
+	same := map[string]interface{}{"target": "10.0.0.0/24", "ports": "22,80"}
+	if scanKey("port_scan", params) != scanKey("port_scan", same) {
+		t.Error("scan key depends on params outside the target set")
+	}
+	for _, other := range []map[string]interface{}{
+		{"target": "10.0.1.0/24", "ports": "22,80"},
+		{"target": "10.0.0.0/24", "ports": "22"},
+	} {
+		if scanKey("port_scan", other) == scanKey("port_scan", params) {
+			t.Errorf("scan key of %v matches %v", other, params)
+		}
+	}
+	if scanKey("ping", same) == scanKey("port_scan", same) {
+		t.Error("scan key ignores the kind")
+	}
+	if scanKey("wol", same) != "" {
+		t.Error("wol has a scan key")
+	}
+}
+
+func TestPortScanDiff(t *testing.T) {
+	params := map[string]interface{}{"target": "10.0.0.0/29", "ports": "22,80,443", "diff": true}
+	history := &memHistory{}
+	previous := map[string]interface{}{"results": []targetResult{
+		{Target: "10.0.0.1", OK: true, Result: map[string]interface{}{"open_ports": []int{22, 80}}},
+		{Target: "10.0.0.2", OK: true, Result: map[string]interface{}{"open_ports": []int{443}}},
+		{Target: "10.0.0.3", OK: true, Result: map[string]interface{}{"open_ports": []int{}}},
+	}}
+	raw, _ := json.Marshal(previous)
+	history.record("tasks", 1, historyTask{TS: 1, TaskID: "t1", Kind: "port_scan", Status: taskStatusCompleted, ScanKey: scanKey("port_scan", params), Result: raw})
+	history.record("tasks", 2, historyTask{TS: 2, TaskID: "t2", Kind: "port_scan", Status: taskStatusFailed, ScanKey: scanKey("port_scan", params)})
+	history.record("tasks", 3, historyTask{TS: 3, TaskID: "t3", Kind: "port_scan", Status: taskStatusCompleted, ScanKey: "other", Result: json.RawMessage(`{"open_ports":[1]}`)})
+
+	result := map[string]interface{}{"results": []targetResult{
+		{Target: "10.0.0.1", OK: true, Result: map[string]interface{}{"open_ports": []int{22, 443}}},
+		{Target: "10.0.0.2", OK: true, Result: map[string]interface{}{"open_ports": []int{}}},
+		{Target: "10.0.0.3", OK: true, Result: map[string]interface{}{"open_ports": []int{80}}},
+	}}
+	addScanDiff(history, TaskPayload{TaskID: "t4", Kind: "port_scan", Params: params}, result)
+	diff, ok := result["diff"].(*scanDiff)
+	if !ok {
+		t.Fatalf("result = %v, want a diff", result)
+	}
+	want := &scanDiff{
+		PreviousTaskID: "t1",
+		PreviousTS:     1,
+		AddedHosts:     []string{"10.0.0.3"},
+		RemovedHosts:   []string{"10.0.0.2"},
+		OpenedPorts:    map[string][]int{"10.0.0.1": {443}, "10.0.0.3": {80}},
+		ClosedPorts:    map[string][]int{"10.0.0.1": {80}, "10.0.0.2": {443}},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("diff = %+v, want %+v", diff, want)
+	}
+}
+
+func TestHostDiscoveryDiffFirstRun(t *testing.T) {
+	params := map[string]interface{}{"cidr": "10.0.0.0/24", "diff": true}
+	result := map[string]interface{}{"hosts": []discoveredHost{{IP: "10.0.0.9"}, {IP: "10.0.0.1"}}}
+	addScanDiff(&memHistory{}, TaskPayload{Kind: "host_discovery", Params: params}, result)
+	diff := result["diff"].(*scanDiff)
+	if !diff.First || !reflect.DeepEqual(diff.AddedHosts, []string{"10.0.0.1", "10.0.0.9"}) || diff.OpenedPorts != nil {
+		t.Fatalf("diff = %+v, want both hosts added on the first run", diff)
+	}
+}
+
+func TestScanDiffWithoutHistory(t *testing.T) {
+	result := map[string]interface{}{"ok": true}
+	addScanDiff(nil, TaskPayload{Kind: "ping", Params: map[string]interface{}{"diff": true}}, result)
+	if _, ok := result["diff_error"]; !ok {
+		t.Fatalf("result = %v, want diff_error", result)
+	}
+	result = map[string]interface{}{"ok": true}
+	addScanDiff(nil, TaskPayload{Kind: "ping", Params: map[string]interface{}{}}, result)
+	if len(result) != 1 {
+		t.Fatalf("result = %v, want no diff without the diff param", result)
+	}
+}
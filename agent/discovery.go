@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+var discoveryDefaultPorts = []int{22, 80, 135, 443, 445, 3389}
+
+type discoveredHost struct {
+	IP        string `json:"ip"`
+	Method    string `json:"method"`
+	Port      int    `json:"port,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+func runHostDiscovery(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	cidr := asString(params["cidr"], "")
+	if cidr == "" {
+		return nil, errors.New("host_discovery requires cidr")
+	}
+	ips, err := expandCIDR(cidr, maxSweepAddresses)
+	if err != nil {
+		return nil, err
+	}
+	ips, shard, err := shardTargets(env, params, ips)
+	if err != nil {
+		return nil, err
+	}
+	ips, excluded := env.Exclude.filterHosts(ips)
+	ports, err := parsePorts(params["ports"], discoveryDefaultPorts)
+	if err != nil {
+		return nil, err
+	}
+	ports, _ = env.Exclude.filterPorts(ports)
+	timeout := time.Duration(asInt(params["timeout_ms"], 800)) * time.Millisecond
+	concurrency := taskConcurrency(params, 64)
+
+	_, icmpErr := netprobe.Echo("127.0.0.1", 200*time.Millisecond)
+	useICMP := !errors.Is(icmpErr, netprobe.ErrICMPUnavailable)
+
+	env.Progress.setTotal(len(ips))
+	live := make([]discoveredHost, 0)
+	var liveMu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				host, ok := probeHost(ip, ports, timeout, useICMP)
+				env.Progress.step(ip)
+				if ok {
+					liveMu.Lock()
+					live = append(live, host)
+					liveMu.Unlock()
+				}
+			}
+		}()
+	}
+	scanned := 0
+	for _, ip := range ips {
+		if env.cancelled() {
+			break
+		}
+		jobs <- ip
+		scanned++
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(live, func(i, j int) bool {
+		return ipLess(live[i].IP, live[j].IP)
+	})
+	result := map[string]interface{}{
+		"cidr":    cidr,
+		"hosts":   live,
+		"live":    len(live),
+		"scanned": scanned,
+		"icmp":    useICMP,
+	}
+	if shard != nil {
+		result["shard"] = shard
+	}
+	if excluded > 0 {
+		result["excluded"] = excluded
+	}
+	return result, nil
+}
+
+func probeHost(ip string, ports []int, timeout time.Duration, useICMP bool) (discoveredHost, bool) {
+	if useICMP {
+		if rtt, err := netprobe.Echo(ip, timeout); err == nil {
+			return discoveredHost{IP: ip, Method: "icmp", LatencyMS: rtt.Milliseconds()}, true
+		}
+	}
+
+	type hit struct {
+		port    int
+		latency time.Duration
+	}
+	found := make(chan hit, len(ports))
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+			if err != nil {
+				if netprobe.IsConnectionRefused(err) {
+					found <- hit{port: port, latency: time.Since(start)}
+				}
+				return
+			}
+			_ = conn.Close()
+			found <- hit{port: port, latency: time.Since(start)}
+		}(port)
+	}
+	wg.Wait()
+	close(found)
+
+	best, ok := <-found
+	if !ok {
+		return discoveredHost{}, false
+	}
+	for h := range found {
+		if h.latency < best.latency {
+			best = h
+		}
+	}
+	return discoveredHost{IP: ip, Method: "tcp", Port: best.port, LatencyMS: best.latency.Milliseconds()}, true
+}
+
+func ipLess(a, b string) bool {
+	ipA, errA := netip.ParseAddr(a)
+	ipB, errB := netip.ParseAddr(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ipA.Less(ipB)
+}
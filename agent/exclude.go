@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// -scan-exclude and -scan-exclude-ports name hosts and ports no task may
+// probe; a task's exclude_targets and exclude_ports add to them.
+var (
+	localScanExclude      string
+	localScanExcludePorts string
+)
+
+// scanExclusions are the hosts and ports a task must leave alone. A nil
+// *scanExclusions excludes nothing.
+type scanExclusions struct {
+	prefixes []netip.Prefix
+	names    map[string]bool
+	ports    map[int]bool
+}
+
+// loadExclusions merges the agent's -scan-exclude lists with the task's
+// exclude_targets and exclude_ports. Excluded hostnames are resolved too,
+// so their addresses are skipped inside a swept range.
+func loadExclusions(ctx context.Context, params map[string]interface{}) (*scanExclusions, error) {
+	hosts := strings.Split(localScanExclude, ",")
+	switch value := params["exclude_targets"].(type) {
+	case string:
+		hosts = append(hosts, strings.Split(value, ",")...)
+	case []interface{}:
+		hosts = append(hosts, asStringSlice(value, nil)...)
+	case nil:
+	default:
+		return nil, fmt.Errorf("exclude_targets must be a list or a comma-separated string, not %T", value)
+	}
+
+	exclude := &scanExclusions{names: make(map[string]bool), ports: make(map[int]bool)}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if prefixes, err := parsePrefixes([]string{unbracket(host)}); err == nil {
+			exclude.prefixes = append(exclude.prefixes, prefixes...)
+			continue
+		}
+		if strings.Contains(host, "/") {
+			return nil, fmt.Errorf("invalid excluded range %q", host)
+		}
+		name := hostName(host)
+		exclude.names[name] = true
+		if addrs, err := lookupHost(ctx, name); err == nil {
+			for _, addr := range addrs {
+				exclude.prefixes = append(exclude.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+
+	for _, spec := range []interface{}{localScanExcludePorts, params["exclude_ports"]} {
+		ports, err := parsePorts(spec, nil)
+		if err != nil {
+			return nil, fmt.Errorf("excluded ports: %w", err)
+		}
+		for _, port := range ports {
+			exclude.ports[port] = true
+		}
+	}
+	if len(exclude.prefixes) == 0 && len(exclude.names) == 0 && len(exclude.ports) == 0 {
+		return nil, nil
+	}
+	return exclude, nil
+}
+
+func hostName(host string) string {
+	return strings.TrimSuffix(strings.ToLower(unbracket(strings.TrimSpace(host))), ".")
+}
+
+// excludesHost reports whether host, a hostname or address with or without
+// a port, is excluded. A hostname counts by name and, when resolve is set,
+// by the addresses it resolves to.
+func (e *scanExclusions) excludesHost(ctx context.Context, host string, resolve bool) bool {
+	if e == nil {
+		return false
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = hostName(host)
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		if e.names[host] {
+			return true
+		}
+		if !resolve || len(e.prefixes) == 0 {
+			return false
+		}
+		addrs, err := lookupHost(ctx, host)
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			if e.excludesAddr(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return e.excludesAddr(addr.Unmap())
+}
+
+func (e *scanExclusions) excludesAddr(addr netip.Addr) bool {
+	for _, prefix := range e.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *scanExclusions) excludesPort(port int) bool {
+	return e != nil && e.ports[port]
+}
+
+// checkTargets fails with a policyError when the task names an excluded
+// host directly: in any of targetParams, as the host of any of urlParams,
+// or through the defaults kind falls back to. Ranges are left to
+// filterHosts.
+func (e *scanExclusions) checkTargets(ctx context.Context, kind string, params map[string]interface{}) error {
+	if e == nil {
+		return nil
+	}
+	effective := withTargetDefaults(kind, params)
+	listed := func(key string) []string {
+		values := asStringSlice(effective[key], nil)
+		if value := asString(effective[key], ""); value != "" {
+			values = append(values, strings.Split(value, ",")...)
+		}
+		return values
+	}
+	excluded := func(host string) error {
+		if e.excludesHost(ctx, host, true) {
+			return &policyError{Code: policyErrorTargetExcluded, Reason: fmt.Sprintf("target %s is excluded from scans", host)}
+		}
+		return nil
+	}
+	for _, key := range targetParams {
+		for _, host := range listed(key) {
+			host = strings.TrimSpace(host)
+			if _, err := netip.ParsePrefix(host); err == nil || host == "" {
+				continue
+			}
+			if parsed, err := url.Parse(host); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+				host = parsed.Hostname()
+			}
+			if err := excluded(host); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range urlParams {
+		for _, raw := range asStringSlice(effective[key], []string{asString(effective[key], "")}) {
+			parsed, err := url.Parse(strings.TrimSpace(raw))
+			if err != nil || parsed.Hostname() == "" {
+				continue
+			}
+			if err := excluded(parsed.Hostname()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterHosts drops excluded hosts from a sweep and returns how many it
+// dropped.
+func (e *scanExclusions) filterHosts(hosts []string) ([]string, int) {
+	if e == nil {
+		return hosts, 0
+	}
+	kept := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !e.excludesHost(context.Background(), host, false) {
+			kept = append(kept, host)
+		}
+	}
+	return kept, len(hosts) - len(kept)
+}
+
+// filterPorts drops excluded ports and returns how many it dropped.
+func (e *scanExclusions) filterPorts(ports []int) ([]int, int) {
+	if e == nil || len(e.ports) == 0 {
+		return ports, 0
+	}
+	kept := make([]int, 0, len(ports))
+	for _, port := range ports {
+		if !e.ports[port] {
+			kept = append(kept, port)
+		}
+	}
+	return kept, len(ports) - len(kept)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestLoadExclusions(t *testing.T) {
+	localScanExclude, localScanExcludePorts = "10.0.0.5, 10.0.9.0/24", "502"
+	defer func() { localScanExclude, localScanExcludePorts = "", "" }()
+
+	exclude, err := loadExclusions(context.Background(), map[string]interface{}{
+		"exclude_targets": []interface{}{"10.0.1.7", "PLC.lab."},
+		"exclude_ports":   "20000-20002",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, excluded := exclude.filterHosts([]string{"10.0.0.4", "10.0.0.5", "10.0.9.200", "10.0.1.7", "plc.lab", "nas.lab"})
+	if excluded != 4 || !slices.Equal(hosts, []string{"10.0.0.4", "nas.lab"}) {
+		t.Fatalf("filterHosts() = %v, %d", hosts, excluded)
+	}
+	ports, excluded := exclude.filterPorts([]int{22, 502, 20001, 20003})
+	if excluded != 2 || !slices.Equal(ports, []int{22, 20003}) {
+		t.Fatalf("filterPorts() = %v, %d", ports, excluded)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"exclude_targets": "10.0.0.0/33"},
+		{"exclude_targets": 5.0},
+		{"exclude_ports": "0"},
+	} {
+		if _, err := loadExclusions(context.Background(), bad); err == nil {
+			t.Errorf("loadExclusions(%v) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestLoadExclusionsEmpty(t *testing.T) {
+	exclude, err := loadExclusions(context.Background(), map[string]interface{}{"exclude_targets": ""})
+	if err != nil || exclude != nil {
+		t.Fatalf("loadExclusions() = %v, %v, want nil", exclude, err)
+	}
+	if hosts, excluded := exclude.filterHosts([]string{"10.0.0.1"}); excluded != 0 || len(hosts) != 1 {
+		t.Fatal("a nil exclusion list dropped a host")
+	}
+}
+
+func TestExcludedTargetRefused(t *testing.T) {
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	tests := []struct {
+		kind   string
+		params map[string]interface{}
+	}{
+		{"ping", map[string]interface{}{"target": "10.0.0.5"}},
+		{"port_scan", map[string]interface{}{"target": "[::1]", "exclude_targets": "::1"}},
+		{"banner_grab", map[string]interface{}{"targets": []interface{}{"10.0.0.1:22", "10.0.0.5:22"}}},
+		{"http_check", map[string]interface{}{"url": "http://10.0.0.5:8080/status"}},
+		{"ntp_check", map[string]interface{}{"servers": []interface{}{"10.0.0.1", "10.0.0.5:123"}}},
+		{"public_ip", map[string]interface{}{"method": "stun", "stun_servers": []interface{}{"10.0.0.5:3478"}}},
+		{"speed_test", map[string]interface{}{"download_url": "https://[::1]/blob", "upload_url": "https://10.0.0.1/up", "exclude_targets": "::1"}},
+		{"wol", map[string]interface{}{"mac": "02:00:00:00:00:01", "broadcast": "10.0.0.5"}},
+	}
+	for _, tt := range tests {
+		params := map[string]interface{}{"exclude_targets": "10.0.0.5"}
+		for key, value := range tt.params {
+			params[key] = value
+		}
+		_, err := runTask(true, env, tt.kind, params)
+		var policyErr *policyError
+		if !errors.As(err, &policyErr) || policyErr.Code != policyErrorTargetExcluded {
+			t.Errorf("%s %v = %v, want %s", tt.kind, tt.params, err, policyErrorTargetExcluded)
+		}
+	}
+}
+
+func TestExclusionsInSweep(t *testing.T) {
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	out, err := runTask(true, env, "port_scan", map[string]interface{}{
+		"target":          "10.0.0.0/29",
+		"ports":           "22,443,502",
+		"exclude_targets": "10.0.0.2, 10.0.0.4/31",
+		"exclude_ports":   []interface{}{502.0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(map[string]interface{})
+	results := result["results"].([]targetResult)
+	if result["excluded"] != 3 || result["count"] != 3 {
+		t.Fatalf("result = %v, want 3 hosts scanned and 3 excluded", result)
+	}
+	for i, want := range []string{"10.0.0.1", "10.0.0.3", "10.0.0.6"} {
+		if results[i].Target != want {
+			t.Fatalf("results[%d] = %s, want %s", i, results[i].Target, want)
+		}
+		scan := results[i].Result.(map[string]interface{})
+		if scan["scanned"] != 2 || scan["excluded_ports"] != 1 {
+			t.Errorf("%s scan = %v, want port 502 excluded", want, scan)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+// fakeSeed seeds every fake agent's simulation; 0 picks one at startup.
+var fakeSeed int64
+
+// fakeSim is a fake agent's simulated network and host. It stands in for
+// the real prober, so probe rounds feed the monitor, latency events, and
+// heartbeats like real ones would, and it supplies the machine metrics
+// real agents read from the OS.
+//
+// Each stream has its own generator seeded from the agent's seed, so the
+// sequence of probe rounds, heartbeats, and pings is the same on every run
+// with the same seed, however the goroutines interleave.
+type fakeSim struct {
+	mu        sync.Mutex
+	probeRNG  *rand.Rand
+	hostRNG   *rand.Rand
+	taskRNG   *rand.Rand
+	resolvers []string
+	started   time.Time
+
+	// network
+	baseLatency float64
+	latency     float64
+	outage      int
+	dnsOutage   int
+
+	// host
+	beats    int
+	cpuBase  float64
+	cpuPhase float64
+	memTotal int64
+	memUsed  float64
+	diskFree float64
+
+	// identity reported by the inventory task
+	hostname string
+	osName   string
+	arch     string
+	macs     []string
+}
+
+func newFakeSim(seed int64, resolvers []string) *fakeSim {
+	s := &fakeSim{
+		probeRNG:  rand.New(rand.NewSource(seed)),
+		hostRNG:   rand.New(rand.NewSource(seed ^ 0x5eed0001)),
+		taskRNG:   rand.New(rand.NewSource(seed ^ 0x5eed0002)),
+		resolvers: resolvers,
+		started:   time.Now(),
+	}
+	s.baseLatency = 8 + s.probeRNG.Float64()*30
+	s.latency = s.baseLatency
+	s.cpuBase = 10 + s.hostRNG.Float64()*25
+	s.cpuPhase = s.hostRNG.Float64() * 2 * math.Pi
+	s.memTotal = []int64{4096, 8192, 16384, 32768}[s.hostRNG.Intn(4)]
+	s.memUsed = 30 + s.hostRNG.Float64()*30
+	s.diskFree = 30 + s.hostRNG.Float64()*60
+	return s
+}
+
+// Probe is one simulated round: latency drifts around a slowly moving
+// baseline with occasional spikes, and about one round in 150 starts an
+// internet outage of 2-10 rounds (DNS fails with it; the gateway stays
+// up). Rarer DNS-only outages happen too.
+func (s *fakeSim) Probe(context.Context) netprobe.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rng := s.probeRNG
+	s.baseLatency = clampFloat(s.baseLatency+rng.NormFloat64()*0.8, 4, 150)
+	s.latency = clampFloat(s.latency+(s.baseLatency-s.latency)*0.3+rng.NormFloat64()*2, 1, 400)
+	if rng.Float64() < 0.02 {
+		s.latency += 40 + rng.Float64()*120
+	}
+	if s.outage == 0 && rng.Float64() < 1.0/150 {
+		s.outage = 2 + rng.Intn(9)
+	}
+	if s.dnsOutage == 0 && rng.Float64() < 1.0/400 {
+		s.dnsOutage = 1 + rng.Intn(4)
+	}
+
+	result := netprobe.Result{
+		Internet:       s.outage == 0,
+		DNS:            s.outage == 0 && s.dnsOutage == 0,
+		Gateway:        true,
+		InternetMethod: netprobe.MethodICMP,
+		GatewayMethod:  netprobe.MethodICMP,
+		At:             time.Now(),
+	}
+	if result.Internet {
+		result.Latency = time.Duration(s.latency * float64(time.Millisecond))
+	}
+	portal := false
+	result.CaptivePortal = &portal
+	for _, resolver := range s.resolvers {
+		ok := result.DNS || (resolver == netprobe.ResolverGateway && s.outage > 0)
+		entry := netprobe.ResolverResult{Resolver: resolver, OK: ok}
+		if ok {
+			ms := 2 + rng.Float64()*6
+			if resolver != netprobe.ResolverGateway {
+				ms += s.latency * (0.6 + rng.Float64()*0.6)
+			}
+			entry.Latency = time.Duration(ms * float64(time.Millisecond))
+		}
+		result.Resolvers = append(result.Resolvers, entry)
+	}
+	if s.outage > 0 {
+		s.outage--
+	}
+	if s.dnsOutage > 0 {
+		s.dnsOutage--
+	}
+	return result
+}
+
+// system returns machine metrics under the names systemMetrics uses. CPU
+// follows a slow curve (one cycle per 360 heartbeats, about 45 minutes)
+// with noise and occasional bursts; memory wanders and disk slowly fills.
+func (s *fakeSim) system() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rng := s.hostRNG
+	s.beats++
+	curve := math.Sin(2*math.Pi*float64(s.beats)/360 + s.cpuPhase)
+	cpu := s.cpuBase + 20*curve + rng.NormFloat64()*4
+	if rng.Float64() < 0.03 {
+		cpu += 30 + rng.Float64()*40
+	}
+	cpu = clampFloat(cpu, 0.5, 100)
+	s.memUsed = clampFloat(s.memUsed+rng.NormFloat64()*0.7+(cpu-s.cpuBase)*0.01, 15, 97)
+	s.diskFree = clampFloat(s.diskFree-rng.Float64()*0.01, 2, 100)
+	return map[string]interface{}{
+		"cpu_percent":       roundTo(cpu, 1),
+		"load_1m":           roundTo(cpu/25, 2),
+		"mem_total_mb":      s.memTotal,
+		"mem_used_percent":  roundTo(s.memUsed, 1),
+		"disk_free_percent": roundTo(s.diskFree, 1),
+		"uptime_s":          int64(time.Since(s.started).Seconds()),
+	}
+}
+
+// inventory is a made-up inventory task result matching the agent's
+// registration and heartbeat memory.
+func (s *fakeSim) inventory(params map[string]interface{}) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nics := make([]inventoryNIC, 0, len(s.macs))
+	for i, mac := range s.macs {
+		nics = append(nics, inventoryNIC{Name: fmt.Sprintf("eth%d", i), MAC: mac, Model: "8086:15b8", Driver: "e1000e", MTU: 1500, Up: true})
+	}
+	spinning := false
+	result := map[string]interface{}{
+		"hostname":  s.hostname,
+		"arch":      s.arch,
+		"os":        inventoryOS{Name: s.osName, Version: "fake"},
+		"cpu":       inventoryCPU{Model: "LabScan Virtual CPU @ 2.40GHz", Cores: 4},
+		"memory_mb": s.memTotal,
+		"disks":     []inventoryDisk{{Name: "sda", Model: "LabScan Virtual Disk", SizeBytes: 256 << 30, Rotational: &spinning}},
+		"nics":      nics,
+	}
+	if want, _ := params["packages"].(bool); want {
+		packages := []inventoryPackage{{Name: "labscan-agent", Version: agentVersion}, {Name: "openssl", Version: "3.0.13"}}
+		result["package_source"] = "fake"
+		result["packages"] = packages
+		result["package_count"] = len(packages)
+	}
+	return result
+}
+
+// ping answers a fake ping from the simulated network state: LAN targets
+// answer in a few milliseconds, anything else at the current internet
+// latency, or not at all during an outage.
+func (s *fakeSim) ping(target string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ip := net.ParseIP(target); ip != nil && isPrivateIP(ip) {
+		return map[string]interface{}{"ok": true, "latency_ms": 1 + s.taskRNG.Intn(3)}
+	}
+	if s.outage > 0 {
+		return map[string]interface{}{"ok": false, "latency_ms": nil}
+	}
+	return map[string]interface{}{"ok": true, "latency_ms": int(math.Round(s.latency + s.taskRNG.Float64()*3))}
+}
+
+func clampFloat(value, low, high float64) float64 {
+	return math.Max(low, math.Min(high, value))
+}
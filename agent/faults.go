@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var errFlapped = errors.New("fault injection: connection dropped")
+
+// fakeFaults make a fake agent misbehave so the admin's timeout and
+// offline handling can be exercised. Set in a scenario's faults, for all
+// agents or per agent.
+type fakeFaults struct {
+	// FlapEvery drops the connection, without going_offline, about this
+	// long (±25%) after each registration; FlapDown is how long the agent
+	// then stays away before redialing.
+	FlapEvery time.Duration `yaml:"flap_every"`
+	FlapDown  time.Duration `yaml:"flap_down"`
+	// RegisterDelay holds back register after the websocket is up.
+	RegisterDelay time.Duration `yaml:"register_delay"`
+	// RejectRegister is the share of registrations sent with a wrong
+	// secret, so the admin turns them down.
+	RejectRegister float64 `yaml:"reject_register"`
+	// DropHeartbeats is the share of heartbeats that are never sent.
+	DropHeartbeats float64 `yaml:"drop_heartbeats"`
+	// TaskDelay is added before every task runs.
+	TaskDelay time.Duration `yaml:"task_delay"`
+}
+
+func (f *fakeFaults) validate() error {
+	if f == nil {
+		return nil
+	}
+	for name, value := range map[string]time.Duration{"flap_every": f.FlapEvery, "flap_down": f.FlapDown, "register_delay": f.RegisterDelay, "task_delay": f.TaskDelay} {
+		if value < 0 {
+			return fmt.Errorf("faults.%s must not be negative", name)
+		}
+	}
+	for name, value := range map[string]float64{"reject_register": f.RejectRegister, "drop_heartbeats": f.DropHeartbeats} {
+		if value < 0 || value > 1 {
+			return fmt.Errorf("faults.%s must be between 0 and 1", name)
+		}
+	}
+	if f.FlapEvery > 0 && f.FlapEvery < time.Second {
+		return errors.New("faults.flap_every must be 0 or at least 1s")
+	}
+	return nil
+}
+
+// flap returns a channel that fires when the current session should drop,
+// or nil when the agent does not flap.
+func (f *fakeFaults) flap() <-chan time.Time {
+	if f == nil || f.FlapEvery <= 0 {
+		return nil
+	}
+	spread := int64(f.FlapEvery / 2)
+	return time.After(f.FlapEvery - f.FlapEvery/4 + time.Duration(rand.Int63n(spread+1)))
+}
+
+func (f *fakeFaults) rejectRegister() bool {
+	return f != nil && f.RejectRegister > 0 && rand.Float64() < f.RejectRegister
+}
+
+func (f *fakeFaults) dropHeartbeat() bool {
+	return f != nil && f.DropHeartbeats > 0 && rand.Float64() < f.DropHeartbeats
+}
+
+func (f *fakeFaults) delayRegister(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	return sleepCtx(ctx, f.RegisterDelay)
+}
+
+func (f *fakeFaults) delayTask(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	return sleepCtx(ctx, f.TaskDelay)
+}
+
+func (f *fakeFaults) stayDown(ctx context.Context) {
+	if f != nil {
+		_ = sleepCtx(ctx, f.FlapDown)
+	}
+}
+
+func sleepCtx(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
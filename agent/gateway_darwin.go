@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/route"
+)
+
+// routeTableGateway returns the IPv4 default route's gateway from the
+// kernel routing table.
+func routeTableGateway() string {
+	rib, err := route.FetchRIB(syscall.AF_INET, route.RIBTypeRoute, 0)
+	if err != nil {
+		return ""
+	}
+	messages, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return ""
+	}
+	for _, message := range messages {
+		rm, ok := message.(*route.RouteMessage)
+		if !ok || rm.Flags&syscall.RTF_UP == 0 || rm.Flags&syscall.RTF_GATEWAY == 0 || len(rm.Addrs) <= syscall.RTAX_NETMASK {
+			continue
+		}
+		dst, ok := rm.Addrs[syscall.RTAX_DST].(*route.Inet4Addr)
+		if !ok || dst.IP != [4]byte{} {
+			continue
+		}
+		if mask, ok := rm.Addrs[syscall.RTAX_NETMASK].(*route.Inet4Addr); ok && mask.IP != [4]byte{} {
+			continue
+		}
+		if gateway, ok := rm.Addrs[syscall.RTAX_GATEWAY].(*route.Inet4Addr); ok {
+			return net.IP(gateway.IP[:]).String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"syscall"
+)
+
+const rtTableMain = 254
+
+// routeTableGateway returns the IPv4 default route's gateway from the main
+// routing table over netlink, preferring the lowest metric.
+func routeTableGateway() string {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		return ""
+	}
+	messages, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return ""
+	}
+	best, bestMetric := "", uint32(math.MaxUint32)
+	for i := range messages {
+		message := &messages[i]
+		// struct rtmsg: family, dst_len, src_len, tos, table, ...
+		if message.Header.Type != syscall.RTM_NEWROUTE || len(message.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		if message.Data[1] != 0 || message.Data[4] != rtTableMain {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(message)
+		if err != nil {
+			continue
+		}
+		var gateway net.IP
+		var metric uint32
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				if len(attr.Value) == net.IPv4len {
+					gateway = net.IP(attr.Value)
+				}
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) == 4 {
+					metric = binary.NativeEndian.Uint32(attr.Value)
+				}
+			}
+		}
+		if gateway != nil && metric < bestMetric {
+			best, bestMetric = gateway.String(), metric
+		}
+	}
+	return best
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !windows && !darwin
+
+package main
+
+func routeTableGateway() string {
+	return ""
+}
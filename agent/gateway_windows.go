@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// routeTableGateway returns the IPv4 default route's next hop from
+// GetIpForwardTable2, preferring the lowest route metric.
+func routeTableGateway() string {
+	var table *windows.MibIpForwardTable2
+	if err := windows.GetIpForwardTable2(windows.AF_INET, &table); err != nil {
+		return ""
+	}
+	defer windows.FreeMibTable(unsafe.Pointer(table))
+
+	best, bestMetric := "", uint32(math.MaxUint32)
+	for _, row := range table.Rows() {
+		if row.DestinationPrefix.PrefixLength != 0 {
+			continue
+		}
+		hop := (*windows.RawSockaddrInet4)(unsafe.Pointer(&row.NextHop))
+		if hop.Family != windows.AF_INET {
+			continue
+		}
+		ip := net.IP(hop.Addr[:])
+		if ip.IsUnspecified() || row.Metric >= bestMetric {
+			continue
+		}
+		best, bestMetric = ip.String(), row.Metric
+	}
+	return best
+}
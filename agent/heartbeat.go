@@ -0,0 +1,70 @@
+package main
+
+import "encoding/json"
+
+var (
+	heartbeatDelta     = false
+	heartbeatFullEvery = 6
+)
+
+// heartbeatVolatile are metrics that move on nearly every heartbeat. In delta
+// mode they only travel with full snapshots, otherwise every delta would
+// carry them and save nothing.
+var heartbeatVolatile = map[string]bool{
+	"goroutines":       true,
+	"latency_ms":       true,
+	"jitter_ms":        true,
+	"dns_resolvers":    true,
+	"cpu_percent":      true,
+	"load_1m":          true,
+	"mem_used_percent": true,
+	"uptime_s":         true,
+	"interfaces":       true,
+}
+
+// heartbeatShaper turns full heartbeats into deltas: every
+// heartbeatFullEvery-th heartbeat, and the first of each session, is sent in
+// full, and the ones in between only carry the metrics and network facts
+// that changed since the last one sent.
+type heartbeatShaper struct {
+	sinceFull int
+	metrics   map[string]string
+	network   string
+}
+
+func (s *heartbeatShaper) shape(payload HeartbeatPayload) HeartbeatPayload {
+	network := encodeForCompare(payload.Network)
+	metrics := make(map[string]string, len(payload.Metrics))
+	for key, value := range payload.Metrics {
+		metrics[key] = encodeForCompare(value)
+	}
+
+	if !heartbeatDelta || s.metrics == nil || s.sinceFull+1 >= heartbeatFullEvery {
+		s.sinceFull, s.metrics, s.network = 0, metrics, network
+		payload.Full = true
+		return payload
+	}
+	s.sinceFull++
+
+	delta := HeartbeatPayload{Status: payload.Status, LastSeen: payload.LastSeen}
+	if network != s.network {
+		delta.Network = payload.Network
+		s.network = network
+	}
+	for key, value := range payload.Metrics {
+		if heartbeatVolatile[key] || metrics[key] == s.metrics[key] {
+			continue
+		}
+		if delta.Metrics == nil {
+			delta.Metrics = make(map[string]interface{})
+		}
+		delta.Metrics[key] = value
+		s.metrics[key] = metrics[key]
+	}
+	return delta
+}
+
+func encodeForCompare(value interface{}) string {
+	raw, _ := json.Marshal(value)
+	return string(raw)
+}
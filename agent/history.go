@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+// historyDBPath is the SQLite file a real agent records its task, probe,
+// and connection history in; empty disables it. Rows older than
+// historyRetention go, and each table keeps at most historyMaxRows.
+var (
+	historyDBPath    = ""
+	historyRetention = 7 * 24 * time.Hour
+	historyMaxRows   = 100000
+)
+
+const (
+	historyPruneInterval  = time.Hour
+	historyMaxResultBytes = resultChunkSize
+	historyDefaultLimit   = 500
+	historyMaxLimit       = 5000
+)
+
+// historyColumns are the fields of each history table, in the order
+// history_query writes them as CSV.
+var historyColumns = map[string][]string{
+	"tasks":       {"ts", "task_id", "schedule_id", "group_id", "kind", "status", "error_code", "duration_ms", "result_truncated", "result"},
+	"probes":      {"ts", "internet", "dns", "gateway", "latency_ms", "internet_method", "gateway_method", "captive_portal"},
+	"connections": {"ts", "event", "admin", "session", "reason"},
+}
+
+type historyTask struct {
+	TS              int64           `json:"ts"`
+	TaskID          string          `json:"task_id"`
+	ScheduleID      string          `json:"schedule_id,omitempty"`
+	GroupID         string          `json:"group_id,omitempty"`
+	Kind            string          `json:"kind"`
+	Status          string          `json:"status"`
+	ErrorCode       string          `json:"error_code,omitempty"`
+	DurationMS      int64           `json:"duration_ms"`
+	ScanKey         string          `json:"scan_key,omitempty"`
+	ResultTruncated bool            `json:"result_truncated,omitempty"`
+	Result          json.RawMessage `json:"result,omitempty"`
+}
+
+type historyProbe struct {
+	TS             int64  `json:"ts"`
+	Internet       bool   `json:"internet"`
+	DNS            bool   `json:"dns"`
+	Gateway        bool   `json:"gateway"`
+	LatencyMS      *int64 `json:"latency_ms,omitempty"`
+	InternetMethod string `json:"internet_method,omitempty"`
+	GatewayMethod  string `json:"gateway_method,omitempty"`
+	CaptivePortal  *bool  `json:"captive_portal,omitempty"`
+}
+
+type historyConnection struct {
+	TS      int64  `json:"ts"`
+	Event   string `json:"event"`
+	Admin   string `json:"admin"`
+	Session string `json:"session,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// historyStore keeps history rows as JSON documents by table. Builds with
+// the sqlite tag provide one backed by SQLite.
+type historyStore interface {
+	record(table string, ts int64, row interface{}) error
+	// query returns up to limit rows with since <= ts < until, oldest
+	// first; when more match, the newest are kept. kind filters tasks.
+	query(table string, since, until int64, kind string, limit int) ([]json.RawMessage, error)
+	// prune removes rows older than before and all but the newest maxRows
+	// of each table.
+	prune(before int64, maxRows int) error
+	close() error
+}
+
+// openAgentHistory opens historyDBPath, logging instead of failing so a
+// build without SQLite still runs.
+func openAgentHistory() historyStore {
+	if historyDBPath == "" {
+		return nil
+	}
+	history, err := openHistoryStore(historyDBPath)
+	if err != nil {
+		slog.Warn("history disabled", "path", historyDBPath, "err", err)
+		return nil
+	}
+	slog.Info("recording history", "path", historyDBPath, "retention", historyRetention)
+	return history
+}
+
+// pruneHistoryLoop applies the retention limits at startup and then every
+// historyPruneInterval.
+func pruneHistoryLoop(ctx context.Context, history historyStore) {
+	ticker := time.NewTicker(historyPruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := history.prune(time.Now().Add(-historyRetention).UnixMilli(), historyMaxRows); err != nil {
+			slog.Warn("failed to prune history", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clearHistory empties every table, for factory_reset.
+func clearHistory(history historyStore) {
+	if history == nil {
+		return
+	}
+	if err := history.prune(math.MaxInt64, 0); err != nil {
+		slog.Warn("factory reset: cannot clear history", "err", err)
+	}
+}
+
+func (c *AgentClient) recordHistory(table string, ts int64, row interface{}) {
+	if c.history == nil {
+		return
+	}
+	if err := c.history.record(table, ts, row); err != nil {
+		c.logger().Warn("failed to record history", "table", table, "err", err)
+	}
+}
+
+func (c *AgentClient) recordTaskHistory(task TaskPayload, response TaskResultPayload, took time.Duration) {
+	if c.history == nil {
+		return
+	}
+	row := historyTask{
+		TS:         nowMS(),
+		TaskID:     task.TaskID,
+		ScheduleID: task.ScheduleID,
+		GroupID:    task.GroupID,
+		Kind:       task.Kind,
+		Status:     response.Status,
+		ErrorCode:  response.ErrorCode,
+		DurationMS: took.Milliseconds(),
+		ScanKey:    scanKey(task.Kind, task.Params),
+	}
+	if response.Result != nil {
+		if result, err := json.Marshal(response.Result); err == nil && len(result) <= historyMaxResultBytes {
+			row.Result = result
+		} else {
+			row.ResultTruncated = true
+		}
+	}
+	c.recordHistory("tasks", row.TS, row)
+}
+
+func (c *AgentClient) recordProbeHistory(result netprobe.Result) {
+	row := historyProbe{
+		TS:             result.At.UnixMilli(),
+		Internet:       result.Internet,
+		DNS:            result.DNS,
+		Gateway:        result.Gateway,
+		InternetMethod: result.InternetMethod,
+		GatewayMethod:  result.GatewayMethod,
+		CaptivePortal:  result.CaptivePortal,
+	}
+	if result.Internet {
+		ms := result.Latency.Milliseconds()
+		row.LatencyMS = &ms
+	}
+	c.recordHistory("probes", row.TS, row)
+}
+
+func (c *AgentClient) recordConnection(event, session, reason string) {
+	row := historyConnection{TS: nowMS(), Event: event, Admin: c.adminIP, Session: session, Reason: reason}
+	c.recordHistory("connections", row.TS, row)
+	c.syslogLifecycle(event, session, reason)
+}
+
+// recordDisconnect records the end of a registered session, with the error
+// that ended it, if any.
+func (c *AgentClient) recordDisconnect(err error) {
+	session, _ := c.state.session.Load().(string)
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	c.recordConnection("disconnected", session, reason)
+}
+
+// runHistoryQuery serves the history_query task: params table (tasks,
+// probes, or connections), since and until (unix ms), kind (tasks only),
+// limit (newest rows kept, default 500), and format (json or csv).
+func runHistoryQuery(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	if env.History == nil {
+		return nil, errors.New("history is not enabled; start the agent with -history-db")
+	}
+	table := asString(params["table"], "")
+	columns, ok := historyColumns[table]
+	if !ok {
+		return nil, fmt.Errorf("unknown history table %q; use tasks, probes, or connections", table)
+	}
+	limit := asInt(params["limit"], historyDefaultLimit)
+	if limit < 1 || limit > historyMaxLimit {
+		limit = historyMaxLimit
+	}
+	until := int64(asInt(params["until"], 0))
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	rows, err := env.History.query(table, int64(asInt(params["since"], 0)), until, asString(params["kind"], ""), limit)
+	if err != nil {
+		return nil, err
+	}
+	switch format := asString(params["format"], "json"); format {
+	case "json":
+		return map[string]interface{}{"table": table, "rows": rows, "count": len(rows)}, nil
+	case "csv":
+		data, err := historyCSV(columns, rows)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"table": table, "csv": data, "count": len(rows)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q; use json or csv", format)
+	}
+}
+
+// historyCSV writes rows as CSV with a header line. Nested values, such as
+// a task's result, are written as JSON.
+func historyCSV(columns []string, rows []json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write(columns)
+	record := make([]string, len(columns))
+	for _, raw := range rows {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return "", err
+		}
+		for i, column := range columns {
+			record[i] = csvField(fields[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
+
+func csvField(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var text string
+	if raw[0] == '"' && json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	return string(raw)
+}
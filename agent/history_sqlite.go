@@ -0,0 +1,96 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteHistory keeps each row as a JSON document next to its timestamp.
+type sqliteHistory struct {
+	db *sql.DB
+}
+
+func openHistoryStore(path string) (historyStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS tasks (ts INTEGER NOT NULL, kind TEXT NOT NULL, data TEXT NOT NULL);
+		CREATE INDEX IF NOT EXISTS tasks_ts ON tasks (ts);
+		CREATE TABLE IF NOT EXISTS probes (ts INTEGER NOT NULL, kind TEXT NOT NULL, data TEXT NOT NULL);
+		CREATE INDEX IF NOT EXISTS probes_ts ON probes (ts);
+		CREATE TABLE IF NOT EXISTS connections (ts INTEGER NOT NULL, kind TEXT NOT NULL, data TEXT NOT NULL);
+		CREATE INDEX IF NOT EXISTS connections_ts ON connections (ts);`)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqliteHistory{db: db}, nil
+}
+
+// checkTable guards the table names spliced into queries.
+func checkTable(table string) error {
+	if _, ok := historyColumns[table]; !ok {
+		return fmt.Errorf("unknown history table %q", table)
+	}
+	return nil
+}
+
+func (h *sqliteHistory) record(table string, ts int64, row interface{}) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	var kind string
+	if task, ok := row.(historyTask); ok {
+		kind = task.Kind
+	}
+	_, err = h.db.Exec(`INSERT INTO `+table+` (ts, kind, data) VALUES (?, ?, ?)`, ts, kind, string(data))
+	return err
+}
+
+func (h *sqliteHistory) query(table string, since, until int64, kind string, limit int) ([]json.RawMessage, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	rows, err := h.db.Query(`SELECT data FROM (SELECT rowid, ts, data FROM `+table+`
+		WHERE ts >= ? AND ts < ? AND (? = '' OR kind = ?) ORDER BY ts DESC, rowid DESC LIMIT ?)
+		ORDER BY ts, rowid`, since, until, kind, kind, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []json.RawMessage
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		out = append(out, json.RawMessage(data))
+	}
+	return out, rows.Err()
+}
+
+func (h *sqliteHistory) prune(before int64, maxRows int) error {
+	for table := range historyColumns {
+		if _, err := h.db.Exec(`DELETE FROM `+table+` WHERE ts < ?`, before); err != nil {
+			return err
+		}
+		if _, err := h.db.Exec(`DELETE FROM `+table+` WHERE rowid NOT IN (SELECT rowid FROM `+table+` ORDER BY ts DESC, rowid DESC LIMIT ?)`, maxRows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sqliteHistory) close() error { return h.db.Close() }
@@ -0,0 +1,71 @@
+//go:build sqlite
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteHistory(t *testing.T) {
+	history, err := openHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.close()
+	for i, kind := range []string{"ping", "port_scan", "ping", "ping"} {
+		row := historyTask{TS: int64(100 + i), TaskID: string(rune('a' + i)), Kind: kind, Status: taskStatusCompleted}
+		if err := history.record("tasks", row.TS, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := history.record("probes", 100, historyProbe{TS: 100, Internet: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(rows []json.RawMessage) string {
+		var out string
+		for _, raw := range rows {
+			var row historyTask
+			_ = json.Unmarshal(raw, &row)
+			out += row.TaskID
+		}
+		return out
+	}
+	tests := []struct {
+		name         string
+		since, until int64
+		kind         string
+		limit        int
+		want         string
+	}{
+		{name: "all", until: 1000, limit: 10, want: "abcd"},
+		{name: "window", since: 101, until: 103, limit: 10, want: "bc"},
+		{name: "kind", until: 1000, kind: "ping", limit: 10, want: "acd"},
+		{name: "limit keeps newest", until: 1000, limit: 2, want: "cd"},
+	}
+	for _, tt := range tests {
+		rows, err := history.query("tasks", tt.since, tt.until, tt.kind, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(rows); got != tt.want {
+			t.Errorf("%s: query() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if err := history.prune(101, 2); err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := history.query("tasks", 0, 1000, "", 10)
+	if got := ids(rows); got != "cd" {
+		t.Fatalf("after prune = %q, want %q", got, "cd")
+	}
+	if rows, _ := history.query("probes", 0, 1000, "", 10); len(rows) != 0 {
+		t.Fatalf("probe older than the cutoff survived prune: %s", rows)
+	}
+	if err := history.record("bogus", 1, historyProbe{}); err == nil {
+		t.Fatal("record accepted an unknown table")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHistoryCSV(t *testing.T) {
+	rows := []json.RawMessage{
+		json.RawMessage(`{"ts":1700000000000,"task_id":"t1","kind":"ping","status":"completed","duration_ms":12,"result":{"rtt_ms":[1.5,2]}}`),
+		json.RawMessage(`{"ts":1700000000001,"task_id":"t2","kind":"port_scan","status":"failed","error_code":"target_not_allowed","duration_ms":0,"result_truncated":true}`),
+	}
+	got, err := historyCSV(historyColumns["tasks"], rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ts,task_id,schedule_id,group_id,kind,status,error_code,duration_ms,result_truncated,result\n" +
+		"1700000000000,t1,,,ping,completed,,12,,\"{\"\"rtt_ms\"\":[1.5,2]}\"\n" +
+		"1700000000001,t2,,,port_scan,failed,target_not_allowed,0,true,\n"
+	if got != want {
+		t.Fatalf("historyCSV() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistoryQueryNeedsStore(t *testing.T) {
+	if _, err := runHistoryQuery(taskEnv{}, map[string]interface{}{"table": "tasks"}); err == nil {
+		t.Fatal("history_query without a store succeeded")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// hostWatchInterval is how often a real agent re-reads its hostname and
+// addresses; 0 disables the check.
+var hostWatchInterval = 30 * time.Second
+
+// hostProfile is the part of register that can change while the agent runs.
+type hostProfile struct {
+	Hostname   string
+	IPs        []string
+	IPv6       []string
+	MACs       []string
+	Interfaces []InterfaceInfo
+}
+
+// UpdateRegisterPayload refreshes the admin's record of the agent after a
+// DHCP renewal or hostname change, without reconnecting.
+type UpdateRegisterPayload struct {
+	Hostname   string          `json:"hostname"`
+	IPs        []string        `json:"ips"`
+	IPv6       []string        `json:"ipv6,omitempty"`
+	MACs       []string        `json:"macs"`
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
+	Network    NetworkFacts    `json:"network"`
+	Changed    []string        `json:"changed"`
+}
+
+func readHostProfile() hostProfile {
+	hostname, _ := os.Hostname()
+	return hostProfile{
+		Hostname:   hostname,
+		IPs:        localIPv4s(),
+		IPv6:       localIPv6s(),
+		MACs:       localMACs(),
+		Interfaces: localInterfaces(),
+	}
+}
+
+func profileHost(profile AgentProfile) hostProfile {
+	return hostProfile{
+		Hostname:   profile.Hostname,
+		IPs:        profile.IPs,
+		IPv6:       profile.IPv6,
+		MACs:       profile.MACs,
+		Interfaces: profile.Interfaces,
+	}
+}
+
+// currentHost returns the hostname and addresses last reported to the admin.
+func (c *AgentClient) currentHost() hostProfile {
+	c.hostMu.Lock()
+	defer c.hostMu.Unlock()
+	return c.host
+}
+
+// refreshHost re-reads a real agent's hostname and addresses before
+// register, so a change while disconnected is not reported stale.
+func (c *AgentClient) refreshHost() hostProfile {
+	c.hostMu.Lock()
+	defer c.hostMu.Unlock()
+	if !c.profile.IsFake {
+		c.host = readHostProfile()
+	}
+	return c.host
+}
+
+// changedHostFields names the register fields that differ between two
+// readings. Address order is not significant.
+func changedHostFields(old, next hostProfile) []string {
+	var changed []string
+	if old.Hostname != next.Hostname {
+		changed = append(changed, "hostname")
+	}
+	if !sameStrings(old.IPs, next.IPs) {
+		changed = append(changed, "ips")
+	}
+	if !sameStrings(old.IPv6, next.IPv6) {
+		changed = append(changed, "ipv6")
+	}
+	if !sameStrings(old.MACs, next.MACs) {
+		changed = append(changed, "macs")
+	}
+	return changed
+}
+
+func sameStrings(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// hostWatchLoop re-reads the hostname and addresses every hostWatchInterval
+// and sends update_register when they change. A version 1 admin does not
+// know update_register, so the agent drops the connection instead and
+// registers again with the fresh profile. Fake agents skip it: their
+// profile comes from the scenario.
+func (c *AgentClient) hostWatchLoop(ctx context.Context, conn sessionConn) {
+	if c.profile.IsFake || hostWatchInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(hostWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		next := readHostProfile()
+		c.hostMu.Lock()
+		changed := changedHostFields(c.host, next)
+		if len(changed) > 0 {
+			c.host = next
+		}
+		c.hostMu.Unlock()
+		if len(changed) == 0 {
+			continue
+		}
+		c.logger().Info("host changed", "changed", strings.Join(changed, ","), "hostname", next.Hostname, "ips", strings.Join(next.IPs, ","))
+		if !c.peerAccepts("update_register") {
+			c.logger().Info("admin does not accept update_register, reconnecting")
+			_ = conn.Close()
+			return
+		}
+		if err := c.send("update_register", UpdateRegisterPayload{
+			Hostname:   next.Hostname,
+			IPs:        next.IPs,
+			IPv6:       next.IPv6,
+			MACs:       next.MACs,
+			Interfaces: next.Interfaces,
+			Network:    c.collectAndStoreNetworkFacts(false),
+			Changed:    changed,
+		}); err != nil {
+			return
+		}
+	}
+}
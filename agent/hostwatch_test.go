@@ -0,0 +1,31 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChangedHostFields(t *testing.T) {
+	base := hostProfile{Hostname: "lab-1", IPs: []string{"10.0.0.5", "172.17.0.1"}, MACs: []string{"02:00:00:00:00:01"}}
+	tests := []struct {
+		name   string
+		update func(hostProfile) hostProfile
+		want   []string
+	}{
+		{name: "unchanged"},
+		{name: "reordered addresses", update: func(h hostProfile) hostProfile { h.IPs = []string{"172.17.0.1", "10.0.0.5"}; return h }},
+		{name: "new lease", update: func(h hostProfile) hostProfile { h.IPs = []string{"10.0.0.9", "172.17.0.1"}; return h }, want: []string{"ips"}},
+		{name: "renamed and ipv6", update: func(h hostProfile) hostProfile { h.Hostname = "lab-2"; h.IPv6 = []string{"2001:db8::5"}; return h },
+			want: []string{"hostname", "ipv6"}},
+		{name: "adapter added", update: func(h hostProfile) hostProfile { h.MACs = append(h.MACs, "02:00:00:00:00:02"); return h }, want: []string{"macs"}},
+	}
+	for _, tt := range tests {
+		next := base
+		if tt.update != nil {
+			next = tt.update(next)
+		}
+		if got := changedHostFields(base, next); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: changedHostFields() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	httpCheckDefaultBody = 1 << 20
+	httpCheckMaxBody     = 16 << 20
+	httpCheckExcerpt     = 256
+)
+
+// httpAssertion is one check http_check made against the response.
+type httpAssertion struct {
+	Check    string `json:"check"`
+	OK       bool   `json:"ok"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// httpCheckSpec is an http_check task's request and assertions.
+type httpCheckSpec struct {
+	url          string
+	method       string
+	timeout      time.Duration
+	maxRedirects int
+	maxBody      int64
+	insecure     bool
+	sendHeaders  map[string]string
+	statuses     []int
+	contains     []string
+	notContains  []string
+	regex        *regexp.Regexp
+	headers      map[string]string
+}
+
+func parseHTTPCheck(params map[string]interface{}) (httpCheckSpec, error) {
+	spec := httpCheckSpec{
+		url:          asString(params["url"], ""),
+		method:       strings.ToUpper(asString(params["method"], http.MethodGet)),
+		timeout:      time.Duration(asInt(params["timeout_ms"], 5000)) * time.Millisecond,
+		maxRedirects: asInt(params["max_redirects"], 5),
+		maxBody:      int64(min(max(asInt(params["max_body_bytes"], httpCheckDefaultBody), 1), httpCheckMaxBody)),
+		sendHeaders:  stringMap(params["request_headers"]),
+		contains:     stringOrList(params["contains"]),
+		notContains:  stringOrList(params["not_contains"]),
+		headers:      stringMap(params["headers"]),
+	}
+	spec.insecure, _ = params["insecure"].(bool)
+	if spec.url == "" {
+		return spec, errors.New("http_check requires url")
+	}
+	if spec.method != http.MethodGet && spec.method != http.MethodHead {
+		return spec, fmt.Errorf("unsupported http_check method %q; use GET or HEAD", spec.method)
+	}
+	if spec.maxRedirects < 0 {
+		spec.maxRedirects = 0
+	}
+	switch value := params["expect_status"].(type) {
+	case nil:
+	case float64:
+		spec.statuses = []int{int(value)}
+	case []interface{}:
+		for _, raw := range value {
+			status, ok := raw.(float64)
+			if !ok {
+				return spec, fmt.Errorf("invalid expect_status entry %v", raw)
+			}
+			spec.statuses = append(spec.statuses, int(status))
+		}
+	default:
+		return spec, fmt.Errorf("expect_status must be a status code or a list of them, not %T", value)
+	}
+	if pattern := asString(params["regex"], ""); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return spec, fmt.Errorf("invalid regex: %w", err)
+		}
+		spec.regex = re
+	}
+	if spec.method == http.MethodHead && (len(spec.contains) > 0 || len(spec.notContains) > 0 || spec.regex != nil) {
+		return spec, errors.New("body assertions need method GET")
+	}
+	return spec, nil
+}
+
+// runHTTPCheck serves http_check: it fetches url, following up to
+// max_redirects redirects, and checks the final response's status, body,
+// and headers. Failed assertions and connection errors give ok false, not
+// a task error, so a monitor keeps running.
+func runHTTPCheck(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	spec, err := parseHTTPCheck(params)
+	if err != nil {
+		return nil, err
+	}
+	client := env.Pins.httpClient(spec.timeout)
+	transport, _ := client.Transport.(*http.Transport)
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		client.Transport = transport
+	}
+	if spec.insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	defer transport.CloseIdleConnections()
+	redirects := make([]string, 0)
+	pinnedRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > spec.maxRedirects {
+			return http.ErrUseLastResponse
+		}
+		if pinnedRedirect != nil {
+			if err := pinnedRedirect(req, via); err != nil {
+				return err
+			}
+		}
+		redirects = append(redirects, req.URL.String())
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(env.context(), spec.method, spec.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range spec.sendHeaders {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	result := map[string]interface{}{"url": spec.url, "redirects": redirects}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		var policyErr *policyError
+		if errors.As(err, &policyErr) {
+			return nil, policyErr
+		}
+		result["ok"] = false
+		result["error"] = err.Error()
+		return result, nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, spec.maxBody+1))
+	result["response_ms"] = time.Since(start).Milliseconds()
+	if err != nil {
+		result["ok"] = false
+		result["error"] = "reading body: " + err.Error()
+		return result, nil
+	}
+	truncated := int64(len(body)) > spec.maxBody
+	if truncated {
+		body = body[:spec.maxBody]
+	}
+	result["final_url"] = resp.Request.URL.String()
+	result["redirects"] = redirects
+	result["status"] = resp.StatusCode
+	result["body_bytes"] = len(body)
+	result["body_truncated"] = truncated
+
+	checks := spec.assert(resp, string(body))
+	failed := 0
+	bodyFailed := false
+	for _, check := range checks {
+		if !check.OK {
+			failed++
+			bodyFailed = bodyFailed || check.Check != "status" && !strings.HasPrefix(check.Check, "header")
+		}
+	}
+	if bodyFailed {
+		result["body_excerpt"] = excerpt(body, httpCheckExcerpt)
+	}
+	result["checks"] = checks
+	result["failed"] = failed
+	result["ok"] = failed == 0
+	return result, nil
+}
+
+// assert runs the spec's checks against a response and its body, in the
+// order status, headers, contains, not_contains, regex.
+func (s httpCheckSpec) assert(resp *http.Response, body string) []httpAssertion {
+	checks := []httpAssertion{s.statusCheck(resp.StatusCode)}
+	names := make([]string, 0, len(s.headers))
+	for name := range s.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want := s.headers[name]
+		values := resp.Header.Values(name)
+		actual := strings.Join(values, ", ")
+		check := httpAssertion{Check: "header " + http.CanonicalHeaderKey(name), Expected: want, Actual: actual}
+		if want == "" {
+			check.Expected = "present"
+			check.OK = len(values) > 0
+		} else {
+			check.OK = strings.Contains(strings.ToLower(actual), strings.ToLower(want))
+		}
+		checks = append(checks, check)
+	}
+	for _, text := range s.contains {
+		checks = append(checks, httpAssertion{Check: "contains", Expected: text, OK: strings.Contains(body, text)})
+	}
+	for _, text := range s.notContains {
+		checks = append(checks, httpAssertion{Check: "not_contains", Expected: text, OK: !strings.Contains(body, text)})
+	}
+	if s.regex != nil {
+		check := httpAssertion{Check: "regex", Expected: s.regex.String()}
+		if match := s.regex.FindStringIndex(body); match != nil {
+			check.OK = true
+			check.Actual = excerpt([]byte(body[match[0]:match[1]]), httpCheckExcerpt)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// statusCheck accepts the expect_status codes, or any 2xx without them.
+func (s httpCheckSpec) statusCheck(status int) httpAssertion {
+	check := httpAssertion{Check: "status", Expected: "2xx", Actual: fmt.Sprint(status), OK: status >= 200 && status < 300}
+	if len(s.statuses) > 0 {
+		expected := make([]string, len(s.statuses))
+		check.OK = false
+		for i, want := range s.statuses {
+			expected[i] = fmt.Sprint(want)
+			check.OK = check.OK || status == want
+		}
+		check.Expected = strings.Join(expected, ", ")
+	}
+	return check
+}
+
+// runFakeHTTPCheck answers http_check for fake agents with a response that
+// passes every assertion.
+func runFakeHTTPCheck(params map[string]interface{}) (interface{}, error) {
+	spec, err := parseHTTPCheck(params)
+	if err != nil {
+		return nil, err
+	}
+	status := http.StatusOK
+	if len(spec.statuses) > 0 {
+		status = spec.statuses[0]
+	}
+	resp := &http.Response{StatusCode: status, Header: http.Header{}}
+	for name, value := range spec.headers {
+		resp.Header.Set(name, value)
+	}
+	checks := spec.assert(resp, strings.Join(spec.contains, "\n"))
+	// The simulated service serves the right thing, so the body checks
+	// that a made-up body cannot satisfy pass too.
+	for i := range checks {
+		checks[i].OK = true
+	}
+	return map[string]interface{}{
+		"url":            spec.url,
+		"final_url":      spec.url,
+		"redirects":      []string{},
+		"status":         status,
+		"response_ms":    20,
+		"body_bytes":     4096,
+		"body_truncated": false,
+		"checks":         checks,
+		"failed":         0,
+		"ok":             true,
+	}, nil
+}
+
+func stringOrList(v interface{}) []string {
+	if text := asString(v, ""); text != "" {
+		return []string{text}
+	}
+	return asStringSlice(v, nil)
+}
+
+func stringMap(v interface{}) map[string]string {
+	raw, _ := v.(map[string]interface{})
+	out := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if text, ok := value.(string); ok {
+			out[key] = text
+		}
+	}
+	return out
+}
+
+func excerpt(body []byte, limit int) string {
+	if len(body) > limit {
+		body = body[:limit]
+	}
+	return strings.ToValidUTF8(string(body), "�")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func httpCheckServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wiki", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Served-By", r.Header.Get("X-Probe"))
+		fmt.Fprint(w, "<title>Lab Wiki</title> build 2026.10")
+	})
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/wiki", http.StatusFound)
+	})
+	mux.HandleFunc("/older", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/old", http.StatusMovedPermanently)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPCheck(t *testing.T) {
+	server := httpCheckServer(t)
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	tests := []struct {
+		name      string
+		params    map[string]interface{}
+		ok        bool
+		status    int
+		redirects int
+		failed    int
+	}{
+		{"plain", map[string]interface{}{"url": server.URL + "/wiki"}, true, 200, 0, 0},
+		{"assertions pass", map[string]interface{}{
+			"url":             server.URL + "/older",
+			"contains":        []interface{}{"Lab Wiki", "build"},
+			"not_contains":    "Index of",
+			"regex":           `build \d{4}\.\d+`,
+			"headers":         map[string]interface{}{"content-type": "TEXT/HTML", "X-Served-By": "labscan"},
+			"request_headers": map[string]interface{}{"X-Probe": "labscan"},
+		}, true, 200, 2, 0},
+		{"assertions fail", map[string]interface{}{
+			"url":          server.URL + "/wiki",
+			"contains":     "Grafana",
+			"not_contains": []interface{}{"Wiki"},
+			"regex":        `^build`,
+			"headers":      map[string]interface{}{"Strict-Transport-Security": ""},
+		}, false, 200, 0, 4},
+		{"redirect not followed", map[string]interface{}{"url": server.URL + "/older", "max_redirects": 0.0}, false, 301, 0, 1},
+		{"redirect expected", map[string]interface{}{"url": server.URL + "/older", "max_redirects": 1.0, "expect_status": []interface{}{302.0, 303.0}}, true, 302, 1, 0},
+		{"not found", map[string]interface{}{"url": server.URL + "/missing"}, false, 404, 0, 1},
+		{"head", map[string]interface{}{"url": server.URL + "/wiki", "method": "head", "headers": map[string]interface{}{"Content-Type": "html"}}, true, 200, 0, 0},
+	}
+	for _, tt := range tests {
+		out, err := runHTTPCheck(env, tt.params)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		result := out.(map[string]interface{})
+		if result["ok"] != tt.ok || result["status"] != tt.status || len(result["redirects"].([]string)) != tt.redirects || result["failed"] != tt.failed {
+			t.Errorf("%s: result = %v", tt.name, result)
+		}
+		if _, excerpt := result["body_excerpt"]; excerpt != (tt.name == "assertions fail") {
+			t.Errorf("%s: body_excerpt present = %v", tt.name, excerpt)
+		}
+	}
+}
+
+func TestHTTPCheckErrors(t *testing.T) {
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	for _, params := range []map[string]interface{}{
+		{},
+		{"url": "http://127.0.0.1/", "method": "POST"},
+		{"url": "http://127.0.0.1/", "regex": "("},
+		{"url": "http://127.0.0.1/", "method": "HEAD", "contains": "x"},
+		{"url": "http://127.0.0.1/", "expect_status": "200"},
+	} {
+		if _, err := runHTTPCheck(env, params); err == nil {
+			t.Errorf("runHTTPCheck(%v) succeeded, want an error", params)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + listener.Addr().String() + "/"
+	listener.Close()
+	out, err := runHTTPCheck(env, map[string]interface{}{"url": closed, "timeout_ms": 500.0})
+	result, _ := out.(map[string]interface{})
+	if err != nil || result["ok"] != false || result["error"] == nil {
+		t.Fatalf("unreachable service = %v, %v, want ok false with an error", result, err)
+	}
+}
+
+func TestFakeHTTPCheck(t *testing.T) {
+	out, err := runTask(true, taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}, "http_check", map[string]interface{}{
+		"url": "http://wiki.lab/", "contains": "Lab Wiki", "regex": "v[0-9]+", "headers": map[string]interface{}{"Server": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(map[string]interface{})
+	if result["ok"] != true || len(result["checks"].([]httpAssertion)) != 4 {
+		t.Fatalf("result = %v", result)
+	}
+}
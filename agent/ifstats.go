@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ifCounters are the cumulative counters the OS keeps for one interface.
+type ifCounters struct {
+	Name      string
+	Up        bool
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+}
+
+// InterfaceTraffic is one interface's traffic since the previous heartbeat.
+type InterfaceTraffic struct {
+	Name       string `json:"name"`
+	Up         bool   `json:"up"`
+	RxBytes    uint64 `json:"rx_bytes"`
+	TxBytes    uint64 `json:"tx_bytes"`
+	RxPackets  uint64 `json:"rx_packets"`
+	TxPackets  uint64 `json:"tx_packets"`
+	RxBps      uint64 `json:"rx_bps"`
+	TxBps      uint64 `json:"tx_bps"`
+	IntervalMS int64  `json:"interval_ms"`
+}
+
+type ifTrafficTracker struct {
+	mu     sync.Mutex
+	last   map[string]ifCounters
+	lastAt time.Time
+}
+
+// sample returns per-interface deltas since the previous call. The first
+// call only records a baseline and returns nil.
+func (t *ifTrafficTracker) sample() []InterfaceTraffic {
+	counters, err := readInterfaceCounters()
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, lastAt := t.last, t.lastAt
+	t.last, t.lastAt = make(map[string]ifCounters, len(counters)), now
+	for _, c := range counters {
+		t.last[c.Name] = c
+	}
+	if last == nil {
+		return nil
+	}
+
+	interval := now.Sub(lastAt)
+	traffic := make([]InterfaceTraffic, 0, len(counters))
+	for _, c := range counters {
+		prev, ok := last[c.Name]
+		if !ok {
+			continue
+		}
+		entry := InterfaceTraffic{
+			Name:       c.Name,
+			Up:         c.Up,
+			RxBytes:    counterDelta(prev.RxBytes, c.RxBytes),
+			TxBytes:    counterDelta(prev.TxBytes, c.TxBytes),
+			RxPackets:  counterDelta(prev.RxPackets, c.RxPackets),
+			TxPackets:  counterDelta(prev.TxPackets, c.TxPackets),
+			IntervalMS: interval.Milliseconds(),
+		}
+		if interval > 0 {
+			entry.RxBps = uint64(float64(entry.RxBytes*8) / interval.Seconds())
+			entry.TxBps = uint64(float64(entry.TxBytes*8) / interval.Seconds())
+		}
+		traffic = append(traffic, entry)
+	}
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].Name < traffic[j].Name })
+	return traffic
+}
+
+// counterDelta treats a counter that went backwards as reset (driver reload,
+// 32-bit wrap) and counts from zero.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// interfaceUp reports whether the interface is up with a carrier.
+func interfaceUp(iface net.Interface) bool {
+	return iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0
+}
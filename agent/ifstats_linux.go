@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readInterfaceCounters parses /proc/net/dev, skipping loopback.
+func readInterfaceCounters() ([]ifCounters, error) {
+	file, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	up := make(map[string]bool)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			up[iface.Name] = interfaceUp(iface)
+		}
+	}
+
+	var counters []ifCounters
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(rest)
+		if name == "lo" || len(fields) < 10 {
+			continue
+		}
+		value := func(i int) uint64 {
+			v, _ := strconv.ParseUint(fields[i], 10, 64)
+			return v
+		}
+		counters = append(counters, ifCounters{
+			Name:      name,
+			Up:        up[name],
+			RxBytes:   value(0),
+			RxPackets: value(1),
+			TxBytes:   value(8),
+			TxPackets: value(9),
+		})
+	}
+	return counters, scanner.Err()
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+func readInterfaceCounters() ([]ifCounters, error) {
+	return nil, errors.New("interface counters unsupported on this platform")
+}
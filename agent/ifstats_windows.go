@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// readInterfaceCounters queries GetIfEntry2Ex for every interface Go can see,
+// skipping loopback.
+func readInterfaceCounters() ([]ifCounters, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var counters []ifCounters
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		row := windows.MibIfRow2{InterfaceIndex: uint32(iface.Index)}
+		if err := windows.GetIfEntry2Ex(windows.MibIfEntryNormal, &row); err != nil {
+			continue
+		}
+		counters = append(counters, ifCounters{
+			Name:      iface.Name,
+			Up:        row.OperStatus == windows.IfOperStatusUp,
+			RxBytes:   row.InOctets,
+			TxBytes:   row.OutOctets,
+			RxPackets: row.InUcastPkts + row.InNUcastPkts,
+			TxPackets: row.OutUcastPkts + row.OutNUcastPkts,
+		})
+	}
+	return counters, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+const (
+	influxMaxBuffered = 10000
+	influxBatch       = 5000
+	influxTimeout     = 10 * time.Second
+)
+
+// -influx pushes heartbeat metrics and probe results to an InfluxDB write
+// endpoint, or anything else that takes line protocol, every
+// -influx-interval.
+var (
+	influxURL      string
+	influxToken    string
+	influxInterval = 10 * time.Second
+	agentInflux    *influxExporter
+)
+
+// influxExporter buffers points and writes them in batches from one
+// goroutine. Points carry their own timestamps, so while the endpoint is
+// down they are kept, up to influxMaxBuffered, and written late rather than
+// lost. A nil *influxExporter exports nothing.
+type influxExporter struct {
+	url    string
+	token  string
+	client *http.Client
+
+	mu      sync.Mutex
+	lines   []string
+	dropped int
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newInfluxExporter checks an -influx write URL and sets precision=ms on
+// it; an empty URL disables the export and returns nil.
+func newInfluxExporter(raw, token string) (*influxExporter, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("%q: want an http:// or https:// write URL", raw)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		return nil, fmt.Errorf("%q: want the write endpoint, e.g. /api/v2/write?org=lab&bucket=labscan or /write?db=labscan", raw)
+	}
+	query := parsed.Query()
+	if precision := query.Get("precision"); precision != "" && precision != "ms" {
+		return nil, fmt.Errorf("%q: the agent writes millisecond timestamps; drop precision or set it to ms", raw)
+	}
+	query.Set("precision", "ms")
+	parsed.RawQuery = query.Encode()
+	return &influxExporter{
+		url:    parsed.String(),
+		token:  token,
+		client: &http.Client{Timeout: influxTimeout, Transport: &http.Transport{Proxy: adminProxy}},
+	}, nil
+}
+
+// startInflux sets up -influx for the process; clients pick it up when they
+// are created.
+func startInflux() error {
+	exporter, err := newInfluxExporter(influxURL, influxToken)
+	if err != nil || exporter == nil {
+		return err
+	}
+	agentInflux = exporter.start(influxInterval)
+	slog.Info("exporting metrics to influxdb", "url", redactedURL(exporter.url))
+	return nil
+}
+
+func (e *influxExporter) start(interval time.Duration) *influxExporter {
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.run(interval)
+	return e
+}
+
+// add queues one point. When the buffer is full the oldest points give way.
+func (e *influxExporter) add(line string) {
+	if e == nil || line == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lines = append(e.lines, line)
+	e.trimLocked()
+}
+
+func (e *influxExporter) trimLocked() {
+	if over := len(e.lines) - influxMaxBuffered; over > 0 {
+		e.lines = e.lines[over:]
+		e.dropped += over
+	}
+}
+
+// close writes what is buffered, waiting at most timeout.
+func (e *influxExporter) close(timeout time.Duration) {
+	if e == nil || e.stop == nil {
+		return
+	}
+	e.closeOnce.Do(func() { close(e.stop) })
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (e *influxExporter) run(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			_ = e.flush()
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				slog.Debug("influxdb write failed", "err", err)
+			}
+		}
+	}
+}
+
+// flush writes the buffer in batches of influxBatch. A batch the endpoint
+// rejects outright is dropped, since it would be rejected again; one that
+// failed for a network error, 429, or 5xx goes back for the next flush.
+func (e *influxExporter) flush() error {
+	for {
+		e.mu.Lock()
+		n := min(len(e.lines), influxBatch)
+		batch := append([]string(nil), e.lines[:n]...)
+		e.lines = e.lines[n:]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+		if dropped > 0 {
+			slog.Warn("influxdb buffer full, dropped oldest points", "count", dropped)
+		}
+		if n == 0 {
+			return nil
+		}
+		retry, err := e.write(batch)
+		if err == nil {
+			continue
+		}
+		if !retry {
+			slog.Warn("influxdb rejected points", "count", n, "err", err)
+			continue
+		}
+		e.mu.Lock()
+		e.lines = append(batch, e.lines...)
+		e.trimLocked()
+		e.mu.Unlock()
+		return err
+	}
+}
+
+func (e *influxExporter) write(batch []string) (bool, error) {
+	body := strings.Join(batch, "\n") + "\n"
+	req, err := http.NewRequest(http.MethodPost, e.url, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "labscan-agent/"+agentVersion)
+	if e.token != "" {
+		req.Header.Set("Authorization", "Token "+e.token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("endpoint answered %s: %s", resp.Status, bytes.TrimSpace(detail))
+}
+
+func redactedURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return parsed.Redacted()
+}
+
+// influxLine renders one point. Fields that are nil, NaN, empty strings,
+// or of a type line protocol cannot carry are left out; a point with no
+// fields left is "".
+func influxLine(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, key := range sortedKeys(tags) {
+		if tags[key] == "" {
+			continue
+		}
+		b.WriteString("," + influxKeyEscaper.Replace(key) + "=" + influxKeyEscaper.Replace(tags[key]))
+	}
+	n := 0
+	for _, key := range sortedKeys(fields) {
+		value, ok := influxField(fields[key])
+		if !ok {
+			continue
+		}
+		if n == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(influxKeyEscaper.Replace(key) + "=" + value)
+		n++
+	}
+	if n == 0 {
+		return ""
+	}
+	b.WriteString(" " + strconv.FormatInt(ts.UnixMilli(), 10))
+	return b.String()
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func influxField(value interface{}) (string, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	// Integers are written as floats too: InfluxDB fixes a field's type on
+	// first write, and the same metric is an integer on some agents and a
+	// float on others.
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	case reflect.String:
+		if v.Len() == 0 {
+			return "", false
+		}
+		return `"` + influxStringEscaper.Replace(v.String()) + `"`, true
+	}
+	return "", false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *AgentClient) influxTags() map[string]string {
+	return map[string]string{"agent_id": c.profile.AgentID, "hostname": c.currentHost().Hostname}
+}
+
+// exportHeartbeat writes a heartbeat's flat metrics as one labscan_heartbeat
+// point. Nested metrics, such as per-interface traffic, are left out.
+func (c *AgentClient) exportHeartbeat(payload HeartbeatPayload) {
+	if c.influx == nil {
+		return
+	}
+	c.influx.add(influxLine("labscan_heartbeat", c.influxTags(), payload.Metrics, time.UnixMilli(payload.LastSeen)))
+}
+
+// exportProbe writes a connectivity probe as a labscan_probe point and a
+// labscan_dns_resolver point per resolver benchmarked.
+func (c *AgentClient) exportProbe(result netprobe.Result) {
+	if c.influx == nil {
+		return
+	}
+	at := result.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	tags := c.influxTags()
+	fields := map[string]interface{}{
+		"internet_reachable": result.Internet,
+		"dns_ok":             result.DNS,
+		"gateway_reachable":  result.Gateway,
+		"internet_method":    result.InternetMethod,
+		"gateway_method":     result.GatewayMethod,
+		"captive_portal":     result.CaptivePortal,
+	}
+	if result.Internet {
+		fields["latency_ms"] = float64(result.Latency.Microseconds()) / 1000
+	}
+	c.influx.add(influxLine("labscan_probe", tags, fields, at))
+	for _, resolver := range result.Resolvers {
+		fields := map[string]interface{}{"ok": resolver.OK}
+		if resolver.OK {
+			fields["latency_ms"] = float64(resolver.Latency.Microseconds()) / 1000
+		}
+		resolverTags := map[string]string{"resolver": resolver.Resolver}
+		for key, value := range tags {
+			resolverTags[key] = value
+		}
+		c.influx.add(influxLine("labscan_dns_resolver", resolverTags, fields, at))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+func TestInfluxLine(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	yes := true
+	var missing *bool
+	line := influxLine("labscan_probe", map[string]string{"hostname": "lab pc,1", "agent_id": "a-1", "site": ""}, map[string]interface{}{
+		"latency_ms":     12.5,
+		"goroutines":     42,
+		"mem_total_mb":   uint64(8192),
+		"dns_ok":         false,
+		"captive_portal": &yes,
+		"unknown":        missing,
+		"method":         `icmp "echo"`,
+		"resolvers":      []string{"1.1.1.1"},
+	}, ts)
+	want := `labscan_probe,agent_id=a-1,hostname=lab\ pc\,1 captive_portal=true,dns_ok=false,goroutines=42,latency_ms=12.5,mem_total_mb=8192,method="icmp \"echo\"" 1700000000123`
+	if line != want {
+		t.Errorf("influxLine =\n%s\nwant\n%s", line, want)
+	}
+	if line := influxLine("empty", nil, map[string]interface{}{"nested": map[string]int{}}, ts); line != "" {
+		t.Errorf("point without fields = %q", line)
+	}
+}
+
+type influxSink struct {
+	mu       sync.Mutex
+	status   int
+	bodies   []string
+	queries  []string
+	authzHdr string
+}
+
+func (s *influxSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, string(body))
+	s.queries = append(s.queries, r.URL.RawQuery)
+	s.authzHdr = r.Header.Get("Authorization")
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestInfluxExporterFlush(t *testing.T) {
+	sink := &influxSink{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	e, err := newInfluxExporter(server.URL+"/api/v2/write?org=lab&bucket=labscan", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.add("m v=1 1")
+	e.add("m v=2 2")
+	if err := e.flush(); err == nil {
+		t.Fatal("flush to a 503 endpoint succeeded")
+	}
+	if len(e.lines) != 2 {
+		t.Fatalf("points kept after 503 = %d, want 2", len(e.lines))
+	}
+
+	sink.mu.Lock()
+	sink.status = 0
+	sink.mu.Unlock()
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.lines) != 0 {
+		t.Fatalf("points left after flush = %d", len(e.lines))
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if got := sink.bodies[len(sink.bodies)-1]; got != "m v=1 1\nm v=2 2\n" {
+		t.Errorf("body = %q", got)
+	}
+	if query := sink.queries[0]; !strings.Contains(query, "precision=ms") || !strings.Contains(query, "bucket=labscan") {
+		t.Errorf("query = %q", query)
+	}
+	if sink.authzHdr != "Token tok" {
+		t.Errorf("Authorization = %q", sink.authzHdr)
+	}
+}
+
+func TestInfluxExporterRejected(t *testing.T) {
+	server := httptest.NewServer(&influxSink{status: http.StatusBadRequest})
+	defer server.Close()
+	e, _ := newInfluxExporter(server.URL+"/write?db=labscan", "")
+	e.add("m v=1 1")
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush = %v; a rejected batch should be dropped", err)
+	}
+	if len(e.lines) != 0 {
+		t.Errorf("rejected points kept: %v", e.lines)
+	}
+}
+
+func TestInfluxExporterBufferLimit(t *testing.T) {
+	e, _ := newInfluxExporter("http://influx.lab/write?db=labscan", "")
+	for i := 0; i < influxMaxBuffered+5; i++ {
+		e.add("m v=1")
+	}
+	if len(e.lines) != influxMaxBuffered || e.dropped != 5 {
+		t.Errorf("buffered %d, dropped %d", len(e.lines), e.dropped)
+	}
+}
+
+func TestNewInfluxExporter(t *testing.T) {
+	for _, raw := range []string{"influx.lab:8086", "http://influx.lab:8086", "http://influx.lab/write?precision=s"} {
+		if _, err := newInfluxExporter(raw, ""); err == nil {
+			t.Errorf("newInfluxExporter(%q) accepted", raw)
+		}
+	}
+	if e, err := newInfluxExporter("", ""); e != nil || err != nil {
+		t.Errorf("empty URL = %v, %v", e, err)
+	}
+}
+
+func TestExportProbe(t *testing.T) {
+	e, _ := newInfluxExporter("http://influx.lab/write?db=labscan", "")
+	c := &AgentClient{profile: AgentProfile{AgentID: "a-1"}, host: hostProfile{Hostname: "lab-1"}, influx: e}
+	c.exportProbe(netprobe.Result{
+		Internet:  true,
+		DNS:       true,
+		Latency:   15 * time.Millisecond,
+		Resolvers: []netprobe.ResolverResult{{Resolver: "1.1.1.1", OK: true, Latency: 3 * time.Millisecond}, {Resolver: "9.9.9.9"}},
+		At:        time.UnixMilli(1000),
+	})
+	want := []string{
+		`labscan_probe,agent_id=a-1,hostname=lab-1 dns_ok=true,gateway_reachable=false,internet_reachable=true,latency_ms=15 1000`,
+		`labscan_dns_resolver,agent_id=a-1,hostname=lab-1,resolver=1.1.1.1 latency_ms=3,ok=true 1000`,
+		`labscan_dns_resolver,agent_id=a-1,hostname=lab-1,resolver=9.9.9.9 ok=false 1000`,
+	}
+	if strings.Join(e.lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("points =\n%s\nwant\n%s", strings.Join(e.lines, "\n"), strings.Join(want, "\n"))
+	}
+}
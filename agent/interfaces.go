@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// InterfaceInfo describes one network interface in register, so the admin
+// can tell the lab NIC from container, VPN, and hypervisor adapters.
+type InterfaceInfo struct {
+	Name  string          `json:"name"`
+	MAC   string          `json:"mac,omitempty"`
+	Addrs []InterfaceAddr `json:"addrs"`
+	MTU   int             `json:"mtu"`
+	Up    bool            `json:"up"`
+	// SpeedMbps is the negotiated link speed, 0 when unknown.
+	SpeedMbps int64 `json:"speed_mbps,omitempty"`
+	Wireless  bool  `json:"wireless"`
+	Virtual   bool  `json:"virtual"`
+}
+
+type InterfaceAddr struct {
+	IP        string `json:"ip"`
+	PrefixLen int    `json:"prefix_len"`
+	// Netmask is the dotted form of an IPv4 prefix.
+	Netmask string `json:"netmask,omitempty"`
+}
+
+// localInterfaces lists every non-loopback interface with its addresses.
+func localInterfaces() []InterfaceInfo {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	infos := make([]InterfaceInfo, 0, len(interfaces))
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		info := InterfaceInfo{
+			Name:  iface.Name,
+			MAC:   normalizeMAC(iface.HardwareAddr.String()),
+			Addrs: []InterfaceAddr{},
+			MTU:   iface.MTU,
+			Up:    iface.Flags&net.FlagUp != 0,
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok {
+					info.Addrs = append(info.Addrs, interfaceAddr(ipNet))
+				}
+			}
+		}
+		link := readLinkDetails(iface)
+		info.SpeedMbps, info.Wireless = link.speedMbps, link.wireless
+		info.Virtual = link.virtual || likelyVirtualInterface(iface.Name) || virtualInterfaceName(iface.Name)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func interfaceAddr(ipNet *net.IPNet) InterfaceAddr {
+	ones, _ := ipNet.Mask.Size()
+	addr := InterfaceAddr{IP: ipNet.IP.String(), PrefixLen: ones}
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		addr.IP = ip4.String()
+		mask := net.CIDRMask(ones, 32)
+		addr.Netmask = net.IP(mask).String()
+	}
+	return addr
+}
+
+// linkDetails is what the platform reports about an interface beyond what
+// net.Interface carries.
+type linkDetails struct {
+	speedMbps int64
+	wireless  bool
+	virtual   bool
+}
+
+// virtualInterfaceName catches tunnel, bridge, and container interfaces by
+// the names their drivers give them, on top of likelyVirtualInterface.
+func virtualInterfaceName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, prefix := range []string{"br-", "virbr", "vmnet", "vnet", "tun", "tap", "utun", "wg", "ppp", "ipsec", "awdl", "llw", "bridge", "cni", "flannel", "cali", "kube"} {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeInterfaces is the single adapter a fake agent registers with.
+func fakeInterfaces(spec fakeAgentSpec) []InterfaceInfo {
+	ones := 24
+	if _, subnet, err := net.ParseCIDR(spec.Subnet); err == nil {
+		ones, _ = subnet.Mask.Size()
+	}
+	info := InterfaceInfo{
+		Name:      "eth0",
+		MAC:       normalizeMAC(spec.MAC),
+		Addrs:     []InterfaceAddr{},
+		MTU:       1500,
+		Up:        true,
+		SpeedMbps: 1000,
+	}
+	if spec.Interface == "wifi" {
+		info.Name, info.SpeedMbps, info.Wireless = "wlan0", 300, true
+	}
+	if ip := net.ParseIP(spec.IP); ip != nil {
+		info.Addrs = append(info.Addrs, interfaceAddr(&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}))
+	}
+	if ip := net.ParseIP(spec.IPv6); ip != nil {
+		info.Addrs = append(info.Addrs, interfaceAddr(&net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}))
+	}
+	return []InterfaceInfo{info}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readLinkDetails reads sysfs: speed in Mb/s (-1 or unreadable when the
+// link is down), the wireless directory, and whether the device sits under
+// /sys/devices/virtual rather than on a bus.
+func readLinkDetails(iface net.Interface) linkDetails {
+	dir := filepath.Join("/sys/class/net", iface.Name)
+	var link linkDetails
+	if raw, err := os.ReadFile(filepath.Join(dir, "speed")); err == nil {
+		if speed, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64); err == nil && speed > 0 {
+			link.speedMbps = speed
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wireless")); err == nil {
+		link.wireless = true
+	} else if _, err := os.Stat(filepath.Join(dir, "phy80211")); err == nil {
+		link.wireless = true
+	}
+	if target, err := os.Readlink(dir); err == nil {
+		link.virtual = strings.Contains(target, "/devices/virtual/")
+	}
+	return link
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package main
+
+import "net"
+
+// readLinkDetails has no portable source for link speed or medium here;
+// virtual adapters are still caught by name.
+func readLinkDetails(net.Interface) linkDetails {
+	return linkDetails{}
+}
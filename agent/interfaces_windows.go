@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// MIB_IF_ROW2 InterfaceAndOperStatusFlags bits.
+const (
+	ifFlagHardwareInterface = 0x01
+	ifFlagConnectorPresent  = 0x04
+)
+
+// readLinkDetails asks GetIfEntry2Ex: interfaces without hardware or a
+// physical connector (Hyper-V, VPN, and loopback adapters) are virtual.
+func readLinkDetails(iface net.Interface) linkDetails {
+	row := windows.MibIfRow2{InterfaceIndex: uint32(iface.Index)}
+	if err := windows.GetIfEntry2Ex(windows.MibIfEntryNormal, &row); err != nil {
+		return linkDetails{}
+	}
+	return linkDetails{
+		speedMbps: int64(row.TransmitLinkSpeed / 1_000_000),
+		wireless:  row.Type == windows.IF_TYPE_IEEE80211,
+		virtual:   row.InterfaceAndOperStatusFlags&ifFlagHardwareInterface == 0 || row.InterfaceAndOperStatusFlags&ifFlagConnectorPresent == 0,
+	}
+}
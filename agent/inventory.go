@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sort"
+)
+
+// inventoryOS is the operating system as the platform names it; Build is
+// the Windows or macOS build number, Kernel the kernel release.
+type inventoryOS struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Build   string `json:"build,omitempty"`
+	Kernel  string `json:"kernel,omitempty"`
+}
+
+type inventoryCPU struct {
+	Model string `json:"model,omitempty"`
+	Cores int    `json:"cores"`
+}
+
+// inventoryDisk is a whole disk on Linux, a mounted volume elsewhere.
+type inventoryDisk struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	Mount      string `json:"mount,omitempty"`
+	SizeBytes  uint64 `json:"size_bytes"`
+	Rotational *bool  `json:"rotational,omitempty"`
+}
+
+type inventoryNIC struct {
+	Name   string `json:"name"`
+	MAC    string `json:"mac,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Driver string `json:"driver,omitempty"`
+	MTU    int    `json:"mtu"`
+	Up     bool   `json:"up"`
+}
+
+type inventoryPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// runInventory implements the "inventory" task kind: the machine's
+// hardware and OS, and with packages=true the installed package list from
+// the platform's package manager. A package list that cannot be read is
+// reported in packages_error rather than failing the task.
+func runInventory(params map[string]interface{}) (interface{}, error) {
+	hostname, _ := os.Hostname()
+	result := map[string]interface{}{
+		"hostname": hostname,
+		"arch":     runtime.GOARCH,
+		"os":       readOSRelease(),
+		"cpu":      inventoryCPU{Model: readCPUModel(), Cores: runtime.NumCPU()},
+		"disks":    nonNilSlice(readDisks()),
+		"nics":     inventoryNICs(),
+	}
+	if total, _, err := readMemory(); err == nil {
+		result["memory_mb"] = total >> 20
+	}
+	if want, _ := params["packages"].(bool); want {
+		source, packages, err := listPackages()
+		if err != nil {
+			result["packages_error"] = err.Error()
+		} else {
+			sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+			result["package_source"] = source
+			result["packages"] = nonNilSlice(packages)
+			result["package_count"] = len(packages)
+		}
+	}
+	return result, nil
+}
+
+// inventoryNICs lists every interface with a hardware address, virtual
+// ones included; the model and driver come from the platform.
+func inventoryNICs() []inventoryNIC {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return []inventoryNIC{}
+	}
+	nics := make([]inventoryNIC, 0, len(interfaces))
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		model, driver := readNICModel(iface.Name)
+		nics = append(nics, inventoryNIC{
+			Name:   iface.Name,
+			MAC:    normalizeMAC(iface.HardwareAddr.String()),
+			Model:  model,
+			Driver: driver,
+			MTU:    iface.MTU,
+			Up:     iface.Flags&net.FlagUp != 0,
+		})
+	}
+	return nics
+}
+
+func nonNilSlice[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func readCPUModel() string {
+	model, _ := unix.Sysctl("machdep.cpu.brand_string")
+	return model
+}
+
+func readOSRelease() inventoryOS {
+	info := inventoryOS{Name: "macOS"}
+	info.Version, _ = unix.Sysctl("kern.osproductversion")
+	info.Build, _ = unix.Sysctl("kern.osversion")
+	info.Kernel, _ = unix.Sysctl("kern.osrelease")
+	return info
+}
+
+// readDisks lists the local mounted volumes, since whole-disk sizes need
+// IOKit.
+func readDisks() []inventoryDisk {
+	count, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil || count == 0 {
+		return nil
+	}
+	mounts := make([]unix.Statfs_t, count)
+	if count, err = unix.Getfsstat(mounts, unix.MNT_NOWAIT); err != nil {
+		return nil
+	}
+	disks := make([]inventoryDisk, 0, count)
+	for _, mount := range mounts[:count] {
+		fsType := unix.ByteSliceToString(mount.Fstypename[:])
+		if mount.Flags&unix.MNT_LOCAL == 0 || fsType == "devfs" || fsType == "autofs" {
+			continue
+		}
+		mountPoint := unix.ByteSliceToString(mount.Mntonname[:])
+		if strings.HasPrefix(mountPoint, "/System/Volumes/") {
+			continue
+		}
+		disks = append(disks, inventoryDisk{
+			Name:      unix.ByteSliceToString(mount.Mntfromname[:]),
+			Mount:     mountPoint,
+			SizeBytes: mount.Blocks * uint64(mount.Bsize),
+		})
+	}
+	return disks
+}
+
+func readNICModel(string) (model, driver string) {
+	return "", ""
+}
+
+// listPackages reports installer receipts from pkgutil, which carry no
+// version in the listing.
+func listPackages() (string, []inventoryPackage, error) {
+	out, err := sandboxedOutput("pkgutil", "--pkgs")
+	if err != nil {
+		return "pkgutil", nil, err
+	}
+	var packages []inventoryPackage
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			packages = append(packages, inventoryPackage{Name: name})
+		}
+	}
+	return "pkgutil", packages, nil
+}
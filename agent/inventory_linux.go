@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readCPUModel takes the first "model name" from /proc/cpuinfo; ARM boards
+// that have none name the SoC under "Hardware" or "Model".
+func readCPUModel() string {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	fallback := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "model name":
+			return strings.TrimSpace(value)
+		case "Hardware", "Model":
+			fallback = strings.TrimSpace(value)
+		}
+	}
+	return fallback
+}
+
+func readOSRelease() inventoryOS {
+	info := inventoryOS{Name: "linux"}
+	if data, err := os.ReadFile("/etc/os-release"); err == nil {
+		fields := make(map[string]string)
+		for _, line := range strings.Split(string(data), "\n") {
+			if key, value, ok := strings.Cut(line, "="); ok {
+				fields[key] = strings.Trim(value, `"'`)
+			}
+		}
+		info.Name = firstNonEmpty(fields["PRETTY_NAME"], fields["NAME"], info.Name)
+		info.Version = fields["VERSION_ID"]
+		info.Build = fields["BUILD_ID"]
+	}
+	var uname unix.Utsname
+	if unix.Uname(&uname) == nil {
+		info.Kernel = unix.ByteSliceToString(uname.Release[:])
+	}
+	return info
+}
+
+// readDisks lists the block devices in /sys/block, leaving out loop, RAM,
+// optical, and device-mapper devices.
+func readDisks() []inventoryDisk {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil
+	}
+	disks := make([]inventoryDisk, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") ||
+			strings.HasPrefix(name, "sr") || strings.HasPrefix(name, "dm-") {
+			continue
+		}
+		dir := filepath.Join("/sys/block", name)
+		sectors, err := strconv.ParseUint(readSysfs(dir, "size"), 10, 64)
+		if err != nil || sectors == 0 {
+			continue
+		}
+		disk := inventoryDisk{Name: name, Model: readSysfs(dir, "device/model"), SizeBytes: sectors * 512}
+		if rotational := readSysfs(dir, "queue/rotational"); rotational != "" {
+			spinning := rotational == "1"
+			disk.Rotational = &spinning
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+// readNICModel reports the PCI or USB vendor:device ID as the model, since
+// names need the pci.ids database, and the bound driver.
+func readNICModel(name string) (model, driver string) {
+	dir := filepath.Join("/sys/class/net", name, "device")
+	if target, err := os.Readlink(filepath.Join(dir, "driver")); err == nil {
+		driver = filepath.Base(target)
+	}
+	vendor, device := readSysfs(dir, "vendor"), readSysfs(dir, "device")
+	if vendor != "" && device != "" {
+		model = strings.TrimPrefix(vendor, "0x") + ":" + strings.TrimPrefix(device, "0x")
+	}
+	if model == "" {
+		for _, line := range strings.Split(readSysfs(dir, "uevent"), "\n") {
+			if value, ok := strings.CutPrefix(line, "PRODUCT="); ok {
+				model = value
+			}
+		}
+	}
+	return model, driver
+}
+
+func readSysfs(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// listPackages asks the first package manager found: dpkg, rpm, apk, or
+// pacman.
+func listPackages() (string, []inventoryPackage, error) {
+	managers := []struct {
+		source string
+		args   []string
+	}{
+		{"dpkg", []string{"dpkg-query", "-W", "-f", "${Package}\t${Version}\n"}},
+		{"rpm", []string{"rpm", "-qa", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\n"}},
+		{"apk", []string{"apk", "list", "--installed"}},
+		{"pacman", []string{"pacman", "-Q"}},
+	}
+	for _, manager := range managers {
+		if _, err := exec.LookPath(manager.args[0]); err != nil {
+			continue
+		}
+		out, err := sandboxedOutput(manager.args[0], manager.args[1:]...)
+		if err != nil {
+			return manager.source, nil, err
+		}
+		return manager.source, parsePackageLines(manager.source, string(out)), nil
+	}
+	return "", nil, errors.New("no supported package manager found")
+}
+
+func parsePackageLines(source, out string) []inventoryPackage {
+	var packages []inventoryPackage
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var name, version string
+		switch source {
+		case "apk":
+			// "musl-1.2.4-r2 x86_64 {musl} (MIT) [installed]": the version
+			// starts at the second-to-last dash of the first field.
+			fields := strings.Fields(line)
+			parts := strings.Split(fields[0], "-")
+			if len(parts) < 3 {
+				continue
+			}
+			name, version = strings.Join(parts[:len(parts)-2], "-"), strings.Join(parts[len(parts)-2:], "-")
+		case "pacman":
+			name, version, _ = strings.Cut(line, " ")
+		default:
+			name, version, _ = strings.Cut(line, "\t")
+		}
+		packages = append(packages, inventoryPackage{Name: name, Version: version})
+	}
+	return packages
+}
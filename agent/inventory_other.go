@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "runtime"
+
+func readCPUModel() string { return "" }
+
+func readOSRelease() inventoryOS { return inventoryOS{Name: runtime.GOOS} }
+
+func readDisks() []inventoryDisk { return nil }
+
+func readNICModel(string) (model, driver string) { return "", "" }
+
+func listPackages() (string, []inventoryPackage, error) { return "", nil, errSysinfoUnsupported }
@@ -0,0 +1,132 @@
+//go:build windows
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+func readCPUModel() string {
+	return readRegistryString(`HARDWARE\DESCRIPTION\System\CentralProcessor\0`, "ProcessorNameString")
+}
+
+// readOSRelease reads the CurrentVersion key; the build includes the update
+// revision, as winver shows it.
+func readOSRelease() inventoryOS {
+	const path = `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	info := inventoryOS{
+		Name:    firstNonEmpty(readRegistryString(path, "ProductName"), "Windows"),
+		Version: firstNonEmpty(readRegistryString(path, "DisplayVersion"), readRegistryString(path, "ReleaseId")),
+		Build:   readRegistryString(path, "CurrentBuild"),
+	}
+	if key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE); err == nil {
+		if ubr, _, err := key.GetIntegerValue("UBR"); err == nil && info.Build != "" {
+			info.Build += "." + strconv.FormatUint(ubr, 10)
+		}
+		key.Close()
+	}
+	major, minor, build := windows.RtlGetNtVersionNumbers()
+	info.Kernel = strconv.Itoa(int(major)) + "." + strconv.Itoa(int(minor)) + "." + strconv.Itoa(int(build))
+	return info
+}
+
+// readDisks lists the fixed drive letters.
+func readDisks() []inventoryDisk {
+	buf := make([]uint16, 256)
+	n, err := windows.GetLogicalDriveStrings(uint32(len(buf)), &buf[0])
+	if err != nil || int(n) > len(buf) {
+		return nil
+	}
+	var disks []inventoryDisk
+	for _, root := range strings.Split(windows.UTF16ToString(buf[:n]), "\x00") {
+		if root == "" {
+			continue
+		}
+		name, err := windows.UTF16PtrFromString(root)
+		if err != nil || windows.GetDriveType(name) != windows.DRIVE_FIXED {
+			continue
+		}
+		if _, total, err := readDiskFree(root); err == nil {
+			disks = append(disks, inventoryDisk{Name: strings.TrimSuffix(root, `\`), Mount: root, SizeBytes: total})
+		}
+	}
+	return disks
+}
+
+// readNICModel returns the adapter description, which Windows fills in from
+// the driver, keyed by the friendly name net.Interfaces uses.
+func readNICModel(name string) (model, driver string) {
+	size := uint32(16 << 10)
+	for range 3 {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_SKIP_ANYCAST|windows.GAA_FLAG_SKIP_MULTICAST|windows.GAA_FLAG_SKIP_DNS_SERVER, 0, first, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue
+		}
+		if err != nil {
+			return "", ""
+		}
+		for adapter := first; adapter != nil; adapter = adapter.Next {
+			if windows.UTF16PtrToString(adapter.FriendlyName) == name {
+				return windows.UTF16PtrToString(adapter.Description), ""
+			}
+		}
+		return "", ""
+	}
+	return "", ""
+}
+
+// listPackages reads the Uninstall keys, both native and 32-bit, which is
+// what Apps & features lists.
+func listPackages() (string, []inventoryPackage, error) {
+	roots := []string{
+		`SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`,
+		`SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+	}
+	seen := make(map[string]bool)
+	var packages []inventoryPackage
+	var firstErr error
+	for _, root := range roots {
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, root, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		names, _ := key.ReadSubKeyNames(-1)
+		key.Close()
+		for _, sub := range names {
+			name := readRegistryString(root+`\`+sub, "DisplayName")
+			version := readRegistryString(root+`\`+sub, "DisplayVersion")
+			if name == "" || seen[name+"\x00"+version] {
+				continue
+			}
+			seen[name+"\x00"+version] = true
+			packages = append(packages, inventoryPackage{Name: name, Version: version})
+		}
+	}
+	if packages == nil && firstErr != nil {
+		return "registry", nil, firstErr
+	}
+	return "registry", packages, nil
+}
+
+func readRegistryString(path, name string) string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+	value, _, err := key.GetStringValue(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
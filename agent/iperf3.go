@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// iperf3 control-channel states, as defined in iperf_api.h.
+const (
+	iperfTestStart       = 1
+	iperfTestRunning     = 2
+	iperfTestEnd         = 4
+	iperfParamExchange   = 9
+	iperfCreateStreams   = 10
+	iperfServerTerminate = 11
+	iperfClientTerminate = 12
+	iperfExchangeResults = 13
+	iperfDisplayResults  = 14
+	iperfDone            = 16
+	iperfAccessDenied    = -1
+	iperfServerError     = -2
+)
+
+const (
+	iperfDefaultPort  = 5201
+	iperfCookieSize   = 37
+	iperfBlockSize    = 128 * 1024
+	iperfMaxParallel  = 8
+	iperfMaxJSONBytes = 1 << 20
+)
+
+type iperfParams struct {
+	TCP           bool   `json:"tcp"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Len           int    `json:"len"`
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+type iperfStreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int64   `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int64   `json:"errors"`
+	Packets     int64   `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+type iperfResults struct {
+	CPUUtilTotal         float64             `json:"cpu_util_total"`
+	CPUUtilUser          float64             `json:"cpu_util_user"`
+	CPUUtilSystem        float64             `json:"cpu_util_system"`
+	SenderHasRetransmits int                 `json:"sender_has_retransmits"`
+	Streams              []iperfStreamResult `json:"streams"`
+}
+
+type iperfStream struct {
+	conn  net.Conn
+	bytes int64
+}
+
+func runIperf3(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	role := asString(params["role"], "client")
+	port := asInt(params["port"], iperfDefaultPort)
+	duration := asInt(params["duration_s"], 10)
+	if duration < 1 {
+		duration = 1
+	}
+	if duration > throughputMaxDuration {
+		duration = throughputMaxDuration
+	}
+
+	switch role {
+	case "server":
+		acceptTimeout := asInt(params["accept_timeout_ms"], 15000)
+		return runIperf3Server(env.context(), port, time.Duration(acceptTimeout)*time.Millisecond)
+	case "client":
+		target := asString(params["target"], "")
+		if target == "" {
+			return nil, errors.New("iperf3 client requires target")
+		}
+		parallel := asInt(params["parallel"], 1)
+		if parallel < 1 {
+			parallel = 1
+		}
+		if parallel > iperfMaxParallel {
+			parallel = iperfMaxParallel
+		}
+		reverse, _ := params["reverse"].(bool)
+		return runIperf3Client(env.context(), target, port, duration, parallel, reverse)
+	default:
+		return nil, fmt.Errorf("unsupported iperf3 role: %s", role)
+	}
+}
+
+func runIperf3Client(ctx context.Context, target string, port, duration, parallel int, reverse bool) (interface{}, error) {
+	addr := net.JoinHostPort(target, strconv.Itoa(port))
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	control, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("iperf3 control dial failed: %w", err)
+	}
+	defer control.Close()
+	stopControl := context.AfterFunc(ctx, func() { _ = control.Close() })
+	defer stopControl()
+	_ = control.SetDeadline(time.Now().Add(time.Duration(duration)*time.Second + 30*time.Second))
+
+	cookie := newIperfCookie()
+	if _, err := control.Write(cookie); err != nil {
+		return nil, err
+	}
+	if err := expectIperfState(control, iperfParamExchange); err != nil {
+		return nil, err
+	}
+	if err := writeIperfJSON(control, iperfParams{
+		TCP:           true,
+		Time:          duration,
+		Parallel:      parallel,
+		Reverse:       reverse,
+		Len:           iperfBlockSize,
+		ClientVersion: "labscan-" + agentVersion,
+	}); err != nil {
+		return nil, err
+	}
+	if err := expectIperfState(control, iperfCreateStreams); err != nil {
+		return nil, err
+	}
+
+	streams := make([]*iperfStream, 0, parallel)
+	defer func() {
+		for _, s := range streams {
+			_ = s.conn.Close()
+		}
+	}()
+	for i := 0; i < parallel; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("iperf3 stream dial failed: %w", err)
+		}
+		streams = append(streams, &iperfStream{conn: conn})
+		if _, err := conn.Write(cookie); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := expectIperfState(control, iperfTestStart); err != nil {
+		return nil, err
+	}
+	if err := expectIperfState(control, iperfTestRunning); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(duration) * time.Second)
+	if reverse {
+		runIperfReceiversUntil(streams, deadline, nil)
+	} else {
+		runIperfSendersUntil(streams, deadline, nil)
+	}
+	elapsed := time.Since(start)
+
+	if err := writeIperfState(control, iperfTestEnd); err != nil {
+		return nil, err
+	}
+	if err := expectIperfState(control, iperfExchangeResults); err != nil {
+		return nil, err
+	}
+	local := buildIperfResults(streams, elapsed, !reverse)
+	if err := writeIperfJSON(control, local); err != nil {
+		return nil, err
+	}
+	var remote iperfResults
+	if err := readIperfJSON(control, &remote); err != nil {
+		return nil, err
+	}
+	if err := expectIperfState(control, iperfDisplayResults); err != nil {
+		return nil, err
+	}
+	_ = writeIperfState(control, iperfDone)
+
+	sent, received := local, remote
+	if reverse {
+		sent, received = remote, local
+	}
+	return map[string]interface{}{
+		"role":        "client",
+		"target":      target,
+		"port":        port,
+		"reverse":     reverse,
+		"parallel":    parallel,
+		"duration_s":  elapsed.Seconds(),
+		"sent_bytes":  sumIperfBytes(sent),
+		"recv_bytes":  sumIperfBytes(received),
+		"mbps":        mbps(sumIperfBytes(received), elapsed),
+		"retransmits": sumIperfRetransmits(sent),
+	}, nil
+}
+
+func runIperf3Server(ctx context.Context, port int, acceptTimeout time.Duration) (interface{}, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("iperf3 listener failed: %w", err)
+	}
+	defer listener.Close()
+	stopListener := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stopListener()
+	tcpListener, _ := listener.(*net.TCPListener)
+	if tcpListener != nil {
+		_ = tcpListener.SetDeadline(time.Now().Add(acceptTimeout))
+	}
+
+	control, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("no iperf3 client connected: %w", err)
+	}
+	defer control.Close()
+	stopControl := context.AfterFunc(ctx, func() { _ = control.Close() })
+	defer stopControl()
+	_ = control.SetDeadline(time.Now().Add(acceptTimeout))
+
+	cookie := make([]byte, iperfCookieSize)
+	if _, err := io.ReadFull(control, cookie); err != nil {
+		return nil, err
+	}
+	if err := writeIperfState(control, iperfParamExchange); err != nil {
+		return nil, err
+	}
+	var testParams iperfParams
+	if err := readIperfJSON(control, &testParams); err != nil {
+		return nil, err
+	}
+	if !testParams.TCP {
+		_ = writeIperfState(control, iperfServerError)
+		return nil, errors.New("iperf3 server supports TCP tests only")
+	}
+	if testParams.Parallel < 1 {
+		testParams.Parallel = 1
+	}
+	if testParams.Parallel > iperfMaxParallel || testParams.Time > throughputMaxDuration {
+		_ = writeIperfState(control, iperfAccessDenied)
+		return nil, errors.New("iperf3 test parameters exceed agent limits")
+	}
+	if err := writeIperfState(control, iperfCreateStreams); err != nil {
+		return nil, err
+	}
+
+	streams := make([]*iperfStream, 0, testParams.Parallel)
+	defer func() {
+		for _, s := range streams {
+			_ = s.conn.Close()
+		}
+	}()
+	for len(streams) < testParams.Parallel {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("iperf3 stream accept failed: %w", err)
+		}
+		streamCookie := make([]byte, iperfCookieSize)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, streamCookie); err != nil || string(streamCookie) != string(cookie) {
+			_ = conn.Close()
+			continue
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		streams = append(streams, &iperfStream{conn: conn})
+	}
+
+	_ = control.SetDeadline(time.Now().Add(time.Duration(testParams.Time)*time.Second + 30*time.Second))
+	if err := writeIperfState(control, iperfTestStart); err != nil {
+		return nil, err
+	}
+	if err := writeIperfState(control, iperfTestRunning); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	testEnded := make(chan error, 1)
+	go func() {
+		testEnded <- expectIperfState(control, iperfTestEnd)
+	}()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		farDeadline := start.Add(time.Duration(testParams.Time)*time.Second + 10*time.Second)
+		if testParams.Reverse {
+			runIperfSendersUntil(streams, farDeadline, done)
+		} else {
+			runIperfReceiversUntil(streams, farDeadline, done)
+		}
+	}()
+	endErr := <-testEnded
+	close(done)
+	for _, s := range streams {
+		_ = s.conn.SetDeadline(time.Now())
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if endErr != nil {
+		return nil, endErr
+	}
+
+	if err := writeIperfState(control, iperfExchangeResults); err != nil {
+		return nil, err
+	}
+	var remote iperfResults
+	if err := readIperfJSON(control, &remote); err != nil {
+		return nil, err
+	}
+	local := buildIperfResults(streams, elapsed, testParams.Reverse)
+	if err := writeIperfJSON(control, local); err != nil {
+		return nil, err
+	}
+	if err := writeIperfState(control, iperfDisplayResults); err != nil {
+		return nil, err
+	}
+	_ = expectIperfState(control, iperfDone)
+
+	sent, received := remote, local
+	if testParams.Reverse {
+		sent, received = local, remote
+	}
+	return map[string]interface{}{
+		"role":        "server",
+		"port":        port,
+		"peer":        control.RemoteAddr().String(),
+		"reverse":     testParams.Reverse,
+		"parallel":    testParams.Parallel,
+		"duration_s":  elapsed.Seconds(),
+		"sent_bytes":  sumIperfBytes(sent),
+		"recv_bytes":  sumIperfBytes(received),
+		"mbps":        mbps(sumIperfBytes(received), elapsed),
+		"retransmits": sumIperfRetransmits(sent),
+	}, nil
+}
+
+func runIperfSendersUntil(streams []*iperfStream, deadline time.Time, done <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *iperfStream) {
+			defer wg.Done()
+			block := make([]byte, iperfBlockSize)
+			_ = s.conn.SetWriteDeadline(deadline.Add(5 * time.Second))
+			for time.Now().Before(deadline) && !isClosed(done) {
+				n, err := s.conn.Write(block)
+				atomic.AddInt64(&s.bytes, int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func runIperfReceiversUntil(streams []*iperfStream, deadline time.Time, done <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *iperfStream) {
+			defer wg.Done()
+			block := make([]byte, iperfBlockSize)
+			_ = s.conn.SetReadDeadline(deadline)
+			for !isClosed(done) {
+				n, err := s.conn.Read(block)
+				atomic.AddInt64(&s.bytes, int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func buildIperfResults(streams []*iperfStream, elapsed time.Duration, sender bool) iperfResults {
+	results := iperfResults{Streams: make([]iperfStreamResult, 0, len(streams))}
+	if sender {
+		results.SenderHasRetransmits = -1
+	}
+	for i, s := range streams {
+		stream := iperfStreamResult{
+			ID:        i + 1,
+			Bytes:     atomic.LoadInt64(&s.bytes),
+			EndTime:   elapsed.Seconds(),
+			StartTime: 0,
+		}
+		if sender {
+			if retransmits, ok := tcpRetransmits(s.conn); ok {
+				stream.Retransmits = int64(retransmits)
+				results.SenderHasRetransmits = 1
+			}
+		}
+		results.Streams = append(results.Streams, stream)
+	}
+	return results
+}
+
+func sumIperfBytes(results iperfResults) int64 {
+	var total int64
+	for _, s := range results.Streams {
+		total += s.Bytes
+	}
+	return total
+}
+
+func sumIperfRetransmits(results iperfResults) interface{} {
+	if results.SenderHasRetransmits != 1 {
+		return nil
+	}
+	var total int64
+	for _, s := range results.Streams {
+		total += s.Retransmits
+	}
+	return total
+}
+
+func newIperfCookie() []byte {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	cookie := make([]byte, iperfCookieSize)
+	_, _ = rand.Read(cookie)
+	for i := 0; i < iperfCookieSize-1; i++ {
+		cookie[i] = alphabet[int(cookie[i])%len(alphabet)]
+	}
+	cookie[iperfCookieSize-1] = 0
+	return cookie
+}
+
+func writeIperfState(conn net.Conn, state int8) error {
+	_, err := conn.Write([]byte{byte(state)})
+	return err
+}
+
+func expectIperfState(conn net.Conn, want int8) error {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("iperf3 control read failed: %w", err)
+	}
+	got := int8(buf[0])
+	switch {
+	case got == want:
+		return nil
+	case got == iperfAccessDenied:
+		return errors.New("iperf3 peer denied access (busy or limits exceeded)")
+	case got == iperfServerError:
+		return errors.New("iperf3 peer reported a server error")
+	case got == iperfServerTerminate || got == iperfClientTerminate:
+		return errors.New("iperf3 peer terminated the test")
+	default:
+		return fmt.Errorf("iperf3 unexpected state %d, want %d", got, want)
+	}
+}
+
+func writeIperfJSON(conn net.Conn, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(raw))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(raw)))
+	copy(frame[4:], raw)
+	_, err = conn.Write(frame)
+	return err
+}
+
+func readIperfJSON(conn net.Conn, v interface{}) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("iperf3 json read failed: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > iperfMaxJSONBytes {
+		return fmt.Errorf("iperf3 json frame too large: %d bytes", size)
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return fmt.Errorf("iperf3 json read failed: %w", err)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func isClosed(done <-chan struct{}) bool {
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"golang.org/x/net/ipv6"
+)
+
+// provisionMulticastGroup is the link-local group the agent joins so an
+// admin on an IPv6-only or dual-stack segment can provision it without a
+// broadcast address.
+const provisionMulticastGroup = "ff02::4c53"
+
+// localIPv6s lists global and unique local IPv6 addresses. Link-local
+// addresses are left out: they are only meaningful with a zone.
+func localIPv6s() []string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			netAddr, ok := addr.(*net.IPNet)
+			if !ok || netAddr.IP.To4() != nil || !netAddr.IP.IsGlobalUnicast() {
+				continue
+			}
+			ips = append(ips, netAddr.IP.String())
+		}
+	}
+	return ips
+}
+
+// listenProvisionIPv6 listens on the provisioning port over IPv6 and joins
+// provisionMulticastGroup on every multicast-capable interface.
+func listenProvisionIPv6() (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", provisionUDPPort))
+	if err != nil {
+		return nil, err
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return conn, nil
+	}
+	group := &net.UDPAddr{IP: net.ParseIP(provisionMulticastGroup)}
+	packetConn := ipv6.NewPacketConn(conn)
+	for i := range interfaces {
+		iface := interfaces[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if err := packetConn.JoinGroup(&iface, group); err != nil {
+			slog.Debug("could not join provisioning group", "interface", iface.Name, "err", err)
+		}
+	}
+	return conn, nil
+}
+
+// adminAddrFor adds the sender's zone to a link-local admin address, which
+// cannot be dialed without one.
+func adminAddrFor(adminIP string, sender *net.UDPAddr) string {
+	ip := net.ParseIP(adminIP)
+	if ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast() && sender.Zone != "" {
+		return adminIP + "%" + sender.Zone
+	}
+	return adminIP
+}
+
+// unbracket accepts "[2001:db8::1]" as a target and returns the bare
+// address net.JoinHostPort expects.
+func unbracket(host string) string {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	pingInterval = 20 * time.Second
+	pongWait     = 60 * time.Second
+)
+
+// armKeepalive sets the read deadline that bounds how long a silent link
+// can pass for a live one. Pongs and pings from the admin push it out, as
+// does every message readLoop receives. It must run before the first read.
+func armKeepalive(conn *websocket.Conn) {
+	if pingInterval <= 0 {
+		return
+	}
+	extend := func() error { return conn.SetReadDeadline(time.Now().Add(pongWait)) }
+	_ = extend()
+	conn.SetPongHandler(func(string) error { return extend() })
+	replyPing := conn.PingHandler()
+	conn.SetPingHandler(func(data string) error {
+		_ = extend()
+		return replyPing(data)
+	})
+}
+
+func extendReadDeadline(conn sessionConn) {
+	if ws, ok := conn.(*websocket.Conn); ok && pingInterval > 0 {
+		_ = ws.SetReadDeadline(time.Now().Add(pongWait))
+	}
+}
+
+// pingLoop sends a control ping every pingInterval. WriteControl may run
+// alongside the send queue's writes, so pings do not wait behind results.
+func (c *AgentClient) pingLoop(ctx context.Context, conn *websocket.Conn) {
+	if pingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				c.logger().Warn("ping failed", "err", err)
+				_ = conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func keepaliveError(err error) error {
+	var netErr net.Error
+	if pingInterval > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("nothing heard from admin for %s: %w", pongWait, err)
+	}
+	return err
+}
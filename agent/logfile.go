@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	logFilePath  = ""
+	logMaxSizeMB = 10
+	logKeepFiles = 5
+	logConsole   = true
+	logFile      *rotatingFile
+)
+
+// rotatingFile is an append-only log file that rolls over to .1 … .keep once
+// it would grow past maxBytes, deleting the oldest.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, keep int) (*rotatingFile, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	r := &rotatingFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := r.openLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		if err := r.openLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		// Rotation failures cannot be logged through the logger writing
+		// here, so they go straight to stderr.
+		if err := r.rotateLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *rotatingFile) openLocked() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// rotateLocked closes the active file before renaming it, since Windows
+// cannot rename a file that is still open.
+func (r *rotatingFile) rotateLocked() error {
+	_ = r.file.Close()
+	r.file = nil
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	var renameErr error
+	if r.keep > 0 {
+		renameErr = os.Rename(r.path, r.path+".1")
+	} else {
+		renameErr = os.Truncate(r.path, 0)
+	}
+	if err := r.openLocked(); err != nil {
+		return err
+	}
+	return renameErr
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	logLevel  = "info"
+	logFormat = "text"
+)
+
+// logOutput is where every log line ends up. It can be swapped after the
+// handler is built, e.g. when a Windows service has no console.
+var logOutput = &switchWriter{w: os.Stderr}
+
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *switchWriter) set(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w = w
+}
+
+// setupLogging installs the slog default handler from -log-level and
+// -log-format, writing to stderr and, with -log-file, a rotating file. The
+// standard log package is routed through it too.
+func setupLogging() error {
+	if logFilePath != "" {
+		if logMaxSizeMB < 1 || logKeepFiles < 0 {
+			return fmt.Errorf("-log-max-size-mb must be at least 1 and -log-keep at least 0")
+		}
+		file, err := openRotatingFile(logFilePath, int64(logMaxSizeMB)<<20, logKeepFiles)
+		if err != nil {
+			return fmt.Errorf("-log-file: %w", err)
+		}
+		logFile = file
+		if logConsole {
+			logOutput.set(io.MultiWriter(os.Stderr, file))
+		} else {
+			logOutput.set(file)
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("-log-level %q: want debug, info, warn, or error", logLevel)
+	}
+	if err := shipLevel.UnmarshalText([]byte(shipLogLevel)); err != nil {
+		return fmt.Errorf("-ship-logs-level %q: want debug, info, warn, or error", shipLogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(logFormat) {
+	case "text":
+		handler = slog.NewTextHandler(logOutput, opts)
+	case "json":
+		handler = slog.NewJSONHandler(logOutput, opts)
+	default:
+		return fmt.Errorf("-log-format %q: want text or json", logFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	logShipInterval = 2 * time.Second
+	logShipBatch    = 20 // records per interval; the rest are counted as dropped
+	logShipBuffer   = 200
+)
+
+var (
+	shipLogs     = false
+	shipLogLevel = "warn"
+	shipLevel    = slog.LevelWarn
+)
+
+type LogRecord struct {
+	TS    int64             `json:"ts"`
+	Level string            `json:"level"`
+	Msg   string            `json:"msg"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+type LogPayload struct {
+	Records []LogRecord `json:"records"`
+	Dropped int         `json:"dropped,omitempty"`
+}
+
+// logShipper buffers a client's log records at or above its level until
+// the next flush. Records logged while disconnected wait for the next
+// session, so dial failures reach the admin once the agent is back.
+type logShipper struct {
+	mu      sync.Mutex
+	level   slog.Level
+	records []LogRecord
+	dropped int
+}
+
+func (s *logShipper) add(record LogRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) >= logShipBuffer {
+		s.records = s.records[1:]
+		s.dropped++
+	}
+	s.records = append(s.records, record)
+}
+
+// take returns up to logShipBatch records. Whatever is left over is dropped,
+// so a log storm costs the link at most one batch per interval.
+func (s *logShipper) take() LogPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload := LogPayload{Records: s.records, Dropped: s.dropped}
+	if len(payload.Records) > logShipBatch {
+		payload.Dropped += len(payload.Records) - logShipBatch
+		payload.Records = payload.Records[len(payload.Records)-logShipBatch:]
+	}
+	s.records, s.dropped = nil, 0
+	return payload
+}
+
+func (c *AgentClient) logShipLoop(ctx context.Context) {
+	if c.shipper == nil {
+		return
+	}
+	ticker := time.NewTicker(logShipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if payload := c.shipper.take(); len(payload.Records) > 0 || payload.Dropped > 0 {
+				_ = c.send("log", payload)
+			}
+		}
+	}
+}
+
+// shipHandler passes records to the wrapped handler and copies those at or
+// above the shipper's level into it.
+type shipHandler struct {
+	slog.Handler
+	ship  *logShipper
+	attrs []slog.Attr
+}
+
+func (h *shipHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.ship.level || h.Handler.Enabled(ctx, level)
+}
+
+func (h *shipHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.ship.level {
+		record := LogRecord{TS: r.Time.UnixMilli(), Level: r.Level.String(), Msg: r.Message, Attrs: make(map[string]string)}
+		for _, a := range h.attrs {
+			record.Attrs[a.Key] = a.Value.String()
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			record.Attrs[a.Key] = a.Value.String()
+			return true
+		})
+		h.ship.add(record)
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *shipHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &shipHandler{Handler: h.Handler.WithAttrs(attrs), ship: h.ship, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h *shipHandler) WithGroup(name string) slog.Handler {
+	return &shipHandler{Handler: h.Handler.WithGroup(name), ship: h.ship, attrs: h.attrs}
+}
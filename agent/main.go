@@ -3,15 +3,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -25,20 +28,47 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
 )
 
-const (
-	provisionUDPPort = 8870
-	wsPort           = 8148
-	configPath       = "agent_config.json"
-	agentVersion     = "0.3.0"
-	fakeAgentCount   = 4
-)
+const fakeAgentCount = 4
+
+var configPath = "agent_config.json"
 
 type PersistedConfig struct {
-	AdminIP       string `json:"admin_ip"`
-	Secret        string `json:"secret"`
-	ProvisionedAt int64  `json:"provisioned_at"`
+	AdminIP        string   `json:"admin_ip"`
+	Secret         string   `json:"secret,omitempty"`
+	SecretStore    string   `json:"secret_store,omitempty"`
+	SecretEnc      string   `json:"secret_enc,omitempty"`
+	AdminPublicKey string   `json:"admin_public_key,omitempty"`
+	TLS            bool     `json:"tls,omitempty"`
+	TLSCAPEM       string   `json:"tls_ca_pem,omitempty"`
+	TLSCertSHA256  string   `json:"tls_cert_sha256,omitempty"`
+	TLSClientCSR   bool     `json:"tls_client_csr,omitempty"`
+	TLSClientCert  string   `json:"tls_client_cert_pem,omitempty"`
+	TLSClientKey   string   `json:"tls_client_key_pem,omitempty"`
+	ScanAllow      []string `json:"scan_allow,omitempty"`
+	DenyKinds      []string `json:"deny_kinds,omitempty"`
+	ChallengeAuth  bool     `json:"challenge_auth,omitempty"`
+	// Transport is "mqtt" or "nats" to reach the admin through MQTTBroker
+	// or NATSURL rather than its websocket; see transport.go.
+	Transport  string `json:"transport,omitempty"`
+	MQTTBroker string `json:"mqtt_broker,omitempty"`
+	MQTTPrefix string `json:"mqtt_prefix,omitempty"`
+	NATSURL    string `json:"nats_url,omitempty"`
+	NATSPrefix string `json:"nats_prefix,omitempty"`
+	// Tuning is the last config_update the admin sent.
+	Tuning        *ConfigUpdatePayload `json:"tuning,omitempty"`
+	ProvisionedAt int64                `json:"provisioned_at"`
+
+	// Tags are the ones set by the tags task.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// TLSClientKeyEnc is the sealed TLSClientKey, kept like SecretEnc.
+	TLSClientKeyEnc string `json:"tls_client_key_enc,omitempty"`
+
+	// Settings holds flag values set by the operator; see applyFileSettings.
+	Settings map[string]json.RawMessage `json:"settings,omitempty"`
 }
 
 type AgentIdentity struct {
@@ -48,11 +78,27 @@ type AgentIdentity struct {
 }
 
 type ProvisionMessage struct {
-	Type    string `json:"type"`
-	V       int    `json:"v"`
-	AdminIP string `json:"admin_ip"`
-	Secret  string `json:"secret"`
-	Nonce   string `json:"nonce"`
+	Type           string   `json:"type"`
+	V              int      `json:"v"`
+	AdminIP        string   `json:"admin_ip"`
+	Secret         string   `json:"secret"`
+	Nonce          string   `json:"nonce"`
+	TS             int64    `json:"ts,omitempty"`
+	AdminPublicKey string   `json:"admin_public_key,omitempty"`
+	TLS            bool     `json:"tls,omitempty"`
+	TLSCAPEM       string   `json:"tls_ca_pem,omitempty"`
+	TLSCertSHA256  string   `json:"tls_cert_sha256,omitempty"`
+	TLSClientCSR   bool     `json:"tls_client_csr,omitempty"`
+	TLSClientCert  string   `json:"tls_client_cert_pem,omitempty"`
+	TLSClientKey   string   `json:"tls_client_key_pem,omitempty"`
+	ScanAllow      []string `json:"scan_allow,omitempty"`
+	DenyKinds      []string `json:"deny_kinds,omitempty"`
+	Transport      string   `json:"transport,omitempty"`
+	MQTTBroker     string   `json:"mqtt_broker,omitempty"`
+	MQTTPrefix     string   `json:"mqtt_prefix,omitempty"`
+	NATSURL        string   `json:"nats_url,omitempty"`
+	NATSPrefix     string   `json:"nats_prefix,omitempty"`
+	Signature      string   `json:"sig,omitempty"`
 }
 
 type ProvisionAck struct {
@@ -65,31 +111,58 @@ type ProvisionAck struct {
 }
 
 type WireMessage struct {
-	Type    string      `json:"type"`
-	TS      int64       `json:"ts"`
-	AgentID string      `json:"agent_id"`
-	Payload interface{} `json:"payload"`
+	Type     string      `json:"type"`
+	TS       int64       `json:"ts"`
+	AgentID  string      `json:"agent_id"`
+	Encoding string      `json:"encoding,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+	Payload  interface{} `json:"payload"`
 }
 
 type RegisterPayload struct {
 	AgentID     string       `json:"agent_id"`
 	Fingerprint string       `json:"fingerprint"`
-	Secret      string       `json:"secret"`
+	Secret      string       `json:"secret,omitempty"`
+	Proof       string       `json:"proof,omitempty"`
 	Hostname    string       `json:"hostname"`
 	IPs         []string     `json:"ips"`
+	IPv6        []string     `json:"ipv6,omitempty"`
 	MACs        []string     `json:"macs,omitempty"`
 	OS          string       `json:"os"`
 	Arch        string       `json:"arch"`
 	Version     string       `json:"version"`
 	StartedAt   int64        `json:"started_at"`
 	Network     NetworkFacts `json:"network"`
+	Encodings   []string     `json:"encodings,omitempty"`
+	Protocol    int          `json:"protocol"`
+	MinProtocol int          `json:"min_protocol"`
+	Messages    []string     `json:"messages"`
+	WireFormats []string     `json:"wire_formats"`
+	CSR         string       `json:"csr,omitempty"`
+	PrevVersion string       `json:"previous_version,omitempty"`
+	UpdateID    string       `json:"update_id,omitempty"`
+
+	// Commit, BuildDate, GoVersion, and TaskKinds identify the build; see
+	// version.go.
+	Commit    string   `json:"commit,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	TaskKinds []string `json:"task_kinds"`
+
+	// Tags are the operator's labels, such as room=lab-b.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Interfaces details every non-loopback adapter; IPs and MACs stay for
+	// admins that only read those.
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
 }
 
 type HeartbeatPayload struct {
 	Status   string                 `json:"status"`
 	LastSeen int64                  `json:"last_seen"`
+	Full     bool                   `json:"full"`
 	Metrics  map[string]interface{} `json:"metrics,omitempty"`
-	Network  NetworkFacts           `json:"network"`
+	Network  *NetworkFacts          `json:"network,omitempty"`
 }
 
 type ArpEntry struct {
@@ -110,21 +183,45 @@ type NetworkFacts struct {
 }
 
 type TaskPayload struct {
-	TaskID string                 `json:"task_id"`
-	Kind   string                 `json:"kind"`
-	Params map[string]interface{} `json:"params"`
+	TaskID     string                 `json:"task_id"`
+	Kind       string                 `json:"kind"`
+	Params     map[string]interface{} `json:"params"`
+	DeadlineMS int64                  `json:"deadline_ms,omitempty"`
+	ScheduleID string                 `json:"schedule_id,omitempty"`
+	GroupID    string                 `json:"group_id,omitempty"`
+	Priority   string                 `json:"priority,omitempty"`
+	// TraceParent and TraceState carry the admin's W3C trace context; see
+	// tracing.go.
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+
+	signed bool
+	trace  *taskTrace
 }
 
 type TaskResultPayload struct {
-	TaskID string      `json:"task_id"`
-	OK     bool        `json:"ok"`
-	Result interface{} `json:"result"`
-	Error  *string     `json:"error,omitempty"`
+	TaskID     string      `json:"task_id"`
+	ScheduleID string      `json:"schedule_id,omitempty"`
+	GroupID    string      `json:"group_id,omitempty"`
+	OK         bool        `json:"ok"`
+	Status     string      `json:"status,omitempty"`
+	Result     interface{} `json:"result"`
+	Error      *string     `json:"error,omitempty"`
+	ErrorCode  string      `json:"error_code,omitempty"`
+	Replayed   bool        `json:"replayed,omitempty"`
+	// TraceParent names the agent's span for the task when it was traced.
+	TraceParent string `json:"traceparent,omitempty"`
 }
 
 type RegisteredResponse struct {
-	OK    bool   `json:"ok"`
-	Error string `json:"error,omitempty"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	Encoding   string `json:"encoding,omitempty"`
+	Protocol   int    `json:"protocol,omitempty"`
+	WireFormat string `json:"wire_format,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	// AdminTime is the admin's clock (unix ms) when it sent the response.
+	AdminTime int64 `json:"admin_time,omitempty"`
 }
 
 type AgentProfile struct {
@@ -132,61 +229,283 @@ type AgentProfile struct {
 	Fingerprint string
 	Hostname    string
 	IPs         []string
+	IPv6        []string
 	MACs        []string
+	Interfaces  []InterfaceInfo
+	OS          string
+	Arch        string
 	StartedAt   int64
 	IsFake      bool
+	Seed        int64
+
+	// Network, Responses, Faults, and Tags come from a fake mode scenario.
+	Network   *NetworkFacts
+	Responses map[string]fakeResponse
+	Faults    *fakeFaults
+	Tags      map[string]string
 }
 
 type AgentClient struct {
 	profile   AgentProfile
+	hostMu    sync.Mutex
+	host      hostProfile
 	adminIP   string
 	secret    string
+	taskKey   ed25519.PublicKey
+	tlsConfig *tls.Config
+	tlsErr    error
+	certs     *clientCertStore
+	config    *PersistedConfig
+	moves     chan *PersistedConfig
+	movedTo   *PersistedConfig
+	resets    chan struct{}
+	wasReset  bool
+	policy    *agentPolicy
 	heartbeat time.Duration
-	conn      *websocket.Conn
-	writeMu   sync.Mutex
-	probeMu   sync.Mutex
-	probe     ProbeState
+	queueMu   sync.Mutex
+	outbound  *sendQueue
+	encoding  string
+	protocol  int
+	format    string
+	tasks     runningTasks
+	pool      *taskPool
+	schedules *scheduleStore
+	outbox    *outbox
+	results   *resultCache
+	audit     *auditLog
+	history   historyStore
+	updated   *updateMarker
+	probes    *netprobe.Monitor
+	sim       *fakeSim
+	prober    *netprobe.TCPProber
+	latency   latencyDetector
 	networkMu sync.Mutex
 	network   NetworkFacts
 	lastARPMS int64
-}
-
-type ProbeState struct {
-	internet          *bool
-	dns               *bool
-	gateway           *bool
-	latencyMS         *int64
-	internetFailCount int
-	dnsFailCount      int
-	gatewayFailCount  int
+	arpWatch  arpWatcher
+	certWatch certWatcher
+	baseLog   *slog.Logger
+	shipper   *logShipper
+	syslog    *syslogForwarder
+	webhooks  *webhookDispatcher
+	influx    *influxExporter
+	tracer    *tracer
+	state     sessionState
+	clock     clockSkew
+	metrics   agentMetrics
+	traffic   ifTrafficTracker
+	tuning    *agentTuning
+	tags      *agentTags
+	acks      ackTracker
+	nonces    *nonceStore
+	logs      atomic.Pointer[slog.Logger]
+}
+
+// logger returns the client's logger, tagged with agent_id and, while
+// connected, the session ID.
+func (c *AgentClient) logger() *slog.Logger {
+	return c.logs.Load()
+}
+
+func newSessionID() string {
+	return uuid.NewString()[:8]
 }
 
 func main() {
-	fake := flag.Bool("fake", false, "Run in fake provisioning mode")
+	if len(os.Args) > 1 && os.Args[1] == sandboxHelperArg {
+		runSandboxHelper(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "version" || os.Args[1] == "-version" || os.Args[1] == "--version") {
+		runVersionCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "install" || os.Args[1] == "uninstall") {
+		runServiceCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	var fake fakeFlag
+	flag.Var(&fake, "fake", "Run in fake provisioning mode; -fake=<file> simulates the lab described in a YAML or JSON scenario")
+	flag.Int64Var(&fakeSeed, "fake-seed", fakeSeed, "Seed for fake agents' simulated metrics, overriding the scenario's; 0 picks one at startup")
 	identityPath := flag.String("identity", "", "Override identity file path")
+	workDir := flag.String("workdir", "", "Change to this directory before reading config and state files")
+	flag.StringVar(&configPath, "config", configPath, "Path of the persisted provisioning config")
+	flag.StringVar(&secretStoreMode, "secret-store", secretStoreMode, "Where the shared secret is kept: file, encrypted, or keyring (OS credential store)")
+	flag.IntVar(&sandboxDefaults.CPUSeconds, "sandbox-cpu", sandboxDefaults.CPUSeconds, "CPU seconds allowed for sandboxed task commands (0 = unlimited)")
+	flag.IntVar(&sandboxDefaults.MemoryMB, "sandbox-mem-mb", sandboxDefaults.MemoryMB, "Memory limit in MiB for sandboxed task commands (0 = unlimited)")
+	flag.DurationVar(&sandboxDefaults.Timeout, "sandbox-timeout", sandboxDefaults.Timeout, "Wall-clock limit for sandboxed task commands")
+	flag.StringVar(&sandboxDefaults.User, "sandbox-user", sandboxDefaults.User, "Unprivileged user for sandboxed task commands (Linux, when running as root)")
+	flag.BoolVar(&tlsDefaults.Force, "tls", false, "Always connect to the admin over wss://, even if provisioning did not ask for TLS")
+	flag.StringVar(&tlsDefaults.CAFile, "tls-ca", "", "PEM CA bundle used to verify the admin certificate")
+	flag.BoolVar(&tlsDefaults.Insecure, "tls-insecure", false, "Accept any admin certificate (self-signed lab setups; no pinning)")
+	flag.BoolVar(&selfUpdateDisabled, "no-self-update", false, "Refuse update messages from the admin")
+	flag.BoolVar(&legacySecretAuth, "legacy-secret-auth", legacySecretAuth, "Send the shared secret in register when the admin sends no challenge (admins that predate challenges)")
+	flag.BoolVar(&requireChallenge, "require-challenge", false, "Never send the shared secret; fail registration when the admin sends no challenge")
+	flag.StringVar(&localScanAllow, "scan-allow", "", "Comma-separated CIDRs tasks may target; admin-provided allowlists can only narrow this")
+	flag.StringVar(&localScanExclude, "scan-exclude", "", "Comma-separated hosts or CIDRs no task may probe, even inside a requested range")
+	flag.StringVar(&localScanExcludePorts, "scan-exclude-ports", "", "Ports no task may probe, e.g. 502,20000-20010")
+	flag.StringVar(&localAllowKinds, "allow-kinds", "", "Comma-separated task kinds this agent may run (empty = all)")
+	flag.Var(localTags, "tags", "Comma-separated key=value tags sent in register, e.g. room=lab-b,role=instructor-pc")
+	flag.StringVar(&localDenyKinds, "deny-kinds", "", "Comma-separated task kinds this agent refuses to run, e.g. pcap_capture")
+	flag.IntVar(&taskPoolDefaults.Workers, "task-workers", taskPoolDefaults.Workers, "Maximum number of tasks run concurrently")
+	flag.IntVar(&resultCacheSize, "result-cache", resultCacheSize, "How many recent task results are kept on disk for the admin's history requests; 0 disables")
+	flag.StringVar(&historyDBPath, "history-db", historyDBPath, "SQLite file recording task, probe, and connection history (builds with -tags sqlite); empty disables")
+	flag.DurationVar(&historyRetention, "history-retention", historyRetention, "How long history rows are kept")
+	flag.IntVar(&historyMaxRows, "history-max-rows", historyMaxRows, "Most rows kept in each history table")
+	flag.IntVar(&taskPoolDefaults.QueueSize, "task-queue", taskPoolDefaults.QueueSize, "Maximum number of tasks waiting for a worker before new ones are rejected")
+	flag.StringVar(&staticAdmin, "admin", staticAdmin, "Admin IP or hostname to connect to directly, skipping provisioning (requires -secret)")
+	flag.StringVar(&staticSecret, "secret", staticSecret, "Shared secret for -admin")
+	flag.IntVar(&provisionUDPPort, "provision-port", provisionUDPPort, "UDP port to listen on for provisioning packets")
+	flag.DurationVar(&mdnsInterval, "mdns-interval", mdnsInterval, "How often to look for an admin advertised over mDNS while waiting for provisioning; 0 disables")
+	flag.IntVar(&wsPort, "admin-port", wsPort, "TCP port of the admin websocket and update server")
+	flag.DurationVar(&probeInterval, "probe-interval", probeInterval, "How often internet, DNS, and gateway reachability are probed")
+	flag.StringVar(&probeInternet, "probe-internet", probeInternet, "Comma-separated host:port endpoints dialed to check internet reachability, tried in order")
+	flag.StringVar(&probeDNSName, "probe-dns-name", probeDNSName, "Name resolved to check DNS")
+	flag.StringVar(&probeMethod, "probe-method", probeMethod, "How internet and gateway reachability is measured: auto (ICMP, falling back to TCP), icmp, or tcp")
+	flag.DurationVar(&arpWatchInterval, "arp-watch-interval", arpWatchInterval, "How often the neighbor table is polled for devices joining or leaving; 0 disables")
+	flag.DurationVar(&hostWatchInterval, "host-watch-interval", hostWatchInterval, "How often the hostname and addresses are checked for changes to report to the admin; 0 disables")
+	flag.StringVar(&certWatchEndpoints, "cert-watch", "", "Comma-separated host:port TLS endpoints whose certificate expiry the agent watches")
+	flag.DurationVar(&certWatchInterval, "cert-watch-interval", certWatchInterval, "How often the -cert-watch certificates are checked; 0 disables")
+	flag.StringVar(&certWarnDays, "cert-warn-days", certWarnDays, "Comma-separated days before expiry at which a watched certificate raises an event")
+	flag.StringVar(&probeResolvers, "probe-resolvers", probeResolvers, "Comma-separated DNS resolvers benchmarked each probe round: system, gateway, an IP, or host:port; empty disables")
+	flag.StringVar(&captivePortalURL, "captive-portal-url", captivePortalURL, "http:// URL answering 204 used to detect captive portals; empty disables the check")
+	flag.IntVar(&probeThreshold, "probe-threshold", probeThreshold, "Consecutive agreeing probe rounds needed to flip internet, DNS, or gateway state")
+	flag.DurationVar(&clockSkewThreshold, "clock-skew-threshold", clockSkewThreshold, "Clock difference from the admin above which heartbeats flag the agent's clock as skewed")
+	flag.DurationVar(&heartbeatMin, "heartbeat-min", heartbeatMin, "Shortest wait between heartbeats")
+	flag.DurationVar(&heartbeatMax, "heartbeat-max", heartbeatMax, "Longest wait between heartbeats")
+	flag.BoolVar(&heartbeatDelta, "heartbeat-delta", heartbeatDelta, "Send only changed heartbeat values between periodic full snapshots")
+	flag.IntVar(&heartbeatFullEvery, "heartbeat-full-every", heartbeatFullEvery, "With -heartbeat-delta, send a full heartbeat every N heartbeats")
+	flag.DurationVar(&networkFactsInterval, "facts-interval", networkFactsInterval, "How often network facts (interfaces, gateway, DNS) are refreshed")
+	flag.StringVar(&proxySetting, "proxy", proxySetting, "Proxy for the admin connection, http://host:port or socks5://host:port, or direct to ignore HTTP_PROXY/HTTPS_PROXY")
+	flag.DurationVar(&reconnectMin, "reconnect-min", reconnectMin, "First wait before redialing the admin; doubles on each failure")
+	flag.DurationVar(&reconnectMax, "reconnect-max", reconnectMax, "Longest wait between redials")
+	flag.DurationVar(&reconnectGiveUp, "reconnect-give-up", reconnectGiveUp, "Go back to waiting for provisioning after the admin is unreachable this long (0 = keep retrying)")
+	flag.DurationVar(&pingInterval, "ws-ping-interval", pingInterval, "How often to ping the admin over the websocket (0 disables pings and read deadlines)")
+	flag.DurationVar(&pongWait, "ws-pong-wait", pongWait, "Drop the connection after this long without a pong or message from the admin")
+	flag.StringVar(&logLevel, "log-level", logLevel, "Minimum log level: debug, info, warn, or error")
+	flag.StringVar(&logFormat, "log-format", logFormat, "Log line format: text or json")
+	flag.BoolVar(&shipLogs, "ship-logs", shipLogs, "Send warning and error log records to the admin as log messages")
+	flag.StringVar(&shipLogLevel, "ship-logs-level", shipLogLevel, "Lowest level sent with -ship-logs: debug, info, warn, or error")
+	flag.StringVar(&statusAddr, "status-addr", statusAddr, "Local address for the /status endpoint (empty to disable)")
+	flag.StringVar(&metricsAddr, "metrics-addr", metricsAddr, "Address for a Prometheus /metrics endpoint, e.g. :9149 (empty to disable)")
+	flag.StringVar(&logFilePath, "log-file", logFilePath, "Also write logs to this file, rotated by size")
+	flag.IntVar(&logMaxSizeMB, "log-max-size-mb", logMaxSizeMB, "Rotate the log file once it reaches this many MiB")
+	flag.IntVar(&logKeepFiles, "log-keep", logKeepFiles, "Number of rotated log files to keep (.1 is the newest)")
+	flag.BoolVar(&logConsole, "log-console", logConsole, "Write logs to stderr as well (set -log-console=false with -log-file for file only)")
+	flag.StringVar(&syslogTarget, "syslog", "", "Send events, task outcomes, and connection changes to a syslog collector: udp://, tcp://, or tls://host:port")
+	flag.StringVar(&syslogFacility, "syslog-facility", syslogFacility, "Syslog facility for -syslog messages, e.g. daemon or local0")
+	flag.StringVar(&syslogCAFile, "syslog-ca", "", "PEM CA bundle for verifying a tls:// syslog collector (default: system roots)")
+	flag.StringVar(&webhookURLs, "webhook", "", "Comma-separated http(s) URLs every task result is POSTed to")
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "Key for the HMAC-SHA256 X-LabScan-Signature on webhook deliveries")
+	flag.BoolVar(&webhookOnly, "webhook-only", webhookOnly, "With -webhook, leave the result body out of the task_result sent to the admin")
+	flag.StringVar(&influxURL, "influx", "", "InfluxDB (or other line protocol) write URL for heartbeat metrics and probe results, e.g. http://influx:8086/api/v2/write?org=lab&bucket=labscan")
+	flag.StringVar(&influxToken, "influx-token", "", "API token sent as Authorization: Token with -influx writes")
+	flag.DurationVar(&influxInterval, "influx-interval", influxInterval, "How often buffered -influx points are written")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OpenTelemetry collector URL for task traces over OTLP/HTTP, e.g. http://collector:4318")
+	flag.StringVar(&otlpHeaders, "otlp-headers", "", "Comma-separated key=value headers sent with -otlp-endpoint exports")
 	flag.Parse()
+	set, err := applyEnvSettings(flag.CommandLine)
+	if err != nil {
+		fatal("invalid settings", "err", err)
+	}
+	if *workDir != "" {
+		if err := os.Chdir(*workDir); err != nil {
+			fatal("cannot change to workdir", "err", err)
+		}
+	}
+	if err := applyFileSettings(flag.CommandLine, set, configPath); err != nil {
+		fatal("invalid settings", "err", err)
+	}
+	if err := validateSettings(); err != nil {
+		fatal("invalid settings", "err", err)
+	}
+	if err := setupLogging(); err != nil {
+		fatal("invalid logging settings", "err", err)
+	}
+	switch secretStoreMode {
+	case secretStoreFile, secretStoreEncrypted, secretStoreKeyring:
+	default:
+		fatal("unknown -secret-store (want file, encrypted, or keyring)", "secret_store", secretStoreMode)
+	}
+	if _, err := newAgentPolicy(nil, nil); err != nil {
+		fatal("invalid policy flags", "err", err)
+	}
 
-	if *fake {
-		runFakeMode(*identityPath)
+	if err := startSyslog(); err != nil {
+		fatal("invalid syslog settings", "err", err)
+	}
+	defer agentSyslog.close(2 * time.Second)
+	if err := startWebhooks(); err != nil {
+		fatal("invalid webhook settings", "err", err)
+	}
+	if err := startInflux(); err != nil {
+		fatal("invalid influx settings", "err", err)
+	}
+	defer agentInflux.close(5 * time.Second)
+	if err := startTracing(); err != nil {
+		fatal("invalid tracing settings", "err", err)
+	}
+	defer agentTracer.close(5 * time.Second)
+
+	ctx := shutdownContext()
+	serveLocalHTTP(statusAddr, metricsAddr)
+	sandboxReport()
+	if fake.enabled {
+		scenario := &fakeScenario{}
+		if fake.scenario != "" {
+			if scenario, err = loadFakeScenario(fake.scenario); err != nil {
+				fatal("invalid fake scenario", "err", err)
+			}
+		} else if err := scenario.validate(); err != nil {
+			fatal("invalid fake scenario", "err", err)
+		}
+		if fakeSeed != 0 {
+			scenario.Seed = fakeSeed
+		}
+		if scenario.Seed == 0 {
+			scenario.Seed = time.Now().UnixNano()
+		}
+		runFakeMode(ctx, *identityPath, scenario)
 		return
 	}
 
-	runNormalMode(*identityPath)
+	if runningAsService() {
+		if err := runAsService(ctx, serviceName, func(ctx context.Context) { runNormalMode(ctx, *identityPath) }); err != nil {
+			fatal("service failed", "err", err)
+		}
+		return
+	}
+	runNormalMode(ctx, *identityPath)
 }
 
-func runNormalMode(identityPath string) {
+func runNormalMode(ctx context.Context, identityPath string) {
 	hostname, _ := os.Hostname()
 	identity, err := loadOrCreateIdentity(resolveIdentityPath(identityPath), "")
 	if err != nil {
-		log.Fatalf("failed to initialize agent identity: %v", err)
-	}
-
-	for {
-		cfg, err := waitForProvision(identity.AgentID, hostname)
-		if err != nil {
-			log.Printf("provisioning listener error: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
+		fatal("failed to initialize agent identity", "err", err)
+	}
+	guard := loadProvisionGuard(provisionStatePath)
+	resumed, updated := resumeAfterUpdate()
+	history := openAgentHistory()
+	if history != nil {
+		defer history.close()
+		go pruneHistoryLoop(ctx, history)
+	}
+
+	for ctx.Err() == nil {
+		cfg := resumed
+		resumed = nil
+		if cfg == nil {
+			cfg, err = nextConfig(ctx, identity.AgentID, hostname, guard)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Error("provisioning listener failed", "err", err)
+				time.Sleep(2 * time.Second)
+				continue
+			}
 		}
 
 		profile := AgentProfile{
@@ -194,93 +513,182 @@ func runNormalMode(identityPath string) {
 			Fingerprint: identity.Fingerprint,
 			Hostname:    hostname,
 			IPs:         localIPv4s(),
+			IPv6:        localIPv6s(),
 			MACs:        localMACs(),
+			Interfaces:  localInterfaces(),
 			StartedAt:   nowMS(),
+			OS:          runtime.GOOS,
+			Arch:        runtime.GOARCH,
 			IsFake:      false,
 		}
-		client := newAgentClient(profile, cfg.AdminIP, cfg.Secret, jitterDuration(5, 10))
-		_ = client.runWithSleepLifecycle(context.Background())
+		client := newAgentClient(profile, cfg, heartbeatJitter())
+		client.updated, updated = updated, nil
+		client.history = history
+		_ = client.runWithSleepLifecycle(ctx)
+		resumed = client.movedTo
+		if client.wasReset {
+			factoryReset(resolveIdentityPath(identityPath))
+			clearHistory(history)
+			if identity, err = loadOrCreateIdentity(resolveIdentityPath(identityPath), ""); err != nil {
+				fatal("failed to initialize agent identity", "err", err)
+			}
+			guard = loadProvisionGuard(provisionStatePath)
+			slog.Info("factory reset done, waiting for provisioning", "agent_id", identity.AgentID)
+		}
 	}
 }
 
-func runFakeMode(identityPath string) {
+func runFakeMode(parent context.Context, identityPath string, scenario *fakeScenario) {
 	hostname, _ := os.Hostname()
 	controllerIdentity, err := loadOrCreateIdentity(resolveIdentityPath(identityPath), "")
 	if err != nil {
-		log.Fatalf("failed to initialize controller identity: %v", err)
+		fatal("failed to initialize controller identity", "err", err)
 	}
+	guard := loadProvisionGuard("")
 	baseFingerprint := controllerIdentity.Fingerprint
 	if strings.TrimSpace(baseFingerprint) == "" {
 		baseFingerprint = computeDeviceFingerprint()
 	}
 
-	for {
-		cfg, err := waitForProvision(controllerIdentity.AgentID, hostname)
+	var moved atomic.Pointer[PersistedConfig]
+	for parent.Err() == nil {
+		cfg := moved.Swap(nil)
+		if cfg == nil {
+			cfg, err = nextConfig(parent, controllerIdentity.AgentID, hostname, guard)
+		}
+		if parent.Err() != nil {
+			return
+		}
 		if err != nil {
-			log.Printf("failed provisioning in fake mode: %v", err)
+			slog.Error("provisioning listener failed", "fake", true, "err", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		var doneOnce int32
-		disconnectCh := make(chan struct{}, 1)
+		ctx, cancel := context.WithCancel(parent)
+		var running sync.WaitGroup
 
-		for i := 1; i <= fakeAgentCount; i++ {
+		for i := 1; i <= scenario.Count; i++ {
 			identity, idErr := loadOrCreateIdentity(fakeIdentityPath(i, identityPath), fakeFingerprint(baseFingerprint, i))
 			if idErr != nil {
-				log.Printf("failed loading fake identity %d: %v", i, idErr)
+				slog.Error("failed loading fake identity", "index", i, "err", idErr)
 				continue
 			}
-			profile := AgentProfile{
-				AgentID:     identity.AgentID,
-				Fingerprint: identity.Fingerprint,
-				Hostname:    fmt.Sprintf("LABSCAN-FAKE-%03d", i),
-				IPs:         []string{fmt.Sprintf("192.168.1.%d", 100+i)},
-				MACs:        []string{fakeMACForIndex(i)},
-				StartedAt:   nowMS(),
-				IsFake:      true,
-			}
-
-			client := newAgentClient(profile, cfg.AdminIP, cfg.Secret, jitterDuration(5, 10))
-			go func(c *AgentClient) {
-				_ = c.runWithSleepLifecycle(ctx)
-				if atomic.CompareAndSwapInt32(&doneOnce, 0, 1) {
-					disconnectCh <- struct{}{}
+			spec, _ := scenario.agent(i)
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				if next := runFakeAgent(ctx, spec.profile(identity), cfg); next != nil && moved.CompareAndSwap(nil, next) {
+					cancel()
 				}
-			}(client)
+			}()
 		}
 
-		log.Printf("Fake mode: spawned 4 agents")
-		<-disconnectCh
+		slog.Info("fake mode: spawned agents", "count", scenario.Count, "seed", scenario.Seed)
+		select {
+		case <-ctx.Done():
+		case <-parent.Done():
+		}
 		cancel()
+		running.Wait()
 	}
 }
 
-func waitForProvision(agentID, hostname string) (*PersistedConfig, error) {
-	listenAddr := fmt.Sprintf(":%d", provisionUDPPort)
-	conn, err := net.ListenPacket("udp4", listenAddr)
+// fakeRestartDelay spaces out restarts of a fake agent whose lifecycle
+// ended on its own.
+const fakeRestartDelay = 5 * time.Second
+
+// runFakeAgent keeps one fake agent running until ctx ends or the admin
+// moves it, and returns the config it was moved to. Faults apply per
+// agent: one that gives up on an admin rejecting it, or is reset, is
+// restarted alone while the rest of the fleet carries on.
+func runFakeAgent(ctx context.Context, profile AgentProfile, cfg *PersistedConfig) *PersistedConfig {
+	for {
+		client := newAgentClient(profile, cfg, heartbeatJitter())
+		err := client.runWithSleepLifecycle(ctx)
+		if client.movedTo != nil {
+			return client.movedTo
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		slog.Info("fake agent stopped, restarting", "agent_id", profile.AgentID, "err", err, "in", fakeRestartDelay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(fakeRestartDelay):
+		}
+	}
+}
+
+type provisionPacket struct {
+	conn   net.PacketConn
+	data   []byte
+	sender net.Addr
+}
+
+func waitForProvision(ctx context.Context, agentID, hostname string, guard *provisionGuard) (*PersistedConfig, error) {
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", provisionUDPPort))
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-
-	log.Printf("Sleep mode: waiting for admin provisioning on UDP 8870...")
+	conns := []net.PacketConn{conn}
+	if conn6, err := listenProvisionIPv6(); err != nil {
+		slog.Debug("IPv6 provisioning unavailable", "err", err)
+	} else {
+		conns = append(conns, conn6)
+	}
+	closeAll := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	defer closeAll()
+	stop := context.AfterFunc(ctx, closeAll)
+	defer stop()
+
+	slog.Info("sleep mode: waiting for admin provisioning", "udp_port", provisionUDPPort, "ipv6_group", len(conns) > 1)
+
+	done := make(chan struct{})
+	defer close(done)
+	browseCtx, stopBrowse := context.WithCancel(ctx)
+	defer stopBrowse()
+	go mdnsProvisionLoop(browseCtx, conn, agentID, hostname)
+	packets := make(chan provisionPacket)
+	readErrs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func() {
+			for {
+				buffer := make([]byte, 4096)
+				n, sender, err := conn.ReadFrom(buffer)
+				if err != nil {
+					readErrs <- err
+					return
+				}
+				select {
+				case packets <- provisionPacket{conn: conn, data: buffer[:n], sender: sender}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
 
-	buffer := make([]byte, 4096)
 	for {
-		n, sender, err := conn.ReadFrom(buffer)
-		if err != nil {
+		var packet provisionPacket
+		select {
+		case packet = <-packets:
+		case err := <-readErrs:
 			return nil, err
 		}
 
-		senderUDP, ok := sender.(*net.UDPAddr)
+		senderUDP, ok := packet.sender.(*net.UDPAddr)
 		if !ok || !isPrivateIP(senderUDP.IP) {
 			continue
 		}
 
 		var provision ProvisionMessage
-		if err := json.Unmarshal(buffer[:n], &provision); err != nil {
+		if err := json.Unmarshal(packet.data, &provision); err != nil {
 			continue
 		}
 
@@ -290,15 +698,41 @@ func waitForProvision(agentID, hostname string) (*PersistedConfig, error) {
 		if strings.TrimSpace(provision.AdminIP) == "" || strings.TrimSpace(provision.Secret) == "" || strings.TrimSpace(provision.Nonce) == "" {
 			continue
 		}
+		if _, err := parseAdminPublicKey(provision.AdminPublicKey); err != nil {
+			slog.Warn("ignoring provision", "admin_ip", provision.AdminIP, "err", err)
+			continue
+		}
+		if err := checkTransport(provision.Transport, provision.MQTTBroker, provision.NATSURL); err != nil {
+			slog.Warn("ignoring provision", "admin_ip", provision.AdminIP, "err", err)
+			continue
+		}
+		if err := guard.check(provision); err != nil {
+			slog.Warn("ignoring provision", "sender", senderUDP.IP, "err", err)
+			continue
+		}
 
 		cfg := &PersistedConfig{
-			AdminIP:       provision.AdminIP,
-			Secret:        provision.Secret,
-			ProvisionedAt: nowMS(),
+			AdminIP:        adminAddrFor(provision.AdminIP, senderUDP),
+			Secret:         provision.Secret,
+			AdminPublicKey: strings.TrimSpace(provision.AdminPublicKey),
+			TLS:            provision.TLS,
+			TLSCAPEM:       provision.TLSCAPEM,
+			TLSCertSHA256:  normalizeFingerprint(provision.TLSCertSHA256),
+			TLSClientCSR:   provision.TLSClientCSR,
+			TLSClientCert:  provision.TLSClientCert,
+			TLSClientKey:   provision.TLSClientKey,
+			ScanAllow:      provision.ScanAllow,
+			DenyKinds:      provision.DenyKinds,
+			Transport:      provision.Transport,
+			MQTTBroker:     provision.MQTTBroker,
+			MQTTPrefix:     provision.MQTTPrefix,
+			NATSURL:        provision.NATSURL,
+			NATSPrefix:     provision.NATSPrefix,
+			ProvisionedAt:  nowMS(),
 		}
 
 		if err := saveConfig(cfg); err != nil {
-			log.Printf("warning: failed to persist config: %v", err)
+			slog.Warn("failed to persist config", "err", err)
 		}
 
 		ack := ProvisionAck{
@@ -310,24 +744,120 @@ func waitForProvision(agentID, hostname string) (*PersistedConfig, error) {
 			TS:      nowMS(),
 		}
 		if raw, err := json.Marshal(ack); err == nil {
-			_, _ = conn.WriteTo(raw, sender)
+			_, _ = packet.conn.WriteTo(raw, packet.sender)
 		}
 
-		log.Printf("Provisioned by %s, connecting to WS 8148...", provision.AdminIP)
+		slog.Info("provisioned, connecting to admin", "admin_ip", cfg.AdminIP, "port", wsPort)
 		return cfg, nil
 	}
 }
 
-func newAgentClient(profile AgentProfile, adminIP, secret string, heartbeat time.Duration) *AgentClient {
+func newAgentClient(profile AgentProfile, cfg *PersistedConfig, heartbeat time.Duration) *AgentClient {
 	if heartbeat <= 0 {
 		heartbeat = 8 * time.Second
 	}
-	return &AgentClient{profile: profile, adminIP: adminIP, secret: secret, heartbeat: heartbeat}
+	taskKey, err := parseAdminPublicKey(cfg.AdminPublicKey)
+	client := &AgentClient{profile: profile, host: profileHost(profile), adminIP: cfg.AdminIP, secret: cfg.Secret, taskKey: taskKey, heartbeat: heartbeat}
+	handler := slog.Default().Handler()
+	if shipLogs {
+		client.shipper = &logShipper{level: shipLevel}
+		handler = &shipHandler{Handler: handler, ship: client.shipper}
+	}
+	client.baseLog = slog.New(handler).With("agent_id", profile.AgentID)
+	client.syslog = agentSyslog
+	client.webhooks = agentWebhooks
+	client.influx = agentInflux
+	client.tracer = agentTracer
+	if profile.IsFake {
+		client.baseLog = client.baseLog.With("host", profile.Hostname)
+	}
+	client.logs.Store(client.baseLog)
+	if err != nil {
+		client.logger().Warn("ignoring admin public key", "err", err)
+	}
+	var saveCert func(certPEM, keyPEM string)
+	if !profile.IsFake {
+		saveCert = func(certPEM, keyPEM string) {
+			err := client.updateConfig(func(cfg *PersistedConfig) {
+				cfg.TLSClientCert, cfg.TLSClientKey = certPEM, keyPEM
+			})
+			if err != nil {
+				client.logger().Warn("failed to persist client certificate", "err", err)
+			}
+		}
+	}
+	client.certs = newClientCertStore(cfg, saveCert)
+	client.config = cfg
+	client.moves = make(chan *PersistedConfig, 1)
+	client.resets = make(chan struct{}, 1)
+	client.policy, err = newAgentPolicy(cfg.ScanAllow, cfg.DenyKinds)
+	if err != nil {
+		client.logger().Warn("ignoring provisioned scan policy", "err", err)
+		client.policy, _ = newAgentPolicy(nil, cfg.DenyKinds)
+	}
+	client.tlsConfig, client.tlsErr = adminTLSConfig(cfg, tlsDefaults)
+	if client.tlsErr != nil {
+		client.logger().Warn("admin TLS unavailable", "err", client.tlsErr)
+	}
+	if client.tlsConfig != nil {
+		client.tlsConfig.GetClientCertificate = client.certs.getClientCertificate
+	}
+	client.pool = newTaskPool(taskPoolDefaults, client.executeTask)
+	client.pool.onPreempt = client.reportPreempted
+	if profile.IsFake {
+		client.schedules = loadScheduleStore("")
+		client.outbox = loadOutbox("")
+		client.results = loadResultCache("")
+		client.audit = newAuditLog("")
+		client.nonces = loadNonceStore("")
+	} else {
+		client.schedules = loadScheduleStore(schedulesPath)
+		client.outbox = loadOutbox(outboxPath)
+		client.results = loadResultCache(resultCachePath)
+		client.audit = newAuditLog(auditPath)
+		client.nonces = loadNonceStore(noncesPath)
+	}
+	client.tuning = newAgentTuning(cfg.Tuning)
+	client.tags = newAgentTags(localTags, cfg.Tags)
+	for key, value := range profile.Tags {
+		client.tags.base[key] = value
+	}
+	client.tags.changed = func(tags map[string]string) {
+		_ = client.send("event", EventPayload{Kind: "tags_changed", Severity: "info", Message: "agent tags changed",
+			Data: map[string]interface{}{"tags": nonNilTags(tags)}})
+	}
+	if !profile.IsFake {
+		client.tags.save = func(tags map[string]string) error {
+			return client.updateConfig(func(cfg *PersistedConfig) { cfg.Tags = tags })
+		}
+	}
+	interval, threshold := client.tuning.probe()
+	targets := client.tuning.probeTargets(netprobe.DefaultTargets())
+	targets.GatewayAddr = client.probeGatewayAddr
+	targets.PortalURL = captivePortalURL
+	targets.Resolvers = splitList(probeResolvers)
+	if probeMethod != "auto" {
+		targets.Method = probeMethod
+	}
+	client.prober = netprobe.NewTCPProber(targets)
+	var prober netprobe.Prober = client.prober
+	if profile.IsFake {
+		client.sim = newFakeSim(profile.Seed, targets.Resolvers)
+		client.sim.hostname, client.sim.osName, client.sim.arch, client.sim.macs = profile.Hostname, profile.OS, profile.Arch, profile.MACs
+		prober = client.sim
+	}
+	client.probes = &netprobe.Monitor{
+		Prober:    prober,
+		Interval:  interval,
+		Threshold: threshold,
+		OnResult:  client.onProbeResult,
+	}
+	return client
 }
 
 func (c *AgentClient) runWithSleepLifecycle(ctx context.Context) error {
-	retryDelays := []time.Duration{3 * time.Second, 5 * time.Second, 8 * time.Second}
-	failureCount := 0
+	defer agentStatus.track(c)()
+	var backoff reconnectBackoff
 
 	for {
 		select {
@@ -337,22 +867,31 @@ func (c *AgentClient) runWithSleepLifecycle(ctx context.Context) error {
 		}
 
 		registered, err := c.runSession(ctx)
+		if registered {
+			c.recordDisconnect(err)
+		}
+		if c.movedTo != nil {
+			return errReprovisioned
+		}
+		if c.wasReset {
+			return errFactoryReset
+		}
 		if err != nil {
-			log.Printf("[%s] session ended: %v", c.profile.Hostname, err)
+			c.logger().Info("session ended", "err", err)
 		}
 
 		if registered {
-			failureCount = 0
+			backoff.reset()
 			continue
 		}
 
-		if failureCount >= len(retryDelays) {
-			log.Printf("Admin offline detected, entering sleep mode...")
+		if backoff.exhausted() {
+			c.logger().Warn("admin offline, entering sleep mode", "unreachable_for", reconnectGiveUp)
 			return errors.New("admin offline")
 		}
 
-		delay := retryDelays[failureCount]
-		failureCount++
+		delay := backoff.next()
+		c.logger().Debug("reconnecting", "in", delay.Round(time.Millisecond))
 
 		select {
 		case <-ctx.Done():
@@ -369,91 +908,249 @@ func (c *AgentClient) runSession(parent context.Context) (bool, error) {
 	default:
 	}
 
-	url := fmt.Sprintf("ws://%s:%d/ws/agent", c.adminIP, wsPort)
-	log.Printf("WS dial url=%s", url)
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if c.tlsErr != nil && !viaBroker(c.configSnapshot().Transport) {
+		return false, fmt.Errorf("admin requires TLS: %w", c.tlsErr)
+	}
+	conn, url, err := c.dialAdmin(parent)
 	if err != nil {
-		log.Printf("WS dial failed err=%v", err)
+		c.logger().Warn("dial failed", "url", url, "err", err)
+		c.metrics.dialFailures.Add(1)
 		return false, fmt.Errorf("dial failed: %w", err)
 	}
-	log.Printf("WS connected agent_id=%s", c.profile.AgentID)
+	sessionID := newSessionID()
+	c.logs.Store(c.baseLog.With("session", sessionID))
+	defer c.logs.Store(c.baseLog)
+	c.logger().Info("connected", "url", url)
+	c.metrics.connects.Add(1)
 	defer conn.Close()
 
-	c.conn = conn
-	ctx, cancel := context.WithCancel(parent)
+	// The session outlives parent by a little: when parent is cancelled the
+	// agent still needs the send queue to say goodbye before closing.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
 	defer cancel()
 
+	queue := newSendQueue(ctx, conn)
+	c.setOutbound(queue)
+	defer c.requeueUnacked()
+	defer c.setOutbound(nil)
+	go func() {
+		if err := queue.run(); err != nil {
+			c.logger().Warn("write failed", "err", err)
+			_ = conn.Close()
+		}
+	}()
+
+	registered := make(chan bool, 1)
+	challenges := make(chan string, 1)
+	errCh := make(chan error, 1)
+	ws, isWebSocket := conn.(*websocket.Conn)
+	if isWebSocket {
+		armKeepalive(ws)
+	}
+	go func() {
+		errCh <- c.readLoop(ctx, conn, registered, challenges)
+	}()
+	if isWebSocket {
+		go c.pingLoop(ctx, ws)
+	}
+
+	secret, proof := "", ""
+	select {
+	case nonce := <-challenges:
+		proof = registerProof(c.secret, nonce, c.profile.AgentID)
+	case err := <-errCh:
+		c.logger().Info("connection closed", "err", err)
+		return false, err
+	case <-parent.Done():
+		return false, parent.Err()
+	case <-time.After(registerChallengeWait):
+		if !c.allowSecretFallback() {
+			c.logger().Warn("no register challenge from admin; not sending the secret")
+			return false, errors.New("admin did not send a register challenge")
+		}
+		secret = c.secret
+	}
+	if err := c.profile.Faults.delayRegister(parent); err != nil {
+		return false, err
+	}
+	if c.profile.Faults.rejectRegister() {
+		c.logger().Info("fault injection: registering with a wrong secret")
+		if secret != "" {
+			secret = "wrong-" + secret
+		}
+		if proof != "" {
+			proof = "wrong-" + proof
+		}
+	}
+
+	prevVersion, updateID := "", ""
+	if c.updated != nil {
+		prevVersion, updateID = c.updated.FromVersion, c.updated.UpdateID
+	}
+	csr, err := c.certs.request(c.profile.AgentID)
+	if err != nil {
+		c.logger().Warn("client certificate request failed", "err", err)
+	}
+	host := c.refreshHost()
+	build := currentBuild()
+	c.clock.registerSent(time.Now())
 	if err := c.send("register", RegisterPayload{
 		AgentID:     c.profile.AgentID,
 		Fingerprint: c.profile.Fingerprint,
-		Secret:      c.secret,
-		Hostname:    c.profile.Hostname,
-		IPs:         c.profile.IPs,
-		MACs:        c.profile.MACs,
-		OS:          runtime.GOOS,
-		Arch:        runtime.GOARCH,
+		Secret:      secret,
+		Proof:       proof,
+		Hostname:    host.Hostname,
+		IPs:         host.IPs,
+		IPv6:        host.IPv6,
+		MACs:        host.MACs,
+		OS:          c.profile.OS,
+		Arch:        c.profile.Arch,
 		Version:     agentVersion,
 		StartedAt:   c.profile.StartedAt,
 		Network:     c.collectAndStoreNetworkFacts(true),
+		Encodings:   supportedEncodings,
+		Protocol:    protocolVersion,
+		MinProtocol: minProtocolVersion,
+		Messages:    acceptedMessages,
+		WireFormats: supportedWireFormats,
+		CSR:         csr,
+		PrevVersion: prevVersion,
+		UpdateID:    updateID,
+		Commit:      build.Commit,
+		BuildDate:   build.BuildDate,
+		GoVersion:   build.GoVersion,
+		TaskKinds:   build.TaskKinds,
+		Tags:        c.tags.current(),
+		Interfaces:  host.Interfaces,
 	}); err != nil {
 		return false, err
 	}
 
-	registered := make(chan bool, 1)
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- c.readLoop(ctx, registered)
-	}()
-
 	select {
 	case ok := <-registered:
 		if !ok {
-			log.Printf("WS register rejected agent_id=%s", c.profile.AgentID)
+			c.logger().Warn("register rejected")
 			return false, errors.New("registration rejected")
 		}
-		log.Printf("WS register accepted agent_id=%s", c.profile.AgentID)
+		c.logger().Info("register accepted")
+		c.state.session.Store(sessionID)
+		c.recordConnection("connected", sessionID, "")
+		c.state.connectedAtMS.Store(nowMS())
+		c.state.connected.Store(true)
+		defer c.state.connected.Store(false)
+		c.reportClockSkew()
+		if c.updated != nil {
+			c.logger().Info("running updated agent", "version", agentVersion, "from_version", c.updated.FromVersion)
+			c.updated = nil
+			_ = os.Remove(updateMarkerPath)
+		}
+		if proof != "" && !c.configSnapshot().ChallengeAuth {
+			if err := c.updateConfig(func(cfg *PersistedConfig) { cfg.ChallengeAuth = true }); err != nil {
+				c.logger().Warn("failed to persist config", "err", err)
+			}
+		}
 	case err := <-errCh:
-		log.Printf("WS closed err=%v -> entering sleep", err)
+		c.logger().Info("connection closed", "err", err)
 		return false, err
+	case <-parent.Done():
+		return false, parent.Err()
 	case <-time.After(10 * time.Second):
-		log.Printf("WS register timeout agent_id=%s", c.profile.AgentID)
+		c.logger().Warn("register timeout")
 		return false, errors.New("register timeout")
 	}
 
+	go c.replayOutbox()
 	go c.heartbeatLoop(ctx)
+	go c.schedules.run(ctx, c.runScheduled)
 	go c.probeLoop(ctx)
 	go c.networkFactsLoop(ctx)
-	err = <-errCh
+	go c.arpWatchLoop(ctx)
+	go c.hostWatchLoop(ctx, conn)
+	go c.certWatchLoop(ctx)
+	go c.logShipLoop(ctx)
+	select {
+	case <-c.profile.Faults.flap():
+		c.logger().Info("fault injection: dropping connection", "down_for", c.profile.Faults.FlapDown)
+		_ = conn.Close()
+		<-errCh
+		c.profile.Faults.stayDown(parent)
+		return true, errFlapped
+	case err = <-errCh:
+	case <-parent.Done():
+		c.goOffline(conn, errCh, shutdownReason(parent))
+		return true, nil
+	case next := <-c.moves:
+		c.movedTo = next
+		c.goOffline(conn, errCh, "reprovisioned to "+next.AdminIP)
+		return true, errReprovisioned
+	case <-c.resets:
+		c.wasReset = true
+		c.goOffline(conn, errCh, "factory reset")
+		return true, errFactoryReset
+	}
 	if err != nil {
-		log.Printf("WS closed err=%v -> entering sleep", err)
+		c.logger().Info("connection closed", "err", err)
 	}
 	return true, err
 }
 
-func (c *AgentClient) readLoop(ctx context.Context, registered chan<- bool) error {
+func (c *AgentClient) readLoop(ctx context.Context, conn sessionConn, registered chan<- bool, challenges chan<- string) error {
 	registeredSent := false
 
 	for {
-		_, raw, err := c.conn.ReadMessage()
+		frameType, raw, err := conn.ReadMessage()
 		if err != nil {
-			return err
+			return keepaliveError(err)
 		}
-
-		var message struct {
-			Type    string          `json:"type"`
-			Payload json.RawMessage `json:"payload"`
+		extendReadDeadline(conn)
+		if raw, err = jsonFromFrame(frameType, raw); err != nil {
+			c.logger().Warn("dropping message", "err", err)
+			continue
 		}
+
+		var message adminMessage
 		if err := json.Unmarshal(raw, &message); err != nil {
 			continue
 		}
+		if message.Payload, err = decodePayload(message.Encoding, message.Payload); err != nil {
+			c.logger().Warn("dropping message", "type", message.Type, "err", err)
+			continue
+		}
 
 		switch message.Type {
+		case "challenge":
+			var payload ChallengePayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil || payload.Nonce == "" {
+				continue
+			}
+			select {
+			case challenges <- payload.Nonce:
+			default:
+			}
+
 		case "registered":
 			var payload RegisteredResponse
 			if err := json.Unmarshal(message.Payload, &payload); err != nil {
 				continue
 			}
-			log.Printf("WS registered response agent_id=%s ok=%v", c.profile.AgentID, payload.OK)
+			c.clock.observe(payload.AdminTime, time.Now())
+			c.logger().Debug("registered response", "ok", payload.OK, "protocol", payload.Protocol)
+			protocol, err := negotiateProtocol(payload.Protocol)
+			if err != nil {
+				c.logger().Warn("incompatible admin", "err", err)
+				if !registeredSent {
+					registered <- false
+				}
+				return err
+			}
+			c.setProtocol(protocol)
+			c.setWireFormat(negotiateWireFormat(protocol, payload.WireFormat))
+			c.setPayloadEncoding(negotiateEncoding(payload.Encoding))
+			if payload.ClientCert != "" {
+				if err := c.certs.accept(payload.ClientCert); err != nil {
+					c.logger().Warn("rejecting issued client certificate", "err", err)
+				}
+			}
 			if !registeredSent {
 				registered <- payload.OK
 				registeredSent = true
@@ -467,10 +1164,114 @@ func (c *AgentClient) readLoop(ctx context.Context, registered chan<- bool) erro
 			if err := json.Unmarshal(message.Payload, &payload); err != nil {
 				continue
 			}
-			go c.executeTask(payload)
+			payload.trace = c.tracer.startTask(payload, "task.receive")
+			c.sendAck(message.Seq)
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("rejecting task", "task_id", payload.TaskID, "kind", payload.Kind, "err", err)
+				c.rejectTask(payload, err)
+				continue
+			}
+			if message.Seq != 0 && !c.acks.firstDelivery(payload.TaskID) {
+				c.logger().Info("ignoring redelivered task", "task_id", payload.TaskID, "seq", message.Seq)
+				continue
+			}
+			if cached, ok := c.results.lookup(payload.TaskID); ok {
+				// Already run, but the admin never got the result.
+				c.logger().Info("resending cached result", "task_id", payload.TaskID)
+				_ = c.resendResult(cached)
+				continue
+			}
+			payload.signed = c.taskKey != nil
+			payload.trace.phase("task.queue")
+			position, err := c.pool.submit(payload)
+			if err != nil {
+				c.logger().Warn("rejecting task", "task_id", payload.TaskID, "kind", payload.Kind, "err", err)
+				c.rejectTask(payload, err)
+				continue
+			}
+			if position > 0 {
+				_ = c.send("task_queued", TaskQueuedPayload{TaskID: payload.TaskID, Position: position, Workers: c.pool.limits.Workers})
+			}
+
+		case "policy":
+			var payload PolicyPayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil {
+				continue
+			}
+			c.sendAck(message.Seq)
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("ignoring policy", "err", err)
+				continue
+			}
+			c.handlePolicy(payload)
+
+		case "config_update":
+			var payload ConfigUpdatePayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil {
+				continue
+			}
+			c.sendAck(message.Seq)
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("ignoring config_update", "err", err)
+				continue
+			}
+			c.handleConfigUpdate(payload)
+
+		case "reprovision":
+			var payload ReprovisionPayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil {
+				continue
+			}
+			c.sendAck(message.Seq)
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("ignoring reprovision", "err", err)
+				continue
+			}
+			c.handleReprovision(payload)
+
+		case "ack":
+			var payload AckPayload
+			if err := json.Unmarshal(message.Payload, &payload); err == nil {
+				c.acks.ack(payload.Seq)
+			}
+
+		case "update":
+			var payload UpdatePayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil {
+				continue
+			}
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("ignoring update", "update_id", payload.UpdateID, "err", err)
+				continue
+			}
+			go c.handleUpdate(payload)
+
+		case "history":
+			var payload HistoryPayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil {
+				continue
+			}
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("ignoring history", "request_id", payload.RequestID, "err", err)
+				continue
+			}
+			go c.handleHistory(payload)
 
 		case "task_cancel":
-			continue
+			var payload TaskCancelPayload
+			if err := json.Unmarshal(message.Payload, &payload); err != nil {
+				continue
+			}
+			if err := c.verifySigned(message); err != nil {
+				c.logger().Warn("ignoring task_cancel", "task_id", payload.TaskID, "err", err)
+				continue
+			}
+			if task, ok := c.pool.remove(payload.TaskID); ok {
+				errText := "task cancelled"
+				c.finishTask(task, TaskResultPayload{TaskID: task.TaskID, ScheduleID: task.ScheduleID, GroupID: task.GroupID, OK: false, Status: taskStatusCancelled, Error: &errText})
+			} else if !c.tasks.cancel(payload.TaskID) {
+				c.logger().Debug("task_cancel for unknown task", "task_id", payload.TaskID)
+			}
 		}
 
 		select {
@@ -482,69 +1283,100 @@ func (c *AgentClient) readLoop(ctx context.Context, registered chan<- bool) erro
 }
 
 func (c *AgentClient) heartbeatLoop(ctx context.Context) {
+	var shaper heartbeatShaper
 	for {
-		wait := jitterDuration(5, 10)
+		wait := c.tuning.heartbeatWait()
 
 		select {
 		case <-ctx.Done():
 			return
 		case <-time.After(wait):
-			internet, dns, gateway, latency := c.probeSnapshot()
+			probe := c.probes.Snapshot()
+			network := c.networkSnapshot()
 			payload := HeartbeatPayload{
 				Status:   "idle",
 				LastSeen: nowMS(),
-				Network:  c.networkSnapshot(),
+				Network:  &network,
 				Metrics: map[string]interface{}{
 					"goroutines":         runtime.NumGoroutine(),
-					"internet_reachable": internet,
-					"dns_ok":             dns,
-					"gateway_reachable":  gateway,
-					"latency_ms":         latency,
+					"internet_reachable": probe.Internet,
+					"dns_ok":             probe.DNS,
+					"gateway_reachable":  probe.Gateway,
+					"latency_ms":         probe.LatencyMS,
+					"jitter_ms":          probe.JitterMS,
+					"internet_method":    probe.InternetMethod,
+					"gateway_method":     probe.GatewayMethod,
+					"captive_portal":     probe.CaptivePortal,
+					"dns_resolvers":      resolverMetrics(probe.Resolvers),
 				},
 			}
-			if err := c.send("heartbeat", payload); err != nil {
+			c.clock.addMetrics(payload.Metrics)
+			if c.profile.Faults.dropHeartbeat() {
+				c.logger().Debug("fault injection: dropping heartbeat")
+				continue
+			}
+			if c.sim != nil {
+				for key, value := range c.sim.system() {
+					payload.Metrics[key] = value
+				}
+			} else {
+				for key, value := range systemMetrics() {
+					payload.Metrics[key] = value
+				}
+				if traffic := c.traffic.sample(); traffic != nil {
+					payload.Metrics["interfaces"] = traffic
+				}
+			}
+			c.exportHeartbeat(payload)
+			sendStart := time.Now()
+			if err := c.send("heartbeat", shaper.shape(payload)); err != nil {
 				return
 			}
+			c.metrics.heartbeatSent(time.Since(sendStart))
+			c.state.lastHeartbeatMS.Store(nowMS())
 		}
 	}
 }
 
 func (c *AgentClient) probeLoop(ctx context.Context) {
-	probeAndStore := func() {
-		internetOK, latency := probeInternet()
-		dnsOK := probeDNS()
-		gatewayOK := probeGateway()
-
-		c.probeMu.Lock()
-		defer c.probeMu.Unlock()
+	c.probes.Run(ctx)
+}
 
-		c.probe.internet = applyDebounce(c.probe.internet, internetOK, &c.probe.internetFailCount)
-		c.probe.dns = applyDebounce(c.probe.dns, dnsOK, &c.probe.dnsFailCount)
-		c.probe.gateway = applyDebounce(c.probe.gateway, gatewayOK, &c.probe.gatewayFailCount)
-		if internetOK {
-			lat := latency
-			c.probe.latencyMS = &lat
-		} else {
-			c.probe.latencyMS = nil
-		}
+func (c *AgentClient) onProbeResult(result netprobe.Result, _ netprobe.Snapshot) {
+	c.metrics.probeRuns.Add(1)
+	c.recordProbeHistory(result)
+	c.exportProbe(result)
+	if !result.Internet {
+		c.metrics.probeFailuresNet.Add(1)
+		return
 	}
+	if transition := c.latency.observe(float64(result.Latency.Milliseconds())); transition != nil {
+		_ = c.send("event", transition.event())
+	}
+}
 
-	probeAndStore()
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// ResolverMetric is one entry of the dns_resolvers heartbeat metric.
+type ResolverMetric struct {
+	Resolver  string `json:"resolver"`
+	OK        bool   `json:"ok"`
+	LatencyMS *int64 `json:"latency_ms"`
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			probeAndStore()
+func resolverMetrics(results []netprobe.ResolverResult) []ResolverMetric {
+	metrics := make([]ResolverMetric, 0, len(results))
+	for _, result := range results {
+		metric := ResolverMetric{Resolver: result.Resolver, OK: result.OK}
+		if result.OK {
+			ms := result.Latency.Milliseconds()
+			metric.LatencyMS = &ms
 		}
+		metrics = append(metrics, metric)
 	}
+	return metrics
 }
 
 func (c *AgentClient) networkFactsLoop(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(networkFactsInterval)
 	defer ticker.Stop()
 
 	for {
@@ -559,6 +1391,13 @@ func (c *AgentClient) networkFactsLoop(ctx context.Context) {
 }
 
 func (c *AgentClient) collectAndStoreNetworkFacts(includeARP bool) NetworkFacts {
+	if c.profile.Network != nil {
+		facts := *c.profile.Network
+		c.networkMu.Lock()
+		c.network = facts
+		c.networkMu.Unlock()
+		return facts
+	}
 	facts := collectNetworkFacts(includeARP)
 	c.networkMu.Lock()
 	c.network = facts
@@ -569,64 +1408,256 @@ func (c *AgentClient) collectAndStoreNetworkFacts(includeARP bool) NetworkFacts
 	return facts
 }
 
+// probeGatewayAddr is the gateway the connectivity probe checks: the one in
+// the latest network facts, or a fresh routing table lookup before the
+// first collection.
+func (c *AgentClient) probeGatewayAddr() string {
+	if gw := c.networkSnapshot().DefaultGatewayIP; gw != "" {
+		return gw
+	}
+	return detectDefaultGatewayIPv4()
+}
+
 func (c *AgentClient) networkSnapshot() NetworkFacts {
 	c.networkMu.Lock()
 	defer c.networkMu.Unlock()
 	return c.network
 }
 
-func (c *AgentClient) probeSnapshot() (*bool, *bool, *bool, *int64) {
-	c.probeMu.Lock()
-	defer c.probeMu.Unlock()
-
-	var internet *bool
-	if c.probe.internet != nil {
-		v := *c.probe.internet
-		internet = &v
+func (c *AgentClient) executeTask(task TaskPayload) {
+	task.trace.phase("task.execute")
+	deadline := taskDeadline(task)
+	ctx, finish := c.tasks.start(task.TaskID, deadline)
+	defer finish()
+
+	seq := 0
+	env := taskEnv{
+		AgentID:   c.profile.AgentID,
+		AdminIP:   c.adminIP,
+		Ctx:       ctx,
+		Progress:  &taskProgress{},
+		Schedules: c.schedules,
+		Policy:    c.policy,
+		Audit:     c.audit,
+		History:   c.history,
+		Reset:     c.requestReset,
+		Tags:      c.tags,
+		Responses: c.profile.Responses,
+		Sim:       c.sim,
+		Update: func(result interface{}, err error) {
+			seq++
+			update := TaskUpdatePayload{TaskID: task.TaskID, Seq: seq, TS: nowMS(), OK: err == nil, Result: result}
+			if err != nil {
+				errText := err.Error()
+				update.Error = &errText
+			}
+			_ = c.send("task_update", update)
+		},
+	}
+	go c.reportProgress(ctx, task.TaskID, env.Progress)
+	logger := c.logger().With("task_id", task.TaskID, "kind", task.Kind)
+	if task.trace != nil {
+		logger = logger.With("trace_id", task.trace.traceIDString())
+	}
+	logger.Debug("task started", "schedule_id", task.ScheduleID)
+	started := time.Now()
+	result, err := awaitTask(ctx, func() (interface{}, error) {
+		if err := c.profile.Faults.delayTask(ctx); err != nil {
+			return nil, err
+		}
+		return runTask(c.profile.IsFake, env, task.Kind, task.Params)
+	})
+	task.trace.phase("task.send_result")
+	response := TaskResultPayload{TaskID: task.TaskID, ScheduleID: task.ScheduleID, GroupID: task.GroupID, OK: err == nil, Status: taskStatusCompleted, Result: result}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("task timed out after %s", deadline)
+		response.OK = false
+		response.Status = taskStatusTimedOut
+	} else if ctx.Err() != nil {
+		err = errors.New("task cancelled")
+		response.OK = false
+		response.Status = taskStatusCancelled
+	} else if perr, ok := err.(*policyError); ok {
+		response.Status = taskStatusRejected
+		response.ErrorCode = perr.Code
+	} else if err != nil {
+		response.Status = taskStatusFailed
+		if perr := (*policyError)(nil); errors.As(err, &perr) {
+			response.ErrorCode = perr.Code
+		}
 	}
-	var dns *bool
-	if c.probe.dns != nil {
-		v := *c.probe.dns
-		dns = &v
+	if err != nil {
+		errText := err.Error()
+		response.Error = &errText
+	} else {
+		addScanDiff(c.history, task, result)
 	}
-	var gateway *bool
-	if c.probe.gateway != nil {
-		v := *c.probe.gateway
-		gateway = &v
+	c.auditTask(task, response, time.Since(started))
+	c.recordTaskHistory(task, response, time.Since(started))
+	c.metrics.taskDone(task.Kind, response.Status)
+	if response.Status == taskStatusFailed || response.Status == taskStatusTimedOut {
+		logger.Warn("task failed", "status", response.Status, "err", err)
+	} else {
+		logger.Debug("task finished", "status", response.Status, "duration_ms", time.Since(started).Milliseconds())
 	}
-	var latency *int64
-	if c.probe.latencyMS != nil {
-		v := *c.probe.latencyMS
-		latency = &v
+	c.pushWebhooks(task, response, time.Since(started))
+	if webhookOnly && c.webhooks != nil {
+		// The webhooks carry the result; the admin still learns the outcome.
+		response.Result = nil
 	}
+	c.finishTask(task, response)
+}
 
-	return internet, dns, gateway, latency
+func (c *AgentClient) auditTask(task TaskPayload, response TaskResultPayload, took time.Duration) {
+	entry := auditEntry{
+		TS:           nowMS(),
+		TaskID:       task.TaskID,
+		ScheduleID:   task.ScheduleID,
+		GroupID:      task.GroupID,
+		Kind:         task.Kind,
+		ParamsSHA256: paramsDigest(task.Params),
+		Admin:        c.adminIP,
+		Signed:       task.signed,
+		Status:       response.Status,
+		ErrorCode:    response.ErrorCode,
+		DurationMS:   took.Milliseconds(),
+	}
+	c.audit.record(entry)
+	c.syslogTask(entry)
 }
 
-func (c *AgentClient) executeTask(task TaskPayload) {
-	result, err := runTask(c.profile.IsFake, task.Kind, task.Params)
-	response := TaskResultPayload{TaskID: task.TaskID, OK: err == nil, Result: result}
-	if err != nil {
-		errText := err.Error()
-		response.Error = &errText
+func (c *AgentClient) reportProgress(ctx context.Context, taskID string, progress *taskProgress) {
+	ticker := time.NewTicker(taskProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if payload, ok := progress.snapshot(taskID); ok {
+				_ = c.send("task_progress", payload)
+			}
+		}
+	}
+}
+
+func (c *AgentClient) reportPreempted(queued TaskPayload, position int, by TaskPayload) {
+	_ = c.send("task_progress", TaskProgressPayload{TaskID: queued.TaskID, Queued: true, Position: position, PreemptedBy: by.TaskID})
+}
+
+func (c *AgentClient) rejectTask(task TaskPayload, reason error) {
+	errText := reason.Error()
+	response := TaskResultPayload{TaskID: task.TaskID, ScheduleID: task.ScheduleID, GroupID: task.GroupID, OK: false, Status: taskStatusRejected, Error: &errText}
+	c.auditTask(task, response, 0)
+	c.recordTaskHistory(task, response, 0)
+	c.metrics.taskDone(task.Kind, response.Status)
+	c.pushWebhooks(task, response, 0)
+	c.finishTask(task, response)
+}
+
+func (c *AgentClient) runScheduled(spec ScheduleSpec, at time.Time) {
+	task := TaskPayload{
+		TaskID:     fmt.Sprintf("%s-%d", spec.ScheduleID, at.UnixMilli()),
+		Kind:       spec.Kind,
+		Params:     spec.Params,
+		DeadlineMS: spec.DeadlineMS,
+		ScheduleID: spec.ScheduleID,
+		Priority:   spec.Priority,
+	}
+	task.trace = c.tracer.startTask(task, "task.queue")
+	if _, err := c.pool.submit(task); err != nil {
+		c.logger().Warn("skipping scheduled task", "schedule_id", spec.ScheduleID, "err", err)
+		c.rejectTask(task, err)
 	}
-	_ = c.send("task_result", response)
 }
 
-func runTask(fake bool, kind string, params map[string]interface{}) (interface{}, error) {
+func runTask(fake bool, env taskEnv, kind string, params map[string]interface{}) (interface{}, error) {
+	if err := env.Policy.checkKind(kind); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "monitor":
+		return runMonitor(fake, env, params)
+	case "pipeline":
+		return runPipeline(fake, env, params)
+	case "audit_log":
+		return runAuditLog(env, params)
+	case "history_query":
+		return runHistoryQuery(env, params)
+	case "tags":
+		return env.Tags.manage(params)
+	case "schedule":
+		if asString(params["action"], "") == "add" {
+			if err := env.Policy.checkKind(asString(params["kind"], "")); err != nil {
+				return nil, err
+			}
+		}
+		if env.Schedules == nil {
+			return nil, errors.New("schedules are not available")
+		}
+		return env.Schedules.manage(params)
+	}
+	params, pins, err := env.Policy.checkTargets(env.context(), kind, params)
+	if err != nil {
+		return nil, err
+	}
+	env.Pins = pins
+	if env.Exclude == nil {
+		if env.Exclude, err = loadExclusions(env.context(), params); err != nil {
+			return nil, err
+		}
+	}
+	if multiTargetKinds[kind] {
+		targets, multi, err := expandTargets(params["target"])
+		if err != nil {
+			return nil, err
+		}
+		if multi {
+			return runEachTarget(env, params, targets, func(env taskEnv, params map[string]interface{}) (interface{}, error) {
+				return runTask(fake, env, kind, params)
+			})
+		}
+	}
+	if err := env.Exclude.checkTargets(env.context(), kind, params); err != nil {
+		return nil, err
+	}
 	if fake {
+		if response, ok := env.Responses[kind]; ok {
+			return response.reply()
+		}
 		switch kind {
 		case "ping":
+			if env.Sim != nil {
+				return env.Sim.ping(asString(params["target"], "")), nil
+			}
 			return map[string]interface{}{"ok": true, "latency_ms": 5 + rand.Intn(25)}, nil
 		case "port_scan":
-			ports := asIntSlice(params["ports"], []int{22, 80, 443})
+			ports, preset, err := scanPorts(params, []int{22, 80, 443})
+			if err != nil {
+				return nil, err
+			}
+			ports, excludedPorts := env.Exclude.filterPorts(ports)
 			openPorts := make([]int, 0)
 			for _, p := range ports {
 				if p%2 == 0 || p == 443 {
 					openPorts = append(openPorts, p)
 				}
 			}
-			return map[string]interface{}{"open_ports": openPorts, "scanned": len(ports)}, nil
+			result := map[string]interface{}{"open_ports": openPorts, "scanned": len(ports)}
+			if preset != "" {
+				result["preset"] = preset
+			}
+			if excludedPorts > 0 {
+				result["excluded_ports"] = excludedPorts
+			}
+			if detect, _ := params["detect_services"].(bool); detect {
+				services := make([]serviceInfo, 0, len(openPorts))
+				for _, port := range openPorts {
+					services = append(services, guessServiceByPort(port))
+				}
+				result["services"] = services
+			}
+			return result, nil
 		case "arp_snapshot":
 			entries := []string{
 				"192.168.1.1 aa-bb-cc-dd-ee-01 dynamic",
@@ -634,6 +1665,106 @@ func runTask(fake bool, kind string, params map[string]interface{}) (interface{}
 				"192.168.1.51 aa-bb-cc-dd-ee-51 dynamic",
 			}
 			return map[string]interface{}{"entries": entries, "count": len(entries)}, nil
+		case "rdns_sweep":
+			return runFakeRDNSSweep(params)
+		case "throughput_test":
+			return map[string]interface{}{
+				"role":       asString(params["role"], "client"),
+				"bytes":      int64(1180000000),
+				"duration_s": 10.0,
+				"mbps":       900 + rand.Float64()*40,
+				"jitter_ms":  rand.Float64() * 2,
+			}, nil
+		case "iperf3":
+			return map[string]interface{}{
+				"role":        asString(params["role"], "client"),
+				"duration_s":  10.0,
+				"sent_bytes":  int64(1175000000),
+				"recv_bytes":  int64(1174000000),
+				"mbps":        920 + rand.Float64()*20,
+				"retransmits": rand.Intn(12),
+			}, nil
+		case "wol":
+			return map[string]interface{}{
+				"mac":     normalizeMAC(asString(params["mac"], "02:00:00:00:00:ff")),
+				"port":    asInt(params["port"], 9),
+				"sent_to": []string{"255.255.255.255", "192.168.1.255"},
+			}, nil
+		case "banner_grab":
+			target := asString(params["target"], "192.168.1.20")
+			banners := []bannerResult{
+				{Target: target, Port: 22, Banner: "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6"},
+				{Target: target, Port: 80, Probe: "http", Banner: "HTTP/1.1 200 OK"},
+			}
+			return map[string]interface{}{"banners": banners, "count": len(banners)}, nil
+		case "os_guess":
+			guesses := []string{"windows", "linux", "printer", "network-device"}
+			return map[string]interface{}{
+				"target":     asString(params["target"], "192.168.1.20"),
+				"guess":      guesses[rand.Intn(len(guesses))],
+				"confidence": 0.6 + rand.Float64()*0.3,
+			}, nil
+		case "host_discovery":
+			hosts := []discoveredHost{
+				{IP: "192.168.1.1", Method: "icmp", LatencyMS: 1},
+				{IP: "192.168.1.20", Method: "icmp", LatencyMS: 2},
+				{IP: "192.168.1.51", Method: "tcp", Port: 9100, LatencyMS: 4},
+			}
+			return map[string]interface{}{"cidr": asString(params["cidr"], "192.168.1.0/24"), "hosts": hosts, "live": len(hosts), "scanned": 254, "icmp": true}, nil
+		case "smb_enum":
+			enabled, required := true, false
+			hosts := []smbHostInfo{{
+				IP:              "192.168.1.20",
+				NetBIOSName:     "LAB-B-PC20",
+				Workgroup:       "LABSCAN",
+				MAC:             "aa:bb:cc:dd:ee:14",
+				SMBDialect:      "3.1.1",
+				SigningEnabled:  &enabled,
+				SigningRequired: &required,
+			}}
+			return map[string]interface{}{"hosts": hosts, "count": len(hosts), "scanned": 254}, nil
+		case "dhcp_discover":
+			offers := []dhcpOfferInfo{{
+				ServerID:   "192.168.1.1",
+				Source:     "192.168.1.1",
+				OfferedIP:  "192.168.1.150",
+				SubnetMask: "255.255.255.0",
+				SubnetCIDR: "192.168.1.0/24",
+				Gateways:   []string{"192.168.1.1"},
+				DNSServers: []string{"192.168.1.1"},
+				LeaseTimeS: 86400,
+			}}
+			return map[string]interface{}{"offers": offers, "servers": len(offers), "duplicate": false}, nil
+		case "speed_test":
+			return map[string]interface{}{
+				"download_mbps":     80 + rand.Float64()*40,
+				"upload_mbps":       20 + rand.Float64()*15,
+				"idle_latency_ms":   8 + rand.Intn(6),
+				"loaded_latency_ms": 25 + rand.Intn(40),
+			}, nil
+		case "pcap_capture":
+			return runFakePCAPCapture(params)
+		case "topology_map":
+			return runFakeTopologyMap(env, params)
+		case "inventory":
+			if env.Sim == nil {
+				return nil, errors.New("fake inventory needs a simulated host")
+			}
+			return env.Sim.inventory(params), nil
+		case "ntp_check":
+			return runFakeNTPCheck(params), nil
+		case "http_check":
+			return runFakeHTTPCheck(params)
+		case "tls_info":
+			return runFakeTLSInfo(params)
+		case "factory_reset":
+			return map[string]interface{}{"resetting": false, "agent_id": env.AgentID, "fake": true}, nil
+		case "public_ip":
+			result := map[string]interface{}{"public_ip": "203.0.113.24", "mapped_port": 40000 + rand.Intn(20000), "source": "stun:stun.l.google.com:19302"}
+			if geo, _ := params["geoip"].(bool); geo {
+				result["geoip"] = map[string]interface{}{"ip": "203.0.113.24", "city": "Colombo", "country": "LK", "org": "AS64500 LabNet ISP"}
+			}
+			return result, nil
 		default:
 			return nil, fmt.Errorf("unsupported task kind: %s", kind)
 		}
@@ -643,16 +1774,52 @@ func runTask(fake bool, kind string, params map[string]interface{}) (interface{}
 	case "ping":
 		return runRealPing(params)
 	case "port_scan":
-		return runRealPortScan(params)
+		return runRealPortScan(env, params)
 	case "arp_snapshot":
 		return runRealARPSnapshot()
+	case "rdns_sweep":
+		return runRDNSSweep(env, params)
+	case "throughput_test":
+		return runThroughputTest(env, params)
+	case "iperf3":
+		return runIperf3(env, params)
+	case "wol":
+		return runWakeOnLAN(params)
+	case "banner_grab":
+		return runBannerGrab(env, params)
+	case "os_guess":
+		return runOSGuess(env, params)
+	case "host_discovery":
+		return runHostDiscovery(env, params)
+	case "smb_enum":
+		return runSMBEnum(env, params)
+	case "dhcp_discover":
+		return runDHCPDiscover(params)
+	case "speed_test":
+		return runSpeedTest(env, params)
+	case "pcap_capture":
+		return runPCAPCapture(env, params)
+	case "public_ip":
+		return runPublicIP(env, params)
+	case "topology_map":
+		return runTopologyMap(env, params)
+	case "inventory":
+		return runInventory(params)
+	case "ntp_check":
+		return runNTPCheck(env, params)
+	case "http_check":
+		return runHTTPCheck(env, params)
+	case "tls_info":
+		return runTLSInfo(env, params)
+	case "factory_reset":
+		return runFactoryReset(env, params)
 	default:
 		return nil, fmt.Errorf("unsupported task kind: %s", kind)
 	}
 }
 
 func runRealPing(params map[string]interface{}) (interface{}, error) {
-	target := asString(params["target"], "8.8.8.8")
+	target := unbracket(asString(params["target"], "8.8.8.8"))
 	timeoutMS := asInt(params["timeout_ms"], 1200)
 	addr := net.JoinHostPort(target, "80")
 
@@ -670,33 +1837,14 @@ func runRealPing(params map[string]interface{}) (interface{}, error) {
 	}, nil
 }
 
-func runRealPortScan(params map[string]interface{}) (interface{}, error) {
-	target := asString(params["target"], "127.0.0.1")
-	ports := asIntSlice(params["ports"], []int{22, 80, 443})
-	timeoutMS := asInt(params["timeout_ms"], 700)
-
-	openPorts := make([]int, 0)
-	for _, port := range ports {
-		addr := fmt.Sprintf("%s:%d", target, port)
-		conn, err := net.DialTimeout("tcp", addr, time.Duration(timeoutMS)*time.Millisecond)
-		if err == nil {
-			openPorts = append(openPorts, port)
-			_ = conn.Close()
-		}
-	}
-
-	return map[string]interface{}{"target": target, "open_ports": openPorts, "scanned": len(ports)}, nil
-}
-
 func runRealARPSnapshot() (interface{}, error) {
-	var cmd *exec.Cmd
+	var out []byte
+	var err error
 	if runtime.GOOS == "windows" {
-		cmd = exec.Command("arp", "-a")
+		out, err = sandboxedOutput("arp", "-a")
 	} else {
-		cmd = exec.Command("ip", "neigh")
+		out, err = sandboxedOutput("ip", "neigh")
 	}
-
-	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("arp snapshot failed: %w", err)
 	}
@@ -706,19 +1854,73 @@ func runRealARPSnapshot() (interface{}, error) {
 }
 
 func (c *AgentClient) send(messageType string, payload interface{}) error {
-	if c.conn == nil {
+	if event, ok := payload.(EventPayload); ok && messageType == "event" {
+		c.syslogEvent(event)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.sendRaw(messageType, nowMS(), raw)
+}
+
+// sendRaw sends an already marshalled payload, buffering task results and
+// heartbeats in the outbox when there is no connection or the write fails.
+func (c *AgentClient) sendRaw(messageType string, ts int64, raw []byte) error {
+	queue := c.currentOutbound()
+	if queue == nil {
+		c.outbox.add(messageType, ts, raw)
 		return errors.New("connection unavailable")
 	}
+	if !c.peerAccepts(messageType) {
+		return nil
+	}
+	body, encoding := c.encodePayload(raw)
+	if err := c.sendWire(queue, messageType, ts, 0, encoding, body); err != nil {
+		c.outbox.add(messageType, ts, raw)
+		return err
+	}
+	return nil
+}
 
-	wire := WireMessage{Type: messageType, TS: nowMS(), AgentID: c.profile.AgentID, Payload: payload}
+func (c *AgentClient) sendWire(queue *sendQueue, messageType string, ts int64, seq uint64, encoding string, body interface{}) error {
+	wire := WireMessage{Type: messageType, TS: ts, AgentID: c.profile.AgentID, Encoding: encoding, Seq: seq, Payload: body}
 	raw, err := json.Marshal(wire)
 	if err != nil {
 		return err
 	}
+	frame, raw, err := frameFor(c.currentWireFormat(), raw)
+	if err != nil {
+		return err
+	}
+	return queue.enqueue(messageClassFor(messageType), frame, raw)
+}
+
+func (c *AgentClient) setOutbound(queue *sendQueue) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.encoding = ""
+	c.protocol = 0
+	c.format = wireJSON
+	c.outbound = queue
+}
+
+func (c *AgentClient) currentOutbound() *sendQueue {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return c.outbound
+}
+
+func (c *AgentClient) setPayloadEncoding(encoding string) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.encoding = encoding
+}
 
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
-	return c.conn.WriteMessage(websocket.TextMessage, raw)
+func (c *AgentClient) payloadEncoding() string {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return c.encoding
 }
 
 func loadConfig() (*PersistedConfig, error) {
@@ -731,15 +1933,89 @@ func loadConfig() (*PersistedConfig, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := openSecret(&cfg); err != nil {
+		return nil, fmt.Errorf("load secret: %w", err)
+	}
 	return &cfg, nil
 }
 
+var (
+	// configMu guards a running client's config, which the session, the
+	// tags task, certificate renewal, and policy and config_update messages
+	// change concurrently.
+	configMu sync.Mutex
+	// configFileMu serializes writes of configPath.
+	configFileMu sync.Mutex
+)
+
+// updateConfig applies change to the client's config and, for real agents,
+// persists the result.
+func (c *AgentClient) updateConfig(change func(cfg *PersistedConfig)) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	change(c.config)
+	if c.profile.IsFake {
+		return nil
+	}
+	return saveConfig(c.config)
+}
+
+func (c *AgentClient) configSnapshot() PersistedConfig {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return *c.config
+}
+
+// saveConfig writes cfg to configPath through writeFileAtomic, so readers
+// and a crash never see a partial file. Callers sharing cfg with a running
+// client go through updateConfig.
 func saveConfig(cfg *PersistedConfig) error {
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	sealed, err := sealSecret(*cfg, secretStoreMode)
+	if err != nil {
+		return err
+	}
+	if sealed.Settings == nil {
+		// Provisioning builds a fresh config; keep the operator's settings.
+		sealed.Settings, _ = readFileSettings(configPath)
+	}
+	data, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(configPath); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(configPath, data, 0o600)
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it,
+// and renames it over path, so a crash or a concurrent writer never leaves
+// a truncated file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(configPath, data, 0o644)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func resolveIdentityPath(override string) string {
@@ -789,7 +2065,7 @@ func loadOrCreateIdentity(path string, defaultFingerprint string) (*AgentIdentit
 				identity.CreatedAt = nowMS()
 			}
 			if writeErr := writeIdentity(path, &identity); writeErr != nil {
-				log.Printf("warning: failed to rewrite identity file: %v", writeErr)
+				slog.Warn("failed to rewrite identity file", "path", path, "err", writeErr)
 			}
 			return &identity, nil
 		}
@@ -876,7 +2152,7 @@ func fakeFingerprint(baseFingerprint string, index int) string {
 }
 
 func fakeMACForIndex(index int) string {
-	return fmt.Sprintf("02:00:00:00:00:%02x", index&0xff)
+	return fmt.Sprintf("02:00:00:00:%02x:%02x", (index>>8)&0xff, index&0xff)
 }
 
 func localIPv4s() []string {
@@ -1058,6 +2334,10 @@ func pickPrimaryInterface(gatewayIP string) (*net.Interface, *net.IPNet) {
 }
 
 func detectDefaultGatewayIPv4() string {
+	if gw := routeTableGateway(); gw != "" {
+		return gw
+	}
+
 	if runtime.GOOS == "windows" {
 		out, err := exec.Command("route", "print", "-4").CombinedOutput()
 		if err == nil {
@@ -1227,102 +2507,53 @@ func defaultSubnetCIDR(ip string) string {
 	return parts[0] + "." + parts[1] + "." + parts[2] + ".0/24"
 }
 
-func normalizeMAC(mac string) string {
-	return strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
-}
-
-func isIPv4(v string) bool {
-	ip := net.ParseIP(strings.TrimSpace(v))
-	return ip != nil && ip.To4() != nil
-}
-
-func isPrivateIP(ip net.IP) bool {
-	ip4 := ip.To4()
-	if ip4 == nil {
-		return false
-	}
-
-	if ip4[0] == 10 {
-		return true
-	}
-	if ip4[0] == 172 && ip4[1] >= 16 && ip4[1] <= 31 {
-		return true
-	}
-	if ip4[0] == 192 && ip4[1] == 168 {
-		return true
-	}
-	if ip4[0] == 127 {
-		return true
-	}
-	return false
-}
-
-func applyDebounce(current *bool, probeOK bool, failCount *int) *bool {
-	if probeOK {
-		*failCount = 0
-		value := true
-		return &value
+// expandCIDR lists the addresses of an IPv4 or IPv6 prefix, skipping the
+// IPv4 network and broadcast addresses and the IPv6 subnet-router anycast
+// address. Prefixes with more than limit addresses are refused; IPv6 sweeps
+// are therefore limited to narrow prefixes such as a /112.
+func expandCIDR(cidr string, limit int) ([]string, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q: %w", cidr, err)
 	}
+	prefix = prefix.Masked()
 
-	*failCount = *failCount + 1
-	if current == nil {
-		if *failCount >= 2 {
-			value := false
-			return &value
-		}
-		return nil
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 30 {
+		return nil, fmt.Errorf("cidr %s has 2^%d addresses, limit is %d", cidr, hostBits, limit)
 	}
-
-	if *current && *failCount >= 2 {
-		value := false
-		return &value
+	size := 1 << hostBits
+	if limit > 0 && size > limit {
+		return nil, fmt.Errorf("cidr %s has %d addresses, limit is %d", cidr, size, limit)
 	}
 
-	return current
-}
-
-func probeInternet() (bool, int64) {
-	targets := []string{"1.1.1.1:443", "8.8.8.8:53"}
-	for _, target := range targets {
-		start := time.Now()
-		conn, err := net.DialTimeout("tcp", target, 2*time.Second)
-		if err == nil {
-			_ = conn.Close()
-			return true, time.Since(start).Milliseconds()
+	ips := make([]string, 0, size)
+	addr := prefix.Addr()
+	for i := 0; i < size; i, addr = i+1, addr.Next() {
+		if size > 2 && (i == 0 || (i == size-1 && addr.Is4())) {
+			continue
 		}
+		ips = append(ips, addr.String())
 	}
-	return false, 0
+	return ips, nil
 }
 
-func probeDNS() bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	resolver := net.Resolver{}
-	_, err := resolver.LookupHost(ctx, "example.com")
-	return err == nil
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
 }
 
-func probeGateway() bool {
-	gateways := []string{"192.168.1.1:53", "10.0.0.1:53", "172.16.0.1:53"}
-	for _, gateway := range gateways {
-		conn, err := net.DialTimeout("tcp", gateway, 1500*time.Millisecond)
-		if err == nil {
-			_ = conn.Close()
-			return true
-		}
-	}
-	return false
+func isIPv4(v string) bool {
+	ip := net.ParseIP(strings.TrimSpace(v))
+	return ip != nil && ip.To4() != nil
 }
 
-func jitterDuration(minSeconds, maxSeconds int) time.Duration {
-	if minSeconds < 1 {
-		minSeconds = 1
-	}
-	if maxSeconds < minSeconds {
-		maxSeconds = minSeconds
+// isPrivateIP accepts RFC 1918 and loopback IPv4 addresses, and unique
+// local (fc00::/7), link-local, and loopback IPv6 addresses.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.IsPrivate() || ip4.IsLoopback()
 	}
-	rangeSize := maxSeconds - minSeconds + 1
-	return time.Duration(minSeconds+rand.Intn(rangeSize)) * time.Second
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLoopback()
 }
 
 func asString(v interface{}, fallback string) string {
@@ -1346,25 +2577,22 @@ func asInt(v interface{}, fallback int) int {
 	}
 }
 
-func asIntSlice(v interface{}, fallback []int) []int {
+func asStringSlice(v interface{}, fallback []string) []string {
 	values, ok := v.([]interface{})
 	if !ok {
 		return fallback
 	}
 
-	ports := make([]int, 0, len(values))
+	out := make([]string, 0, len(values))
 	for _, raw := range values {
-		switch val := raw.(type) {
-		case int:
-			ports = append(ports, val)
-		case float64:
-			ports = append(ports, int(val))
+		if str := asString(raw, ""); str != "" {
+			out = append(out, str)
 		}
 	}
-	if len(ports) == 0 {
+	if len(out) == 0 {
 		return fallback
 	}
-	return ports
+	return out
 }
 
 func nowMS() int64 {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandCIDR(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		first string
+		last  string
+		count int
+	}{
+		{"192.168.1.0/24", "192.168.1.1", "192.168.1.254", 254},
+		{"192.168.1.77/30", "192.168.1.77", "192.168.1.78", 2},
+		{"10.0.0.8/31", "10.0.0.8", "10.0.0.9", 2},
+		{"10.0.0.8/32", "10.0.0.8", "10.0.0.8", 1},
+		{"2001:db8::/120", "2001:db8::1", "2001:db8::ff", 255},
+		{"2001:db8::5/127", "2001:db8::4", "2001:db8::5", 2},
+		{"2001:db8::/112", "2001:db8::1", "2001:db8::ffff", 65535},
+	}
+	for _, tt := range tests {
+		ips, err := expandCIDR(tt.cidr, maxSweepAddresses)
+		if err != nil {
+			t.Fatalf("expandCIDR(%q): %v", tt.cidr, err)
+		}
+		if len(ips) != tt.count || ips[0] != tt.first || ips[len(ips)-1] != tt.last {
+			t.Errorf("expandCIDR(%q) = %d addresses %s..%s, want %d %s..%s", tt.cidr, len(ips), ips[0], ips[len(ips)-1], tt.count, tt.first, tt.last)
+		}
+	}
+}
+
+func TestExpandCIDRLimits(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{"10.0.0.0/8", "has 16777216 addresses"},
+		{"2001:db8::/111", "has 131072 addresses"},
+		{"2001:db8::/64", "has 2^64 addresses"},
+		{"::/0", "has 2^128 addresses"},
+		{"2001:db8::/129", "invalid cidr"},
+		{"fe80::1", "invalid cidr"},
+	}
+	for _, tt := range tests {
+		_, err := expandCIDR(tt.cidr, maxSweepAddresses)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("expandCIDR(%q) = %v, want an error containing %q", tt.cidr, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const mdnsService = "_labscan._tcp.local."
+
+var (
+	mdnsInterval = 30 * time.Second
+	mdnsGroup    = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+// ProvisionRequest asks an admin found over mDNS to send this agent a
+// LABSCAN_PROVISION packet directly, for networks where its broadcasts do
+// not arrive.
+type ProvisionRequest struct {
+	Type    string `json:"type"`
+	V       int    `json:"v"`
+	AgentID string `json:"agent_id"`
+	Host    string `json:"hostname"`
+	Nonce   string `json:"nonce"`
+	TS      int64  `json:"ts"`
+}
+
+// mdnsAdmin is one _labscan._tcp advertisement.
+type mdnsAdmin struct {
+	instance      string
+	ip            net.IP
+	port          int
+	provisionPort int
+}
+
+// browseMDNS sends a one-shot PTR query for mdnsService from an ephemeral
+// port, so responders answer by unicast (RFC 6762 section 6.7) and the
+// agent needs neither port 5353 nor group membership.
+func browseMDNS(ctx context.Context, timeout time.Duration) ([]mdnsAdmin, error) {
+	query := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName(mdnsService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}}
+	raw, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if _, err := conn.WriteTo(raw, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	var admins []mdnsAdmin
+	buf := make([]byte, 9000)
+	for {
+		n, sender, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return admins, nil
+			}
+			return admins, err
+		}
+		admins = append(admins, parseMDNSResponse(buf[:n], sender.IP)...)
+	}
+}
+
+// parseMDNSResponse collects the advertised instances from one response.
+// Responders put SRV, TXT, and A records in the additional section; when
+// the A record is missing the sender's address is used.
+func parseMDNSResponse(raw []byte, sender net.IP) []mdnsAdmin {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(raw); err != nil {
+		return nil
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	var records []dnsmessage.Resource
+	for section := 0; section < 3; section++ {
+		for {
+			var resource dnsmessage.Resource
+			var err error
+			switch section {
+			case 0:
+				resource, err = parser.Answer()
+			case 1:
+				resource, err = parser.Authority()
+			default:
+				resource, err = parser.Additional()
+			}
+			if err != nil {
+				break
+			}
+			records = append(records, resource)
+		}
+	}
+
+	addrs := make(map[string]net.IP)
+	srvs := make(map[string]*dnsmessage.SRVResource)
+	txts := make(map[string][]string)
+	var instances []string
+	for _, record := range records {
+		name := strings.ToLower(record.Header.Name.String())
+		switch body := record.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == mdnsService {
+				instances = append(instances, strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			srvs[name] = body
+		case *dnsmessage.TXTResource:
+			txts[name] = body.TXT
+		case *dnsmessage.AResource:
+			addrs[name] = net.IP(body.A[:])
+		}
+	}
+
+	var admins []mdnsAdmin
+	for _, instance := range instances {
+		admin := mdnsAdmin{instance: instance, ip: sender, provisionPort: provisionUDPPort}
+		if srv := srvs[instance]; srv != nil {
+			admin.port = int(srv.Port)
+			if ip := addrs[strings.ToLower(srv.Target.String())]; ip != nil {
+				admin.ip = ip
+			}
+		}
+		for _, entry := range txts[instance] {
+			if value, ok := strings.CutPrefix(entry, "provision_port="); ok {
+				if port, err := strconv.Atoi(value); err == nil && port > 0 && port < 65536 {
+					admin.provisionPort = port
+				}
+			}
+		}
+		admins = append(admins, admin)
+	}
+	return admins
+}
+
+// mdnsProvisionLoop browses for admins every mdnsInterval while the agent
+// waits for provisioning and asks each one it finds for a provisioning
+// packet. Requests go out from conn, the provisioning listener, so the
+// admin's unicast reply is handled like a broadcast one.
+func mdnsProvisionLoop(ctx context.Context, conn net.PacketConn, agentID, hostname string) {
+	if mdnsInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(mdnsInterval)
+	defer ticker.Stop()
+	for {
+		admins, err := browseMDNS(ctx, 2*time.Second)
+		if err != nil && ctx.Err() == nil {
+			slog.Debug("mDNS browse failed", "err", err)
+		}
+		for _, admin := range admins {
+			if !isPrivateIP(admin.ip) {
+				continue
+			}
+			request := ProvisionRequest{Type: "LABSCAN_PROVISION_REQUEST", V: 1, AgentID: agentID, Host: hostname, Nonce: uuid.NewString(), TS: nowMS()}
+			raw, err := json.Marshal(request)
+			if err != nil {
+				continue
+			}
+			target := &net.UDPAddr{IP: admin.ip, Port: admin.provisionPort}
+			slog.Info("admin found over mDNS, requesting provisioning", "instance", admin.instance, "admin", target.String(), "ws_port", admin.port)
+			_, _ = conn.WriteTo(raw, target)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
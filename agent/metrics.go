@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var metricsAddr = ""
+
+// agentMetrics are per-client counters exported on /metrics. They are kept
+// by hand in the Prometheus text format rather than pulling in the client
+// library for a handful of series.
+type agentMetrics struct {
+	connects         atomic.Uint64
+	dialFailures     atomic.Uint64
+	heartbeatSendNS  atomic.Int64
+	heartbeatsSent   atomic.Uint64
+	probeRuns        atomic.Uint64
+	probeFailuresNet atomic.Uint64
+
+	mu    sync.Mutex
+	tasks map[taskMetricKey]uint64
+}
+
+type taskMetricKey struct {
+	kind   string
+	status string
+}
+
+func (m *agentMetrics) taskDone(kind, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tasks == nil {
+		m.tasks = make(map[taskMetricKey]uint64)
+	}
+	m.tasks[taskMetricKey{kind, status}]++
+}
+
+func (m *agentMetrics) heartbeatSent(took time.Duration) {
+	m.heartbeatsSent.Add(1)
+	m.heartbeatSendNS.Store(took.Nanoseconds())
+}
+
+type metricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func (mw *metricsWriter) sample(name, kind, help string, value float64, labels ...string) {
+	if !mw.seen[name] {
+		mw.seen[name] = true
+		fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	if len(pairs) > 0 {
+		fmt.Fprintf(mw.w, "%s{%s} %g\n", name, strings.Join(pairs, ","), value)
+	} else {
+		fmt.Fprintf(mw.w, "%s %g\n", name, value)
+	}
+}
+
+func boolGauge(v *bool) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	if *v {
+		return 1, true
+	}
+	return 0, true
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{w: w, seen: make(map[string]bool)}
+	mw.sample("labscan_agent_info", "gauge", "Agent build information.", 1, "version", agentVersion, "os", runtime.GOOS, "arch", runtime.GOARCH)
+	mw.sample("labscan_agent_uptime_seconds", "gauge", "Seconds since the agent process started.", time.Since(processStarted).Seconds())
+	mw.sample("labscan_agent_goroutines", "gauge", "Number of goroutines in the agent process.", float64(runtime.NumGoroutine()))
+
+	clients := agentStatus.snapshot()
+	// Emit each metric for every client before moving to the next metric, so
+	// HELP/TYPE appear once per family as the format requires.
+	each := func(emit func(c *AgentClient, id string)) {
+		for _, c := range clients {
+			emit(c, c.profile.AgentID)
+		}
+	}
+	each(func(c *AgentClient, id string) {
+		connected := 0.0
+		if c.state.connected.Load() {
+			connected = 1
+		}
+		mw.sample("labscan_agent_connected", "gauge", "Whether the agent is registered with the admin.", connected, "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_ws_connects_total", "counter", "Websocket connections established; more than one means reconnects.", float64(c.metrics.connects.Load()), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_ws_dial_failures_total", "counter", "Failed websocket dials.", float64(c.metrics.dialFailures.Load()), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_heartbeats_sent_total", "counter", "Heartbeats written to the admin.", float64(c.metrics.heartbeatsSent.Load()), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_heartbeat_send_seconds", "gauge", "Time the last heartbeat took from queueing to being written.", time.Duration(c.metrics.heartbeatSendNS.Load()).Seconds(), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_running_tasks", "gauge", "Tasks currently running.", float64(len(c.tasks.ids())), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_queued_tasks", "gauge", "Tasks waiting for a worker.", float64(c.pool.queued()), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		c.metrics.mu.Lock()
+		keys := make([]taskMetricKey, 0, len(c.metrics.tasks))
+		for key := range c.metrics.tasks {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].kind != keys[j].kind {
+				return keys[i].kind < keys[j].kind
+			}
+			return keys[i].status < keys[j].status
+		})
+		counts := make([]uint64, len(keys))
+		for i, key := range keys {
+			counts[i] = c.metrics.tasks[key]
+		}
+		c.metrics.mu.Unlock()
+		for i, key := range keys {
+			mw.sample("labscan_agent_tasks_total", "counter", "Tasks finished, by kind and final status.", float64(counts[i]), "agent_id", id, "kind", key.kind, "status", key.status)
+		}
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_probe_runs_total", "counter", "Connectivity probe rounds run.", float64(c.metrics.probeRuns.Load()), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		mw.sample("labscan_agent_probe_internet_failures_total", "counter", "Probe rounds where the internet was unreachable.", float64(c.metrics.probeFailuresNet.Load()), "agent_id", id)
+	})
+	each(func(c *AgentClient, id string) {
+		probe := c.probes.Snapshot()
+		for _, p := range []struct {
+			name  string
+			value *bool
+		}{{"internet", probe.Internet}, {"dns", probe.DNS}, {"gateway", probe.Gateway}} {
+			if v, ok := boolGauge(p.value); ok {
+				mw.sample("labscan_agent_probe_up", "gauge", "Debounced probe state (1 reachable, 0 not).", v, "agent_id", id, "probe", p.name)
+			}
+		}
+	})
+	each(func(c *AgentClient, id string) {
+		for _, r := range c.probes.Snapshot().Resolvers {
+			if r.OK {
+				mw.sample("labscan_agent_dns_resolver_latency_ms", "gauge", "Latest lookup time through each benchmarked resolver.", float64(r.Latency.Milliseconds()), "agent_id", id, "resolver", r.Resolver)
+			}
+		}
+	})
+	each(func(c *AgentClient, id string) {
+		if v, ok := boolGauge(c.probes.Snapshot().CaptivePortal); ok {
+			mw.sample("labscan_agent_captive_portal", "gauge", "Whether the latest portal check was intercepted (1) or answered cleanly (0).", v, "agent_id", id)
+		}
+	})
+	each(func(c *AgentClient, id string) {
+		if latency := c.probes.Snapshot().LatencyMS; latency != nil {
+			mw.sample("labscan_agent_probe_latency_ms", "gauge", "Latest internet probe latency.", float64(*latency), "agent_id", id)
+		}
+	})
+}
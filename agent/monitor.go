@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	monitorMaxDuration = 24 * time.Hour
+	monitorMinInterval = time.Second
+)
+
+type TaskUpdatePayload struct {
+	TaskID string      `json:"task_id"`
+	Seq    int         `json:"seq"`
+	TS     int64       `json:"ts"`
+	OK     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *string     `json:"error,omitempty"`
+}
+
+// runMonitor repeats a one-shot task kind every interval_s for duration_s
+// and streams each run as a task_update; the final task_result only carries
+// the run summary and the last result.
+func runMonitor(fake bool, env taskEnv, params map[string]interface{}) (interface{}, error) {
+	kind := asString(params["task"], "")
+	if kind == "" {
+		return nil, errors.New("monitor requires task")
+	}
+	if kind == "monitor" || kind == "schedule" {
+		return nil, fmt.Errorf("monitor cannot wrap a %s task", kind)
+	}
+	if err := env.Policy.checkKind(kind); err != nil {
+		return nil, err
+	}
+	inner, _ := params["params"].(map[string]interface{})
+	interval := time.Duration(asInt(params["interval_s"], 10)) * time.Second
+	if interval < monitorMinInterval {
+		interval = monitorMinInterval
+	}
+	duration := time.Duration(asInt(params["duration_s"], 3600)) * time.Second
+	if duration <= 0 || duration > monitorMaxDuration {
+		duration = monitorMaxDuration
+	}
+
+	deadline := time.Now().Add(duration)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	runs, failures := 0, 0
+	var last interface{}
+	var lastErr error
+	for {
+		result, err := runTask(fake, env, kind, inner)
+		runs++
+		last, lastErr = result, err
+		if err != nil {
+			failures++
+		}
+		if env.cancelled() {
+			return monitorSummary(kind, interval, runs, failures, last, lastErr), env.context().Err()
+		}
+		env.update(result, err)
+
+		if !time.Now().Add(interval).Before(deadline) {
+			break
+		}
+		select {
+		case <-env.context().Done():
+			return monitorSummary(kind, interval, runs, failures, last, lastErr), env.context().Err()
+		case <-ticker.C:
+		}
+	}
+
+	summary := monitorSummary(kind, interval, runs, failures, last, lastErr)
+	if failures == runs {
+		return summary, fmt.Errorf("all %d %s runs failed", runs, kind)
+	}
+	return summary, nil
+}
+
+func monitorSummary(kind string, interval time.Duration, runs, failures int, last interface{}, lastErr error) map[string]interface{} {
+	summary := map[string]interface{}{
+		"task":       kind,
+		"runs":       runs,
+		"failures":   failures,
+		"interval_s": int(interval / time.Second),
+		"last":       last,
+	}
+	if lastErr != nil {
+		summary["last_error"] = lastErr.Error()
+	}
+	return summary
+}
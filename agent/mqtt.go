@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mqttDefaultPrefix = "labscan"
+	mqttMaxPacket     = 64 << 20
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttQoS1        = 1
+	mqttKeepAliveS  = 30
+	mqttConnectWait = 10 * time.Second
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttTopics are an agent's topics under the provisioned prefix: the agent
+// publishes wire messages to up, takes the admin's from down, and keeps a
+// retained online/offline in status, which the broker sets to offline if
+// the agent vanishes.
+type mqttTopics struct {
+	up     string
+	down   string
+	status string
+}
+
+func topicsFor(prefix, agentID string) mqttTopics {
+	if prefix = strings.Trim(prefix, "/"); prefix == "" {
+		prefix = mqttDefaultPrefix
+	}
+	base := prefix + "/agents/" + agentID
+	return mqttTopics{up: base + "/up", down: base + "/down", status: base + "/status"}
+}
+
+// mqttConn carries a session over an MQTT 3.1.1 broker. Wire messages go
+// out as QoS 1 publishes, so a broker holding a persistent admin session
+// keeps them while the admin is away. The broker's own keepalive replaces
+// websocket pings.
+type mqttConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	topics mqttTopics
+
+	writeMu  sync.Mutex
+	deadline time.Time
+	nextID   uint16
+
+	inbox     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	errMu     sync.Mutex
+	err       error
+}
+
+// parseMQTTBroker reads a broker URL: mqtt://host[:1883] or
+// mqtts://host[:8883], with an optional user:password.
+func parseMQTTBroker(raw string) (*url.URL, error) {
+	broker, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || broker.Hostname() == "" {
+		return nil, fmt.Errorf("invalid mqtt_broker %q: want mqtt:// or mqtts://host:port", raw)
+	}
+	switch broker.Scheme {
+	case "mqtt", "tcp":
+		if broker.Port() == "" {
+			broker.Host = net.JoinHostPort(broker.Hostname(), "1883")
+		}
+	case "mqtts", "ssl", "tls":
+		if broker.Port() == "" {
+			broker.Host = net.JoinHostPort(broker.Hostname(), "8883")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mqtt_broker scheme %q: want mqtt or mqtts", broker.Scheme)
+	}
+	return broker, nil
+}
+
+// dialMQTT connects to cfg's broker as client labscan-<agentID>, subscribes
+// to the agent's down topic, and marks it online.
+func dialMQTT(ctx context.Context, cfg *PersistedConfig, agentID string) (*mqttConn, error) {
+	broker, err := parseMQTTBroker(cfg.MQTTBroker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: mqttConnectWait}
+	var conn net.Conn
+	if broker.Scheme == "mqtt" || broker.Scheme == "tcp" {
+		conn, err = dialer.DialContext(ctx, "tcp", broker.Host)
+	} else {
+		config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: broker.Hostname()}
+		if cfg.TLSCAPEM != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(cfg.TLSCAPEM)) {
+				return nil, errors.New("provisioned CA bundle contains no certificates")
+			}
+			config.RootCAs = pool
+		}
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", broker.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &mqttConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		topics: topicsFor(cfg.MQTTPrefix, agentID),
+		inbox:  make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+	if err := m.handshake(broker, "labscan-"+agentID); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go m.readLoop()
+	go m.keepalive()
+	return m, nil
+}
+
+func (m *mqttConn) handshake(broker *url.URL, clientID string) error {
+	_ = m.conn.SetDeadline(time.Now().Add(mqttConnectWait))
+	defer m.conn.SetDeadline(time.Time{})
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	// Protocol level 4 (3.1.1); clean session; a retained QoS 1 will.
+	flags := byte(0x02 | 0x04 | mqttQoS1<<3 | 0x20)
+	password, hasPassword := broker.User.Password()
+	if broker.User != nil && broker.User.Username() != "" {
+		flags |= 0x80
+		if hasPassword {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, mqttKeepAliveS)
+	body = appendMQTTString(body, clientID)
+	body = appendMQTTString(body, m.topics.status)
+	body = appendMQTTString(body, "offline")
+	if flags&0x80 != 0 {
+		body = appendMQTTString(body, broker.User.Username())
+		if hasPassword {
+			body = appendMQTTString(body, password)
+		}
+	}
+	if err := writeMQTTPacket(m.conn, mqttConnect<<4, body); err != nil {
+		return err
+	}
+	header, reply, err := readMQTTPacket(m.reader)
+	if err != nil {
+		return fmt.Errorf("mqtt connect: %w", err)
+	}
+	if header>>4 != mqttConnack || len(reply) < 2 {
+		return fmt.Errorf("mqtt connect: unexpected packet type %d", header>>4)
+	}
+	if code := reply[1]; code != 0 {
+		reason := mqttConnackErrors[code]
+		if reason == "" {
+			reason = fmt.Sprintf("code %d", code)
+		}
+		return fmt.Errorf("mqtt broker refused connection: %s", reason)
+	}
+
+	m.nextID++
+	sub := binary.BigEndian.AppendUint16(nil, m.nextID)
+	sub = appendMQTTString(sub, m.topics.down)
+	sub = append(sub, mqttQoS1)
+	if err := writeMQTTPacket(m.conn, mqttSubscribe<<4|0x02, sub); err != nil {
+		return err
+	}
+	for {
+		header, reply, err := readMQTTPacket(m.reader)
+		if err != nil {
+			return fmt.Errorf("mqtt subscribe: %w", err)
+		}
+		if header>>4 != mqttSuback {
+			// Only a retained message can come first, and the admin does
+			// not retain anything on down.
+			continue
+		}
+		if len(reply) < 3 || reply[2] == 0x80 {
+			return fmt.Errorf("mqtt broker refused subscription to %s", m.topics.down)
+		}
+		break
+	}
+	return m.publish(m.topics.status, []byte("online"), true)
+}
+
+// publish sends a QoS 1 publish. The PUBACK is not awaited: delivery to the
+// admin is confirmed end to end by its acks, as over a websocket.
+func (m *mqttConn) publish(topic string, payload []byte, retain bool) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.nextID++
+	if m.nextID == 0 {
+		m.nextID = 1
+	}
+	header := byte(mqttPublish<<4 | mqttQoS1<<1)
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	body = binary.BigEndian.AppendUint16(body, m.nextID)
+	body = append(body, payload...)
+	return m.writeLocked(header, body)
+}
+
+func (m *mqttConn) writeLocked(header byte, body []byte) error {
+	if !m.deadline.IsZero() {
+		_ = m.conn.SetWriteDeadline(m.deadline)
+	}
+	return writeMQTTPacket(m.conn, header, body)
+}
+
+func (m *mqttConn) WriteMessage(_ int, data []byte) error {
+	return m.publish(m.topics.up, data, false)
+}
+
+func (m *mqttConn) SetWriteDeadline(t time.Time) error {
+	m.writeMu.Lock()
+	m.deadline = t
+	m.writeMu.Unlock()
+	return nil
+}
+
+// ReadMessage returns the next message the admin published to the down
+// topic. MQTT has no frame types, so JSON is told from msgpack by its
+// opening brace.
+func (m *mqttConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-m.inbox:
+		return frameTypeOf(data), data, nil
+	case <-m.closed:
+		return 0, nil, m.closeErr()
+	}
+}
+
+// Close marks the agent offline and disconnects cleanly, which tells the
+// broker not to publish the will.
+func (m *mqttConn) Close() error {
+	m.closeOnce.Do(func() {
+		_ = m.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = m.publish(m.topics.status, []byte("offline"), true)
+		m.writeMu.Lock()
+		_ = m.writeLocked(mqttDisconnect<<4, nil)
+		m.writeMu.Unlock()
+		m.fail(net.ErrClosed)
+	})
+	return nil
+}
+
+func (m *mqttConn) fail(err error) {
+	m.errMu.Lock()
+	if m.err == nil {
+		m.err = err
+		close(m.closed)
+		_ = m.conn.Close()
+	}
+	m.errMu.Unlock()
+}
+
+func (m *mqttConn) closeErr() error {
+	m.errMu.Lock()
+	defer m.errMu.Unlock()
+	return m.err
+}
+
+// readLoop acknowledges and queues the admin's publishes. Without any
+// packet for 1.5 keepalive periods the broker is taken to be gone; the
+// keepalive pings guarantee a PINGRESP well within that.
+func (m *mqttConn) readLoop() {
+	for {
+		_ = m.conn.SetReadDeadline(time.Now().Add(mqttKeepAliveS * 3 / 2 * time.Second))
+		header, body, err := readMQTTPacket(m.reader)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = fmt.Errorf("nothing heard from mqtt broker for %ds: %w", mqttKeepAliveS*3/2, err)
+			}
+			m.fail(err)
+			return
+		}
+		if header>>4 != mqttPublish {
+			continue
+		}
+		qos := header >> 1 & 0x03
+		if len(body) < 2 {
+			continue
+		}
+		topicLen := int(binary.BigEndian.Uint16(body))
+		rest := body[2+min(topicLen, len(body)-2):]
+		if qos > 0 {
+			if len(rest) < 2 {
+				continue
+			}
+			id := rest[:2]
+			rest = rest[2:]
+			m.writeMu.Lock()
+			err := m.writeLocked(mqttPuback<<4, id)
+			m.writeMu.Unlock()
+			if err != nil {
+				m.fail(err)
+				return
+			}
+		}
+		select {
+		case m.inbox <- rest:
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+func (m *mqttConn) keepalive() {
+	ticker := time.NewTicker(mqttKeepAliveS / 2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+			m.writeMu.Lock()
+			_ = m.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := writeMQTTPacket(m.conn, mqttPingreq<<4, nil)
+			m.writeMu.Unlock()
+			if err != nil {
+				m.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed mqtt remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("mqtt packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
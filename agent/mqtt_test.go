@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeBroker accepts one MQTT client and hands the test its packets.
+type fakeBroker struct {
+	t        *testing.T
+	listener net.Listener
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return &fakeBroker{t: t, listener: listener}
+}
+
+func (b *fakeBroker) url(userinfo string) string {
+	return "mqtt://" + userinfo + b.listener.Addr().String()
+}
+
+func (b *fakeBroker) accept() {
+	conn, err := b.listener.Accept()
+	if err != nil {
+		b.t.Error(err)
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b.conn, b.reader = conn, bufio.NewReader(conn)
+}
+
+func (b *fakeBroker) expect(packetType byte) []byte {
+	header, body, err := readMQTTPacket(b.reader)
+	if err != nil {
+		b.t.Errorf("reading packet %d: %v", packetType, err)
+		return nil
+	}
+	if header>>4 != packetType {
+		b.t.Errorf("packet type %d, want %d", header>>4, packetType)
+	}
+	return body
+}
+
+func (b *fakeBroker) send(header byte, body []byte) {
+	if err := writeMQTTPacket(b.conn, header, body); err != nil {
+		b.t.Error(err)
+	}
+}
+
+func mqttStrings(body []byte) []string {
+	var out []string
+	for len(body) >= 2 {
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+n {
+			break
+		}
+		out = append(out, string(body[2:2+n]))
+		body = body[2+n:]
+	}
+	return out
+}
+
+func TestMQTTSession(t *testing.T) {
+	broker := newFakeBroker(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.accept()
+		if broker.conn == nil {
+			return
+		}
+		connect := broker.expect(mqttConnect)
+		// "MQTT", level 4, flags, keepalive, then the payload strings.
+		if flags := connect[7]; flags != 0xEE {
+			t.Errorf("connect flags = %#x", flags)
+		}
+		fields := mqttStrings(connect[10:])
+		want := []string{"labscan-agent-1", "lab/agents/agent-1/status", "offline", "probe", "s3cret"}
+		if strings.Join(fields, " ") != strings.Join(want, " ") {
+			t.Errorf("connect payload = %q, want %q", fields, want)
+		}
+		broker.send(mqttConnack<<4, []byte{0, 0})
+
+		sub := broker.expect(mqttSubscribe)
+		if topics := mqttStrings(sub[2:]); len(topics) != 1 || topics[0] != "lab/agents/agent-1/down" {
+			t.Errorf("subscribe = %q", topics)
+		}
+		broker.send(mqttSuback<<4, []byte{sub[0], sub[1], mqttQoS1})
+
+		online := broker.expect(mqttPublish)
+		if got := mqttStrings(online)[0]; got != "lab/agents/agent-1/status" || !strings.HasSuffix(string(online), "online") {
+			t.Errorf("status publish = %q", online)
+		}
+
+		down := appendMQTTString(nil, "lab/agents/agent-1/down")
+		down = append(down, 0, 7)
+		down = append(down, `{"type":"registered"}`...)
+		broker.send(mqttPublish<<4|mqttQoS1<<1, down)
+		if ack := broker.expect(mqttPuback); string(ack) != "\x00\x07" {
+			t.Errorf("puback = %q", ack)
+		}
+
+		up := broker.expect(mqttPublish)
+		if !strings.HasPrefix(string(up[2:]), "lab/agents/agent-1/up") || !strings.HasSuffix(string(up), `{"type":"heartbeat"}`) {
+			t.Errorf("up publish = %q", up)
+		}
+
+		offline := broker.expect(mqttPublish)
+		if !strings.HasSuffix(string(offline), "offline") {
+			t.Errorf("closing status publish = %q", offline)
+		}
+		broker.expect(mqttDisconnect)
+	}()
+
+	cfg := &PersistedConfig{Transport: transportMQTT, MQTTBroker: broker.url("probe:s3cret@"), MQTTPrefix: "/lab/"}
+	conn, err := dialMQTT(context.Background(), cfg, "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameType, data, err := conn.ReadMessage()
+	if err != nil || frameType != websocket.TextMessage || string(data) != `{"type":"registered"}` {
+		t.Fatalf("ReadMessage = %d, %q, %v", frameType, data, err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"heartbeat"}`)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	<-done
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage after Close succeeded")
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	broker := newFakeBroker(t)
+	go func() {
+		broker.accept()
+		if broker.conn != nil {
+			broker.expect(mqttConnect)
+			broker.send(mqttConnack<<4, []byte{0, 5})
+		}
+	}()
+	_, err := dialMQTT(context.Background(), &PersistedConfig{MQTTBroker: broker.url("")}, "agent-1")
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("dialMQTT = %v, want not authorized", err)
+	}
+}
+
+func TestCheckTransport(t *testing.T) {
+	for _, tt := range []struct {
+		transport, broker string
+		ok                bool
+	}{
+		{"", "", true},
+		{"ws", "", true},
+		{"mqtt", "mqtt://broker.lab", true},
+		{"mqtt", "mqtts://user:pw@broker.lab:8884", true},
+		{"mqtt", "", false},
+		{"mqtt", "http://broker.lab", false},
+		{"amqp", "mqtt://broker.lab", false},
+	} {
+		if err := checkTransport(tt.transport, tt.broker, ""); (err == nil) != tt.ok {
+			t.Errorf("checkTransport(%q, %q) = %v", tt.transport, tt.broker, err)
+		}
+	}
+	broker, _ := parseMQTTBroker("mqtts://broker.lab")
+	if broker.Host != "broker.lab:8883" {
+		t.Errorf("default mqtts port: %s", broker.Host)
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 300000} {
+		var buf strings.Builder
+		body := make([]byte, size)
+		if err := writeMQTTPacket(&buf, mqttPublish<<4, body); err != nil {
+			t.Fatal(err)
+		}
+		header, got, err := readMQTTPacket(bufio.NewReader(strings.NewReader(buf.String())))
+		if err != nil || header != mqttPublish<<4 || len(got) != size {
+			t.Fatalf("size %d: header %#x, %d bytes, %v", size, header, len(got), err)
+		}
+	}
+}
+
+func TestProvisionSigningTransport(t *testing.T) {
+	provision := ProvisionMessage{Type: "LABSCAN_PROVISION", V: 1, Nonce: "n", AdminIP: "10.0.0.2", Secret: "s"}
+	plain := provisionSigningString(provision)
+	if lines := strings.Count(plain, "\n"); lines != 14 {
+		t.Fatalf("signing string without transport has %d newlines, want 14", lines)
+	}
+	provision.Transport, provision.MQTTBroker = transportMQTT, "mqtt://broker.lab"
+	if got := provisionSigningString(provision); got != plain+"\nmqtt\nmqtt://broker.lab\n" {
+		t.Fatalf("signing string with transport = %q", got)
+	}
+}
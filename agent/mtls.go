@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// clientCertStore holds the certificate the agent presents on wss:// dials.
+// The cert is either delivered by provisioning or issued by the admin in
+// reply to a CSR sent with register; in CSR mode the agent renews once half
+// of the certificate's lifetime has passed.
+type clientCertStore struct {
+	mu      sync.Mutex
+	csr     bool
+	certPEM string
+	keyPEM  string
+	cert    *tls.Certificate
+	save    func(certPEM, keyPEM string)
+}
+
+func newClientCertStore(cfg *PersistedConfig, save func(certPEM, keyPEM string)) *clientCertStore {
+	store := &clientCertStore{csr: cfg.TLSClientCSR, certPEM: cfg.TLSClientCert, keyPEM: cfg.TLSClientKey, save: save}
+	if store.certPEM != "" && store.keyPEM != "" {
+		cert, err := parseClientCert(store.certPEM, store.keyPEM)
+		if err != nil {
+			slog.Warn("ignoring stored client certificate", "err", err)
+		} else {
+			store.cert = cert
+		}
+	}
+	return store
+}
+
+func (s *clientCertStore) enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.csr || s.cert != nil
+}
+
+// getClientCertificate is wired into tls.Config. An expired certificate is
+// not presented, so the admin can fall back to secret-only registration and
+// issue a fresh one.
+func (s *clientCertStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert == nil || time.Now().After(s.cert.Leaf.NotAfter) {
+		return &tls.Certificate{}, nil
+	}
+	return s.cert, nil
+}
+
+// request returns a PEM CSR when the agent is in CSR mode and has no
+// certificate or one due for renewal, generating and persisting the private
+// key on first use.
+func (s *clientCertStore) request(commonName string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.csr || (s.cert != nil && !certRenewalDue(s.cert.Leaf, time.Now())) {
+		return "", nil
+	}
+	if s.keyPEM == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+		s.keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+		s.persist()
+	}
+	key, err := parseClientKey(s.keyPEM)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName, Organization: []string{"LabScan Agent"}},
+	}, key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// accept installs a certificate issued by the admin for the agent's key.
+func (s *clientCertStore) accept(certPEM string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyPEM == "" {
+		return errors.New("no client key for issued certificate")
+	}
+	cert, err := parseClientCert(certPEM, s.keyPEM)
+	if err != nil {
+		return err
+	}
+	s.certPEM = certPEM
+	s.cert = cert
+	s.persist()
+	return nil
+}
+
+func (s *clientCertStore) persist() {
+	if s.save != nil {
+		s.save(s.certPEM, s.keyPEM)
+	}
+}
+
+func certRenewalDue(leaf *x509.Certificate, now time.Time) bool {
+	half := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2)
+	return !now.Before(half)
+}
+
+func parseClientCert(certPEM, keyPEM string) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+	}
+	return &cert, nil
+}
+
+func parseClientKey(keyPEM string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("client key is not PEM")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natsDefaultPrefix  = "labscan"
+	natsConnectWait    = 10 * time.Second
+	natsPingInterval   = 30 * time.Second
+	natsDefaultPayload = 1 << 20
+	natsMaxLine        = 64 << 10
+	// natsMaxReplies bounds the reply subjects waiting for a task result;
+	// tasks past it are answered on the up subject only.
+	natsMaxReplies = 1024
+)
+
+// natsSubjects are an agent's subjects under the provisioned prefix: the
+// agent publishes wire messages to up, takes the admin's from down, and
+// publishes online or offline to status as it comes and goes.
+type natsSubjects struct {
+	up     string
+	down   string
+	status string
+}
+
+func subjectsFor(prefix, agentID string) natsSubjects {
+	if prefix = strings.Trim(prefix, "."); prefix == "" {
+		prefix = natsDefaultPrefix
+	}
+	base := prefix + ".agents." + agentID
+	return natsSubjects{up: base + ".up", down: base + ".down", status: base + ".status"}
+}
+
+// natsInfo is the part of the server's INFO the agent uses.
+type natsInfo struct {
+	MaxPayload  int  `json:"max_payload"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+type natsMsg struct {
+	data  []byte
+	reply string
+}
+
+// natsConn carries a session over a NATS server using the core text
+// protocol. NATS keeps nothing for a subscriber that is away, so messages
+// published while the agent reconnects are lost, as they are when a
+// websocket drops; the outbox and the admin's acks cover both alike.
+//
+// When the admin sends a task as a request, the agent answers the reply
+// subject with the task's result, and with each chunk of a chunked result,
+// besides publishing them to up as usual.
+type natsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	subjects   natsSubjects
+	maxPayload int
+
+	writeMu  sync.Mutex
+	deadline time.Time
+
+	repliesMu sync.Mutex
+	replies   map[string]string
+
+	inbox     chan natsMsg
+	closed    chan struct{}
+	closeOnce sync.Once
+	errMu     sync.Mutex
+	err       error
+	serverErr string
+}
+
+// parseNATSURL reads a server URL: nats://host[:4222] or tls://host[:4222],
+// with an optional user:password or a token as the user.
+func parseNATSURL(raw string) (*url.URL, error) {
+	server, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || server.Hostname() == "" {
+		return nil, fmt.Errorf("invalid nats_url %q: want nats:// or tls://host:port", raw)
+	}
+	if server.Scheme != "nats" && server.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported nats_url scheme %q: want nats or tls", server.Scheme)
+	}
+	if server.Port() == "" {
+		server.Host = net.JoinHostPort(server.Hostname(), "4222")
+	}
+	return server, nil
+}
+
+// dialNATS connects to cfg's server as labscan-<agentID>, subscribes to the
+// agent's down subject, and marks it online.
+func dialNATS(ctx context.Context, cfg *PersistedConfig, agentID string) (*natsConn, error) {
+	server, err := parseNATSURL(cfg.NATSURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&net.Dialer{Timeout: natsConnectWait}).DialContext(ctx, "tcp", server.Host)
+	if err != nil {
+		return nil, err
+	}
+	n := &natsConn{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		subjects: subjectsFor(cfg.NATSPrefix, agentID),
+		replies:  make(map[string]string),
+		inbox:    make(chan natsMsg, 16),
+		closed:   make(chan struct{}),
+	}
+	if err := n.handshake(ctx, server, cfg.TLSCAPEM, "labscan-"+agentID); err != nil {
+		_ = n.conn.Close()
+		return nil, err
+	}
+	go n.readLoop()
+	go n.keepalive()
+	return n, nil
+}
+
+func (n *natsConn) handshake(ctx context.Context, server *url.URL, caPEM, name string) error {
+	_ = n.conn.SetDeadline(time.Now().Add(natsConnectWait))
+	line, err := readNATSLine(n.reader)
+	if err != nil {
+		return fmt.Errorf("nats connect: %w", err)
+	}
+	op, args := splitNATSOp(line)
+	if op != "INFO" {
+		return fmt.Errorf("nats connect: expected INFO, got %q", op)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		return fmt.Errorf("nats connect: bad INFO: %w", err)
+	}
+	n.maxPayload = info.MaxPayload
+	if n.maxPayload <= 0 {
+		n.maxPayload = natsDefaultPayload
+	}
+
+	secure := server.Scheme == "tls" || info.TLSRequired
+	if secure {
+		config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: server.Hostname()}
+		if caPEM != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+				return errors.New("provisioned CA bundle contains no certificates")
+			}
+			config.RootCAs = pool
+		}
+		tlsConn := tls.Client(n.conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		n.conn = tlsConn
+		n.reader = bufio.NewReader(tlsConn)
+	}
+	defer n.conn.SetDeadline(time.Time{})
+
+	connect := map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": secure,
+		"name":         name,
+		"lang":         "go",
+		"version":      agentVersion,
+		"protocol":     1,
+		"echo":         false,
+	}
+	if user := server.User; user != nil {
+		if password, ok := user.Password(); ok {
+			connect["user"] = user.Username()
+			connect["pass"] = password
+		} else {
+			connect["auth_token"] = user.Username()
+		}
+	}
+	body, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	// The PING is answered only once CONNECT and SUB went through, so a
+	// PONG confirms both and an -ERR comes before it.
+	hello := fmt.Sprintf("CONNECT %s\r\nSUB %s 1\r\nPING\r\n", body, n.subjects.down)
+	if _, err := io.WriteString(n.conn, hello); err != nil {
+		return err
+	}
+	for {
+		line, err := readNATSLine(n.reader)
+		if err != nil {
+			return fmt.Errorf("nats connect: %w", err)
+		}
+		op, args := splitNATSOp(line)
+		switch op {
+		case "PONG":
+			return n.publish(n.subjects.status, []byte("online"))
+		case "-ERR":
+			return fmt.Errorf("nats server refused connection: %s", strings.Trim(args, "'"))
+		case "PING":
+			if _, err := io.WriteString(n.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publish sends payload to subject. Like the websocket, the agent does not
+// wait for the server: delivery to the admin is confirmed by its acks.
+func (n *natsConn) publish(subject string, payload []byte) error {
+	if len(payload) > n.maxPayload {
+		return fmt.Errorf("message of %d bytes exceeds the nats server's max_payload of %d", len(payload), n.maxPayload)
+	}
+	msg := make([]byte, 0, len(subject)+len(payload)+32)
+	msg = fmt.Appendf(msg, "PUB %s %d\r\n", subject, len(payload))
+	msg = append(msg, payload...)
+	msg = append(msg, "\r\n"...)
+	return n.write(msg)
+}
+
+func (n *natsConn) write(data []byte) error {
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+	if !n.deadline.IsZero() {
+		_ = n.conn.SetWriteDeadline(n.deadline)
+	}
+	_, err := n.conn.Write(data)
+	return err
+}
+
+// WriteMessage publishes to up and, for a task result the admin asked for
+// with a request, to its reply subject too.
+func (n *natsConn) WriteMessage(frameType int, data []byte) error {
+	if err := n.publish(n.subjects.up, data); err != nil {
+		return err
+	}
+	if reply := n.replyFor(frameType, data); reply != "" {
+		return n.publish(reply, data)
+	}
+	return nil
+}
+
+func (n *natsConn) SetWriteDeadline(t time.Time) error {
+	n.writeMu.Lock()
+	n.deadline = t
+	n.writeMu.Unlock()
+	return nil
+}
+
+// ReadMessage returns the next message the admin published to the down
+// subject.
+func (n *natsConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-n.inbox:
+		if msg.reply != "" {
+			n.trackReply(msg.data, msg.reply)
+		}
+		return frameTypeOf(msg.data), msg.data, nil
+	case <-n.closed:
+		return 0, nil, n.closeErr()
+	}
+}
+
+// trackReply remembers the reply subject of a task sent as a request.
+// Other requests get no reply.
+func (n *natsConn) trackReply(data []byte, reply string) {
+	var envelope adminMessage
+	if !decodeNATSEnvelope(frameTypeOf(data), data, &envelope) || envelope.Type != "task" {
+		return
+	}
+	payload, err := decodePayload(envelope.Encoding, envelope.Payload)
+	if err != nil {
+		return
+	}
+	var task struct {
+		TaskID string `json:"task_id"`
+	}
+	if json.Unmarshal(payload, &task) != nil || task.TaskID == "" {
+		return
+	}
+	n.repliesMu.Lock()
+	if len(n.replies) < natsMaxReplies {
+		n.replies[task.TaskID] = reply
+	}
+	n.repliesMu.Unlock()
+}
+
+// replyFor returns the reply subject an outgoing message also goes to: a
+// task_result answers its request and ends it; a task_result_chunk answers
+// it and ends it if final.
+func (n *natsConn) replyFor(frameType int, data []byte) string {
+	n.repliesMu.Lock()
+	pending := len(n.replies)
+	n.repliesMu.Unlock()
+	if pending == 0 {
+		return ""
+	}
+	var envelope adminMessage
+	if !decodeNATSEnvelope(frameType, data, &envelope) {
+		return ""
+	}
+	if envelope.Type != "task_result" && envelope.Type != "task_result_chunk" {
+		return ""
+	}
+	decoded, err := decodePayload(envelope.Encoding, envelope.Payload)
+	if err != nil {
+		return ""
+	}
+	var result struct {
+		TaskID string `json:"task_id"`
+		Final  bool   `json:"final"`
+	}
+	if json.Unmarshal(decoded, &result) != nil {
+		return ""
+	}
+	n.repliesMu.Lock()
+	defer n.repliesMu.Unlock()
+	reply := n.replies[result.TaskID]
+	if envelope.Type == "task_result" || result.Final {
+		delete(n.replies, result.TaskID)
+	}
+	return reply
+}
+
+func decodeNATSEnvelope(frameType int, data []byte, v interface{}) bool {
+	raw, err := jsonFromFrame(frameType, data)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+// Close marks the agent offline and disconnects. NATS has no will, so an
+// agent that vanishes stays online in status; the admin goes by heartbeats.
+func (n *natsConn) Close() error {
+	n.closeOnce.Do(func() {
+		_ = n.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = n.publish(n.subjects.status, []byte("offline"))
+		n.fail(net.ErrClosed)
+	})
+	return nil
+}
+
+func (n *natsConn) fail(err error) {
+	n.errMu.Lock()
+	if n.err == nil {
+		n.err = err
+		close(n.closed)
+		_ = n.conn.Close()
+	}
+	n.errMu.Unlock()
+}
+
+func (n *natsConn) closeErr() error {
+	n.errMu.Lock()
+	defer n.errMu.Unlock()
+	return n.err
+}
+
+// readLoop answers the server's pings and queues the admin's messages. The
+// server closes the connection after a fatal -ERR, so the last one it sent
+// becomes the session's error. Without anything for two ping intervals the
+// server is taken to be gone; our own pings guarantee a PONG well within
+// that.
+func (n *natsConn) readLoop() {
+	for {
+		_ = n.conn.SetReadDeadline(time.Now().Add(2 * natsPingInterval))
+		line, err := readNATSLine(n.reader)
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case n.serverErr != "":
+				err = fmt.Errorf("nats server: %s: %w", n.serverErr, err)
+			case errors.As(err, &netErr) && netErr.Timeout():
+				err = fmt.Errorf("nothing heard from nats server for %s: %w", 2*natsPingInterval, err)
+			}
+			n.fail(err)
+			return
+		}
+		op, args := splitNATSOp(line)
+		switch op {
+		case "MSG":
+			msg, err := n.readMsg(args)
+			if err != nil {
+				n.fail(err)
+				return
+			}
+			select {
+			case n.inbox <- msg:
+			case <-n.closed:
+				return
+			}
+		case "PING":
+			if err := n.write([]byte("PONG\r\n")); err != nil {
+				n.fail(err)
+				return
+			}
+		case "-ERR":
+			n.serverErr = strings.Trim(args, "'")
+		}
+	}
+}
+
+// readMsg reads the payload of "MSG <subject> <sid> [reply] <size>".
+func (n *natsConn) readMsg(args string) (natsMsg, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 3 && len(fields) != 4 {
+		return natsMsg{}, fmt.Errorf("nats: malformed MSG %q", args)
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 || size > n.maxPayload {
+		return natsMsg{}, fmt.Errorf("nats: bad MSG size %q", fields[len(fields)-1])
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(n.reader, buf); err != nil {
+		return natsMsg{}, err
+	}
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		return natsMsg{}, errors.New("nats: MSG payload not terminated")
+	}
+	msg := natsMsg{data: buf[:size]}
+	if len(fields) == 4 {
+		msg.reply = fields[2]
+	}
+	return msg, nil
+}
+
+func (n *natsConn) keepalive() {
+	ticker := time.NewTicker(natsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+			n.writeMu.Lock()
+			_ = n.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := io.WriteString(n.conn, "PING\r\n")
+			n.writeMu.Unlock()
+			if err != nil {
+				n.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// readNATSLine reads one CRLF-terminated protocol line.
+func readNATSLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > natsMaxLine {
+			return "", errors.New("nats: protocol line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func splitNATSOp(line string) (string, string) {
+	op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	return strings.ToUpper(op), strings.TrimSpace(args)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeNATSServer accepts one NATS client and hands the test its protocol
+// lines and publishes.
+type fakeNATSServer struct {
+	t        *testing.T
+	listener net.Listener
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return &fakeNATSServer{t: t, listener: listener}
+}
+
+func (s *fakeNATSServer) url(userinfo string) string {
+	return "nats://" + userinfo + s.listener.Addr().String()
+}
+
+func (s *fakeNATSServer) accept(info string) bool {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		s.t.Error(err)
+		return false
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	s.send("INFO " + info + "\r\n")
+	return true
+}
+
+func (s *fakeNATSServer) line() string {
+	line, err := readNATSLine(s.reader)
+	if err != nil {
+		s.t.Errorf("reading line: %v", err)
+	}
+	return line
+}
+
+// pub reads one PUB and returns its subject and payload.
+func (s *fakeNATSServer) pub() (string, string) {
+	fields := strings.Fields(s.line())
+	if len(fields) != 3 || fields[0] != "PUB" {
+		s.t.Errorf("expected PUB, got %q", fields)
+		return "", ""
+	}
+	size, _ := strconv.Atoi(fields[2])
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(s.reader, payload); err != nil {
+		s.t.Error(err)
+	}
+	return fields[1], string(payload[:size])
+}
+
+func (s *fakeNATSServer) send(data string) {
+	if _, err := io.WriteString(s.conn, data); err != nil {
+		s.t.Error(err)
+	}
+}
+
+func TestNATSSession(t *testing.T) {
+	server := newFakeNATSServer(t)
+	task := `{"type":"task","payload":{"task_id":"t-1","kind":"ping"}}`
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !server.accept(`{"server_id":"test","max_payload":1048576}`) {
+			return
+		}
+		connect := server.line()
+		if !strings.HasPrefix(connect, "CONNECT {") || !strings.Contains(connect, `"user":"probe"`) ||
+			!strings.Contains(connect, `"pass":"s3cret"`) || !strings.Contains(connect, `"name":"labscan-agent-1"`) {
+			t.Errorf("connect = %q", connect)
+		}
+		if sub := server.line(); sub != "SUB lab.agents.agent-1.down 1" {
+			t.Errorf("sub = %q", sub)
+		}
+		if ping := server.line(); ping != "PING" {
+			t.Errorf("ping = %q", ping)
+		}
+		server.send("PONG\r\n")
+		if subject, payload := server.pub(); subject != "lab.agents.agent-1.status" || payload != "online" {
+			t.Errorf("status publish = %s %q", subject, payload)
+		}
+
+		server.send(fmt.Sprintf("PING\r\nMSG lab.agents.agent-1.down 1 _INBOX.abc %d\r\n%s\r\n", len(task), task))
+		if pong := server.line(); pong != "PONG" {
+			t.Errorf("pong = %q", pong)
+		}
+		if subject, payload := server.pub(); subject != "lab.agents.agent-1.up" || !strings.Contains(payload, "task_result") {
+			t.Errorf("up publish = %s %q", subject, payload)
+		}
+		if subject, _ := server.pub(); subject != "_INBOX.abc" {
+			t.Errorf("reply publish went to %s", subject)
+		}
+		if subject, payload := server.pub(); subject != "lab.agents.agent-1.up" || !strings.Contains(payload, "heartbeat") {
+			t.Errorf("second up publish = %s %q", subject, payload)
+		}
+		if subject, payload := server.pub(); subject != "lab.agents.agent-1.status" || payload != "offline" {
+			t.Errorf("closing status publish = %s %q", subject, payload)
+		}
+	}()
+
+	cfg := &PersistedConfig{Transport: transportNATS, NATSURL: server.url("probe:s3cret@"), NATSPrefix: "lab."}
+	conn, err := dialNATS(context.Background(), cfg, "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameType, data, err := conn.ReadMessage()
+	if err != nil || frameType != websocket.TextMessage || string(data) != task {
+		t.Fatalf("ReadMessage = %d, %q, %v", frameType, data, err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"task_result","payload":{"task_id":"t-1","status":"ok"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	// The request was answered, so later messages go to up only.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"heartbeat","payload":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	<-done
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage after Close succeeded")
+	}
+}
+
+func TestNATSRefused(t *testing.T) {
+	server := newFakeNATSServer(t)
+	go func() {
+		if server.accept(`{"server_id":"test","auth_required":true}`) {
+			server.line()
+			server.send("-ERR 'Authorization Violation'\r\n")
+		}
+	}()
+	_, err := dialNATS(context.Background(), &PersistedConfig{NATSURL: server.url("wrong-token@")}, "agent-1")
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("dialNATS = %v, want Authorization Violation", err)
+	}
+}
+
+func TestNATSChunkedReply(t *testing.T) {
+	n := &natsConn{replies: make(map[string]string)}
+	n.trackReply([]byte(`{"type":"task","payload":{"task_id":"t-2"}}`), "_INBOX.big")
+	n.trackReply([]byte(`{"type":"config_update","payload":{"task_id":"t-3"}}`), "_INBOX.other")
+
+	chunk := func(final bool) []byte {
+		return []byte(fmt.Sprintf(`{"type":"task_result_chunk","payload":{"task_id":"t-2","index":0,"final":%t}}`, final))
+	}
+	if reply := n.replyFor(websocket.TextMessage, chunk(false)); reply != "_INBOX.big" {
+		t.Errorf("first chunk reply = %q", reply)
+	}
+	if reply := n.replyFor(websocket.TextMessage, []byte(`{"type":"task_progress","payload":{"task_id":"t-2"}}`)); reply != "" {
+		t.Errorf("progress reply = %q", reply)
+	}
+	if reply := n.replyFor(websocket.TextMessage, chunk(true)); reply != "_INBOX.big" {
+		t.Errorf("final chunk reply = %q", reply)
+	}
+	if len(n.replies) != 0 {
+		t.Errorf("replies left after final chunk: %v", n.replies)
+	}
+}
+
+func TestParseNATSURL(t *testing.T) {
+	for _, tt := range []struct {
+		transport, url string
+		ok             bool
+	}{
+		{"nats", "nats://nats.lab", true},
+		{"nats", "tls://token@nats.lab:4443", true},
+		{"nats", "", false},
+		{"nats", "mqtt://nats.lab", false},
+	} {
+		if err := checkTransport(tt.transport, "", tt.url); (err == nil) != tt.ok {
+			t.Errorf("checkTransport(%q, %q) = %v", tt.transport, tt.url, err)
+		}
+	}
+	server, _ := parseNATSURL("nats://nats.lab")
+	if server.Host != "nats.lab:4222" {
+		t.Errorf("default port: %s", server.Host)
+	}
+	if got := subjectsFor("", "a-1").down; got != "labscan.agents.a-1.down" {
+		t.Errorf("default down subject = %s", got)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ntpPacketSize = 48
+	// ntpEpochOffset is the seconds from 1900, the NTP epoch, to 1970.
+	ntpEpochOffset = 2208988800
+	ntpModeClient  = 3
+	ntpModeServer  = 4
+	ntpVersion     = 4
+	ntpMaxSamples  = 8
+)
+
+var defaultNTPServers = []string{"pool.ntp.org", "time.google.com", "time.cloudflare.com"}
+
+// ntpLeap names the leap indicator values; "unsynchronized" means the
+// server's own clock is not set.
+var ntpLeap = []string{"none", "add_second", "del_second", "unsynchronized"}
+
+type ntpServerResult struct {
+	Server           string   `json:"server"`
+	Address          string   `json:"address,omitempty"`
+	Reachable        bool     `json:"reachable"`
+	Stratum          int      `json:"stratum,omitempty"`
+	Leap             string   `json:"leap,omitempty"`
+	RefID            string   `json:"ref_id,omitempty"`
+	OffsetMS         *float64 `json:"offset_ms,omitempty"`
+	DelayMS          *float64 `json:"delay_ms,omitempty"`
+	RootDelayMS      *float64 `json:"root_delay_ms,omitempty"`
+	RootDispersionMS *float64 `json:"root_dispersion_ms,omitempty"`
+	Samples          int      `json:"samples"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// ntpSample is one SNTP exchange: the server's answer and the clock
+// offset and round-trip delay it implies (RFC 5905 section 8).
+type ntpSample struct {
+	stratum        int
+	leap           int
+	refID          string
+	offset         time.Duration
+	delay          time.Duration
+	rootDelay      time.Duration
+	rootDispersion time.Duration
+}
+
+// runNTPCheck serves ntp_check: it queries each of servers (host or
+// host:port, default port 123) with SNTP, samples times, and keeps the
+// sample with the shortest round trip. The agent is in sync when some
+// server answered and the median offset of the synchronized ones is within
+// max_offset_ms.
+func runNTPCheck(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	servers := asStringSlice(params["servers"], defaultNTPServers)
+	timeout := time.Duration(asInt(params["timeout_ms"], 2000)) * time.Millisecond
+	samples := min(max(asInt(params["samples"], 3), 1), ntpMaxSamples)
+	maxOffset := time.Duration(asInt(params["max_offset_ms"], 500)) * time.Millisecond
+
+	env.Progress.setTotal(len(servers))
+	results := make([]ntpServerResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			results[i] = checkNTPServer(env, server, samples, timeout)
+			env.Progress.step(server)
+		}(i, server)
+	}
+	wg.Wait()
+	return summarizeNTP(results, maxOffset), nil
+}
+
+func summarizeNTP(results []ntpServerResult, maxOffset time.Duration) map[string]interface{} {
+	reachable := 0
+	var offsets []float64
+	for _, result := range results {
+		if !result.Reachable {
+			continue
+		}
+		reachable++
+		if result.Leap != "unsynchronized" && result.OffsetMS != nil {
+			offsets = append(offsets, *result.OffsetMS)
+		}
+	}
+	summary := map[string]interface{}{
+		"servers":       results,
+		"reachable":     reachable,
+		"max_offset_ms": maxOffset.Milliseconds(),
+		"in_sync":       false,
+	}
+	if len(offsets) > 0 {
+		sort.Float64s(offsets)
+		median := offsets[len(offsets)/2]
+		if len(offsets)%2 == 0 {
+			median = (offsets[len(offsets)/2-1] + median) / 2
+		}
+		summary["offset_ms"] = median
+		summary["in_sync"] = math.Abs(median) <= float64(maxOffset.Milliseconds())
+	}
+	return summary
+}
+
+func checkNTPServer(env taskEnv, server string, samples int, timeout time.Duration) ntpServerResult {
+	result := ntpServerResult{Server: server}
+	addr := strings.TrimSpace(server)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(unbracket(addr), "123")
+	}
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	result.Address = conn.RemoteAddr().String()
+
+	var best *ntpSample
+	var lastErr error
+	for i := 0; i < samples && !env.cancelled(); i++ {
+		sample, err := queryNTP(conn, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		result.Samples++
+		if best == nil || sample.delay < best.delay {
+			best = &sample
+		}
+	}
+	if best == nil {
+		if lastErr == nil {
+			lastErr = errors.New("cancelled")
+		}
+		result.Error = lastErr.Error()
+		return result
+	}
+	result.Reachable = true
+	result.Stratum = best.stratum
+	result.Leap = ntpLeap[best.leap]
+	result.RefID = best.refID
+	result.OffsetMS = durationMS(best.offset)
+	result.DelayMS = durationMS(best.delay)
+	result.RootDelayMS = durationMS(best.rootDelay)
+	result.RootDispersionMS = durationMS(best.rootDispersion)
+	return result
+}
+
+func durationMS(d time.Duration) *float64 {
+	ms := math.Round(float64(d.Microseconds())) / 1000
+	return &ms
+}
+
+// queryNTP sends one client request on conn and reads the server's answer.
+func queryNTP(conn net.Conn, timeout time.Duration) (ntpSample, error) {
+	request := make([]byte, ntpPacketSize)
+	request[0] = ntpVersion<<3 | ntpModeClient
+	sent := time.Now()
+	binary.BigEndian.PutUint64(request[40:48], toNTPTime(sent))
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(request); err != nil {
+		return ntpSample{}, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return ntpSample{}, err
+		}
+		received := time.Now()
+		sample, err := parseNTPResponse(buf[:n], request[40:48], sent, received)
+		if errors.Is(err, errNTPStale) {
+			// An answer to an earlier request that timed out.
+			continue
+		}
+		return sample, err
+	}
+}
+
+var errNTPStale = errors.New("ntp response does not match the request")
+
+// parseNTPResponse checks a server reply to the request whose transmit
+// timestamp was origin, sent at sent and answered at received by the local
+// clock, and computes the offset and delay.
+func parseNTPResponse(msg, origin []byte, sent, received time.Time) (ntpSample, error) {
+	if len(msg) < ntpPacketSize {
+		return ntpSample{}, fmt.Errorf("short ntp response: %d bytes", len(msg))
+	}
+	if mode := msg[0] & 0x7; mode != ntpModeServer {
+		return ntpSample{}, fmt.Errorf("ntp response has mode %d, want %d", mode, ntpModeServer)
+	}
+	if string(msg[24:32]) != string(origin) {
+		return ntpSample{}, errNTPStale
+	}
+	sample := ntpSample{
+		stratum:        int(msg[1]),
+		leap:           int(msg[0] >> 6),
+		rootDelay:      ntpShortDuration(binary.BigEndian.Uint32(msg[4:8])),
+		rootDispersion: ntpShortDuration(binary.BigEndian.Uint32(msg[8:12])),
+		refID:          ntpRefID(msg[1], msg[12:16]),
+	}
+	if sample.stratum == 0 {
+		// A kiss-o'-death packet: the server refuses to serve us.
+		return ntpSample{}, fmt.Errorf("server sent kiss code %s", sample.refID)
+	}
+	serverReceived := fromNTPTime(binary.BigEndian.Uint64(msg[32:40]))
+	serverSent := fromNTPTime(binary.BigEndian.Uint64(msg[40:48]))
+	if serverSent.Before(serverReceived) {
+		return ntpSample{}, errors.New("ntp response transmit time is before its receive time")
+	}
+	sample.offset = (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2
+	sample.delay = max(received.Sub(sent)-serverSent.Sub(serverReceived), 0)
+	return sample, nil
+}
+
+// ntpRefID is a stratum 1 server's reference clock name, or the address of
+// the server a stratum 2+ server follows (an IPv6 server sends a hash).
+func ntpRefID(stratum byte, raw []byte) string {
+	if stratum <= 1 {
+		return strings.TrimRight(string(raw), "\x00 ")
+	}
+	return net.IP(raw).String()
+}
+
+func ntpShortDuration(value uint32) time.Duration {
+	return time.Duration(value) * time.Second / (1 << 16)
+}
+
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// fromNTPTime converts an NTP timestamp, reading seconds below 2^31 as the
+// era that starts in 2036.
+func fromNTPTime(value uint64) time.Time {
+	seconds := int64(value >> 32)
+	if seconds < 1<<31 {
+		seconds += 1 << 32
+	}
+	nanos := int64((value & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds-ntpEpochOffset, nanos)
+}
+
+// runFakeNTPCheck answers ntp_check for fake agents with servers a few
+// milliseconds off.
+func runFakeNTPCheck(params map[string]interface{}) interface{} {
+	servers := asStringSlice(params["servers"], defaultNTPServers)
+	maxOffset := time.Duration(asInt(params["max_offset_ms"], 500)) * time.Millisecond
+	results := make([]ntpServerResult, len(servers))
+	for i, server := range servers {
+		results[i] = ntpServerResult{
+			Server:           server,
+			Reachable:        true,
+			Stratum:          2,
+			Leap:             "none",
+			RefID:            "192.0.2.1",
+			OffsetMS:         durationMS(time.Duration(rand.Intn(10000)-5000) * time.Microsecond),
+			DelayMS:          durationMS(time.Duration(5000+rand.Intn(20000)) * time.Microsecond),
+			RootDelayMS:      durationMS(12 * time.Millisecond),
+			RootDispersionMS: durationMS(20 * time.Millisecond),
+			Samples:          asInt(params["samples"], 3),
+		}
+	}
+	return summarizeNTP(results, maxOffset)
+}
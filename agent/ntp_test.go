@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveNTP answers SNTP requests on a loopback port with a clock that is
+// skew ahead of the local one, a stratum, and a leap indicator.
+func serveNTP(t *testing.T, skew time.Duration, stratum, leap byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < ntpPacketSize {
+				continue
+			}
+			received := time.Now().Add(skew)
+			reply := make([]byte, ntpPacketSize)
+			reply[0] = leap<<6 | ntpVersion<<3 | ntpModeServer
+			reply[1] = stratum
+			binary.BigEndian.PutUint32(reply[4:8], 1<<14) // 250ms
+			copy(reply[12:16], "GPS")
+			copy(reply[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(reply[32:40], toNTPTime(received))
+			binary.BigEndian.PutUint64(reply[40:48], toNTPTime(time.Now().Add(skew)))
+			_, _ = conn.WriteTo(reply, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNTPTimeRoundTrip(t *testing.T) {
+	for _, at := range []time.Time{
+		time.Date(2026, 10, 16, 12, 0, 0, 123456000, time.UTC),
+		time.Date(2040, 1, 1, 0, 0, 0, 500000000, time.UTC),
+	} {
+		if got := fromNTPTime(toNTPTime(at)); got.Sub(at).Abs() > time.Microsecond {
+			t.Errorf("fromNTPTime(toNTPTime(%v)) = %v", at, got)
+		}
+	}
+}
+
+func TestNTPCheck(t *testing.T) {
+	ahead := serveNTP(t, 5*time.Second, 1, 0)
+	unsynced := serveNTP(t, time.Hour, 16, 3)
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	out, err := runNTPCheck(env, map[string]interface{}{"servers": []interface{}{ahead, unsynced}, "samples": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(map[string]interface{})
+	servers := result["servers"].([]ntpServerResult)
+	first := servers[0]
+	if !first.Reachable || first.Stratum != 1 || first.RefID != "GPS" || first.Leap != "none" || first.Samples != 2 {
+		t.Fatalf("servers[0] = %+v", first)
+	}
+	if math.Abs(*first.OffsetMS-5000) > 50 || *first.DelayMS < 0 || *first.RootDelayMS != 250 {
+		t.Fatalf("servers[0] offset %v, delay %v, root delay %v", *first.OffsetMS, *first.DelayMS, *first.RootDelayMS)
+	}
+	if servers[1].Leap != "unsynchronized" {
+		t.Fatalf("servers[1] = %+v, want unsynchronized", servers[1])
+	}
+	// The unsynchronized server's hour is left out of the agent's offset.
+	if result["reachable"] != 2 || math.Abs(result["offset_ms"].(float64)-5000) > 50 || result["in_sync"] != false {
+		t.Fatalf("result = %v", result)
+	}
+}
+
+func TestNTPCheckUnreachable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	out, _ := runNTPCheck(env, map[string]interface{}{"servers": []interface{}{conn.LocalAddr().String()}, "timeout_ms": 100.0, "samples": 1.0})
+	result := out.(map[string]interface{})
+	server := result["servers"].([]ntpServerResult)[0]
+	if server.Reachable || server.Error == "" || result["reachable"] != 0 || result["in_sync"] != false {
+		t.Fatalf("result = %v, server = %+v", result, server)
+	}
+}
+
+func TestParseNTPResponse(t *testing.T) {
+	origin := make([]byte, 8)
+	binary.BigEndian.PutUint64(origin, toNTPTime(time.Now()))
+	reply := func(edit func([]byte)) []byte {
+		msg := make([]byte, ntpPacketSize)
+		msg[0] = ntpVersion<<3 | ntpModeServer
+		msg[1] = 2
+		copy(msg[24:32], origin)
+		now := toNTPTime(time.Now())
+		binary.BigEndian.PutUint64(msg[32:40], now)
+		binary.BigEndian.PutUint64(msg[40:48], now)
+		if edit != nil {
+			edit(msg)
+		}
+		return msg
+	}
+	now := time.Now()
+	if _, err := parseNTPResponse(reply(nil), origin, now, now); err != nil {
+		t.Fatalf("valid reply: %v", err)
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+		want string
+	}{
+		{"short", reply(nil)[:40], "short"},
+		{"client mode", reply(func(m []byte) { m[0] = ntpVersion<<3 | ntpModeClient }), "mode"},
+		{"other request", reply(func(m []byte) { m[31]++ }), "does not match"},
+		{"kiss of death", reply(func(m []byte) { m[1] = 0; copy(m[12:16], "RATE") }), "RATE"},
+	}
+	for _, tt := range tests {
+		if _, err := parseNTPResponse(tt.msg, origin, now, now); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
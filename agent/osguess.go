@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ttlPattern = regexp.MustCompile(`(?i)\bttl[=:]\s*(\d+)`)
+
+var osGuessPorts = []int{22, 23, 80, 135, 139, 443, 445, 515, 548, 631, 3389, 5985, 8080, 8291, 9100}
+
+var osPortHints = map[int]map[string]int{
+	22:   {"linux": 2, "network-device": 1},
+	23:   {"network-device": 2},
+	135:  {"windows": 2},
+	139:  {"windows": 1},
+	445:  {"windows": 2, "linux": 1},
+	515:  {"printer": 3},
+	548:  {"macos": 3},
+	631:  {"printer": 2, "linux": 1},
+	3389: {"windows": 3},
+	5985: {"windows": 3},
+	8291: {"network-device": 4},
+	9100: {"printer": 4},
+}
+
+var osBannerHints = []struct {
+	pattern string
+	os      string
+	weight  int
+}{
+	{"microsoft-iis", "windows", 3},
+	{"microsoft-httpapi", "windows", 3},
+	{"openssh_for_windows", "windows", 4},
+	{"ubuntu", "linux", 3},
+	{"debian", "linux", 3},
+	{"centos", "linux", 3},
+	{"red hat", "linux", 3},
+	{"raspbian", "linux", 3},
+	{"apache", "linux", 1},
+	{"nginx", "linux", 1},
+	{"cisco", "network-device", 4},
+	{"routeros", "network-device", 4},
+	{"mikrotik", "network-device", 4},
+	{"ubiquiti", "network-device", 3},
+	{"juniper", "network-device", 4},
+	{"jetdirect", "printer", 4},
+	{"hp http server", "printer", 3},
+	{"printer", "printer", 3},
+	{"cups", "printer", 2},
+	{"ipp", "printer", 2},
+}
+
+func runOSGuess(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	target := asString(params["target"], "")
+	if target == "" {
+		return nil, errors.New("os_guess requires target")
+	}
+	if err := checkPingTarget(target); err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(asInt(params["timeout_ms"], 1000)) * time.Millisecond
+	ports, excludedPorts := env.Exclude.filterPorts(osGuessPorts)
+	result := guessOS(env, target, ports, timeout)
+	if env.cancelled() {
+		return nil, env.context().Err()
+	}
+	if excludedPorts > 0 {
+		result["excluded_ports"] = excludedPorts
+	}
+	return result, nil
+}
+
+// checkPingTarget makes sure target is an address or a hostname before it
+// goes on ping's command line, where a leading "-" would be read as an
+// option.
+func checkPingTarget(target string) error {
+	if _, err := netip.ParseAddr(target); err == nil {
+		return nil
+	}
+	if !validHostname(target) {
+		return fmt.Errorf("os_guess target %q is not an IP address or hostname", target)
+	}
+	return nil
+}
+
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func guessOS(env taskEnv, target string, ports []int, timeout time.Duration) map[string]interface{} {
+	scores := map[string]int{}
+	evidence := make([]string, 0)
+
+	ttl, ttlOK := observeTTL(target, timeout)
+	if ttlOK {
+		switch {
+		case ttl <= 64:
+			scores["linux"] += 2
+			scores["macos"] += 1
+			evidence = append(evidence, fmt.Sprintf("ttl=%d (initial 64)", ttl))
+		case ttl <= 128:
+			scores["windows"] += 3
+			evidence = append(evidence, fmt.Sprintf("ttl=%d (initial 128)", ttl))
+		default:
+			scores["network-device"] += 3
+			evidence = append(evidence, fmt.Sprintf("ttl=%d (initial 255)", ttl))
+		}
+	}
+
+	openPorts := connectScan(env.context(), target, ports, timeout)
+	for _, port := range openPorts {
+		for osName, weight := range osPortHints[port] {
+			scores[osName] += weight
+		}
+	}
+	if len(openPorts) > 0 {
+		evidence = append(evidence, fmt.Sprintf("open ports %v", openPorts))
+	}
+
+	var smb map[string]interface{}
+	if slices.Contains(openPorts, 445) && !env.cancelled() {
+		if dialect, enabled, required, err := negotiateSMB(target, timeout); err == nil {
+			smb = map[string]interface{}{"dialect": dialect, "signing_enabled": enabled, "signing_required": required}
+			evidence = append(evidence, fmt.Sprintf("smb dialect %s, signing required %v", dialect, required))
+			if required {
+				scores["windows"] += 2
+			}
+		}
+	}
+
+	banners := make([]string, 0)
+	for _, port := range openPorts {
+		if env.cancelled() {
+			break
+		}
+		var banner string
+		switch port {
+		case 80, 8080:
+			banner = httpServerHeader(target, port, timeout)
+		case 22, 23:
+			banner = grabBanner(target, port, timeout, false).Banner
+		}
+		if banner == "" {
+			continue
+		}
+		banners = append(banners, banner)
+		lower := strings.ToLower(banner)
+		for _, hint := range osBannerHints {
+			if strings.Contains(lower, hint.pattern) {
+				scores[hint.os] += hint.weight
+				evidence = append(evidence, fmt.Sprintf("banner %q matches %s", banner, hint.os))
+			}
+		}
+	}
+
+	guess, confidence := pickOSGuess(scores)
+	result := map[string]interface{}{
+		"target":     target,
+		"guess":      guess,
+		"confidence": confidence,
+		"scores":     scores,
+		"open_ports": openPorts,
+		"evidence":   evidence,
+	}
+	if ttlOK {
+		result["ttl"] = ttl
+	}
+	if len(banners) > 0 {
+		result["banners"] = banners
+	}
+	if smb != nil {
+		result["smb"] = smb
+	}
+	return result
+}
+
+func pickOSGuess(scores map[string]int) (string, float64) {
+	total := 0
+	best := "unknown"
+	bestScore := 0
+	names := make([]string, 0, len(scores))
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		score := scores[name]
+		total += score
+		if score > bestScore {
+			best = name
+			bestScore = score
+		}
+	}
+	if total == 0 {
+		return "unknown", 0
+	}
+	return best, float64(bestScore) / float64(total)
+}
+
+func observeTTL(target string, timeout time.Duration) (int, bool) {
+	waitMS := strconv.Itoa(int(timeout.Milliseconds()))
+	var out []byte
+	switch runtime.GOOS {
+	case "windows":
+		out, _ = sandboxedOutput("ping", "-n", "1", "-w", waitMS, target)
+	case "darwin":
+		out, _ = sandboxedOutput("ping", "-c", "1", "-W", waitMS, target)
+	default:
+		waitS := int(timeout.Seconds())
+		if waitS < 1 {
+			waitS = 1
+		}
+		out, _ = sandboxedOutput("ping", "-c", "1", "-W", strconv.Itoa(waitS), target)
+	}
+	match := ttlPattern.FindStringSubmatch(string(out))
+	if len(match) < 2 {
+		return 0, false
+	}
+	ttl, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, false
+	}
+	return ttl, true
+}
+
+func connectScan(ctx context.Context, target string, ports []int, timeout time.Duration) []int {
+	dialer := net.Dialer{Timeout: timeout}
+	open := make([]int, 0)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target, strconv.Itoa(port)))
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+			mu.Lock()
+			open = append(open, port)
+			mu.Unlock()
+		}(port)
+	}
+	wg.Wait()
+	sort.Ints(open)
+	return open
+}
+
+func httpServerHeader(target string, port int, timeout time.Duration) string {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(target, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	_, _ = fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\n\r\n", target)
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "server:") {
+			return sanitizeBanner(strings.TrimSpace(line[len("server:"):]))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckPingTarget(t *testing.T) {
+	for _, target := range []string{"192.168.1.20", "fe80::1", "nas.lab", "printer-2", "host_1.corp.example."} {
+		if err := checkPingTarget(target); err != nil {
+			t.Errorf("checkPingTarget(%q) = %v", target, err)
+		}
+	}
+	for _, target := range []string{"-f", "-s 65000 10.0.0.1", "--help", "nas..lab", "bad-.lab", "a b", "10.0.0.1;reboot"} {
+		if err := checkPingTarget(target); err == nil {
+			t.Errorf("checkPingTarget(%q) accepted", target)
+		}
+	}
+	if _, err := runOSGuess(taskEnv{}, map[string]interface{}{"target": "-f"}); err == nil {
+		t.Error("runOSGuess accepted a target that ping would read as an option")
+	}
+}
+
+func TestConnectScanCancelled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if open := connectScan(context.Background(), "127.0.0.1", []int{port}, time.Second); len(open) != 1 {
+		t.Fatalf("open = %v, want [%d]", open, port)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if open := connectScan(ctx, "127.0.0.1", []int{port}, time.Second); len(open) != 0 {
+		t.Errorf("cancelled scan found %v", open)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+const (
+	outboxPath       = "agent_outbox.jsonl"
+	outboxMaxEntries = 500
+)
+
+type outboxEntry struct {
+	Type    string          `json:"type"`
+	TS      int64           `json:"ts"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// outbox keeps task_result and heartbeat messages that could not be sent
+// so they can be replayed after the next registration. It is a ring of
+// outboxMaxEntries persisted as JSON lines at path (memory only when path is
+// empty); the oldest entries are dropped first.
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	entries []outboxEntry
+}
+
+func loadOutbox(path string) *outbox {
+	box := &outbox{path: path}
+	if path == "" {
+		return box
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read outbox", "err", err)
+		}
+		return box
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxDecodedPayload)
+	for scanner.Scan() {
+		var entry outboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			box.entries = append(box.entries, entry)
+		}
+	}
+	box.trimLocked()
+	return box
+}
+
+func outboxKeeps(messageType string) bool {
+	return messageType == "task_result" || messageType == "heartbeat"
+}
+
+func (b *outbox) add(messageType string, ts int64, payload []byte) {
+	if !outboxKeeps(messageType) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(b.entries, outboxEntry{Type: messageType, TS: ts, Payload: payload})
+	b.trimLocked()
+	if err := b.saveLocked(); err != nil {
+		slog.Warn("failed to persist outbox", "err", err)
+	}
+}
+
+// drain removes and returns every buffered entry, oldest first.
+func (b *outbox) drain() []outboxEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.entries
+	b.entries = nil
+	if len(entries) > 0 {
+		if err := b.saveLocked(); err != nil {
+			slog.Warn("failed to persist outbox", "err", err)
+		}
+	}
+	return entries
+}
+
+func (b *outbox) trimLocked() {
+	if over := len(b.entries) - outboxMaxEntries; over > 0 {
+		b.entries = append([]outboxEntry(nil), b.entries[over:]...)
+	}
+}
+
+func (b *outbox) saveLocked() error {
+	if b.path == "" {
+		return nil
+	}
+	if len(b.entries) == 0 {
+		err := os.Remove(b.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range b.entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// replayOutbox resends buffered messages after a successful registration.
+// Anything that fails again goes straight back into the outbox.
+func (c *AgentClient) replayOutbox() {
+	entries := c.outbox.drain()
+	if len(entries) == 0 {
+		return
+	}
+	c.logger().Info("replaying buffered messages", "count", len(entries))
+	for _, entry := range entries {
+		if entry.Type == "task_result" {
+			var result TaskResultPayload
+			if err := json.Unmarshal(entry.Payload, &result); err != nil {
+				continue
+			}
+			result.Replayed = true
+			_ = c.sendTaskResult(result)
+			continue
+		}
+		_ = c.sendRaw(entry.Type, entry.TS, entry.Payload)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	pcapMaxDuration = 300
+	pcapMaxBytes    = 32 * 1024 * 1024
+)
+
+var errCaptureTimeout = errors.New("capture read timeout")
+
+type captureSource interface {
+	ReadPacket() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	Close() error
+}
+
+type flowKey struct {
+	Proto   string
+	Src     string
+	Dst     string
+	SrcPort int
+	DstPort int
+}
+
+type flowStats struct {
+	Proto   string `json:"proto"`
+	Src     string `json:"src"`
+	Dst     string `json:"dst"`
+	SrcPort int    `json:"src_port,omitempty"`
+	DstPort int    `json:"dst_port,omitempty"`
+	Packets int    `json:"packets"`
+	Bytes   int    `json:"bytes"`
+}
+
+func runPCAPCapture(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	iface := asString(params["interface"], "")
+	if iface == "" {
+		return nil, errors.New("pcap_capture requires interface")
+	}
+	filter := asString(params["filter"], "")
+	mode := asString(params["mode"], "summary")
+	if mode != "summary" && mode != "pcap" {
+		return nil, fmt.Errorf("unsupported pcap_capture mode %q", mode)
+	}
+	duration := asInt(params["duration_s"], 10)
+	if duration < 1 {
+		duration = 1
+	}
+	if duration > pcapMaxDuration {
+		duration = pcapMaxDuration
+	}
+	maxPackets := asInt(params["max_packets"], 10000)
+	maxBytes := asInt(params["max_bytes"], 4*1024*1024)
+	if maxBytes > pcapMaxBytes {
+		maxBytes = pcapMaxBytes
+	}
+	snaplen := asInt(params["snaplen"], 65535)
+
+	source, filtered, err := openCapture(iface, filter, snaplen)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	var match *packetFilter
+	if filter != "" && !filtered {
+		if match, err = parsePacketFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+
+	var pcapBuf bytes.Buffer
+	var writer *pcapgo.Writer
+	if mode == "pcap" {
+		writer = pcapgo.NewWriter(&pcapBuf)
+		if err := writer.WriteFileHeader(uint32(snaplen), source.LinkType()); err != nil {
+			return nil, err
+		}
+	}
+
+	flows := make(map[flowKey]*flowStats)
+	protocols := make(map[string]int)
+	packets, totalBytes := 0, 0
+	truncated := ""
+	deadline := time.Now().Add(time.Duration(duration) * time.Second)
+
+	for time.Now().Before(deadline) && !env.cancelled() {
+		data, ci, err := source.ReadPacket()
+		if errors.Is(err, errCaptureTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("capture on %s: %w", iface, err)
+		}
+		packet := gopacket.NewPacket(data, source.LinkType(), gopacket.NoCopy)
+		key := packetFlowKey(packet)
+		if match != nil && !match.matches(key) {
+			continue
+		}
+
+		packets++
+		totalBytes += ci.Length
+		protocols[key.Proto]++
+		flow, ok := flows[key]
+		if !ok {
+			flow = &flowStats{Proto: key.Proto, Src: key.Src, Dst: key.Dst, SrcPort: key.SrcPort, DstPort: key.DstPort}
+			flows[key] = flow
+		}
+		flow.Packets++
+		flow.Bytes += ci.Length
+
+		if writer != nil {
+			if err := writer.WritePacket(ci, data); err != nil {
+				return nil, err
+			}
+			if pcapBuf.Len() >= maxBytes {
+				truncated = "max_bytes"
+				break
+			}
+		}
+		if maxPackets > 0 && packets >= maxPackets {
+			truncated = "max_packets"
+			break
+		}
+	}
+
+	result := map[string]interface{}{
+		"interface": iface,
+		"filter":    filter,
+		"packets":   packets,
+		"bytes":     totalBytes,
+		"protocols": protocols,
+		"flows":     len(flows),
+	}
+	if truncated != "" {
+		result["truncated"] = truncated
+	}
+
+	if writer == nil {
+		result["top_flows"] = topFlows(flows, asInt(params["top"], 50))
+		return result, nil
+	}
+
+	result["pcap_bytes"] = pcapBuf.Len()
+	if uploadURL := asString(params["upload_url"], ""); uploadURL != "" {
+		status, err := uploadCapture(env.Pins.httpClient(60*time.Second), uploadURL, pcapBuf.Bytes())
+		if err != nil {
+			return result, fmt.Errorf("upload capture: %w", err)
+		}
+		result["upload_status"] = status
+		return result, nil
+	}
+	result["pcap_b64"] = base64.StdEncoding.EncodeToString(pcapBuf.Bytes())
+	return result, nil
+}
+
+func runFakePCAPCapture(params map[string]interface{}) (interface{}, error) {
+	flows := []flowStats{
+		{Proto: "tcp", Src: "192.168.1.20", Dst: "192.168.1.1", SrcPort: 51544, DstPort: 443, Packets: 412, Bytes: 388201},
+		{Proto: "udp", Src: "192.168.1.20", Dst: "192.168.1.1", SrcPort: 40112, DstPort: 53, Packets: 36, Bytes: 3420},
+		{Proto: "arp", Src: "192.168.1.1", Dst: "192.168.1.255", Packets: 4, Bytes: 240},
+	}
+	return map[string]interface{}{
+		"interface": asString(params["interface"], "eth0"),
+		"filter":    asString(params["filter"], ""),
+		"packets":   452,
+		"bytes":     391861,
+		"protocols": map[string]int{"tcp": 412, "udp": 36, "arp": 4},
+		"flows":     len(flows),
+		"top_flows": flows,
+	}, nil
+}
+
+func packetFlowKey(packet gopacket.Packet) flowKey {
+	key := flowKey{Proto: "other"}
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		key.Proto = "arp"
+		key.Src = fmt.Sprintf("%d.%d.%d.%d", arp.SourceProtAddress[0], arp.SourceProtAddress[1], arp.SourceProtAddress[2], arp.SourceProtAddress[3])
+		key.Dst = fmt.Sprintf("%d.%d.%d.%d", arp.DstProtAddress[0], arp.DstProtAddress[1], arp.DstProtAddress[2], arp.DstProtAddress[3])
+		return key
+	}
+	if network := packet.NetworkLayer(); network != nil {
+		src, dst := network.NetworkFlow().Endpoints()
+		key.Src, key.Dst = src.String(), dst.String()
+		key.Proto = "ip"
+		if network.LayerType() == layers.LayerTypeIPv6 {
+			key.Proto = "ip6"
+		}
+	}
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		key.Proto, key.SrcPort, key.DstPort = "tcp", int(transport.SrcPort), int(transport.DstPort)
+	case *layers.UDP:
+		key.Proto, key.SrcPort, key.DstPort = "udp", int(transport.SrcPort), int(transport.DstPort)
+	default:
+		if packet.Layer(layers.LayerTypeICMPv4) != nil || packet.Layer(layers.LayerTypeICMPv6) != nil {
+			key.Proto = "icmp"
+		}
+	}
+	return key
+}
+
+func topFlows(flows map[flowKey]*flowStats, limit int) []flowStats {
+	out := make([]flowStats, 0, len(flows))
+	for _, flow := range flows {
+		out = append(out, *flow)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func uploadCapture(client *http.Client, target string, data []byte) (int, error) {
+	resp, err := client.Post(target, "application/vnd.tcpdump.pcap", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("upload returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
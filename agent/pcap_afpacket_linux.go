@@ -0,0 +1,82 @@
+//go:build linux && !pcap
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+type afPacketSource struct {
+	fd       int
+	buf      []byte
+	snaplen  int
+	loopback bool
+}
+
+// openCapture uses a raw AF_PACKET socket so the default build needs neither
+// cgo nor libpcap; the filter is applied in userspace by the caller.
+func openCapture(iface, _ string, snaplen int) (captureSource, bool, error) {
+	intf, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, false, err
+	}
+	proto := int(htons(unix.ETH_P_ALL))
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, false, fmt.Errorf("open packet socket (needs root or CAP_NET_RAW): %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: intf.Index}); err != nil {
+		_ = unix.Close(fd)
+		return nil, false, fmt.Errorf("bind to %s: %w", iface, err)
+	}
+	timeout := unix.NsecToTimeval((500 * time.Millisecond).Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		_ = unix.Close(fd)
+		return nil, false, err
+	}
+	return &afPacketSource{fd: fd, buf: make([]byte, 65536), snaplen: snaplen, loopback: intf.Flags&net.FlagLoopback != 0}, false, nil
+}
+
+func (s *afPacketSource) ReadPacket() ([]byte, gopacket.CaptureInfo, error) {
+	n, from, err := unix.Recvfrom(s.fd, s.buf, unix.MSG_TRUNC)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+		return nil, gopacket.CaptureInfo{}, errCaptureTimeout
+	}
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	// Loopback delivers every frame twice (outgoing and incoming); keep one
+	// copy like libpcap does.
+	if ll, ok := from.(*unix.SockaddrLinklayer); ok && s.loopback && ll.Pkttype == unix.PACKET_OUTGOING {
+		return nil, gopacket.CaptureInfo{}, errCaptureTimeout
+	}
+	captured := n
+	if captured > len(s.buf) {
+		captured = len(s.buf)
+	}
+	if s.snaplen > 0 && captured > s.snaplen {
+		captured = s.snaplen
+	}
+	data := make([]byte, captured)
+	copy(data, s.buf[:captured])
+	return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: captured, Length: n}, nil
+}
+
+func (s *afPacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (s *afPacketSource) Close() error {
+	return unix.Close(s.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,48 @@
+//go:build pcap
+
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+type libpcapSource struct {
+	handle *pcap.Handle
+}
+
+// openCapture uses libpcap when built with -tags pcap, which compiles the
+// filter to kernel BPF and works on every platform libpcap/Npcap supports.
+func openCapture(iface, filter string, snaplen int) (captureSource, bool, error) {
+	handle, err := pcap.OpenLive(iface, int32(snaplen), true, 500*time.Millisecond)
+	if err != nil {
+		return nil, false, err
+	}
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, false, err
+		}
+	}
+	return &libpcapSource{handle: handle}, true, nil
+}
+
+func (s *libpcapSource) ReadPacket() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		return nil, ci, errCaptureTimeout
+	}
+	return data, ci, err
+}
+
+func (s *libpcapSource) LinkType() layers.LinkType {
+	return s.handle.LinkType()
+}
+
+func (s *libpcapSource) Close() error {
+	s.handle.Close()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !pcap
+
+package main
+
+import "errors"
+
+func openCapture(string, string, int) (captureSource, bool, error) {
+	return nil, false, errors.New("pcap_capture on this platform requires an agent built with -tags pcap")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// packetFilter is a userspace fallback for builds without libpcap. It accepts
+// a subset of the BPF syntax: protocol names, [src|dst] host/net/port
+// primitives, optional "not", joined by "and"/"or" (no parentheses, "and"
+// binds tighter).
+type packetFilter struct {
+	any [][]filterTerm
+}
+
+type filterTerm struct {
+	negate bool
+	kind   string
+	dir    string
+	host   net.IP
+	net    *net.IPNet
+	port   int
+}
+
+func parsePacketFilter(expr string) (*packetFilter, error) {
+	tokens := strings.Fields(strings.ToLower(expr))
+	filter := &packetFilter{}
+	var group []filterTerm
+	for i := 0; i < len(tokens); {
+		switch tokens[i] {
+		case "or", "||":
+			if len(group) == 0 {
+				return nil, fmt.Errorf("filter %q: unexpected %q", expr, tokens[i])
+			}
+			filter.any = append(filter.any, group)
+			group = nil
+			i++
+			continue
+		case "and", "&&":
+			i++
+			continue
+		}
+		term, next, err := parseFilterTerm(tokens, i)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", expr, err)
+		}
+		group = append(group, term)
+		i = next
+	}
+	if len(group) == 0 {
+		return nil, fmt.Errorf("filter %q: empty expression", expr)
+	}
+	filter.any = append(filter.any, group)
+	return filter, nil
+}
+
+func parseFilterTerm(tokens []string, i int) (filterTerm, int, error) {
+	term := filterTerm{}
+	if tokens[i] == "not" || tokens[i] == "!" {
+		term.negate = true
+		i++
+	}
+	if i < len(tokens) && (tokens[i] == "src" || tokens[i] == "dst") {
+		term.dir = tokens[i]
+		i++
+	}
+	if i >= len(tokens) {
+		return term, i, fmt.Errorf("incomplete expression")
+	}
+	term.kind = tokens[i]
+	i++
+	switch term.kind {
+	case "tcp", "udp", "icmp", "arp", "ip", "ip6":
+		if term.dir != "" {
+			return term, i, fmt.Errorf("%s cannot take a direction", term.kind)
+		}
+		return term, i, nil
+	case "host", "net", "port":
+	default:
+		return term, i, fmt.Errorf("unsupported primitive %q (build with -tags pcap for full BPF syntax)", term.kind)
+	}
+	if i >= len(tokens) {
+		return term, i, fmt.Errorf("%s requires a value", term.kind)
+	}
+	value := tokens[i]
+	i++
+	switch term.kind {
+	case "host":
+		if term.host = net.ParseIP(value); term.host == nil {
+			return term, i, fmt.Errorf("invalid host %q", value)
+		}
+	case "net":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return term, i, fmt.Errorf("invalid net %q", value)
+		}
+		term.net = ipNet
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return term, i, fmt.Errorf("invalid port %q", value)
+		}
+		term.port = port
+	}
+	return term, i, nil
+}
+
+func (f *packetFilter) matches(key flowKey) bool {
+	for _, group := range f.any {
+		matched := true
+		for _, term := range group {
+			if term.matches(key) == term.negate {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (t filterTerm) matches(key flowKey) bool {
+	switch t.kind {
+	case "tcp", "udp", "icmp", "arp":
+		return key.Proto == t.kind
+	case "ip":
+		return key.Src != "" && key.Proto != "arp" && net.ParseIP(key.Src).To4() != nil
+	case "ip6":
+		return key.Src != "" && key.Proto != "arp" && net.ParseIP(key.Src).To4() == nil
+	case "host":
+		return t.either(func(addr string, _ int) bool { return t.host.Equal(net.ParseIP(addr)) }, key)
+	case "net":
+		return t.either(func(addr string, _ int) bool {
+			ip := net.ParseIP(addr)
+			return ip != nil && t.net.Contains(ip)
+		}, key)
+	case "port":
+		if key.Proto != "tcp" && key.Proto != "udp" {
+			return false
+		}
+		return t.either(func(_ string, port int) bool { return port == t.port }, key)
+	}
+	return false
+}
+
+func (t filterTerm) either(check func(addr string, port int) bool, key flowKey) bool {
+	switch t.dir {
+	case "src":
+		return check(key.Src, key.SrcPort)
+	case "dst":
+		return check(key.Dst, key.DstPort)
+	}
+	return check(key.Src, key.SrcPort) || check(key.Dst, key.DstPort)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const pipelineMaxItems = 1024
+
+var pipelineRef = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+type pipelineStep struct {
+	Name    string
+	Kind    string
+	Params  map[string]interface{}
+	ForEach string
+}
+
+// runPipeline runs steps in order. A string param that is exactly
+// "${path}" is replaced by the value at path (keeping its type); "${path}"
+// inside a longer string is interpolated as text. Paths start at an earlier
+// step's name, or "item" inside a foreach step, and use ".field", "[n]" and
+// "[]" (map over a list, flattening nested lists).
+func runPipeline(fake bool, env taskEnv, params map[string]interface{}) (interface{}, error) {
+	steps, err := parsePipelineSteps(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if err := env.Policy.checkKind(step.Kind); err != nil {
+			return nil, err
+		}
+	}
+
+	scope := make(map[string]interface{})
+	results := make([]map[string]interface{}, 0, len(steps))
+	for _, step := range steps {
+		if env.cancelled() {
+			return map[string]interface{}{"steps": results}, env.context().Err()
+		}
+
+		var output interface{}
+		var stepErr error
+		if step.ForEach == "" {
+			resolved, err := resolvePipelineValue(step.Params, scope)
+			if err != nil {
+				stepErr = fmt.Errorf("step %s: %w", step.Name, err)
+			} else {
+				output, stepErr = runTask(fake, env, step.Kind, resolved.(map[string]interface{}))
+			}
+		} else {
+			output, stepErr = runPipelineForEach(fake, env, step, scope)
+		}
+
+		normalized := normalizeResult(output)
+		scope[step.Name] = normalized
+		entry := map[string]interface{}{"name": step.Name, "kind": step.Kind, "result": normalized}
+		if stepErr != nil {
+			entry["error"] = stepErr.Error()
+		}
+		results = append(results, entry)
+		env.update(entry, stepErr)
+
+		if stepErr != nil {
+			return map[string]interface{}{"steps": results, "failed_step": step.Name}, fmt.Errorf("pipeline step %s failed: %w", step.Name, stepErr)
+		}
+	}
+	return map[string]interface{}{"steps": results, "completed": len(results)}, nil
+}
+
+// runPipelineForEach runs the step once per element of its foreach list.
+// Item failures are recorded next to the item rather than failing the step.
+func runPipelineForEach(fake bool, env taskEnv, step pipelineStep, scope map[string]interface{}) (interface{}, error) {
+	listValue, err := resolvePipelineValue(step.ForEach, scope)
+	if err != nil {
+		return nil, fmt.Errorf("foreach: %w", err)
+	}
+	items, ok := listValue.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("foreach %s is not a list", step.ForEach)
+	}
+	if len(items) > pipelineMaxItems {
+		return nil, fmt.Errorf("foreach expands to %d items (max %d)", len(items), pipelineMaxItems)
+	}
+
+	outputs := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if env.cancelled() {
+			break
+		}
+		itemScope := make(map[string]interface{}, len(scope)+1)
+		for k, v := range scope {
+			itemScope[k] = v
+		}
+		itemScope["item"] = item
+
+		resolved, err := resolvePipelineValue(step.Params, itemScope)
+		var result interface{}
+		if err == nil {
+			result, err = runTask(fake, env, step.Kind, resolved.(map[string]interface{}))
+		}
+		entry := map[string]interface{}{"item": item, "result": result}
+		if err != nil {
+			entry["error"] = err.Error()
+		}
+		outputs = append(outputs, entry)
+	}
+	return outputs, nil
+}
+
+func parsePipelineSteps(params map[string]interface{}) ([]pipelineStep, error) {
+	rawSteps, ok := params["steps"].([]interface{})
+	if !ok || len(rawSteps) == 0 {
+		return nil, errors.New("pipeline requires steps")
+	}
+	steps := make([]pipelineStep, 0, len(rawSteps))
+	seen := make(map[string]bool)
+	for i, raw := range rawSteps {
+		spec, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("pipeline step %d is not an object", i)
+		}
+		step := pipelineStep{
+			Name:    asString(spec["name"], fmt.Sprintf("step%d", i)),
+			Kind:    asString(spec["kind"], ""),
+			ForEach: asString(spec["foreach"], ""),
+		}
+		step.Params, _ = spec["params"].(map[string]interface{})
+		if step.Params == nil {
+			step.Params = map[string]interface{}{}
+		}
+		switch step.Kind {
+		case "":
+			return nil, fmt.Errorf("pipeline step %s requires kind", step.Name)
+		case "pipeline", "monitor", "schedule":
+			return nil, fmt.Errorf("pipeline step %s cannot be a %s task", step.Name, step.Kind)
+		}
+		if step.Name == "item" || seen[step.Name] {
+			return nil, fmt.Errorf("pipeline step name %q is reserved or duplicated", step.Name)
+		}
+		seen[step.Name] = true
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// normalizeResult round-trips a handler result through JSON so references
+// see the same maps, lists and numbers the admin would.
+func normalizeResult(result interface{}) interface{} {
+	if result == nil {
+		return nil
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+func resolvePipelineValue(value interface{}, scope map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		matches := pipelineRef.FindAllStringSubmatchIndex(v, -1)
+		if len(matches) == 0 {
+			return v, nil
+		}
+		if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(v) {
+			return lookupPipelinePath(scope, v[matches[0][2]:matches[0][3]])
+		}
+		var err error
+		text := pipelineRef.ReplaceAllStringFunc(v, func(ref string) string {
+			resolved, lookupErr := lookupPipelinePath(scope, ref[2:len(ref)-1])
+			if lookupErr != nil {
+				err = lookupErr
+				return ""
+			}
+			if s, ok := resolved.(string); ok {
+				return s
+			}
+			encoded, _ := json.Marshal(resolved)
+			return string(encoded)
+		})
+		return text, err
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			resolved, err := resolvePipelineValue(inner, scope)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, inner := range v {
+			resolved, err := resolvePipelineValue(inner, scope)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, resolved)
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func lookupPipelinePath(scope map[string]interface{}, path string) (interface{}, error) {
+	segments := splitPipelinePath(strings.TrimSpace(path))
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty reference")
+	}
+	root, ok := scope[segments[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown reference %q", segments[0])
+	}
+	value, err := walkPipelinePath(root, segments[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return value, nil
+}
+
+// splitPipelinePath turns "scan[].open_ports[0]" into
+// ["scan", "[]", "open_ports", "[0]"].
+func splitPipelinePath(path string) []string {
+	var segments []string
+	for _, part := range strings.Split(path, ".") {
+		for part != "" {
+			open := strings.Index(part, "[")
+			if open < 0 {
+				segments = append(segments, part)
+				break
+			}
+			if open > 0 {
+				segments = append(segments, part[:open])
+			}
+			end := strings.Index(part[open:], "]")
+			if end < 0 {
+				segments = append(segments, part[open:])
+				break
+			}
+			segments = append(segments, part[open:open+end+1])
+			part = part[open+end+1:]
+		}
+	}
+	return segments
+}
+
+func walkPipelinePath(value interface{}, segments []string) (interface{}, error) {
+	for i, segment := range segments {
+		switch {
+		case segment == "[]" || segment == "[*]":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s applied to a non-list", segment)
+			}
+			out := make([]interface{}, 0, len(list))
+			for _, element := range list {
+				mapped, err := walkPipelinePath(element, segments[i+1:])
+				if err != nil {
+					continue
+				}
+				if nested, ok := mapped.([]interface{}); ok && containsMapSegment(segments[i+1:]) {
+					out = append(out, nested...)
+				} else {
+					out = append(out, mapped)
+				}
+			}
+			return out, nil
+		case strings.HasPrefix(segment, "["):
+			index, err := strconv.Atoi(strings.Trim(segment, "[]"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %s", segment)
+			}
+			list, ok := value.([]interface{})
+			if !ok || index < 0 || index >= len(list) {
+				return nil, fmt.Errorf("index %d out of range", index)
+			}
+			value = list[index]
+		default:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("field %q applied to a non-object", segment)
+			}
+			if value, ok = object[segment]; !ok {
+				return nil, fmt.Errorf("missing field %q", segment)
+			}
+		}
+	}
+	return value, nil
+}
+
+func containsMapSegment(segments []string) bool {
+	for _, segment := range segments {
+		if segment == "[]" || segment == "[*]" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package netprobe
+
+// Debouncer turns noisy pass/fail observations into a stable tri-state
+// value: nil until the first verdict, true after any success, and false
+// only after Threshold consecutive failures.
+type Debouncer struct {
+	Threshold int
+	value     *bool
+	failures  int
+}
+
+// Observe records one probe outcome and returns the debounced value.
+func (d *Debouncer) Observe(ok bool) *bool {
+	threshold := d.Threshold
+	if threshold < 1 {
+		threshold = 2
+	}
+
+	if ok {
+		d.failures = 0
+		d.value = boolPtr(true)
+		return d.Value()
+	}
+
+	d.failures++
+	if d.failures >= threshold && (d.value == nil || *d.value) {
+		d.value = boolPtr(false)
+	}
+	return d.Value()
+}
+
+// Value returns a copy of the current debounced value.
+func (d *Debouncer) Value() *bool {
+	if d.value == nil {
+		return nil
+	}
+	return boolPtr(*d.value)
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
@@ -0,0 +1,57 @@
+package netprobe
+
+import "time"
+
+// History keeps the most recent latency samples in a fixed-size ring.
+type History struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// NewHistory returns a ring holding up to size samples.
+func NewHistory(size int) *History {
+	if size < 2 {
+		size = 2
+	}
+	return &History{samples: make([]time.Duration, size)}
+}
+
+// Add records a sample, evicting the oldest when full.
+func (h *History) Add(sample time.Duration) {
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Samples returns the stored samples, oldest first.
+func (h *History) Samples() []time.Duration {
+	if !h.full {
+		out := make([]time.Duration, h.next)
+		copy(out, h.samples[:h.next])
+		return out
+	}
+	out := make([]time.Duration, 0, len(h.samples))
+	out = append(out, h.samples[h.next:]...)
+	return append(out, h.samples[:h.next]...)
+}
+
+// Jitter returns the mean absolute difference between consecutive samples,
+// and false when fewer than two samples are available.
+func (h *History) Jitter() (time.Duration, bool) {
+	samples := h.Samples()
+	if len(samples) < 2 {
+		return 0, false
+	}
+	var total time.Duration
+	for i := 1; i < len(samples); i++ {
+		diff := samples[i] - samples[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	return total / time.Duration(len(samples)-1), true
+}
@@ -0,0 +1,108 @@
+package netprobe
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ErrICMPUnavailable is returned by Echo when the process may open neither
+// datagram nor raw ICMP sockets.
+var ErrICMPUnavailable = errors.New("icmp sockets unavailable")
+
+// Echo sends one echo request and waits for the matching reply. It prefers
+// unprivileged datagram ICMP sockets and falls back to raw sockets,
+// returning ErrICMPUnavailable when neither is permitted. IPv6 targets use
+// ICMPv6.
+func Echo(target string, timeout time.Duration) (time.Duration, error) {
+	dst, err := net.ResolveIPAddr("ip", target)
+	if err != nil {
+		return 0, err
+	}
+	v6 := dst.IP.To4() == nil
+
+	conn, privileged, err := listenICMP(v6)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	seq := rand.Intn(0xffff)
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := 1
+	if v6 {
+		echoType, replyType, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("labscan")},
+	}
+	raw, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var addr net.Addr = dst
+	if !privileged {
+		addr = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.WriteTo(raw, addr); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (privileged && echo.ID != id) {
+			continue
+		}
+		if !sameHost(peer, dst.IP) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+func listenICMP(v6 bool) (*icmp.PacketConn, bool, error) {
+	dgram, rawNet, addr := "udp4", "ip4:icmp", "0.0.0.0"
+	if v6 {
+		dgram, rawNet, addr = "udp6", "ip6:ipv6-icmp", "::"
+	}
+	if conn, err := icmp.ListenPacket(dgram, addr); err == nil {
+		return conn, false, nil
+	}
+	if conn, err := icmp.ListenPacket(rawNet, addr); err == nil {
+		return conn, true, nil
+	}
+	return nil, false, ErrICMPUnavailable
+}
+
+func sameHost(addr net.Addr, ip net.IP) bool {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,200 @@
+package netprobe
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Snapshot is the debounced connectivity state. Nil fields are unknown.
+type Snapshot struct {
+	Internet  *bool
+	DNS       *bool
+	Gateway   *bool
+	LatencyMS *int64
+	JitterMS  *int64
+	// InternetMethod, GatewayMethod, CaptivePortal and Resolvers come from
+	// the latest round.
+	InternetMethod string
+	GatewayMethod  string
+	CaptivePortal  *bool
+	Resolvers      []ResolverResult
+}
+
+// Monitor runs a Prober periodically and maintains debounced state and
+// latency history. It is safe to read Snapshot while Run is active.
+type Monitor struct {
+	Prober    Prober
+	Interval  time.Duration
+	Threshold int
+	// HistorySize bounds the latency ring used for jitter (default 20).
+	HistorySize int
+
+	// OnResult is called after every round with the raw result and the
+	// updated snapshot.
+	OnResult func(Result, Snapshot)
+	// OnChange is called when a debounced value changes; check is
+	// "internet", "dns" or "gateway".
+	OnChange func(check string, previous, current *bool)
+
+	mu       sync.Mutex
+	retick   chan time.Duration
+	internet Debouncer
+	dns      Debouncer
+	gateway  Debouncer
+	history  *History
+	latency  *int64
+	last     Result
+}
+
+// Run probes immediately and then every Interval until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	m.mu.Lock()
+	interval := m.Interval
+	if m.retick == nil {
+		m.retick = make(chan time.Duration, 1)
+	}
+	retick := m.retick
+	m.mu.Unlock()
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	m.ProbeOnce(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.ProbeOnce(ctx)
+		case interval = <-retick:
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// SetInterval changes the probe interval, taking effect on a running
+// monitor from the next tick.
+func (m *Monitor) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Interval = interval
+	if m.retick == nil {
+		return
+	}
+	select {
+	case <-m.retick:
+	default:
+	}
+	m.retick <- interval
+}
+
+// SetThreshold changes how many consecutive agreeing rounds flip a
+// debounced value. It is safe to call while Run is active.
+func (m *Monitor) SetThreshold(threshold int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Threshold = threshold
+}
+
+// ProbeOnce runs a single round and returns the updated snapshot.
+func (m *Monitor) ProbeOnce(ctx context.Context) Snapshot {
+	result := m.Prober.Probe(ctx)
+
+	type change struct {
+		check             string
+		previous, current *bool
+	}
+	changes := make([]change, 0, 3)
+
+	m.mu.Lock()
+	if m.history == nil {
+		size := m.HistorySize
+		if size <= 0 {
+			size = 20
+		}
+		m.history = NewHistory(size)
+	}
+	for _, item := range []struct {
+		check string
+		d     *Debouncer
+		ok    bool
+	}{
+		{"internet", &m.internet, result.Internet},
+		{"dns", &m.dns, result.DNS},
+		{"gateway", &m.gateway, result.Gateway},
+	} {
+		item.d.Threshold = m.Threshold
+		previous := item.d.Value()
+		current := item.d.Observe(item.ok)
+		if !sameValue(previous, current) {
+			changes = append(changes, change{item.check, previous, current})
+		}
+	}
+	if result.Internet {
+		ms := result.Latency.Milliseconds()
+		m.latency = &ms
+		m.history.Add(result.Latency)
+	} else {
+		m.latency = nil
+	}
+	m.last = result
+	snapshot := m.snapshotLocked()
+	m.mu.Unlock()
+
+	if m.OnChange != nil {
+		for _, c := range changes {
+			m.OnChange(c.check, c.previous, c.current)
+		}
+	}
+	if m.OnResult != nil {
+		m.OnResult(result, snapshot)
+	}
+	return snapshot
+}
+
+// Snapshot returns a copy of the current debounced state.
+func (m *Monitor) Snapshot() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshotLocked()
+}
+
+func (m *Monitor) snapshotLocked() Snapshot {
+	snapshot := Snapshot{
+		Internet: m.internet.Value(),
+		DNS:      m.dns.Value(),
+		Gateway:  m.gateway.Value(),
+
+		InternetMethod: m.last.InternetMethod,
+		GatewayMethod:  m.last.GatewayMethod,
+	}
+	snapshot.Resolvers = append([]ResolverResult(nil), m.last.Resolvers...)
+	if m.last.CaptivePortal != nil {
+		v := *m.last.CaptivePortal
+		snapshot.CaptivePortal = &v
+	}
+	if m.latency != nil {
+		v := *m.latency
+		snapshot.LatencyMS = &v
+	}
+	if m.history != nil {
+		if jitter, ok := m.history.Jitter(); ok {
+			v := jitter.Milliseconds()
+			snapshot.JitterMS = &v
+		}
+	}
+	return snapshot
+}
+
+func sameValue(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
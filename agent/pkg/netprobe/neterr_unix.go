@@ -0,0 +1,14 @@
+//go:build !windows
+
+package netprobe
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsConnectionRefused reports a TCP RST, which proves the host is alive even
+// though the port is closed.
+func IsConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
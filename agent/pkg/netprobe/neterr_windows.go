@@ -0,0 +1,16 @@
+//go:build windows
+
+package netprobe
+
+import (
+	"errors"
+	"syscall"
+)
+
+const wsaeconnrefused syscall.Errno = 10061
+
+// IsConnectionRefused reports a TCP RST, which proves the host is alive even
+// though the port is closed.
+func IsConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, wsaeconnrefused)
+}
@@ -0,0 +1,340 @@
+// Package netprobe implements the LabScan agent's connectivity checks:
+// internet reachability with connect latency, DNS resolution, and default
+// gateway reachability, plus the debouncing and latency history the agent
+// layers on top. It has no dependency on the agent itself, so other lab
+// tooling can embed the same probing logic.
+package netprobe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Targets configures what the TCP prober dials and resolves.
+type Targets struct {
+	// Internet endpoints (host:port) tried in order; the first successful
+	// connect determines reachability and latency.
+	Internet []string
+	// DNSName is resolved with the system resolver.
+	DNSName string
+	// Gateways (host:port) tried in order when GatewayAddr is nil.
+	Gateways []string
+	// GatewayAddr returns the default gateway's IP, usually read from the
+	// routing table, for ProbeGatewayHost. An empty result means there is
+	// no default route, which counts as the gateway being down.
+	GatewayAddr func() string
+	// Method selects how internet and gateway reachability is measured:
+	// MethodICMP, MethodTCP, or empty for ICMP echoes with TCP connects as
+	// the fallback.
+	Method string
+	// Resolvers are benchmarked each round by resolving DNSName through
+	// each of them: ResolverSystem, ResolverGateway (the GatewayAddr host),
+	// or a server IP or host:port, port 53 by default. Empty skips the
+	// benchmark.
+	Resolvers []string
+	// PortalURL is fetched over plain HTTP to detect a captive portal. It
+	// must answer 204 with an empty body; empty skips the check.
+	PortalURL string
+	// InternetTimeout, DNSTimeout, GatewayTimeout and PortalTimeout bound
+	// each check.
+	InternetTimeout time.Duration
+	DNSTimeout      time.Duration
+	GatewayTimeout  time.Duration
+	PortalTimeout   time.Duration
+}
+
+// Special Targets.Resolvers entries.
+const (
+	ResolverSystem  = "system"
+	ResolverGateway = "gateway"
+)
+
+// Probe methods reported in Result and Snapshot.
+const (
+	MethodICMP = "icmp"
+	MethodTCP  = "tcp"
+)
+
+// DefaultTargets returns the endpoints the agent has always used.
+func DefaultTargets() Targets {
+	return Targets{
+		Internet:        []string{"1.1.1.1:443", "8.8.8.8:53"},
+		DNSName:         "example.com",
+		Resolvers:       []string{ResolverSystem, ResolverGateway, "1.1.1.1", "8.8.8.8"},
+		Gateways:        []string{"192.168.1.1:53", "10.0.0.1:53", "172.16.0.1:53"},
+		InternetTimeout: 2 * time.Second,
+		DNSTimeout:      2 * time.Second,
+		GatewayTimeout:  1500 * time.Millisecond,
+		PortalURL:       "http://connectivitycheck.gstatic.com/generate_204",
+		PortalTimeout:   3 * time.Second,
+	}
+}
+
+// Result is the raw, undebounced outcome of one probe round.
+type Result struct {
+	Internet bool
+	DNS      bool
+	Gateway  bool
+	// Latency is the internet round trip (echo or connect time); zero when
+	// unreachable.
+	Latency time.Duration
+	// InternetMethod and GatewayMethod name the method that produced each
+	// reading: the one that succeeded, or the last one tried.
+	InternetMethod string
+	GatewayMethod  string
+	// CaptivePortal is nil when the portal check was skipped or got no
+	// HTTP answer.
+	CaptivePortal *bool
+	Resolvers     []ResolverResult
+	At            time.Time
+}
+
+// ResolverResult is one resolver's answer in a DNS benchmark.
+type ResolverResult struct {
+	Resolver string
+	OK       bool
+	// Latency is the lookup time; zero when the lookup failed.
+	Latency time.Duration
+}
+
+// Prober runs one round of connectivity checks.
+type Prober interface {
+	Probe(ctx context.Context) Result
+}
+
+// TCPProber checks reachability with ICMP echoes and TCP connects as
+// Targets.Method selects. Targets may be changed with SetTargets while
+// probes are running.
+type TCPProber struct {
+	Targets Targets
+
+	mu sync.Mutex
+}
+
+// NewTCPProber returns a prober for the given targets.
+func NewTCPProber(targets Targets) *TCPProber {
+	return &TCPProber{Targets: targets}
+}
+
+// SetTargets replaces the targets used from the next round on.
+func (p *TCPProber) SetTargets(targets Targets) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Targets = targets
+}
+
+// CurrentTargets returns the targets the next round will use.
+func (p *TCPProber) CurrentTargets() Targets {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Targets
+}
+
+// Probe implements Prober.
+func (p *TCPProber) Probe(ctx context.Context) Result {
+	targets := p.CurrentTargets()
+	result := Result{DNS: ProbeDNS(ctx, targets.DNSName, targets.DNSTimeout)}
+	result.Internet, result.Latency, result.InternetMethod = probeInternetWith(ctx, targets)
+	if targets.GatewayAddr != nil {
+		result.Gateway, result.GatewayMethod = ProbeGatewayHost(ctx, targets.GatewayAddr(), targets.GatewayTimeout, targets.Method)
+	} else {
+		result.Gateway, result.GatewayMethod = ProbeGateway(ctx, targets.Gateways, targets.GatewayTimeout), MethodTCP
+	}
+	if len(targets.Resolvers) > 0 {
+		gateway := ""
+		if targets.GatewayAddr != nil {
+			gateway = targets.GatewayAddr()
+		}
+		result.Resolvers = BenchmarkResolvers(ctx, targets.DNSName, targets.Resolvers, gateway, targets.DNSTimeout)
+	}
+	if targets.PortalURL != "" {
+		if portal, err := ProbeCaptivePortal(ctx, targets.PortalURL, targets.PortalTimeout); err == nil {
+			result.CaptivePortal = &portal
+		}
+	}
+	result.At = time.Now()
+	return result
+}
+
+func probeInternetWith(ctx context.Context, targets Targets) (bool, time.Duration, string) {
+	if targets.Method != MethodTCP {
+		ok, latency, _ := ProbeInternetICMP(targets.Internet, targets.InternetTimeout)
+		if ok || targets.Method == MethodICMP {
+			return ok, latency, MethodICMP
+		}
+	}
+	ok, latency := ProbeInternet(ctx, targets.Internet, targets.InternetTimeout)
+	return ok, latency, MethodTCP
+}
+
+// ProbeInternet dials each target in turn and reports the first success.
+func ProbeInternet(ctx context.Context, targets []string, timeout time.Duration) (bool, time.Duration) {
+	for _, target := range targets {
+		start := time.Now()
+		if dialOK(ctx, target, timeout) {
+			return true, time.Since(start)
+		}
+	}
+	return false, 0
+}
+
+// ProbeInternetICMP echoes the host of each host:port target in turn and
+// reports the first reply's round trip. It stops with ErrICMPUnavailable
+// when the process may not send echoes at all.
+func ProbeInternetICMP(targets []string, timeout time.Duration) (bool, time.Duration, error) {
+	tried := make(map[string]bool, len(targets))
+	var lastErr error
+	for _, target := range targets {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			host = target
+		}
+		if tried[host] {
+			continue
+		}
+		tried[host] = true
+		rtt, err := Echo(host, timeout)
+		if err == nil {
+			return true, rtt, nil
+		}
+		if errors.Is(err, ErrICMPUnavailable) {
+			return false, 0, err
+		}
+		lastErr = err
+	}
+	return false, 0, lastErr
+}
+
+// ProbeCaptivePortal fetches url, which normally answers 204 No Content,
+// and reports whether something intercepted it: a redirect or any other
+// answer means a portal or filtering proxy sits in the path. Redirects are
+// not followed and proxies are bypassed, so the answer comes from the
+// network itself. An error means no HTTP answer arrived at all.
+func ProbeCaptivePortal(ctx context.Context, url string, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{
+		Transport:     &http.Transport{Proxy: nil, DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	return response.StatusCode != http.StatusNoContent || len(body) > 0, nil
+}
+
+// ProbeDNS reports whether name resolves with the system resolver.
+func ProbeDNS(ctx context.Context, name string, timeout time.Duration) bool {
+	if name == "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resolver := net.Resolver{}
+	_, err := resolver.LookupHost(ctx, name)
+	return err == nil
+}
+
+// BenchmarkResolvers resolves name through each resolver concurrently and
+// returns the outcomes in the same order. gateway stands in for
+// ResolverGateway; with no gateway that entry fails.
+func BenchmarkResolvers(ctx context.Context, name string, resolvers []string, gateway string, timeout time.Duration) []ResolverResult {
+	results := make([]ResolverResult, len(resolvers))
+	var wg sync.WaitGroup
+	for i, resolver := range resolvers {
+		results[i].Resolver = resolver
+		server := resolver
+		if resolver == ResolverGateway {
+			server = gateway
+		}
+		if server == "" || name == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(result *ResolverResult, server string) {
+			defer wg.Done()
+			lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			if _, err := resolverFor(server).LookupHost(lookupCtx, name); err == nil {
+				result.OK, result.Latency = true, time.Since(start)
+			}
+		}(&results[i], server)
+	}
+	wg.Wait()
+	return results
+}
+
+// resolverFor returns the system resolver, or one that sends every query to
+// server.
+func resolverFor(server string) *net.Resolver {
+	if server == ResolverSystem {
+		return &net.Resolver{}
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// ProbeGateway reports whether any gateway endpoint accepts a connection.
+func ProbeGateway(ctx context.Context, gateways []string, timeout time.Duration) bool {
+	for _, gateway := range gateways {
+		if dialOK(ctx, gateway, timeout) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeGatewayHost reports whether the host at ip answers an ICMP echo or,
+// when ICMP is blocked or not permitted, a TCP connect to port 53, along
+// with the method that decided it. A refused connect counts: the RST proves
+// the gateway is up even with the port closed. method restricts the check
+// as in Targets.Method.
+func ProbeGatewayHost(ctx context.Context, ip string, timeout time.Duration, method string) (bool, string) {
+	if ip == "" {
+		return false, method
+	}
+	if method != MethodTCP {
+		_, err := Echo(ip, timeout)
+		if err == nil || method == MethodICMP {
+			return err == nil, MethodICMP
+		}
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, "53"))
+	if err != nil {
+		return IsConnectionRefused(err), MethodTCP
+	}
+	_ = conn.Close()
+	return true, MethodTCP
+}
+
+func dialOK(ctx context.Context, address string, timeout time.Duration) bool {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
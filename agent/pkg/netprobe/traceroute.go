@@ -0,0 +1,116 @@
+package netprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Hop is one TTL step of a traceroute. IP is empty when nothing answered
+// within the timeout.
+type Hop struct {
+	TTL int
+	IP  string
+	RTT time.Duration
+}
+
+// Traceroute sends ICMP echoes to target with increasing TTL and records
+// which router answered each one, stopping at the target or after maxHops.
+// Reading the routers' time-exceeded replies needs a raw socket, so it
+// returns ErrICMPUnavailable without root or CAP_NET_RAW. Only IPv4 is
+// supported.
+func Traceroute(target string, maxHops int, timeout time.Duration) ([]Hop, error) {
+	dst, err := net.ResolveIPAddr("ip4", target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrICMPUnavailable, err)
+	}
+	defer conn.Close()
+	packets := conn.IPv4PacketConn()
+
+	id := os.Getpid() & 0xffff
+	buf := make([]byte, 1500)
+	var hops []Hop
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := packets.SetTTL(ttl); err != nil {
+			return hops, err
+		}
+		msg := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: ttl, Data: []byte("labscan")}}
+		raw, err := msg.Marshal(nil)
+		if err != nil {
+			return hops, err
+		}
+		start := time.Now()
+		_ = conn.SetReadDeadline(start.Add(timeout))
+		if _, err := conn.WriteTo(raw, dst); err != nil {
+			return hops, err
+		}
+
+		hop := Hop{TTL: ttl}
+		reached := false
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return hops, err
+			}
+			final, ok := matchTraceReply(buf[:n], id, ttl)
+			if !ok {
+				continue
+			}
+			hop.IP, hop.RTT = peer.(*net.IPAddr).IP.String(), time.Since(start)
+			reached = final
+			break
+		}
+		hops = append(hops, hop)
+		if reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// matchTraceReply reports whether reply answers the echo with id and seq,
+// and whether it came from the end of the path (an echo reply or an
+// unreachable) rather than a router on the way.
+func matchTraceReply(reply []byte, id, seq int) (final, ok bool) {
+	msg, err := icmp.ParseMessage(1, reply)
+	if err != nil {
+		return false, false
+	}
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		return true, msg.Type == ipv4.ICMPTypeEchoReply && body.ID == id && body.Seq == seq
+	case *icmp.TimeExceeded:
+		return false, quotesEcho(body.Data, id, seq)
+	case *icmp.DstUnreach:
+		return true, quotesEcho(body.Data, id, seq)
+	}
+	return false, false
+}
+
+// quotesEcho checks the original datagram quoted in an ICMP error: its IP
+// header followed by at least the first 8 bytes of our echo request.
+func quotesEcho(quoted []byte, id, seq int) bool {
+	if len(quoted) < 20 {
+		return false
+	}
+	headerLen := int(quoted[0]&0x0f) * 4
+	if len(quoted) < headerLen+8 || quoted[headerLen] != byte(ipv4.ICMPTypeEcho) {
+		return false
+	}
+	echo := quoted[headerLen:]
+	return int(binary.BigEndian.Uint16(echo[4:6])) == id && int(binary.BigEndian.Uint16(echo[6:8])) == seq
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	policyErrorTargetNotAllowed = "target_not_allowed"
+	policyErrorKindDisabled     = "kind_disabled"
+	policyErrorTargetExcluded   = "target_excluded"
+)
+
+// targetParams are the task parameters that name hosts or ranges the agent
+// will send probes to, as a host, host:port, or CIDR.
+var targetParams = []string{"target", "targets", "cidr", "verify_target", "upstream", "resolver", "broadcast", "stun_servers", "servers"}
+
+// urlParams are the task parameters holding URLs the agent will fetch.
+var urlParams = []string{"download_url", "upload_url", "echo_urls", "geoip_url", "url"}
+
+// agentPolicy restricts what tasks may do. The local lists come from
+// -scan-allow, -allow-kinds, and -deny-kinds and cannot be changed remotely;
+// the admin lists arrive with provisioning or a policy message and can only
+// narrow them further.
+type agentPolicy struct {
+	mu         sync.RWMutex
+	localAllow []netip.Prefix
+	adminAllow []netip.Prefix
+	allowKinds map[string]bool
+	denyKinds  map[string]bool
+	adminDeny  map[string]bool
+}
+
+type PolicyPayload struct {
+	ScanAllow []string `json:"scan_allow"`
+	DenyKinds []string `json:"deny_kinds,omitempty"`
+}
+
+type PolicyAppliedPayload struct {
+	OK     bool          `json:"ok"`
+	Error  string        `json:"error,omitempty"`
+	Policy PolicyPayload `json:"policy"`
+}
+
+type policyError struct {
+	Code   string
+	Reason string
+}
+
+func (e *policyError) Error() string {
+	return "policy: " + e.Reason
+}
+
+var (
+	localScanAllow  string
+	localAllowKinds string
+	localDenyKinds  string
+)
+
+func newAgentPolicy(scanAllow, denyKinds []string) (*agentPolicy, error) {
+	local, err := parsePrefixes(strings.Split(localScanAllow, ","))
+	if err != nil {
+		return nil, fmt.Errorf("-scan-allow: %w", err)
+	}
+	if _, err := loadExclusions(context.Background(), nil); err != nil {
+		return nil, fmt.Errorf("-scan-exclude: %w", err)
+	}
+	policy := &agentPolicy{
+		localAllow: local,
+		allowKinds: kindSet(strings.Split(localAllowKinds, ",")),
+		denyKinds:  kindSet(strings.Split(localDenyKinds, ",")),
+	}
+	if err := policy.setScanAllow(scanAllow); err != nil {
+		return nil, err
+	}
+	policy.setDenyKinds(denyKinds)
+	return policy, nil
+}
+
+func (p *agentPolicy) setDenyKinds(kinds []string) {
+	p.mu.Lock()
+	p.adminDeny = kindSet(kinds)
+	p.mu.Unlock()
+}
+
+// handlePolicy applies a policy message and reports the outcome to the
+// admin with policy_applied.
+func (c *AgentClient) handlePolicy(payload PolicyPayload) {
+	applied := PolicyAppliedPayload{OK: true, Policy: payload}
+	if err := c.policy.setScanAllow(payload.ScanAllow); err != nil {
+		c.logger().Warn("rejecting policy", "err", err)
+		cfg := c.configSnapshot()
+		applied = PolicyAppliedPayload{Error: err.Error(), Policy: PolicyPayload{ScanAllow: cfg.ScanAllow, DenyKinds: cfg.DenyKinds}}
+		_ = c.send("policy_applied", applied)
+		return
+	}
+	c.policy.setDenyKinds(payload.DenyKinds)
+	c.logger().Info("policy updated", "scan_allow", payload.ScanAllow, "deny_kinds", payload.DenyKinds)
+	if !c.profile.IsFake {
+		err := c.updateConfig(func(cfg *PersistedConfig) {
+			cfg.ScanAllow = payload.ScanAllow
+			cfg.DenyKinds = payload.DenyKinds
+		})
+		if err != nil {
+			c.logger().Warn("failed to persist policy", "err", err)
+		}
+	}
+	_ = c.send("policy_applied", applied)
+}
+
+// checkKind fails with a policyError when kind is outside -allow-kinds or
+// listed in -deny-kinds or the admin's deny_kinds.
+func (p *agentPolicy) checkKind(kind string) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if (len(p.allowKinds) > 0 && !p.allowKinds[kind]) || p.denyKinds[kind] || p.adminDeny[kind] {
+		return &policyError{Code: policyErrorKindDisabled, Reason: fmt.Sprintf("task kind %s disabled by policy", kind)}
+	}
+	return nil
+}
+
+func kindSet(kinds []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, kind := range kinds {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			set[kind] = true
+		}
+	}
+	return set
+}
+
+func (p *agentPolicy) setScanAllow(cidrs []string) error {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return fmt.Errorf("scan_allow: %w", err)
+	}
+	p.mu.Lock()
+	p.adminAllow = prefixes
+	p.mu.Unlock()
+	return nil
+}
+
+// checkTargets resolves every host, range, and URL the task will contact,
+// including the defaults it falls back to, and fails with a policyError if
+// any address falls outside the allowlists. The returned params name the
+// checked addresses in place of hostnames, and the returned pins hold them
+// for URL hosts, so a DNS answer that changes after the check cannot point
+// the task somewhere else. Without an allowlist params are returned as is.
+func (p *agentPolicy) checkTargets(ctx context.Context, kind string, params map[string]interface{}) (map[string]interface{}, pinnedAddrs, error) {
+	if p == nil {
+		return params, nil, nil
+	}
+	p.mu.RLock()
+	allow := allowlists{local: p.localAllow, admin: p.adminAllow}
+	p.mu.RUnlock()
+	if len(allow.local) == 0 && len(allow.admin) == 0 {
+		return params, nil, nil
+	}
+
+	effective := withTargetDefaults(kind, params)
+	for _, key := range targetParams {
+		switch value := effective[key].(type) {
+		case string:
+			// A comma-separated target list is checked host by host.
+			parts := strings.Split(value, ",")
+			for i, part := range parts {
+				checked, err := allow.checkHost(ctx, part)
+				if err != nil {
+					return nil, nil, err
+				}
+				parts[i] = checked
+			}
+			effective[key] = strings.Join(parts, ",")
+		case []interface{}:
+			checked := make([]interface{}, len(value))
+			for i, item := range value {
+				checked[i] = item
+				if host, ok := item.(string); ok {
+					var err error
+					if checked[i], err = allow.checkHost(ctx, host); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+			effective[key] = checked
+		}
+	}
+
+	pins := pinnedAddrs{}
+	for _, key := range urlParams {
+		urls := asStringSlice(effective[key], nil)
+		if value := asString(effective[key], ""); value != "" {
+			urls = append(urls, value)
+		}
+		for _, value := range urls {
+			if err := allow.checkURL(ctx, value, pins); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return effective, pins, nil
+}
+
+// withTargetDefaults copies params, filling in the targets kind falls back
+// to when they are left out and dropping URLs the task will not fetch.
+func withTargetDefaults(kind string, params map[string]interface{}) map[string]interface{} {
+	effective := make(map[string]interface{}, len(params)+2)
+	for key, value := range params {
+		effective[key] = value
+	}
+	setDefault := func(key string, value interface{}) {
+		if asString(effective[key], "") == "" && asStringSlice(effective[key], nil) == nil {
+			effective[key] = value
+		}
+	}
+	switch kind {
+	case "ping":
+		setDefault("target", "8.8.8.8")
+	case "port_scan":
+		setDefault("target", "127.0.0.1")
+	case "topology_map":
+		setDefault("upstream", "1.1.1.1")
+	case "ntp_check":
+		setDefault("servers", anySlice(defaultNTPServers))
+	case "tls_info":
+		// The target is replaced by its checked address; keep its name
+		// for SNI.
+		host := unbracket(asString(effective["target"], ""))
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if _, err := netip.ParseAddr(host); err != nil && host != "" {
+			setDefault("server_name", host)
+		}
+	case "speed_test":
+		if useAdmin, _ := effective["use_admin"].(bool); useAdmin {
+			delete(effective, "download_url")
+			delete(effective, "upload_url")
+			break
+		}
+		setDefault("download_url", speedTestDownloadURL)
+		setDefault("upload_url", speedTestUploadURL)
+	case "public_ip":
+		method := asString(effective["method"], "auto")
+		if method == "auto" || method == "stun" {
+			setDefault("stun_servers", anySlice(defaultSTUNServers))
+		} else {
+			delete(effective, "stun_servers")
+		}
+		if method == "auto" || method == "https" {
+			setDefault("echo_urls", anySlice(defaultEchoURLs))
+		} else {
+			delete(effective, "echo_urls")
+		}
+		if geo, _ := effective["geoip"].(bool); geo {
+			setDefault("geoip_url", defaultGeoIPURL)
+		} else {
+			delete(effective, "geoip_url")
+		}
+	}
+	return effective
+}
+
+func anySlice(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, value := range values {
+		out[i] = value
+	}
+	return out
+}
+
+type allowlists struct {
+	local []netip.Prefix
+	admin []netip.Prefix
+}
+
+func (a allowlists) permits(prefix netip.Prefix) bool {
+	return prefixAllowed(a.local, prefix) && prefixAllowed(a.admin, prefix)
+}
+
+// checkHost checks a host, host:port, or CIDR and returns it with a
+// hostname replaced by the first address it resolved to.
+func (a allowlists) checkHost(ctx context.Context, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		if !a.permits(prefix.Masked()) {
+			return "", &policyError{Code: policyErrorTargetNotAllowed, Reason: fmt.Sprintf("target %s is outside the scan allowlist", value)}
+		}
+		return value, nil
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		host, port = unbracket(value), ""
+	}
+	addrs, err := a.resolve(ctx, value, host)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return value, nil
+	}
+	if port == "" {
+		return addrs[0].String(), nil
+	}
+	return net.JoinHostPort(addrs[0].String(), port), nil
+}
+
+// checkURL checks the host of rawURL and records the addresses it
+// resolved to in pins.
+func (a allowlists) checkURL(ctx context.Context, rawURL string, pins pinnedAddrs) error {
+	parsed, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || parsed.Hostname() == "" {
+		return &policyError{Code: policyErrorTargetNotAllowed, Reason: fmt.Sprintf("cannot parse url %s", rawURL)}
+	}
+	host := strings.ToLower(parsed.Hostname())
+	addrs, err := a.resolve(ctx, rawURL, host)
+	if err != nil {
+		return err
+	}
+	pins[host] = addrs
+	return nil
+}
+
+// resolve looks host up and fails unless every address is allowed; value
+// is what the error names.
+func (a allowlists) resolve(ctx context.Context, value, host string) ([]netip.Addr, error) {
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, &policyError{Code: policyErrorTargetNotAllowed, Reason: fmt.Sprintf("cannot resolve target %s: %v", value, err)}
+	}
+	for _, addr := range addrs {
+		if !a.permits(netip.PrefixFrom(addr, addr.BitLen())) {
+			return nil, &policyError{Code: policyErrorTargetNotAllowed, Reason: fmt.Sprintf("target %s is outside the scan allowlist", value)}
+		}
+	}
+	return addrs, nil
+}
+
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(lookupCtx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, nil
+}
+
+// checkEndpoints checks host:port endpoints the agent will probe on its
+// own, such as probe_internet, and returns them with hostnames replaced by
+// the checked addresses.
+func (p *agentPolicy) checkEndpoints(ctx context.Context, endpoints []string) ([]string, error) {
+	if p == nil {
+		return endpoints, nil
+	}
+	p.mu.RLock()
+	allow := allowlists{local: p.localAllow, admin: p.adminAllow}
+	p.mu.RUnlock()
+	if len(allow.local) == 0 && len(allow.admin) == 0 {
+		return endpoints, nil
+	}
+	checked := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if strings.TrimSpace(endpoint) == "" {
+			continue
+		}
+		value, err := allow.checkHost(ctx, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		checked = append(checked, value)
+	}
+	return checked, nil
+}
+
+// pinnedAddrs maps the URL hosts a task was checked against to the
+// addresses the check resolved. A nil map pins nothing.
+type pinnedAddrs map[string][]netip.Addr
+
+// hostPort rewrites a host:port whose host is pinned to the first pinned
+// address.
+func (p pinnedAddrs) hostPort(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if addrs := p[strings.ToLower(host)]; len(addrs) > 0 {
+		return net.JoinHostPort(addrs[0].String(), port)
+	}
+	return addr
+}
+
+func (p pinnedAddrs) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	host, port, err := net.SplitHostPort(addr)
+	addrs := p[strings.ToLower(host)]
+	if err != nil || len(addrs) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	var lastErr error
+	for _, pinned := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(pinned.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// httpClient returns a client that connects to pinned hosts only at their
+// pinned addresses and, when anything is pinned, refuses redirects to hosts
+// that were not checked.
+func (p pinnedAddrs) httpClient(timeout time.Duration) *http.Client {
+	if p == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = p.dialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if _, ok := p[strings.ToLower(req.URL.Hostname())]; !ok {
+				return &policyError{Code: policyErrorTargetNotAllowed, Reason: fmt.Sprintf("redirect to %s is outside the scan allowlist", req.URL.Host)}
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// prefixAllowed reports whether target lies entirely inside one of allow;
+// an empty list allows everything.
+func prefixAllowed(allow []netip.Prefix, target netip.Prefix) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	for _, prefix := range allow {
+		if prefix.Addr().Is4() == target.Addr().Is4() && prefix.Bits() <= target.Bits() && prefix.Contains(target.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func testPolicy(t *testing.T, allow ...string) *agentPolicy {
+	t.Helper()
+	prefixes, err := parsePrefixes(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &agentPolicy{adminAllow: prefixes}
+}
+
+func TestCheckTargets(t *testing.T) {
+	policy := testPolicy(t, "10.0.0.0/8", "127.0.0.0/8", "::1/128")
+	tests := []struct {
+		name   string
+		kind   string
+		params map[string]interface{}
+		ok     bool
+	}{
+		{name: "ping target allowed", kind: "ping", params: map[string]interface{}{"target": "10.1.2.3"}, ok: true},
+		{name: "ping default target", kind: "ping", params: map[string]interface{}{}},
+		{name: "ping empty target", kind: "ping", params: map[string]interface{}{"target": ""}},
+		{name: "port_scan default target", kind: "port_scan", params: map[string]interface{}{}, ok: true},
+		{name: "topology_map default upstream", kind: "topology_map", params: map[string]interface{}{}},
+		{name: "comma list allowed", kind: "port_scan", params: map[string]interface{}{"target": "10.0.0.1, 127.0.0.1"}, ok: true},
+		{name: "comma list one outside", kind: "ping", params: map[string]interface{}{"target": "10.0.0.1,192.168.1.1"}},
+		{name: "target cidr outside", kind: "port_scan", params: map[string]interface{}{"target": "10.0.0.0/7"}},
+		{name: "one of targets outside", kind: "banner_grab", params: map[string]interface{}{"targets": []interface{}{"10.0.0.1", "192.168.1.1"}}},
+		{name: "cidr wider than allowlist", kind: "host_discovery", params: map[string]interface{}{"cidr": "10.0.0.0/7"}},
+		{name: "cidr inside allowlist", kind: "host_discovery", params: map[string]interface{}{"cidr": "10.9.0.0/16"}, ok: true},
+		{name: "rdns resolver outside", kind: "rdns_sweep", params: map[string]interface{}{"cidr": "10.0.0.0/24", "resolver": "8.8.8.8"}},
+		{name: "wol broadcast outside", kind: "wol", params: map[string]interface{}{"mac": "02:00:00:00:00:01", "broadcast": "192.168.1.255"}},
+		{name: "wol verify_target outside", kind: "wol", params: map[string]interface{}{"mac": "02:00:00:00:00:01", "verify_target": "192.168.1.5"}},
+		{name: "wol local broadcast", kind: "wol", params: map[string]interface{}{"mac": "02:00:00:00:00:01"}, ok: true},
+		{name: "speed_test default urls", kind: "speed_test", params: map[string]interface{}{}},
+		{name: "speed_test upload_url outside", kind: "speed_test", params: map[string]interface{}{"download_url": "http://10.0.0.1/down", "upload_url": "https://203.0.113.9/up"}},
+		{name: "speed_test urls allowed", kind: "speed_test", params: map[string]interface{}{"download_url": "http://10.0.0.1/down", "upload_url": "http://10.0.0.1:8080/up"}, ok: true},
+		{name: "speed_test use_admin", kind: "speed_test", params: map[string]interface{}{"use_admin": true, "download_url": "https://203.0.113.9/"}, ok: true},
+		{name: "public_ip default servers", kind: "public_ip", params: map[string]interface{}{}},
+		{name: "public_ip stun allowed", kind: "public_ip", params: map[string]interface{}{"method": "stun", "stun_servers": []interface{}{"10.0.0.1:3478"}}, ok: true},
+		{name: "public_ip stun outside", kind: "public_ip", params: map[string]interface{}{"method": "stun", "stun_servers": []interface{}{"203.0.113.9:3478"}}},
+		{name: "public_ip echo_urls outside", kind: "public_ip", params: map[string]interface{}{"method": "https", "echo_urls": []interface{}{"https://203.0.113.9/"}}},
+		{name: "public_ip geoip default", kind: "public_ip", params: map[string]interface{}{"method": "https", "echo_urls": []interface{}{"http://10.0.0.1/"}, "geoip": true}},
+		{name: "public_ip geoip_url unused", kind: "public_ip", params: map[string]interface{}{"method": "https", "echo_urls": []interface{}{"http://10.0.0.1/"}, "geoip_url": "https://203.0.113.9/{ip}"}, ok: true},
+		{name: "pcap upload_url outside", kind: "pcap_capture", params: map[string]interface{}{"upload_url": "https://203.0.113.9/upload"}},
+		{name: "unparsable url", kind: "pcap_capture", params: map[string]interface{}{"upload_url": "not a url"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := policy.checkTargets(context.Background(), tt.kind, tt.params)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("checkTargets() = %v, want nil", err)
+				}
+				return
+			}
+			var policyErr *policyError
+			if !errors.As(err, &policyErr) || policyErr.Code != policyErrorTargetNotAllowed {
+				t.Fatalf("checkTargets() = %v, want %s", err, policyErrorTargetNotAllowed)
+			}
+		})
+	}
+}
+
+func TestCheckTargetsPinsResolvedAddresses(t *testing.T) {
+	policy := testPolicy(t, "127.0.0.0/8", "::1/128")
+	params := map[string]interface{}{
+		"target":  "localhost:22",
+		"targets": []interface{}{"localhost", "127.0.0.2"},
+		"ports":   []interface{}{22.0},
+	}
+	effective, _, err := policy.checkTargets(context.Background(), "banner_grab", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrPort, err := netip.ParseAddrPort(effective["target"].(string)); err != nil || !addrPort.Addr().IsLoopback() || addrPort.Port() != 22 {
+		t.Fatalf("target = %v, want a loopback address with port 22", effective["target"])
+	}
+	targets := effective["targets"].([]interface{})
+	if addr, err := netip.ParseAddr(targets[0].(string)); err != nil || !addr.IsLoopback() {
+		t.Fatalf("targets[0] = %v, want a loopback address", targets[0])
+	}
+	if targets[1] != "127.0.0.2" {
+		t.Fatalf("targets[1] = %v, want 127.0.0.2", targets[1])
+	}
+	if params["target"] != "localhost:22" {
+		t.Fatal("checkTargets modified the caller's params")
+	}
+
+	_, pins, err := policy.checkTargets(context.Background(), "speed_test", map[string]interface{}{
+		"download_url": "http://localhost:8080/down",
+		"upload_url":   "http://127.0.0.1/up",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins["localhost"]) == 0 || len(pins["127.0.0.1"]) != 1 {
+		t.Fatalf("pins = %v, want localhost and 127.0.0.1", pins)
+	}
+}
+
+func TestCheckTargetsWithoutAllowlist(t *testing.T) {
+	params := map[string]interface{}{"target": "example.invalid"}
+	for _, policy := range []*agentPolicy{nil, {}} {
+		effective, pins, err := policy.checkTargets(context.Background(), "ping", params)
+		if err != nil || pins != nil || effective["target"] != "example.invalid" {
+			t.Fatalf("checkTargets() = %v, %v, %v", effective, pins, err)
+		}
+	}
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	policy := testPolicy(t, "10.0.0.0/8")
+	if _, err := policy.checkEndpoints(context.Background(), []string{"10.0.0.1:443", "1.1.1.1:443"}); err == nil {
+		t.Fatal("probe endpoint outside the allowlist was accepted")
+	}
+	checked, err := policy.checkEndpoints(context.Background(), []string{"10.0.0.1:443", " "})
+	if err != nil || len(checked) != 1 || checked[0] != "10.0.0.1:443" {
+		t.Fatalf("checkEndpoints() = %v, %v", checked, err)
+	}
+}
+
+func TestPinnedHTTPClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://unpinned.invalid/", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	// pinned.invalid does not resolve; the pin is the only way to reach it.
+	pins := pinnedAddrs{"pinned.invalid": {netip.MustParseAddr(serverURL.Hostname())}}
+	client := pins.httpClient(0)
+	resp, err := client.Get("http://pinned.invalid:" + serverURL.Port() + "/ok")
+	if err != nil {
+		t.Fatalf("pinned request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	_, err = client.Get("http://pinned.invalid:" + serverURL.Port() + "/away")
+	var policyErr *policyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("redirect to an unchecked host = %v, want a policy error", err)
+	}
+}
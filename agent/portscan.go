@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+// Without an explicit timeout_ms, port_scan derives its connect timeout
+// from the target's round trip: scanTimeoutFactor times the smoothed RTT,
+// kept between scanMinTimeout and scanMaxTimeout. scanDefaultTimeout applies
+// until the target has answered at all.
+const (
+	scanTimeoutFactor   = 3
+	scanMinTimeout      = 50 * time.Millisecond
+	scanMaxTimeout      = 3 * time.Second
+	scanDefaultTimeout  = 700 * time.Millisecond
+	scanRTTProbeTimeout = time.Second
+	scanRTTProbePorts   = 3
+)
+
+// rttEstimator smooths round-trip samples like TCP's SRTT (RFC 6298, alpha
+// 1/8) and turns them into a connect timeout.
+type rttEstimator struct {
+	mu      sync.Mutex
+	srtt    time.Duration
+	samples int
+}
+
+func (e *rttEstimator) observe(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = rtt
+	} else {
+		e.srtt += (rtt - e.srtt) / 8
+	}
+	e.samples++
+}
+
+func (e *rttEstimator) rtt() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt, e.samples > 0
+}
+
+func (e *rttEstimator) timeout() time.Duration {
+	rtt, ok := e.rtt()
+	if !ok {
+		return scanDefaultTimeout
+	}
+	return min(max(scanTimeoutFactor*rtt, scanMinTimeout), scanMaxTimeout)
+}
+
+// refusedIsRTT reports whether a refused connect measures the round trip.
+// Windows retries a SYN that was answered with a reset before giving up, so
+// there a refusal takes about a second whatever the distance.
+var refusedIsRTT = runtime.GOOS != "windows"
+
+// connectAnswered reports whether a connect attempt got an answer from the
+// target, open or refused, that timed the round trip.
+func connectAnswered(err error) bool {
+	return err == nil || refusedIsRTT && netprobe.IsConnectionRefused(err)
+}
+
+// measureRTT races an ICMP echo against TCP connects to the first few ports,
+// when withConnect is set, and returns the first answer's round trip.
+func measureRTT(ctx context.Context, target string, ports []int, withConnect bool) (time.Duration, string, bool) {
+	type sample struct {
+		rtt    time.Duration
+		method string
+	}
+	ctx, cancel := context.WithTimeout(ctx, scanRTTProbeTimeout)
+	defer cancel()
+	samples := make(chan sample, 1+scanRTTProbePorts)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if rtt, err := netprobe.Echo(target, scanRTTProbeTimeout); err == nil {
+			samples <- sample{rtt, "icmp"}
+		}
+	}()
+	var dialer net.Dialer
+	probePorts := ports[:min(len(ports), scanRTTProbePorts)]
+	if !withConnect {
+		probePorts = nil
+	}
+	for _, port := range probePorts {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target, strconv.Itoa(port)))
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if connectAnswered(err) {
+				samples <- sample{time.Since(start), "tcp"}
+			}
+		}(port)
+	}
+	go func() {
+		wg.Wait()
+		close(samples)
+	}()
+	first, ok := <-samples
+	return first.rtt, first.method, ok
+}
+
+// parsePorts reads a ports param: a JSON list of ports, or a string such as
+// "1-1024,3389,8000-8100" of ports and inclusive ranges. List entries may
+// be spec strings too. Repeats are dropped, keeping the first position.
+// Without the param it returns fallback.
+func parsePorts(v interface{}, fallback []int) ([]int, error) {
+	var specs []string
+	switch value := v.(type) {
+	case nil:
+		return fallback, nil
+	case string:
+		if strings.TrimSpace(value) == "" {
+			return fallback, nil
+		}
+		specs = []string{value}
+	case []interface{}:
+		if len(value) == 0 {
+			return fallback, nil
+		}
+		for _, raw := range value {
+			switch entry := raw.(type) {
+			case string:
+				specs = append(specs, entry)
+			case float64:
+				if entry != float64(int(entry)) {
+					return nil, fmt.Errorf("invalid port %v", entry)
+				}
+				specs = append(specs, strconv.Itoa(int(entry)))
+			case int:
+				specs = append(specs, strconv.Itoa(entry))
+			default:
+				return nil, fmt.Errorf("invalid port %v", raw)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ports must be a list or a string like \"1-1024,3389\", not %T", v)
+	}
+
+	seen := make(map[int]bool)
+	ports := make([]int, 0)
+	for _, spec := range specs {
+		for _, part := range strings.Split(spec, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			lowText, highText, isRange := strings.Cut(part, "-")
+			low, err := parsePort(lowText)
+			if err != nil {
+				return nil, err
+			}
+			high := low
+			if isRange {
+				if high, err = parsePort(highText); err != nil {
+					return nil, err
+				}
+				if high < low {
+					return nil, fmt.Errorf("invalid port range %q: start is above end", part)
+				}
+			}
+			for port := low; port <= high; port++ {
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports in %v", v)
+	}
+	return ports, nil
+}
+
+func parsePort(text string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q: want 1-65535", strings.TrimSpace(text))
+	}
+	return port, nil
+}
+
+// portPresets names common port sets for port_scan's preset param, written
+// in the ports string syntax. top100 and top1000 are nmap's most frequently
+// open TCP ports, in port order.
+var portPresets = map[string]string{
+	"top100": "7,9,13,21-23,25-26,37,53,79-81,88,106,110-111,113,119,135,139," +
+		"143-144,179,199,389,427,443-445,465,513-515,543-544,548,554,587," +
+		"631,646,873,990,993,995,1025-1029,1110,1433,1720,1723,1755,1900," +
+		"2000-2001,2049,2121,2717,3000,3128,3306,3389,3986,4899,5000,5009," +
+		"5051,5060,5101,5190,5357,5432,5631,5666,5800,5900,6000-6001,6646," +
+		"7070,8000,8008-8009,8080-8081,8443,8888,9100,9999-10000,32768," +
+		"49152-49157",
+	"top1000": "1,3-4,6-7,9,13,17,19-26,30,32-33,37,42-43,49,53,70,79-85,88-90," +
+		"99-100,106,109-111,113,119,125,135,139,143-144,146,161,163,179," +
+		"199,211-212,222,254-256,259,264,280,301,306,311,340,366,389," +
+		"406-407,416-417,425,427,443-445,458,464-465,481,497,500,512-515," +
+		"524,541,543-545,548,554-555,563,587,593,616-617,625,631,636,646," +
+		"648,666-668,683,687,691,700,705,711,714,720,722,726,749,765,777," +
+		"783,787,800-801,808,843,873,880,888,898,900-903,911-912,981,987," +
+		"990,992-993,995,999-1002,1007,1009-1011,1021-1100,1102,1104-1108," +
+		"1110-1114,1117,1119,1121-1124,1126,1130-1132,1137-1138,1141,1145," +
+		"1147-1149,1151-1152,1154,1163-1166,1169,1174-1175,1183,1185-1187," +
+		"1192,1198-1199,1201,1213,1216-1218,1233-1234,1236,1244,1247-1248," +
+		"1259,1271-1272,1277,1287,1296,1300-1301,1309-1311,1322,1328,1334," +
+		"1352,1417,1433-1434,1443,1455,1461,1494,1500-1501,1503,1521,1524," +
+		"1533,1556,1580,1583,1594,1600,1641,1658,1666,1687-1688,1700," +
+		"1717-1721,1723,1755,1761,1782-1783,1801,1805,1812,1839-1840," +
+		"1862-1864,1875,1900,1914,1935,1947,1971-1972,1974,1984,1998-2010," +
+		"2013,2020-2022,2030,2033-2035,2038,2040-2043,2045-2049,2065,2068," +
+		"2099-2100,2103,2105-2107,2111,2119,2121,2126,2135,2144,2160-2161," +
+		"2170,2179,2190-2191,2196,2200,2222,2251,2260,2288,2301,2323,2366," +
+		"2381-2383,2393-2394,2399,2401,2492,2500,2522,2525,2557,2601-2602," +
+		"2604-2605,2607-2608,2638,2701-2702,2710,2717-2718,2725,2800,2809," +
+		"2811,2869,2875,2909-2910,2920,2967-2968,2998,3000-3001,3003," +
+		"3005-3007,3011,3013,3017,3030-3031,3052,3071,3077,3128,3168,3211," +
+		"3221,3260-3261,3268-3269,3283,3300-3301,3306,3322-3325,3333,3351," +
+		"3367,3369-3372,3389-3390,3404,3476,3493,3517,3527,3546,3551,3580," +
+		"3659,3689-3690,3703,3737,3766,3784,3800-3801,3809,3814,3826-3828," +
+		"3851,3869,3871,3878,3880,3889,3905,3914,3918,3920,3945,3971,3986," +
+		"3995,3998,4000-4006,4045,4111,4125-4126,4129,4224,4242,4279,4321," +
+		"4343,4443-4446,4449,4550,4567,4662,4848,4899-4900,4998,5000-5004," +
+		"5009,5030,5033,5050-5051,5054,5060-5061,5080,5087,5100-5102,5120," +
+		"5190,5200,5214,5221-5222,5225-5226,5269,5280,5298,5357,5405,5414," +
+		"5431-5432,5440,5500,5510,5544,5550,5555,5560,5566,5631,5633,5666," +
+		"5678-5679,5718,5730,5800-5802,5810-5811,5815,5822,5825,5850,5859," +
+		"5862,5877,5900-5904,5906-5907,5910-5911,5915,5922,5925,5950,5952," +
+		"5959-5963,5987-5989,5998-6007,6009,6025,6059,6100-6101,6106,6112," +
+		"6123,6129,6156,6346,6389,6502,6510,6543,6547,6565-6567,6580,6646," +
+		"6666-6669,6689,6692,6699,6779,6788-6789,6792,6839,6881,6901,6969," +
+		"7000-7002,7004,7007,7019,7025,7070,7100,7103,7106,7200-7201,7402," +
+		"7435,7443,7496,7512,7625,7627,7676,7741,7777-7778,7800,7911," +
+		"7920-7921,7937-7938,7999-8002,8007-8011,8021-8022,8031,8042,8045," +
+		"8080-8090,8093,8099-8100,8180-8181,8192-8194,8200,8222,8254," +
+		"8290-8292,8300,8333,8383,8400,8402,8443,8500,8600,8649,8651-8652," +
+		"8654,8701,8800,8873,8888,8899,8994,9000-9003,9009-9011,9040,9050," +
+		"9071,9080-9081,9090-9091,9099-9103,9110-9111,9200,9207,9220,9290," +
+		"9415,9418,9485,9500,9502-9503,9535,9575,9593-9595,9618,9666," +
+		"9876-9878,9898,9900,9917,9929,9943-9944,9968,9998-10004," +
+		"10009-10010,10012,10024-10025,10082,10180,10215,10243,10566," +
+		"10616-10617,10621,10626,10628-10629,10778,11110-11111,11967," +
+		"12000,12174,12265,12345,13456,13722,13782-13783,14000,14238," +
+		"14441-14442,15000,15002-15004,15660,15742,16000-16001,16012," +
+		"16016,16018,16080,16113,16992-16993,17877,17988,18040,18101," +
+		"18988,19101,19283,19315,19350,19780,19801,19842,20000,20005," +
+		"20031,20221-20222,20828,21571,22939,23502,24444,24800," +
+		"25734-25735,26214,27000,27352-27353,27355-27356,27715,28201," +
+		"30000,30718,30951,31038,31337,32768-32785,33354,33899," +
+		"34571-34573,35500,38292,40193,40911,41511,42510,44176," +
+		"44442-44443,44501,45100,48080,49152-49161,49163,49165,49167," +
+		"49175-49176,49400,49999-50003,50006,50300,50389,50500,50636," +
+		"50800,51103,51493,52673,52822,52848,52869,54045,54328," +
+		"55055-55056,55555,55600,56737-56738,57294,57797,58080,60020," +
+		"60443,61532,61900,62078,63331,64623,64680,65000,65129,65389",
+	"windows": "53,88,135,139,389,445,464,593,636,3268-3269,3389,5985-5986,9389,47001",
+	"web":     "80-81,443,591,2082-2083,2087,2096,3000,4443,5000,8000,8008,8080-8081,8088,8443,8888,9000,9090,9443",
+	"iot":     "23,80-81,102,443,502,554,1883,2323,5000,5555,7547,8080-8081,8443,8554,8883,9000,10554,20000,34567,37777,44818,49152",
+}
+
+// scanPorts picks the ports for a port_scan: an explicit ports param wins,
+// then a named preset, then fallback. It also returns the preset it used.
+func scanPorts(params map[string]interface{}, fallback []int) ([]int, string, error) {
+	ports, err := parsePorts(params["ports"], nil)
+	if err != nil || ports != nil {
+		return ports, "", err
+	}
+	name := asString(params["preset"], "")
+	if name == "" {
+		return fallback, "", nil
+	}
+	spec, ok := portPresets[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown port preset %q; use top100, top1000, windows, web, or iot", name)
+	}
+	ports, err = parsePorts(spec, nil)
+	return ports, name, err
+}
+
+func runRealPortScan(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	target := unbracket(asString(params["target"], "127.0.0.1"))
+	ports, preset, err := scanPorts(params, []int{22, 80, 443})
+	if err != nil {
+		return nil, err
+	}
+	ports, excludedPorts := env.Exclude.filterPorts(ports)
+	fixedMS := asInt(params["timeout_ms"], 0)
+	mode := asString(params["mode"], "connect")
+	if mode != "connect" && mode != "syn" {
+		return nil, fmt.Errorf("unknown port_scan mode %q; use connect or syn", mode)
+	}
+	var fixed time.Duration
+	if fixedMS > 0 {
+		fixed = time.Duration(fixedMS) * time.Millisecond
+	}
+
+	var estimator rttEstimator
+	result := map[string]interface{}{"target": target, "adaptive": fixed == 0, "scanned": len(ports)}
+	if preset != "" {
+		result["preset"] = preset
+	}
+	if excludedPorts > 0 {
+		result["excluded_ports"] = excludedPorts
+	}
+	// A SYN scan measures the RTT with ICMP only: connects to the first
+	// ports are the noise it is meant to avoid.
+	if fixed == 0 {
+		if rtt, method, ok := measureRTT(env.context(), target, ports, mode == "connect"); ok {
+			estimator.observe(rtt)
+			result["rtt_method"] = method
+		}
+	}
+	if mode == "syn" {
+		syn, err := scanSYN(env, target, ports, fixed, &estimator)
+		switch {
+		case err == nil:
+			result["mode"] = "syn"
+			result["open_ports"] = syn.Open
+			result["closed"] = syn.Closed
+			result["filtered"] = syn.Filtered
+			addScanTiming(result, fixed, &estimator)
+			addServices(env, result, target, syn.Open, params)
+			return result, nil
+		case errors.Is(err, errSYNUnavailable):
+			result["fallback_reason"] = err.Error()
+		default:
+			return nil, err
+		}
+	}
+
+	result["mode"] = "connect"
+	openPorts := scanConnect(env, target, ports, fixed, &estimator)
+	result["open_ports"] = openPorts
+	addScanTiming(result, fixed, &estimator)
+	addServices(env, result, target, openPorts, params)
+	return result, nil
+}
+
+// addServices adds a service guess for each open port when the task asked
+// for detect_services.
+func addServices(env taskEnv, result map[string]interface{}, target string, openPorts []int, params map[string]interface{}) {
+	if detect, _ := params["detect_services"].(bool); !detect {
+		return
+	}
+	timeout := time.Duration(asInt(params["service_timeout_ms"], int(serviceDefaultTimeout.Milliseconds()))) * time.Millisecond
+	result["services"] = detectServices(env, target, openPorts, timeout)
+}
+
+// scanConnect completes a TCP handshake with each port; a port is open if
+// the connect succeeds. Answers, open or refused, feed the estimator.
+func scanConnect(env taskEnv, target string, ports []int, fixed time.Duration, estimator *rttEstimator) []int {
+	openPorts := make([]int, 0)
+	env.Progress.setTotal(len(ports))
+	for _, port := range ports {
+		if env.cancelled() {
+			break
+		}
+		timeout := fixed
+		if timeout <= 0 {
+			timeout = estimator.timeout()
+		}
+		dialer := net.Dialer{Timeout: timeout}
+		addr := net.JoinHostPort(target, strconv.Itoa(port))
+		start := time.Now()
+		conn, err := dialer.DialContext(env.context(), "tcp", addr)
+		if connectAnswered(err) {
+			estimator.observe(time.Since(start))
+		}
+		env.Progress.step(addr)
+		if err == nil {
+			openPorts = append(openPorts, port)
+			_ = conn.Close()
+		}
+	}
+	return openPorts
+}
+
+func addScanTiming(result map[string]interface{}, fixed time.Duration, estimator *rttEstimator) {
+	if fixed > 0 {
+		result["timeout_ms"] = fixed.Milliseconds()
+		return
+	}
+	result["timeout_ms"] = estimator.timeout().Milliseconds()
+	if rtt, ok := estimator.rtt(); ok {
+		result["rtt_ms"] = float64(rtt.Microseconds()) / 1000
+	}
+}
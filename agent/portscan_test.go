@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRTTEstimatorTimeout(t *testing.T) {
+	var estimator rttEstimator
+	if got := estimator.timeout(); got != scanDefaultTimeout {
+		t.Fatalf("timeout before any sample = %v, want %v", got, scanDefaultTimeout)
+	}
+	estimator.observe(time.Millisecond)
+	if got := estimator.timeout(); got != scanMinTimeout {
+		t.Fatalf("LAN timeout = %v, want the floor %v", got, scanMinTimeout)
+	}
+	estimator = rttEstimator{}
+	estimator.observe(200 * time.Millisecond)
+	if got := estimator.timeout(); got != 600*time.Millisecond {
+		t.Fatalf("timeout = %v, want 600ms", got)
+	}
+	estimator.observe(30 * time.Second)
+	if got := estimator.timeout(); got != scanMaxTimeout {
+		t.Fatalf("timeout after a slow sample = %v, want the ceiling %v", got, scanMaxTimeout)
+	}
+}
+
+func TestRealPortScanAdaptive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	open := listener.Addr().(*net.TCPAddr).Port
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	env := taskEnv{Progress: &taskProgress{}}
+	out, err := runRealPortScan(env, map[string]interface{}{"target": "127.0.0.1", "ports": []interface{}{float64(open), float64(closedPort)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(map[string]interface{})
+	if !slices.Equal(result["open_ports"].([]int), []int{open}) {
+		t.Fatalf("open_ports = %v, want [%d]", result["open_ports"], open)
+	}
+	if result["adaptive"] != true || result["rtt_ms"] == nil || result["timeout_ms"].(int64) != scanMinTimeout.Milliseconds() {
+		t.Fatalf("result = %v, want an adaptive scan at the floor timeout", result)
+	}
+
+	out, _ = runRealPortScan(env, map[string]interface{}{"target": "127.0.0.1", "ports": []interface{}{float64(open)}, "timeout_ms": 250.0})
+	if result := out.(map[string]interface{}); result["adaptive"] != false || result["timeout_ms"] != int64(250) {
+		t.Fatalf("fixed timeout result = %v", result)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	fallback := []int{22, 80, 443}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []int
+	}{
+		{"missing", nil, fallback},
+		{"empty string", " ", fallback},
+		{"empty list", []interface{}{}, fallback},
+		{"json list", []interface{}{22.0, 80.0}, []int{22, 80}},
+		{"single port", "3389", []int{3389}},
+		{"ranges and ports", "1-3, 3389,8000-8002", []int{1, 2, 3, 3389, 8000, 8001, 8002}},
+		{"repeats dropped", "80,79-81,80", []int{80, 79, 81}},
+		{"list with ranges", []interface{}{"20-21", 22.0}, []int{20, 21, 22}},
+		{"full range", "1-65535", nil},
+	}
+	for _, tt := range tests {
+		got, err := parsePorts(tt.value, fallback)
+		if err != nil {
+			t.Errorf("%s: parsePorts(%v) = %v", tt.name, tt.value, err)
+			continue
+		}
+		if tt.want == nil {
+			if len(got) != 65535 || got[0] != 1 || got[65534] != 65535 {
+				t.Errorf("%s: got %d ports", tt.name, len(got))
+			}
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: parsePorts(%v) = %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+	for _, bad := range []interface{}{"0", "65536", "80-", "-80", "90-80", "http", ",", []interface{}{22.5}, []interface{}{true}, 443.0} {
+		if _, err := parsePorts(bad, fallback); err == nil {
+			t.Errorf("parsePorts(%v) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestScanPorts(t *testing.T) {
+	fallback := []int{22, 80, 443}
+	sizes := map[string]int{"top100": 100, "top1000": 1000}
+	for name := range portPresets {
+		ports, preset, err := scanPorts(map[string]interface{}{"preset": name}, fallback)
+		if err != nil || preset != name || len(ports) == 0 {
+			t.Fatalf("preset %s = %d ports, %q, %v", name, len(ports), preset, err)
+		}
+		if want, ok := sizes[name]; ok && len(ports) != want {
+			t.Errorf("preset %s has %d ports, want %d", name, len(ports), want)
+		}
+	}
+
+	ports, preset, err := scanPorts(map[string]interface{}{"preset": "web", "ports": "22"}, fallback)
+	if err != nil || preset != "" || !slices.Equal(ports, []int{22}) {
+		t.Fatalf("explicit ports with a preset = %v, %q, %v", ports, preset, err)
+	}
+	ports, preset, err = scanPorts(map[string]interface{}{"preset": "windows", "ports": []interface{}{}}, fallback)
+	if err != nil || preset != "windows" || !slices.Contains(ports, 445) {
+		t.Fatalf("empty ports with a preset = %v, %q, %v", ports, preset, err)
+	}
+	if ports, _, err := scanPorts(map[string]interface{}{}, fallback); err != nil || !slices.Equal(ports, fallback) {
+		t.Fatalf("no ports or preset = %v, %v", ports, err)
+	}
+	if _, _, err := scanPorts(map[string]interface{}{"preset": "top5"}, fallback); err == nil {
+		t.Fatal("unknown preset accepted")
+	}
+}
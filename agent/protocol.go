@@ -0,0 +1,62 @@
+package main
+
+import "fmt"
+
+// protocolVersion is the wire protocol this agent speaks. Version 1 is the
+// original exchange: register, heartbeat, task, task_cancel, and
+// task_result. Version 2 adds everything since, listed in
+// protocolV2Messages. Admins that predate negotiation do not send a
+// protocol in registered and are treated as version 1.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 1
+)
+
+// acceptedMessages are the admin-to-agent message types this agent handles,
+// advertised in register.
+var acceptedMessages = []string{"challenge", "registered", "task", "task_cancel", "policy", "config_update", "update", "reprovision", "ack", "history"}
+
+// protocolV2Messages are agent-to-admin message types a version 1 admin
+// does not know. They are dropped rather than sent when the session
+// negotiated version 1.
+var protocolV2Messages = map[string]bool{
+	"task_update":     true,
+	"task_progress":   true,
+	"task_queued":     true,
+	"event":           true,
+	"log":             true,
+	"going_offline":   true,
+	"config_applied":  true,
+	"policy_applied":  true,
+	"update_result":   true,
+	"reprovisioned":   true,
+	"ack":             true,
+	"update_register": true,
+	"history_result":  true,
+}
+
+func negotiateProtocol(offered int) (int, error) {
+	switch {
+	case offered == 0:
+		return 1, nil
+	case offered > protocolVersion:
+		return 0, fmt.Errorf("admin chose protocol %d, agent speaks at most %d", offered, protocolVersion)
+	case offered < minProtocolVersion:
+		return 0, fmt.Errorf("admin protocol %d is older than %d, the oldest this agent supports", offered, minProtocolVersion)
+	}
+	return offered, nil
+}
+
+func (c *AgentClient) setProtocol(protocol int) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.protocol = protocol
+}
+
+// peerAccepts reports whether the admin of the current session understands
+// messageType. Before registered arrives nothing is filtered.
+func (c *AgentClient) peerAccepts(messageType string) bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return c.protocol == 0 || c.protocol >= 2 || !protocolV2Messages[messageType]
+}
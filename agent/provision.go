@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	provisionStatePath   = "agent_provision_state.json"
+	provisionNonceTTL    = 24 * time.Hour
+	provisionMaxNonces   = 1024
+	provisionMaxClockGap = 5 * time.Minute
+)
+
+// provisionGuard rejects replayed provisioning packets and, once an admin has
+// provisioned the agent with a signed packet, only accepts later packets
+// signed by that same admin key.
+type provisionGuard struct {
+	mu    sync.Mutex
+	path  string
+	state provisionState
+}
+
+type provisionState struct {
+	AdminPublicKey   string           `json:"admin_public_key,omitempty"`
+	AdminFingerprint string           `json:"admin_fingerprint,omitempty"`
+	Nonces           map[string]int64 `json:"nonces"`
+}
+
+func loadProvisionGuard(path string) *provisionGuard {
+	guard := &provisionGuard{path: path, state: provisionState{Nonces: map[string]int64{}}}
+	if path == "" {
+		return guard
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return guard
+	}
+	if err := json.Unmarshal(data, &guard.state); err != nil {
+		slog.Warn("ignoring provisioning state", "path", path, "err", err)
+		guard.state = provisionState{}
+	}
+	if guard.state.Nonces == nil {
+		guard.state.Nonces = map[string]int64{}
+	}
+	return guard
+}
+
+// check validates a provisioning packet and, on success, records its nonce
+// and binds the admin key it was signed with.
+func (g *provisionGuard) check(provision ProvisionMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.prune(now)
+	if strings.TrimSpace(provision.Nonce) == "" {
+		return errors.New("provisioning requires nonce")
+	}
+	if _, seen := g.state.Nonces[provision.Nonce]; seen {
+		return errors.New("replayed provisioning nonce")
+	}
+	// The nonce memory only lasts provisionNonceTTL, so every packet also
+	// has to be recent.
+	if provision.TS == 0 {
+		return errors.New("provisioning requires ts")
+	}
+	gap := now.Sub(time.UnixMilli(provision.TS))
+	if gap > provisionMaxClockGap || gap < -provisionMaxClockGap {
+		return fmt.Errorf("provisioning timestamp off by %s", gap.Round(time.Second))
+	}
+
+	signed := strings.TrimSpace(provision.Signature) != ""
+	bound := g.state.AdminPublicKey
+	switch {
+	case bound != "" && strings.TrimSpace(provision.AdminPublicKey) != bound:
+		return fmt.Errorf("provisioning is not from the bound admin %s", g.state.AdminFingerprint)
+	case bound != "" && !signed:
+		return errors.New("provisioning from the bound admin must be signed")
+	}
+	if signed {
+		if err := verifyProvisionSignature(provision); err != nil {
+			return err
+		}
+	}
+
+	g.state.Nonces[provision.Nonce] = now.UnixMilli()
+	if signed && bound == "" {
+		g.state.AdminPublicKey = strings.TrimSpace(provision.AdminPublicKey)
+		g.state.AdminFingerprint = adminKeyFingerprint(g.state.AdminPublicKey)
+		slog.Info("bound provisioning to admin key", "fingerprint", g.state.AdminFingerprint)
+	}
+	g.save()
+	return nil
+}
+
+func (g *provisionGuard) prune(now time.Time) {
+	cutoff := now.Add(-provisionNonceTTL).UnixMilli()
+	for nonce, seen := range g.state.Nonces {
+		if seen < cutoff {
+			delete(g.state.Nonces, nonce)
+		}
+	}
+	for len(g.state.Nonces) >= provisionMaxNonces {
+		oldest, oldestAt := "", int64(0)
+		for nonce, seen := range g.state.Nonces {
+			if oldest == "" || seen < oldestAt {
+				oldest, oldestAt = nonce, seen
+			}
+		}
+		delete(g.state.Nonces, oldest)
+	}
+}
+
+func (g *provisionGuard) save() {
+	if g.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(g.state, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(g.path, data, 0o600); err != nil {
+		slog.Warn("failed to persist provisioning state", "err", err)
+	}
+}
+
+// verifyProvisionSignature checks the base64 Ed25519 sig, made with the key
+// carried in admin_public_key, over provisionSigningString.
+func verifyProvisionSignature(provision ProvisionMessage) error {
+	key, err := parseAdminPublicKey(provision.AdminPublicKey)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return errors.New("signed provisioning requires admin_public_key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(provision.Signature))
+	if err != nil || len(sig) != ed25519.SignatureSize || !ed25519.Verify(key, []byte(provisionSigningString(provision)), sig) {
+		return errors.New("provisioning signature verification failed")
+	}
+	return nil
+}
+
+// provisionSigningString joins every field that steers the agent, one per
+// line, in a fixed order. The transport fields are only appended when set,
+// so admins that predate them sign the same string as before.
+func provisionSigningString(provision ProvisionMessage) string {
+	fields := []string{
+		provision.Type,
+		strconv.Itoa(provision.V),
+		provision.Nonce,
+		strconv.FormatInt(provision.TS, 10),
+		provision.AdminIP,
+		provision.Secret,
+		strings.TrimSpace(provision.AdminPublicKey),
+		strconv.FormatBool(provision.TLS),
+		provision.TLSCAPEM,
+		provision.TLSCertSHA256,
+		strconv.FormatBool(provision.TLSClientCSR),
+		provision.TLSClientCert,
+		provision.TLSClientKey,
+		strings.Join(provision.ScanAllow, ","),
+		strings.Join(provision.DenyKinds, ","),
+	}
+	if provision.Transport != "" || provision.MQTTBroker != "" || provision.MQTTPrefix != "" {
+		fields = append(fields, provision.Transport, provision.MQTTBroker, provision.MQTTPrefix)
+	}
+	if provision.NATSURL != "" || provision.NATSPrefix != "" {
+		fields = append(fields, provision.NATSURL, provision.NATSPrefix)
+	}
+	return strings.Join(fields, "\n")
+}
+
+func adminKeyFingerprint(encoded string) string {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProvisionGuardFreshness(t *testing.T) {
+	guard := loadProvisionGuard("")
+	packet := func(nonce string, ts int64) ProvisionMessage {
+		return ProvisionMessage{Type: "LABSCAN_PROVISION", V: 1, AdminIP: "10.0.0.2", Secret: "s", Nonce: nonce, TS: ts}
+	}
+	now := time.Now()
+	for name, bad := range map[string]ProvisionMessage{
+		"no nonce": packet("", now.UnixMilli()),
+		"no ts":    packet("n-1", 0),
+		"stale ts": packet("n-2", now.Add(-provisionMaxClockGap-time.Minute).UnixMilli()),
+		"future":   packet("n-3", now.Add(provisionMaxClockGap+time.Minute).UnixMilli()),
+	} {
+		if err := guard.check(bad); err == nil {
+			t.Errorf("%s: unsigned packet accepted", name)
+		}
+	}
+	fresh := packet("n-4", now.UnixMilli())
+	if err := guard.check(fresh); err != nil {
+		t.Fatalf("fresh packet: %v", err)
+	}
+	if err := guard.check(fresh); err == nil {
+		t.Error("replayed nonce accepted")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var proxySetting = ""
+
+// adminProxy picks the proxy for connections to the admin: the websocket
+// and update downloads. By default it follows HTTP_PROXY, HTTPS_PROXY, and
+// NO_PROXY; -proxy overrides them, and -proxy direct ignores them.
+var adminProxy = http.ProxyFromEnvironment
+
+func parseProxySetting(value string) (func(*http.Request) (*url.URL, error), error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct", "none":
+		return nil, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("-proxy: %w", err)
+	}
+	// The websocket dialer only speaks these two; https:// proxies are not
+	// supported by it.
+	if (u.Scheme != "http" && u.Scheme != "socks5") || u.Host == "" {
+		return nil, fmt.Errorf("-proxy %q: want http://host:port or socks5://host:port", value)
+	}
+	return http.ProxyURL(u), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+	defaultGeoIPURL      = "https://ipinfo.io/{ip}/json"
+)
+
+var (
+	defaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+	defaultEchoURLs    = []string{"https://api.ipify.org", "https://ifconfig.me/ip", "https://icanhazip.com"}
+)
+
+func runPublicIP(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	method := asString(params["method"], "auto")
+	if method != "auto" && method != "stun" && method != "https" {
+		return nil, fmt.Errorf("unsupported public_ip method %q", method)
+	}
+	timeout := time.Duration(asInt(params["timeout_ms"], 3000)) * time.Millisecond
+	client := env.Pins.httpClient(timeout)
+	stunServers := asStringSlice(params["stun_servers"], defaultSTUNServers)
+	echoURLs := asStringSlice(params["echo_urls"], defaultEchoURLs)
+
+	var attempts []string
+	result := map[string]interface{}{}
+	found := false
+
+	if method == "auto" || method == "stun" {
+		for _, server := range stunServers {
+			addr, err := stunMappedAddr(server, timeout)
+			if err != nil {
+				attempts = append(attempts, fmt.Sprintf("stun %s: %v", server, err))
+				continue
+			}
+			result["public_ip"] = addr.IP.String()
+			result["mapped_port"] = addr.Port
+			result["source"] = "stun:" + server
+			found = true
+			break
+		}
+	}
+	if !found && (method == "auto" || method == "https") {
+		for _, echoURL := range echoURLs {
+			ip, err := httpEchoIP(client, echoURL)
+			if err != nil {
+				attempts = append(attempts, fmt.Sprintf("%s: %v", echoURL, err))
+				continue
+			}
+			result["public_ip"] = ip.String()
+			result["source"] = echoURL
+			found = true
+			break
+		}
+	}
+	if !found {
+		return map[string]interface{}{"errors": attempts}, errors.New("could not determine public ip")
+	}
+
+	if geo, _ := params["geoip"].(bool); geo {
+		info, err := lookupGeoIP(client, asString(params["geoip_url"], defaultGeoIPURL), result["public_ip"].(string))
+		if err != nil {
+			result["geoip_error"] = err.Error()
+		} else {
+			result["geoip"] = info
+		}
+	}
+	return result, nil
+}
+
+func stunMappedAddr(server string, timeout time.Duration) (*net.UDPAddr, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	txID := request[8:20]
+	if _, err := rand.Read(txID); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return parseSTUNResponse(buf[:n], txID)
+}
+
+func parseSTUNResponse(msg, txID []byte) (*net.UDPAddr, error) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:2]) != stunBindingSuccess {
+		return nil, errors.New("not a binding success response")
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || !bytes.Equal(msg[8:20], txID) {
+		return nil, errors.New("transaction mismatch")
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if 20+length > len(msg) {
+		return nil, errors.New("truncated response")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := msg[20 : 20+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunXORMappedAddress:
+			if addr := decodeSTUNAddress(value, msg[4:20]); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = decodeSTUNAddress(value, nil)
+		}
+		padded := (attrLen + 3) &^ 3
+		if 4+padded > len(attrs) {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, errors.New("no mapped address in response")
+}
+
+// decodeSTUNAddress parses a (XOR-)MAPPED-ADDRESS value; xorKey is the magic
+// cookie plus transaction id, or nil for the plain attribute.
+func decodeSTUNAddress(value, xorKey []byte) *net.UDPAddr {
+	if len(value) < 8 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	var ip net.IP
+	switch value[1] {
+	case 0x01:
+		ip = append(net.IP(nil), value[4:8]...)
+	case 0x02:
+		if len(value) < 20 {
+			return nil
+		}
+		ip = append(net.IP(nil), value[4:20]...)
+	default:
+		return nil
+	}
+	if xorKey != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+func httpEchoIP(client *http.Client, echoURL string) (net.IP, error) {
+	resp, err := client.Get(echoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("unexpected response %q", strings.TrimSpace(string(body)))
+	}
+	return ip, nil
+}
+
+func lookupGeoIP(client *http.Client, template, ip string) (map[string]interface{}, error) {
+	resp, err := client.Get(strings.ReplaceAll(template, "{ip}", ip))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var info map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
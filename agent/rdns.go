@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxSweepAddresses = 65536
+	maxConcurrency    = 256
+)
+
+// taskConcurrency reads the "concurrency" param, clamped to
+// 1..maxConcurrency so one task cannot open unbounded sockets.
+func taskConcurrency(params map[string]interface{}, fallback int) int {
+	return max(1, min(asInt(params["concurrency"], fallback), maxConcurrency))
+}
+
+func runRDNSSweep(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	cidr := asString(params["cidr"], "")
+	if cidr == "" {
+		return nil, fmt.Errorf("rdns_sweep requires cidr")
+	}
+	timeoutMS := asInt(params["timeout_ms"], 1500)
+	concurrency := taskConcurrency(params, 64)
+
+	ips, err := expandCIDR(cidr, maxSweepAddresses)
+	if err != nil {
+		return nil, err
+	}
+	ips, shard, err := shardTargets(env, params, ips)
+	if err != nil {
+		return nil, err
+	}
+	ips, excluded := env.Exclude.filterHosts(ips)
+
+	resolver := &net.Resolver{}
+	if server := asString(params["resolver"], ""); server != "" {
+		resolver = customResolver(server)
+	}
+
+	env.Progress.setTotal(len(ips))
+	hosts := make(map[string]string)
+	var hostsMu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				name := lookupPTR(env.context(), resolver, ip, time.Duration(timeoutMS)*time.Millisecond)
+				env.Progress.step(ip)
+				if name == "" {
+					continue
+				}
+				hostsMu.Lock()
+				hosts[ip] = name
+				hostsMu.Unlock()
+			}
+		}()
+	}
+	scanned := 0
+	for _, ip := range ips {
+		if env.cancelled() {
+			break
+		}
+		jobs <- ip
+		scanned++
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := map[string]interface{}{
+		"cidr":     cidr,
+		"hosts":    hosts,
+		"resolved": len(hosts),
+		"scanned":  scanned,
+	}
+	if shard != nil {
+		result["shard"] = shard
+	}
+	if excluded > 0 {
+		result["excluded"] = excluded
+	}
+	return result, nil
+}
+
+func runFakeRDNSSweep(params map[string]interface{}) (interface{}, error) {
+	cidr := asString(params["cidr"], "192.168.1.0/24")
+	hosts := map[string]string{
+		"192.168.1.1":  "gateway.lab.local",
+		"192.168.1.20": "labscan-admin.lab.local",
+		"192.168.1.51": "printer-lab-b.lab.local",
+	}
+	return map[string]interface{}{"cidr": cidr, "hosts": hosts, "resolved": len(hosts), "scanned": 254}, nil
+}
+
+func lookupPTR(parent context.Context, resolver *net.Resolver, ip string, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	names, err := resolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+func customResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
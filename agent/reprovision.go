@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// ReprovisionPayload moves a connected agent to a new admin address or
+// secret. Omitted optional fields keep their current value.
+type ReprovisionPayload struct {
+	AdminIP        string `json:"admin_ip"`
+	Secret         string `json:"secret"`
+	AdminPublicKey string `json:"admin_public_key,omitempty"`
+	TLS            *bool  `json:"tls,omitempty"`
+	TLSCAPEM       string `json:"tls_ca_pem,omitempty"`
+	TLSCertSHA256  string `json:"tls_cert_sha256,omitempty"`
+}
+
+type ReprovisionedPayload struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	AdminIP string `json:"admin_ip,omitempty"`
+}
+
+var errReprovisioned = errors.New("reprovisioned")
+
+// handleReprovision validates and persists the new admin, reports the
+// outcome to the current one, and hands the new config to runSession,
+// which ends the session so the agent reconnects with it.
+func (c *AgentClient) handleReprovision(payload ReprovisionPayload) {
+	next, err := c.reprovisionConfig(payload)
+	if err != nil {
+		c.logger().Warn("rejecting reprovision", "err", err)
+		_ = c.send("reprovisioned", ReprovisionedPayload{OK: false, Error: err.Error()})
+		return
+	}
+	if !c.profile.IsFake {
+		if err := saveConfig(next); err != nil {
+			c.logger().Warn("rejecting reprovision", "err", err)
+			_ = c.send("reprovisioned", ReprovisionedPayload{OK: false, Error: "persist config: " + err.Error()})
+			return
+		}
+	}
+	c.logger().Info("reprovisioned, moving to new admin", "admin_ip", next.AdminIP)
+	_ = c.send("reprovisioned", ReprovisionedPayload{OK: true, AdminIP: next.AdminIP})
+	select {
+	case c.moves <- next:
+	default:
+	}
+}
+
+func (c *AgentClient) reprovisionConfig(payload ReprovisionPayload) (*PersistedConfig, error) {
+	adminIP := unbracket(strings.TrimSpace(payload.AdminIP))
+	if adminIP == "" || payload.Secret == "" {
+		return nil, errors.New("reprovision requires admin_ip and secret")
+	}
+	next := c.configSnapshot()
+	next.AdminIP, next.Secret = adminIP, payload.Secret
+	if key := strings.TrimSpace(payload.AdminPublicKey); key != "" {
+		if _, err := parseAdminPublicKey(key); err != nil {
+			return nil, err
+		}
+		next.AdminPublicKey = key
+	}
+	if payload.TLS != nil {
+		next.TLS = *payload.TLS
+	}
+	if payload.TLSCAPEM != "" {
+		next.TLSCAPEM = payload.TLSCAPEM
+	}
+	if payload.TLSCertSHA256 != "" {
+		next.TLSCertSHA256 = normalizeFingerprint(payload.TLSCertSHA256)
+	}
+	if _, err := adminTLSConfig(&next, tlsDefaults); err != nil {
+		return nil, err
+	}
+	next.ProvisionedAt = nowMS()
+	return &next, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var errFactoryReset = errors.New("factory reset")
+
+// runFactoryReset only asks the session to reset. The wipe itself happens
+// in factoryReset once the agent has reported this result and gone offline,
+// so nothing the session still writes survives it.
+func runFactoryReset(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	if confirm, _ := params["confirm"].(bool); !confirm {
+		return nil, errors.New("factory_reset requires confirm: true")
+	}
+	if env.Reset == nil {
+		return nil, errors.New("factory_reset is not available here")
+	}
+	env.Reset()
+	return map[string]interface{}{"resetting": true, "agent_id": env.AgentID}, nil
+}
+
+func (c *AgentClient) requestReset() {
+	select {
+	case c.resets <- struct{}{}:
+	default:
+	}
+}
+
+// factoryReset removes what provisioning and past sessions left behind:
+// the config (except the operator's settings object), the secrets in the OS
+// credential store, queued results, schedules, provisioning state, and the
+// identity, so the next start gets a new agent_id. The audit log is
+// archived rather than removed.
+func factoryReset(identityPath string) {
+	for _, account := range []string{keyringAccount(), tlsKeyAccount()} {
+		if err := keyringDelete(account); err != nil {
+			slog.Warn("factory reset: cannot remove keyring entry", "account", account, "err", err)
+		}
+	}
+	archiveAuditLog(time.Now())
+
+	paths := []string{outboxPath, resultCachePath, schedulesPath, provisionStatePath, updateMarkerPath, noncesPath, secretKeyPath(), identityPath}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("factory reset: cannot remove", "path", path, "err", err)
+		}
+	}
+	settings, _ := readFileSettings(configPath)
+	if len(settings) == 0 {
+		if err := os.Remove(configPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("factory reset: cannot remove", "path", configPath, "err", err)
+		}
+		return
+	}
+	data, err := json.MarshalIndent(struct {
+		Settings map[string]json.RawMessage `json:"settings"`
+	}{settings}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(configPath, data, 0o600)
+	}
+	if err != nil {
+		slog.Warn("factory reset: cannot rewrite", "path", configPath, "err", err)
+	}
+}
+
+// archiveAuditLog renames the audit log and its rotated files to
+// <name>.reset-<unix ms>, out of reach of rotation and the audit_log task,
+// so the previous identity's history is kept on disk but not handed to the
+// next admin.
+func archiveAuditLog(now time.Time) {
+	paths := []string{auditPath}
+	for i := 1; i <= auditKeepFiles; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", auditPath, i))
+	}
+	for _, path := range paths {
+		archived := fmt.Sprintf("%s.reset-%d", path, now.UnixMilli())
+		if err := os.Rename(path, archived); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("factory reset: cannot archive", "path", path, "err", err)
+		}
+	}
+}
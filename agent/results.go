@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+)
+
+const resultCachePath = "agent_results.jsonl"
+
+// resultCacheSize is how many recent task results the agent keeps for
+// history requests; 0 disables the cache. resultCacheMaxBytes bounds the
+// encoded results kept, so a few large captures cannot fill the disk.
+var (
+	resultCacheSize     = 200
+	resultCacheMaxBytes = 32 << 20
+)
+
+type cachedResult struct {
+	TaskID     string          `json:"task_id"`
+	FinishedAt int64           `json:"finished_at"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// resultCache keeps the last task results as JSON lines at path (memory
+// only when path is empty), so the admin can fetch results it missed with a
+// history request. A result sent again for the same task replaces the old
+// entry.
+type resultCache struct {
+	mu      sync.Mutex
+	path    string
+	entries []cachedResult
+	bytes   int
+}
+
+func loadResultCache(path string) *resultCache {
+	cache := &resultCache{path: path}
+	if path == "" || resultCacheSize <= 0 {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read result cache", "err", err)
+		}
+		return cache
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxDecodedPayload)
+	for scanner.Scan() {
+		var entry cachedResult
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry.TaskID != "" {
+			cache.entries = append(cache.entries, entry)
+			cache.bytes += len(entry.Result)
+		}
+	}
+	cache.trimLocked()
+	return cache
+}
+
+func (r *resultCache) add(taskID string, finishedAt int64, encoded []byte) {
+	if resultCacheSize <= 0 || taskID == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, entry := range r.entries {
+		if entry.TaskID == taskID {
+			r.bytes -= len(entry.Result)
+			r.entries = append(r.entries[:i], r.entries[i+1:]...)
+			break
+		}
+	}
+	r.entries = append(r.entries, cachedResult{TaskID: taskID, FinishedAt: finishedAt, Result: encoded})
+	r.bytes += len(encoded)
+	r.trimLocked()
+	if err := r.saveLocked(); err != nil {
+		slog.Warn("failed to persist result cache", "err", err)
+	}
+}
+
+// lookup returns the cached result for taskID.
+func (r *resultCache) lookup(taskID string) (cachedResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.entries {
+		if entry.TaskID == taskID {
+			return entry, true
+		}
+	}
+	return cachedResult{}, false
+}
+
+// find returns cached results oldest first: those for taskIDs when any are
+// given, otherwise those finished at or after since, at most limit of the
+// newest when limit is positive.
+func (r *resultCache) find(taskIDs []string, since int64, limit int) []cachedResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wanted := make(map[string]bool, len(taskIDs))
+	for _, id := range taskIDs {
+		wanted[id] = true
+	}
+	var found []cachedResult
+	for _, entry := range r.entries {
+		if len(wanted) > 0 && !wanted[entry.TaskID] || len(wanted) == 0 && entry.FinishedAt < since {
+			continue
+		}
+		found = append(found, entry)
+	}
+	if limit > 0 && len(found) > limit {
+		found = found[len(found)-limit:]
+	}
+	return found
+}
+
+// trimLocked drops the oldest entries beyond resultCacheSize or
+// resultCacheMaxBytes. The newest result is kept even if it alone is larger.
+func (r *resultCache) trimLocked() {
+	drop := 0
+	for drop < len(r.entries)-1 && (len(r.entries)-drop > resultCacheSize || r.bytes > resultCacheMaxBytes) {
+		r.bytes -= len(r.entries[drop].Result)
+		drop++
+	}
+	if drop > 0 {
+		r.entries = append([]cachedResult(nil), r.entries[drop:]...)
+	}
+}
+
+func (r *resultCache) saveLocked() error {
+	if r.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range r.entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(r.path, buf.Bytes(), 0o600)
+}
+
+// HistoryPayload asks for cached task results: those for TaskIDs, or when
+// none are given every result finished at or after Since.
+type HistoryPayload struct {
+	RequestID string   `json:"request_id"`
+	TaskIDs   []string `json:"task_ids,omitempty"`
+	Since     int64    `json:"since,omitempty"`
+	Limit     int      `json:"limit,omitempty"`
+}
+
+// HistoryResultPayload follows the resent results and lists what was found,
+// and which requested task IDs are no longer (or never were) cached.
+type HistoryResultPayload struct {
+	RequestID string   `json:"request_id"`
+	TaskIDs   []string `json:"task_ids"`
+	Missing   []string `json:"missing,omitempty"`
+}
+
+// handleHistory resends matching cached results as task_result messages
+// marked replayed, then reports what it sent in history_result.
+func (c *AgentClient) handleHistory(request HistoryPayload) {
+	found := c.results.find(request.TaskIDs, request.Since, request.Limit)
+	sent := make([]string, 0, len(found))
+	for _, entry := range found {
+		if err := c.resendResult(entry); err != nil {
+			c.logger().Warn("history request interrupted", "request_id", request.RequestID, "err", err)
+			return
+		}
+		sent = append(sent, entry.TaskID)
+	}
+	var missing []string
+	for _, id := range request.TaskIDs {
+		if !slices.Contains(sent, id) {
+			missing = append(missing, id)
+		}
+	}
+	c.logger().Info("answered history request", "request_id", request.RequestID, "results", len(sent), "missing", len(missing))
+	_ = c.send("history_result", HistoryResultPayload{RequestID: request.RequestID, TaskIDs: sent, Missing: missing})
+}
+
+// resendResult sends a cached result again, marked replayed.
+func (c *AgentClient) resendResult(entry cachedResult) error {
+	var result TaskResultPayload
+	if err := json.Unmarshal(entry.Result, &result); err != nil {
+		return err
+	}
+	result.Replayed = true
+	return c.sendTaskResult(result)
+}
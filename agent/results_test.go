@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func cachedIDs(entries []cachedResult) []string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.TaskID)
+	}
+	return ids
+}
+
+func TestResultCache(t *testing.T) {
+	defer func(size, maxBytes int) { resultCacheSize, resultCacheMaxBytes = size, maxBytes }(resultCacheSize, resultCacheMaxBytes)
+	resultCacheSize, resultCacheMaxBytes = 3, 1<<20
+
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	cache := loadResultCache(path)
+	for i, id := range []string{"t1", "t2", "t3", "t2", "t4"} {
+		cache.add(id, int64(100+i), []byte(`{"task_id":"`+id+`","ok":true}`))
+	}
+	if got, want := cachedIDs(cache.find(nil, 0, 0)), []string{"t3", "t2", "t4"}; !slices.Equal(got, want) {
+		t.Fatalf("cached = %v, want %v", got, want)
+	}
+
+	reloaded := loadResultCache(path)
+	tests := []struct {
+		name    string
+		taskIDs []string
+		since   int64
+		limit   int
+		want    []string
+	}{
+		{name: "since", since: 103, want: []string{"t2", "t4"}},
+		{name: "limit keeps newest", limit: 1, want: []string{"t4"}},
+		{name: "by task id", taskIDs: []string{"t4", "t1", "t3"}, since: 1000, want: []string{"t3", "t4"}},
+	}
+	for _, tt := range tests {
+		if got := cachedIDs(reloaded.find(tt.taskIDs, tt.since, tt.limit)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: find() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := reloaded.lookup("t1"); ok {
+		t.Error("evicted result t1 is still cached")
+	}
+}
+
+func TestResultCacheByteLimit(t *testing.T) {
+	defer func(size, maxBytes int) { resultCacheSize, resultCacheMaxBytes = size, maxBytes }(resultCacheSize, resultCacheMaxBytes)
+	resultCacheSize, resultCacheMaxBytes = 10, 40
+
+	cache := loadResultCache("")
+	cache.add("small", 1, make([]byte, 20))
+	cache.add("big", 2, make([]byte, 30))
+	if got := cachedIDs(cache.find(nil, 0, 0)); !slices.Equal(got, []string{"big"}) {
+		t.Fatalf("cached = %v, want only the newest result", got)
+	}
+	cache.add("huge", 3, make([]byte, 100))
+	if got := cachedIDs(cache.find(nil, 0, 0)); !slices.Equal(got, []string{"huge"}) {
+		t.Fatalf("cached = %v, want the oversized newest result kept", got)
+	}
+}
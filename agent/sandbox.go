@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const sandboxHelperArg = "__sandbox-exec"
+
+type sandboxLimits struct {
+	CPUSeconds int
+	MemoryMB   int
+	Timeout    time.Duration
+	User       string
+}
+
+var sandboxDefaults = sandboxLimits{
+	CPUSeconds: 30,
+	MemoryMB:   256,
+	Timeout:    60 * time.Second,
+}
+
+// sandboxStatus is shown in /status: whether task commands get the
+// syscall filter, and why not.
+type sandboxStatus struct {
+	Seccomp bool   `json:"seccomp"`
+	Error   string `json:"error,omitempty"`
+}
+
+var errSandboxTimeout = errors.New("sandboxed command exceeded its time limit")
+
+// runSandboxed runs an external command on behalf of a task handler under
+// the platform sandbox (see sandbox_<os>.go) and returns its combined output.
+func runSandboxed(limits sandboxLimits, name string, args ...string) ([]byte, error) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = sandboxDefaults.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+
+	cmd, err := sandboxCommand(ctx, limits, name, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox setup failed: %w", err)
+	}
+	out, err := runSandboxCommand(cmd, limits)
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, errSandboxTimeout
+	}
+	return out, err
+}
+
+func sandboxedOutput(name string, args ...string) ([]byte, error) {
+	return runSandboxed(sandboxDefaults, name, args...)
+}
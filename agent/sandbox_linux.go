@@ -0,0 +1,233 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxCommand re-executes the agent binary as a small helper that
+// applies rlimits, drops privileges, sets no_new_privs, installs a seccomp
+// deny-list and then execs the real command.
+func sandboxCommand(ctx context.Context, limits sandboxLimits, name string, args ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	helperArgs := []string{
+		sandboxHelperArg,
+		"-cpu", strconv.Itoa(limits.CPUSeconds),
+		"-mem-mb", strconv.Itoa(limits.MemoryMB),
+		"-user", limits.User,
+		"-seccomp=" + strconv.FormatBool(seccompUnavailable() == nil),
+		"--", path,
+	}
+	helperArgs = append(helperArgs, args...)
+	cmd := exec.CommandContext(ctx, self, helperArgs...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL, Setpgid: true}
+	return cmd, nil
+}
+
+func runSandboxCommand(cmd *exec.Cmd, _ sandboxLimits) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+func runSandboxHelper(args []string) {
+	fs := flag.NewFlagSet(sandboxHelperArg, flag.ExitOnError)
+	cpu := fs.Int("cpu", 0, "CPU seconds limit")
+	memMB := fs.Int("mem-mb", 0, "address space limit in MiB")
+	userName := fs.String("user", "", "user to run as")
+	seccomp := fs.Bool("seccomp", true, "install the syscall deny-list")
+	_ = fs.Parse(args)
+	command := fs.Args()
+	if len(command) == 0 {
+		fmt.Fprintln(os.Stderr, "sandbox: missing command")
+		os.Exit(127)
+	}
+
+	runtime.LockOSThread()
+	if err := applySandbox(*cpu, *memMB, *userName, *seccomp); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(126)
+	}
+	err := syscall.Exec(command[0], command, os.Environ())
+	fmt.Fprintf(os.Stderr, "sandbox: exec %s: %v\n", command[0], err)
+	os.Exit(127)
+}
+
+// applySandbox fails rather than run the command unconfined when the
+// seccomp filter was expected but cannot be installed.
+func applySandbox(cpuSeconds, memoryMB int, userName string, seccomp bool) error {
+	if cpuSeconds > 0 {
+		limit := &unix.Rlimit{Cur: uint64(cpuSeconds), Max: uint64(cpuSeconds)}
+		if err := unix.Setrlimit(unix.RLIMIT_CPU, limit); err != nil {
+			return fmt.Errorf("cpu limit: %w", err)
+		}
+	}
+	if memoryMB > 0 {
+		bytes := uint64(memoryMB) << 20
+		if err := unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: bytes, Max: bytes}); err != nil {
+			return fmt.Errorf("memory limit: %w", err)
+		}
+	}
+	if userName != "" && os.Geteuid() == 0 {
+		if err := dropPrivileges(userName); err != nil {
+			return err
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	if !seccomp {
+		return nil
+	}
+	return installSeccompDenyList()
+}
+
+var seccompCheck struct {
+	once sync.Once
+	err  error
+}
+
+// seccompUnavailable reports why this kernel or architecture cannot take
+// the syscall filter. It is checked once, logged at warn level, and shown
+// in /status; sandboxed commands then run with rlimits and no_new_privs
+// only.
+func seccompUnavailable() error {
+	seccompCheck.once.Do(func() {
+		if _, ok := seccompAuditArch(); !ok {
+			seccompCheck.err = fmt.Errorf("no seccomp filter for %s", runtime.GOARCH)
+		} else if _, err := unix.PrctlRetInt(unix.PR_GET_SECCOMP, 0, 0, 0, 0); err != nil {
+			seccompCheck.err = fmt.Errorf("seccomp unavailable: %w", err)
+		}
+		if seccompCheck.err != nil {
+			slog.Warn("sandboxed commands run without the syscall filter", "err", seccompCheck.err)
+		}
+	})
+	return seccompCheck.err
+}
+
+func sandboxReport() *sandboxStatus {
+	status := &sandboxStatus{Seccomp: true}
+	if err := seccompUnavailable(); err != nil {
+		status.Seccomp, status.Error = false, err.Error()
+	}
+	return status
+}
+
+func dropPrivileges(userName string) error {
+	account, err := user.Lookup(userName)
+	if err != nil {
+		return fmt.Errorf("sandbox user: %w", err)
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
+
+var seccompDeniedSyscalls = []uint32{
+	unix.SYS_PTRACE,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_REBOOT,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_BPF,
+	unix.SYS_SETNS,
+	unix.SYS_UNSHARE,
+	unix.SYS_ACCT,
+}
+
+func seccompAuditArch() (uint32, bool) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return unix.AUDIT_ARCH_X86_64, true
+	case "arm64":
+		return unix.AUDIT_ARCH_AARCH64, true
+	case "386":
+		return unix.AUDIT_ARCH_I386, true
+	case "arm":
+		return unix.AUDIT_ARCH_ARM, true
+	default:
+		return 0, false
+	}
+}
+
+func installSeccompDenyList() error {
+	arch, ok := seccompAuditArch()
+	if !ok {
+		return fmt.Errorf("seccomp: no filter for %s", runtime.GOARCH)
+	}
+
+	const (
+		offsetNR   = 0
+		offsetArch = 4
+		retDeny    = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+		// x32Bit marks x32 ABI syscalls, which pass the x86_64 arch check
+		// with their own numbers.
+		x32Bit = 0x40000000
+	)
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offsetArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: retDeny},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offsetNR},
+	}
+	if arch == unix.AUDIT_ARCH_X86_64 {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 0, Jf: 1, K: x32Bit},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: retDeny},
+		)
+	}
+	for _, nr := range seccompDeniedSyscalls {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: nr},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: retDeny},
+		)
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW})
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func runSandboxHelper(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox helper is not supported on this platform")
+	os.Exit(127)
+}
+
+func sandboxCommand(ctx context.Context, _ sandboxLimits, name string, args ...string) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, name, args...), nil
+}
+
+func runSandboxCommand(cmd *exec.Cmd, _ sandboxLimits) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// sandboxReport is nil where there is no syscall filter to report on.
+func sandboxReport() *sandboxStatus { return nil }
@@ -0,0 +1,70 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func runSandboxHelper(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox helper is not used on windows")
+	os.Exit(127)
+}
+
+func sandboxCommand(ctx context.Context, _ sandboxLimits, name string, args ...string) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, name, args...), nil
+}
+
+// runSandboxCommand places the child in a job object with memory, CPU time
+// and process-count limits. The job is closed with KILL_ON_JOB_CLOSE, so
+// every process the command spawned dies with it.
+func runSandboxCommand(cmd *exec.Cmd, limits sandboxLimits) ([]byte, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create job object: %w", err)
+	}
+	defer windows.CloseHandle(job)
+
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE | windows.JOB_OBJECT_LIMIT_ACTIVE_PROCESS
+	info.BasicLimitInformation.ActiveProcessLimit = 4
+	if limits.MemoryMB > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_PROCESS_MEMORY
+		info.ProcessMemoryLimit = uintptr(limits.MemoryMB) << 20
+	}
+	if limits.CPUSeconds > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_PROCESS_TIME
+		info.BasicLimitInformation.PerProcessUserTimeLimit = int64(limits.CPUSeconds) * 10_000_000
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		return nil, fmt.Errorf("configure job object: %w", err)
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err == nil {
+		if assignErr := windows.AssignProcessToJobObject(job, process); assignErr != nil {
+			_ = cmd.Process.Kill()
+		}
+		_ = windows.CloseHandle(process)
+	} else {
+		_ = cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	return output.Bytes(), err
+}
+
+// sandboxReport is nil where there is no syscall filter to report on.
+func sandboxReport() *sandboxStatus { return nil }
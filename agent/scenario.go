@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fakeFlag is -fake: a plain switch, or the path of a scenario file with
+// -fake=lab.yaml.
+type fakeFlag struct {
+	enabled  bool
+	scenario string
+}
+
+func (f *fakeFlag) String() string {
+	if f == nil || !f.enabled {
+		return "false"
+	}
+	if f.scenario != "" {
+		return f.scenario
+	}
+	return "true"
+}
+
+func (f *fakeFlag) Set(value string) error {
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		f.enabled, f.scenario = enabled, ""
+		return nil
+	}
+	f.enabled, f.scenario = true, value
+	return nil
+}
+
+func (f *fakeFlag) IsBoolFlag() bool { return true }
+
+// fakeScenario describes the lab fake mode simulates. Top-level os, arch,
+// subnet, gateway, responses, faults, and tags apply to every agent that does
+// not set its own; agents past the listed ones are generated from them.
+type fakeScenario struct {
+	Count     int                     `yaml:"count"`
+	Seed      int64                   `yaml:"seed"`
+	OS        string                  `yaml:"os"`
+	Arch      string                  `yaml:"arch"`
+	Subnet    string                  `yaml:"subnet"`
+	Gateway   string                  `yaml:"gateway"`
+	Responses map[string]fakeResponse `yaml:"responses"`
+	Faults    *fakeFaults             `yaml:"faults"`
+	Tags      map[string]string       `yaml:"tags"`
+	Agents    []fakeAgentSpec         `yaml:"agents"`
+}
+
+type fakeAgentSpec struct {
+	Hostname  string                  `yaml:"hostname"`
+	IP        string                  `yaml:"ip"`
+	IPv6      string                  `yaml:"ipv6"`
+	MAC       string                  `yaml:"mac"`
+	OS        string                  `yaml:"os"`
+	Arch      string                  `yaml:"arch"`
+	Subnet    string                  `yaml:"subnet"`
+	Gateway   string                  `yaml:"gateway"`
+	Interface string                  `yaml:"interface_type"`
+	Responses map[string]fakeResponse `yaml:"responses"`
+	Faults    *fakeFaults             `yaml:"faults"`
+	Tags      map[string]string       `yaml:"tags"`
+
+	seed int64
+
+	// simulated is set when the scenario gives the agent a subnet; only
+	// then does it report made-up network facts instead of the host's.
+	simulated bool
+}
+
+// fakeResponse is a canned task result: result is returned as is, or the
+// task fails with error.
+type fakeResponse struct {
+	Result interface{} `yaml:"result"`
+	Error  string      `yaml:"error"`
+}
+
+func (r fakeResponse) reply() (interface{}, error) {
+	if r.Error != "" {
+		return nil, errors.New(r.Error)
+	}
+	return r.Result, nil
+}
+
+// loadFakeScenario reads a YAML or JSON scenario; JSON is valid YAML, so
+// both go through the same decoder. Unknown keys are rejected to catch
+// typos.
+func loadFakeScenario(path string) (*fakeScenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	scenario := &fakeScenario{}
+	if err := decoder.Decode(scenario); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := scenario.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return scenario, nil
+}
+
+func (s *fakeScenario) validate() error {
+	if s.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(s.Subnet)
+		if err != nil || subnet.IP.To4() == nil {
+			return fmt.Errorf("subnet must be an IPv4 CIDR")
+		}
+		s.Subnet = subnet.String()
+	}
+	if s.Count == 0 {
+		s.Count = len(s.Agents)
+	}
+	if s.Count == 0 {
+		s.Count = fakeAgentCount
+	}
+	if s.Count < len(s.Agents) || s.Count > 4096 {
+		return fmt.Errorf("count %d must be between the %d listed agents and 4096", s.Count, len(s.Agents))
+	}
+	hostnames := make(map[string]bool)
+	for i := 1; i <= s.Count; i++ {
+		spec, err := s.agent(i)
+		if err != nil {
+			return fmt.Errorf("agent %d: %w", i, err)
+		}
+		if hostnames[spec.Hostname] {
+			return fmt.Errorf("agent %d: duplicate hostname %s", i, spec.Hostname)
+		}
+		hostnames[spec.Hostname] = true
+	}
+	return nil
+}
+
+// agent returns the i-th agent (from 1) with every field filled in.
+func (s *fakeScenario) agent(i int) (fakeAgentSpec, error) {
+	var spec fakeAgentSpec
+	if i <= len(s.Agents) {
+		spec = s.Agents[i-1]
+	}
+	spec.seed = s.Seed + int64(i)*7919
+	spec.OS = firstNonEmpty(spec.OS, s.OS, runtime.GOOS)
+	spec.Arch = firstNonEmpty(spec.Arch, s.Arch, runtime.GOARCH)
+	spec.Hostname = firstNonEmpty(spec.Hostname, fmt.Sprintf("LABSCAN-FAKE-%03d", i))
+	spec.IPv6 = firstNonEmpty(spec.IPv6, fmt.Sprintf("fd00:1ab5::%x", 100+i))
+	spec.MAC = firstNonEmpty(spec.MAC, fakeMACForIndex(i))
+	spec.Interface = firstNonEmpty(spec.Interface, "ethernet")
+	spec.simulated = spec.Subnet != "" || s.Subnet != ""
+	if _, err := net.ParseMAC(spec.MAC); err != nil {
+		return spec, fmt.Errorf("mac: %w", err)
+	}
+
+	cidr := firstNonEmpty(spec.Subnet, s.Subnet, "192.168.1.0/24")
+	if !spec.simulated && spec.IP != "" {
+		cidr = spec.IP + "/24"
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil || subnet.IP.To4() == nil {
+		return spec, fmt.Errorf("subnet must be an IPv4 CIDR")
+	}
+	spec.Subnet = subnet.String()
+	if spec.IP == "" {
+		spec.IP = subnetHost(subnet, 100+i).String()
+	}
+	if spec.Gateway == "" && spec.Subnet == s.Subnet {
+		spec.Gateway = s.Gateway
+	}
+	if spec.Gateway == "" {
+		spec.Gateway = subnetHost(subnet, 1).String()
+	}
+	for name, value := range map[string]string{"ip": spec.IP, "gateway": spec.Gateway} {
+		if ip := net.ParseIP(value); ip == nil || !subnet.Contains(ip) {
+			return spec, fmt.Errorf("%s %s is not in subnet %s", name, value, spec.Subnet)
+		}
+	}
+	if net.ParseIP(spec.IPv6) == nil {
+		return spec, fmt.Errorf("ipv6 %q is not an address", spec.IPv6)
+	}
+
+	responses := make(map[string]fakeResponse, len(s.Responses)+len(spec.Responses))
+	for kind, response := range s.Responses {
+		responses[kind] = response
+	}
+	for kind, response := range spec.Responses {
+		responses[kind] = response
+	}
+	spec.Responses = responses
+	tags := make(map[string]string, len(s.Tags)+len(spec.Tags))
+	for key, value := range s.Tags {
+		tags[key] = value
+	}
+	for key, value := range spec.Tags {
+		tags[key] = value
+	}
+	if err := validateTags(tags); err != nil {
+		return spec, err
+	}
+	spec.Tags = tags
+	if spec.Faults == nil {
+		spec.Faults = s.Faults
+	}
+	if err := spec.Faults.validate(); err != nil {
+		return spec, err
+	}
+	return spec, nil
+}
+
+// profile turns a filled-in spec into the identity fake mode registers.
+func (spec fakeAgentSpec) profile(identity *AgentIdentity) AgentProfile {
+	profile := AgentProfile{
+		AgentID:     identity.AgentID,
+		Fingerprint: identity.Fingerprint,
+		Hostname:    spec.Hostname,
+		IPs:         []string{spec.IP},
+		IPv6:        []string{spec.IPv6},
+		MACs:        []string{normalizeMAC(spec.MAC)},
+		Interfaces:  fakeInterfaces(spec),
+		OS:          spec.OS,
+		Arch:        spec.Arch,
+		StartedAt:   nowMS(),
+		IsFake:      true,
+		Seed:        spec.seed,
+		Responses:   spec.Responses,
+		Faults:      spec.Faults,
+		Tags:        spec.Tags,
+	}
+	if spec.simulated {
+		profile.Network = &NetworkFacts{
+			IP:               spec.IP,
+			SubnetCIDR:       spec.Subnet,
+			DefaultGatewayIP: spec.Gateway,
+			InterfaceType:    spec.Interface,
+			MAC:              normalizeMAC(spec.MAC),
+		}
+	}
+	return profile
+}
+
+func subnetHost(subnet *net.IPNet, n int) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+uint32(n))
+	return ip
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const schedulesPath = "agent_schedules.json"
+
+// scheduleMaxWait bounds how long the scheduler sleeps so wall-clock jumps
+// (suspend, NTP corrections) are noticed within a minute.
+const scheduleMaxWait = time.Minute
+
+type ScheduleSpec struct {
+	ScheduleID string                 `json:"schedule_id"`
+	Cron       string                 `json:"cron"`
+	Kind       string                 `json:"kind"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	DeadlineMS int64                  `json:"deadline_ms,omitempty"`
+	Priority   string                 `json:"priority,omitempty"`
+	CreatedAt  int64                  `json:"created_at"`
+	LastRunAt  int64                  `json:"last_run_at,omitempty"`
+	NextRunAt  int64                  `json:"next_run_at,omitempty"`
+}
+
+type scheduleEntry struct {
+	spec ScheduleSpec
+	cron *cronSpec
+	next time.Time
+}
+
+// scheduleStore holds the admin-installed recurring tasks. Schedules are
+// persisted to path (in-memory only when path is empty) and fire only while
+// run is active, i.e. while the agent is connected.
+type scheduleStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*scheduleEntry
+	changed chan struct{}
+}
+
+func loadScheduleStore(path string) *scheduleStore {
+	store := &scheduleStore{path: path, entries: make(map[string]*scheduleEntry), changed: make(chan struct{}, 1)}
+	if path == "" {
+		return store
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read schedules", "err", err)
+		}
+		return store
+	}
+	var specs []ScheduleSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		slog.Warn("failed to parse schedules", "err", err)
+		return store
+	}
+	now := time.Now()
+	for _, spec := range specs {
+		cron, err := parseCron(spec.Cron)
+		if err != nil {
+			slog.Warn("dropping schedule", "schedule_id", spec.ScheduleID, "err", err)
+			continue
+		}
+		store.entries[spec.ScheduleID] = &scheduleEntry{spec: spec, cron: cron, next: cron.next(now)}
+	}
+	return store
+}
+
+// manage implements the "schedule" task kind: action "add", "remove" or
+// "list".
+func (s *scheduleStore) manage(params map[string]interface{}) (interface{}, error) {
+	switch action := asString(params["action"], "list"); action {
+	case "add":
+		spec, err := s.add(params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"schedule": spec}, nil
+	case "remove":
+		id := asString(params["schedule_id"], "")
+		if id == "" {
+			return nil, errors.New("schedule remove requires schedule_id")
+		}
+		removed, err := s.remove(id)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"schedule_id": id, "removed": removed}, nil
+	case "list":
+		schedules := s.list()
+		return map[string]interface{}{"schedules": schedules, "count": len(schedules)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported schedule action %q", action)
+	}
+}
+
+func (s *scheduleStore) add(params map[string]interface{}) (ScheduleSpec, error) {
+	kind := asString(params["kind"], "")
+	if kind == "" {
+		return ScheduleSpec{}, errors.New("schedule add requires kind")
+	}
+	if kind == "schedule" {
+		return ScheduleSpec{}, errors.New("schedules cannot install schedules")
+	}
+	expr := asString(params["cron"], "")
+	cron, err := parseCron(expr)
+	if err != nil {
+		return ScheduleSpec{}, err
+	}
+	next := cron.next(time.Now())
+	if next.IsZero() {
+		return ScheduleSpec{}, fmt.Errorf("cron %q never fires", expr)
+	}
+	inner, _ := params["params"].(map[string]interface{})
+	spec := ScheduleSpec{
+		ScheduleID: asString(params["schedule_id"], uuid.NewString()),
+		Cron:       expr,
+		Kind:       kind,
+		Params:     inner,
+		DeadlineMS: int64(asInt(params["deadline_ms"], 0)),
+		Priority:   asString(params["priority"], "low"),
+		CreatedAt:  nowMS(),
+	}
+	entry := &scheduleEntry{spec: spec, cron: cron, next: next}
+
+	s.mu.Lock()
+	s.entries[spec.ScheduleID] = entry
+	err = s.saveLocked()
+	spec.NextRunAt = entry.next.UnixMilli()
+	s.mu.Unlock()
+	s.notify()
+	return spec, err
+}
+
+func (s *scheduleStore) remove(id string) (bool, error) {
+	s.mu.Lock()
+	_, ok := s.entries[id]
+	delete(s.entries, id)
+	var err error
+	if ok {
+		err = s.saveLocked()
+	}
+	s.mu.Unlock()
+	s.notify()
+	return ok, err
+}
+
+func (s *scheduleStore) list() []ScheduleSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	specs := make([]ScheduleSpec, 0, len(s.entries))
+	for _, entry := range s.entries {
+		spec := entry.spec
+		if !entry.next.IsZero() {
+			spec.NextRunAt = entry.next.UnixMilli()
+		}
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ScheduleID < specs[j].ScheduleID })
+	return specs
+}
+
+// due returns the schedules whose activation time has passed, advancing
+// them, and how long to wait for the next one.
+func (s *scheduleStore) due(now time.Time) ([]ScheduleSpec, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait := scheduleMaxWait
+	var fired []ScheduleSpec
+	for _, entry := range s.entries {
+		if entry.next.IsZero() {
+			continue
+		}
+		if !entry.next.After(now) {
+			entry.spec.LastRunAt = now.UnixMilli()
+			fired = append(fired, entry.spec)
+			entry.next = entry.cron.next(now)
+		}
+		if until := entry.next.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if len(fired) > 0 {
+		if err := s.saveLocked(); err != nil {
+			slog.Warn("failed to save schedules", "err", err)
+		}
+	}
+	return fired, wait
+}
+
+// run fires due schedules until ctx is done. Activations missed while the
+// agent was disconnected are skipped rather than replayed.
+func (s *scheduleStore) run(ctx context.Context, fire func(ScheduleSpec, time.Time)) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, entry := range s.entries {
+		entry.next = entry.cron.next(now)
+	}
+	s.mu.Unlock()
+
+	for {
+		now := time.Now()
+		fired, wait := s.due(now)
+		for _, spec := range fired {
+			fire(spec, now)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *scheduleStore) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduleStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	specs := make([]ScheduleSpec, 0, len(s.entries))
+	for _, entry := range s.entries {
+		specs = append(specs, entry.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ScheduleID < specs[j].ScheduleID })
+	data, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0o644)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	secretStoreFile      = "file"
+	secretStoreEncrypted = "encrypted"
+	secretStoreKeyring   = "keyring"
+
+	keyringService = "labscan-agent"
+)
+
+var secretStoreMode = secretStoreFile
+
+// sealSecret returns the copy of cfg that is written to disk: depending on
+// the store, the secret and the TLS client key are left in place, AES-GCM
+// encrypted with a key kept next to the config, or handed to the OS
+// credential store.
+func sealSecret(cfg PersistedConfig, mode string) (PersistedConfig, error) {
+	cfg.SecretStore, cfg.SecretEnc, cfg.TLSClientKeyEnc = "", "", ""
+	switch mode {
+	case "", secretStoreFile:
+		return cfg, nil
+	case secretStoreKeyring:
+		ref, err := keyringStore(keyringAccount(), cfg.Secret)
+		keyRef := ""
+		if err == nil && cfg.TLSClientKey != "" {
+			// Base64, since keychains print multi-line values as hex.
+			keyRef, err = keyringStore(tlsKeyAccount(), base64.StdEncoding.EncodeToString([]byte(cfg.TLSClientKey)))
+		}
+		if err == nil {
+			cfg.SecretStore, cfg.SecretEnc, cfg.Secret = secretStoreKeyring, ref, ""
+			cfg.TLSClientKeyEnc, cfg.TLSClientKey = keyRef, ""
+			return cfg, nil
+		}
+		slog.Warn("OS credential store unavailable, encrypting secret instead", "err", err)
+		fallthrough
+	case secretStoreEncrypted:
+		sealed, err := encryptSecret(cfg.Secret)
+		if err != nil {
+			return cfg, err
+		}
+		keySealed := ""
+		if cfg.TLSClientKey != "" {
+			if keySealed, err = encryptSecret(cfg.TLSClientKey); err != nil {
+				return cfg, err
+			}
+		}
+		cfg.SecretStore, cfg.SecretEnc, cfg.Secret = secretStoreEncrypted, sealed, ""
+		cfg.TLSClientKeyEnc, cfg.TLSClientKey = keySealed, ""
+		return cfg, nil
+	default:
+		return cfg, fmt.Errorf("unknown secret store %q", mode)
+	}
+}
+
+// openSecret restores cfg.Secret and cfg.TLSClientKey from wherever
+// sealSecret put them.
+func openSecret(cfg *PersistedConfig) error {
+	var err error
+	switch cfg.SecretStore {
+	case "", secretStoreFile:
+		return nil
+	case secretStoreKeyring:
+		cfg.Secret, err = keyringLoad(keyringAccount(), cfg.SecretEnc)
+		if err == nil && cfg.TLSClientKeyEnc != "" {
+			var encoded string
+			if encoded, err = keyringLoad(tlsKeyAccount(), cfg.TLSClientKeyEnc); err == nil {
+				var raw []byte
+				raw, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+				cfg.TLSClientKey = string(raw)
+			}
+		}
+	case secretStoreEncrypted:
+		cfg.Secret, err = decryptSecret(cfg.SecretEnc)
+		if err == nil && cfg.TLSClientKeyEnc != "" {
+			cfg.TLSClientKey, err = decryptSecret(cfg.TLSClientKeyEnc)
+		}
+	default:
+		err = fmt.Errorf("unknown secret store %q", cfg.SecretStore)
+	}
+	return err
+}
+
+func commandError(what string, err error, out []byte) error {
+	if detail := strings.TrimSpace(string(out)); detail != "" {
+		return fmt.Errorf("%s failed: %v: %s", what, err, detail)
+	}
+	return fmt.Errorf("%s failed: %w", what, err)
+}
+
+func keyringAccount() string {
+	if abs, err := filepath.Abs(configPath); err == nil {
+		return abs
+	}
+	return configPath
+}
+
+// tlsKeyAccount names the credential store entry of the TLS client key.
+func tlsKeyAccount() string {
+	return keyringAccount() + "#tls-client-key"
+}
+
+func secretKeyPath() string {
+	return configPath + ".key"
+}
+
+func loadOrCreateSecretKey() ([]byte, error) {
+	path := secretKeyPath()
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("secret key %s has invalid length %d", path, len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encryptSecret(secret string) (string, error) {
+	key, err := loadOrCreateSecretKey()
+	if err != nil {
+		return "", err
+	}
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(keyringService))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	key, err := os.ReadFile(secretKeyPath())
+	if err != nil {
+		return "", fmt.Errorf("read secret key: %w", err)
+	}
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted secret is truncated")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyringService))
+	if err != nil {
+		return "", errors.New("encrypted secret does not match the secret key")
+	}
+	return string(plain), nil
+}
+
+func newSecretAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,59 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// On macOS the secret lives in the login/system keychain as a generic
+// password. It is written through security's interactive mode on stdin,
+// hex encoded, so it never appears in the process list; the reference kept
+// in the config is just the account.
+func keyringStore(account, secret string) (string, error) {
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n",
+		keyringService, securityQuote(account), hex.EncodeToString([]byte(secret))))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", commandError("keychain store", err, out)
+	}
+	// security -i exits 0 even when a command fails, so read it back.
+	if stored, err := keyringLoad(account, ""); err != nil || stored != secret {
+		return "", commandError("keychain store", errors.New("secret not stored"), out)
+	}
+	return account, nil
+}
+
+func keyringLoad(account, _ string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("keychain lookup failed: %w", err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// keyringDelete removes the account's entry; a missing one is not an error.
+func keyringDelete(account string) error {
+	out, err := exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", account).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound {
+		return nil
+	}
+	if err != nil {
+		return commandError("keychain delete", err, out)
+	}
+	return nil
+}
+
+// securityItemNotFound is security's exit status for errSecItemNotFound.
+const securityItemNotFound = 44
+
+// securityQuote quotes an argument for security's interactive mode.
+func securityQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,46 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Elsewhere the secret goes to the freedesktop Secret Service through
+// secret-tool (libsecret), which needs a running keyring daemon. The
+// reference kept in the config is just the account.
+func keyringStore(account, secret string) (string, error) {
+	cmd := exec.Command("secret-tool", "store", "--label=LabScan agent secret", "service", keyringService, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", commandError("secret-tool store", err, out)
+	}
+	return account, nil
+}
+
+// keyringDelete removes the account's entry. Without secret-tool there is
+// no keyring the agent could have written to.
+func keyringDelete(account string) error {
+	out, err := exec.Command("secret-tool", "clear", "service", keyringService, "account", account).CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return commandError("secret-tool clear", err, out)
+	}
+	return nil
+}
+
+func keyringLoad(account, _ string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "account", account).Output()
+	if err != nil {
+		return "", fmt.Errorf("secret-tool lookup failed: %w", err)
+	}
+	if len(out) == 0 {
+		return "", errors.New("secret not found in keyring")
+	}
+	return string(out), nil
+}
@@ -0,0 +1,55 @@
+//go:build windows
+
+package main
+
+import (
+	"encoding/base64"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// On Windows the secret is protected with DPAPI for the account the agent
+// runs as; the opaque blob is kept in the config file.
+func keyringStore(account, secret string) (string, error) {
+	name, _ := windows.UTF16PtrFromString(keyringService)
+	in := windows.DataBlob{Size: uint32(len(secret))}
+	if len(secret) > 0 {
+		in.Data = unsafe.StringData(secret)
+	}
+	entropy := dpapiEntropy(account)
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(&in, name, &entropy, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return base64.StdEncoding.EncodeToString(unsafe.Slice(out.Data, out.Size)), nil
+}
+
+func keyringLoad(account, ref string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(ref)
+	if err != nil {
+		return "", err
+	}
+	in := windows.DataBlob{Size: uint32(len(blob))}
+	if len(blob) > 0 {
+		in.Data = &blob[0]
+	}
+	entropy := dpapiEntropy(account)
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(&in, nil, &entropy, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return string(unsafe.Slice(out.Data, out.Size)), nil
+}
+
+// keyringDelete has nothing to remove: the DPAPI blob lives in the config,
+// which the caller deletes.
+func keyringDelete(string) error {
+	return nil
+}
+
+func dpapiEntropy(account string) windows.DataBlob {
+	return windows.DataBlob{Size: uint32(len(account)), Data: unsafe.StringData(account)}
+}
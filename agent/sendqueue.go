@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type messageClass int
+
+const (
+	classControl messageClass = iota
+	classTaskResult
+	classHeartbeat
+	classBulk
+	messageClassCount
+)
+
+const writeTimeout = 10 * time.Second
+
+var errSendQueueClosed = errors.New("send queue closed")
+
+type outboundMessage struct {
+	frame int
+	raw   []byte
+	done  chan error
+}
+
+type sendQueue struct {
+	ctx    context.Context
+	conn   sessionConn
+	queues [messageClassCount]chan outboundMessage
+}
+
+func newSendQueue(ctx context.Context, conn sessionConn) *sendQueue {
+	q := &sendQueue{ctx: ctx, conn: conn}
+	q.queues[classControl] = make(chan outboundMessage, 16)
+	q.queues[classTaskResult] = make(chan outboundMessage, 64)
+	q.queues[classHeartbeat] = make(chan outboundMessage, 4)
+	q.queues[classBulk] = make(chan outboundMessage, 16)
+	return q
+}
+
+func messageClassFor(messageType string) messageClass {
+	switch messageType {
+	case "task_result", "task_update":
+		return classTaskResult
+	case "heartbeat", "task_progress":
+		return classHeartbeat
+	case "task_result_chunk":
+		return classBulk
+	default:
+		return classControl
+	}
+}
+
+func (q *sendQueue) enqueue(class messageClass, frame int, raw []byte) error {
+	msg := outboundMessage{frame: frame, raw: raw, done: make(chan error, 1)}
+	select {
+	case q.queues[class] <- msg:
+	case <-q.ctx.Done():
+		return errSendQueueClosed
+	}
+
+	select {
+	case err := <-msg.done:
+		return err
+	case <-q.ctx.Done():
+		return errSendQueueClosed
+	}
+}
+
+// run is the only goroutine allowed to write to the socket. Lower classes
+// are drained only when every higher class is empty, and each class is FIFO.
+func (q *sendQueue) run() error {
+	for {
+		msg, ok := q.next()
+		if !ok {
+			return nil
+		}
+		_ = q.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := q.conn.WriteMessage(msg.frame, msg.raw)
+		msg.done <- err
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (q *sendQueue) next() (outboundMessage, bool) {
+	for _, ch := range q.queues {
+		select {
+		case msg := <-ch:
+			return msg, true
+		default:
+		}
+	}
+
+	select {
+	case <-q.ctx.Done():
+		return outboundMessage{}, false
+	case msg := <-q.queues[classControl]:
+		return msg, true
+	case msg := <-q.queues[classTaskResult]:
+		return msg, true
+	case msg := <-q.queues[classHeartbeat]:
+		return msg, true
+	case msg := <-q.queues[classBulk]:
+		return msg, true
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const serviceName = "labscan-agent"
+
+type serviceSpec struct {
+	Name    string
+	Exe     string
+	WorkDir string
+	Args    []string
+}
+
+// runServiceCommand implements `labscan-agent install|uninstall`. Everything
+// after `--` is passed to the agent when the service starts, e.g.
+// `labscan-agent install -- -tls -deny-kinds pcap_capture`.
+func runServiceCommand(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	name := fs.String("name", serviceName, "Service name")
+	workDir := fs.String("workdir", defaultServiceWorkDir(), "Working directory for config, state, and logs")
+	_ = fs.Parse(args)
+
+	spec := serviceSpec{Name: *name, WorkDir: *workDir, Args: fs.Args()}
+	var err error
+	switch command {
+	case "install":
+		if spec.Exe, err = os.Executable(); err == nil {
+			spec.Exe, err = filepath.EvalSymlinks(spec.Exe)
+		}
+		if err == nil {
+			err = os.MkdirAll(spec.WorkDir, 0o700)
+		}
+		if err == nil {
+			spec.Args = append([]string{"-workdir", spec.WorkDir}, spec.Args...)
+			err = installService(spec)
+		}
+	case "uninstall":
+		err = uninstallService(spec)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", command, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %s done\n", spec.Name, command)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const launchdDir = "/Library/LaunchDaemons"
+
+func defaultServiceWorkDir() string {
+	return "/Library/Application Support/LabScan"
+}
+
+func installService(spec serviceSpec) error {
+	var args strings.Builder
+	for _, arg := range append([]string{spec.Exe}, spec.Args...) {
+		args.WriteString("\t\t<string>")
+		_ = xml.EscapeText(&args, []byte(arg))
+		args.WriteString("</string>\n")
+	}
+	logPath := filepath.Join("/Library/Logs", spec.Name+".log")
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>5</integer>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, launchdLabel(spec.Name), args.String(), xmlEscape(spec.WorkDir), logPath, logPath)
+
+	path := launchdPlistPath(spec.Name)
+	if err := os.WriteFile(path, []byte(plist), 0o644); err != nil {
+		return err
+	}
+	out, err := exec.Command("launchctl", "bootstrap", "system", path).CombinedOutput()
+	if err != nil {
+		return commandError("launchctl bootstrap", err, out)
+	}
+	return nil
+}
+
+func uninstallService(spec serviceSpec) error {
+	_ = exec.Command("launchctl", "bootout", "system/"+launchdLabel(spec.Name)).Run()
+	if err := os.Remove(launchdPlistPath(spec.Name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func launchdLabel(name string) string {
+	return "com.labscan." + strings.TrimPrefix(name, "labscan-")
+}
+
+func launchdPlistPath(name string) string {
+	return filepath.Join(launchdDir, launchdLabel(name)+".plist")
+}
+
+func xmlEscape(value string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+func runningAsService() bool {
+	return false
+}
+
+func runAsService(ctx context.Context, name string, run func(context.Context)) error {
+	run(ctx)
+	return nil
+}
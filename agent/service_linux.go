@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+func defaultServiceWorkDir() string {
+	return "/var/lib/labscan-agent"
+}
+
+func installService(spec serviceSpec) error {
+	unit := fmt.Sprintf(`[Unit]
+Description=LabScan agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s
+WorkingDirectory=%s
+Restart=on-failure
+RestartSec=5
+KillSignal=SIGTERM
+TimeoutStopSec=20
+StandardOutput=journal
+StandardError=journal
+SyslogIdentifier=%s
+
+[Install]
+WantedBy=multi-user.target
+`, systemdCommandLine(append([]string{spec.Exe}, spec.Args...)), spec.WorkDir, spec.Name)
+
+	if err := os.WriteFile(systemdUnitPath(spec.Name), []byte(unit), 0o644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", spec.Name+".service")
+}
+
+func uninstallService(spec serviceSpec) error {
+	_ = systemctl("disable", "--now", spec.Name+".service")
+	if err := os.Remove(systemdUnitPath(spec.Name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func systemdUnitPath(name string) string {
+	return filepath.Join(systemdUnitDir, name+".service")
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return commandError("systemctl "+strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// systemdCommandLine quotes each argument for ExecStart.
+func systemdCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.ReplaceAll(arg, `\`, `\\`)
+		arg = strings.ReplaceAll(arg, `"`, `\"`)
+		arg = strings.ReplaceAll(arg, "%", "%%")
+		quoted[i] = `"` + arg + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func runningAsService() bool {
+	return false
+}
+
+func runAsService(ctx context.Context, name string, run func(context.Context)) error {
+	run(ctx)
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+)
+
+func defaultServiceWorkDir() string {
+	return "/var/lib/labscan-agent"
+}
+
+func installService(spec serviceSpec) error {
+	return errors.New("service installation is not supported on " + runtime.GOOS)
+}
+
+func uninstallService(spec serviceSpec) error {
+	return installService(spec)
+}
+
+func runningAsService() bool {
+	return false
+}
+
+func runAsService(ctx context.Context, name string, run func(context.Context)) error {
+	run(ctx)
+	return nil
+}
@@ -0,0 +1,123 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func defaultServiceWorkDir() string {
+	base := os.Getenv("ProgramData")
+	if base == "" {
+		base = `C:\ProgramData`
+	}
+	return filepath.Join(base, "LabScan")
+}
+
+func installService(spec serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if existing, err := m.OpenService(spec.Name); err == nil {
+		existing.Close()
+		return errors.New("service already exists")
+	}
+	s, err := m.CreateService(spec.Name, spec.Exe, mgr.Config{
+		DisplayName:      "LabScan Agent",
+		Description:      "Runs network diagnostics for the LabScan admin.",
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, spec.Args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		return err
+	}
+	return s.Start()
+}
+
+func uninstallService(spec serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(spec.Name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_, _ = s.Control(svc.Stop)
+	return s.Delete()
+}
+
+func runningAsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runAsService hands control to the service manager. Services have no
+// console, so logs go only to the -log-file, or to a rotating agent.log in
+// the working directory when none is set. A stop or
+// shutdown request cancels run's context so the agent can go offline cleanly.
+func runAsService(ctx context.Context, name string, run func(context.Context)) error {
+	if logFile == nil {
+		logFile, _ = openRotatingFile("agent.log", int64(logMaxSizeMB)<<20, logKeepFiles)
+	}
+	if logFile != nil {
+		logOutput.set(logFile)
+	}
+	return svc.Run(name, &agentService{ctx: ctx, run: run})
+}
+
+type agentService struct {
+	ctx context.Context
+	run func(context.Context)
+}
+
+func (a *agentService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancelCause(a.ctx)
+	defer cancel(nil)
+	done := make(chan struct{})
+	go func() {
+		a.run(ctx)
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownGrace + 5*time.Second).Milliseconds())}
+				if req.Cmd == svc.Shutdown {
+					cancel(errors.New("system shutdown"))
+				} else {
+					cancel(errors.New("service stopped"))
+				}
+				select {
+				case <-done:
+				case <-time.After(shutdownGrace + 5*time.Second):
+				}
+				return false, 0
+			}
+		}
+	}
+}
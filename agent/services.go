@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceDetectConcurrency bounds the open ports probed at once, and
+// serviceDefaultTimeout is each probe's default timeout.
+const (
+	serviceDetectConcurrency = 16
+	serviceDefaultTimeout    = 1500 * time.Millisecond
+)
+
+// clientFirstPorts are ports whose usual services never greet, so
+// detection skips waiting for a greeting there.
+var clientFirstPorts = map[int]bool{80: true, 443: true, 445: true, 3389: true, 8080: true, 8443: true}
+
+// serviceInfo is port_scan's guess at what listens on an open port.
+// Method is banner when the service announced itself, probe when it
+// answered one of ours, and port when only the port number suggests it.
+type serviceInfo struct {
+	Port    int    `json:"port"`
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	Banner  string `json:"banner,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// wellKnownServices names the service usually found on a port, the guess
+// of last resort.
+var wellKnownServices = map[int]string{
+	21: "ftp", 22: "ssh", 23: "telnet", 25: "smtp", 53: "dns", 80: "http", 110: "pop3",
+	135: "msrpc", 139: "netbios-ssn", 143: "imap", 443: "https", 445: "smb", 587: "smtp",
+	993: "imaps", 995: "pop3s", 1433: "mssql", 3306: "mysql", 3389: "rdp", 5432: "postgresql",
+	5900: "vnc", 5985: "winrm", 6379: "redis", 8080: "http", 8443: "https", 9100: "jetdirect",
+}
+
+// bannerServices maps the start of a greeting to its service.
+var bannerServices = []struct {
+	prefix  string
+	service string
+}{
+	{"SSH-", "ssh"},
+	{"RFB ", "vnc"},
+	{"+OK", "pop3"},
+	{"* OK", "imap"},
+}
+
+// detectServices probes each open port of host concurrently and returns
+// the guesses in port order.
+func detectServices(env taskEnv, host string, ports []int, timeout time.Duration) []serviceInfo {
+	services := make([]serviceInfo, len(ports))
+	sem := make(chan struct{}, serviceDetectConcurrency)
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		if env.cancelled() {
+			services[i] = guessServiceByPort(port)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, port int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			services[i] = detectService(host, port, timeout)
+		}(i, port)
+	}
+	wg.Wait()
+	return services
+}
+
+// detectService waits for a greeting first, since SSH, FTP, SMTP, and
+// friends speak first, except on clientFirstPorts. A silent port gets the probe its number suggests:
+// SMB negotiate on 445, an RDP connection request on 3389, and otherwise a
+// TLS handshake or a plain HTTP request.
+func detectService(host string, port int, timeout time.Duration) serviceInfo {
+	if !clientFirstPorts[port] {
+		if info, ok := serviceFromGreeting(host, port, timeout); ok {
+			return info
+		}
+	}
+	switch port {
+	case 445:
+		if dialect, _, required, err := negotiateSMB(host, timeout); err == nil {
+			detail := "SMB " + dialect
+			if required {
+				detail += ", signing required"
+			}
+			return serviceInfo{Port: port, Service: "smb", Method: "probe", Detail: detail}
+		}
+	case 3389:
+		if probeRDP(host, port, timeout) {
+			return serviceInfo{Port: port, Service: "rdp", Method: "probe"}
+		}
+	}
+	if info, ok := probeTLS(host, port, timeout); ok {
+		return info
+	}
+	if server, ok := probeHTTP(host, port, timeout); ok {
+		return serviceInfo{Port: port, Service: "http", Method: "probe", Detail: server}
+	}
+	return guessServiceByPort(port)
+}
+
+func guessServiceByPort(port int) serviceInfo {
+	if service, ok := wellKnownServices[port]; ok {
+		return serviceInfo{Port: port, Service: service, Method: "port"}
+	}
+	return serviceInfo{Port: port, Service: "unknown", Method: "port"}
+}
+
+func serviceFromGreeting(host string, port int, timeout time.Duration) (serviceInfo, bool) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return serviceInfo{}, false
+	}
+	defer conn.Close()
+	banner := readBannerLine(conn, bufio.NewReaderSize(conn, maxBannerBytes), timeout)
+	if banner == "" {
+		return serviceInfo{}, false
+	}
+	info := serviceInfo{Port: port, Service: classifyBanner(banner, port), Method: "banner", Banner: banner}
+	return info, true
+}
+
+// classifyBanner names the service behind a greeting line. A 220 greeting
+// is FTP or SMTP, told apart by its text and then by the port.
+func classifyBanner(banner string, port int) string {
+	for _, known := range bannerServices {
+		if strings.HasPrefix(banner, known.prefix) {
+			return known.service
+		}
+	}
+	if strings.HasPrefix(banner, "220") {
+		upper := strings.ToUpper(banner)
+		switch {
+		case strings.Contains(upper, "FTP"):
+			return "ftp"
+		case strings.Contains(upper, "SMTP") || strings.Contains(upper, "MAIL"):
+			return "smtp"
+		case port == 21:
+			return "ftp"
+		}
+		return "smtp"
+	}
+	if service, ok := wellKnownServices[port]; ok {
+		return service
+	}
+	return "unknown"
+}
+
+// rdpConnectionRequest is an X.224 connection request carrying an RDP
+// negotiation request for TLS or CredSSP.
+var rdpConnectionRequest = []byte{
+	0x03, 0x00, 0x00, 0x13, 0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00,
+}
+
+// probeRDP reports whether the port answers an RDP connection request with
+// an X.224 connection confirm.
+func probeRDP(host string, port int, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(rdpConnectionRequest); err != nil {
+		return false
+	}
+	reply := make([]byte, 11)
+	n, _ := conn.Read(reply)
+	return n >= 6 && reply[0] == 0x03 && reply[1] == 0x00 && reply[5]&0xf0 == 0xd0
+}
+
+// probeTLS tries a TLS handshake and then an HTTP request over it. It
+// verifies nothing: the question is only what the port speaks.
+func probeTLS(host string, port int, timeout time.Duration) (serviceInfo, bool) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true, ServerName: host})
+	if err != nil {
+		return serviceInfo{}, false
+	}
+	defer conn.Close()
+	info := serviceInfo{Port: port, Service: "tls", Method: "probe", Detail: tls.VersionName(conn.ConnectionState().Version)}
+	if server, ok := httpHead(conn, host, timeout); ok {
+		info.Service = "https"
+		if server != "" {
+			info.Detail += ", " + server
+		}
+	}
+	return info, true
+}
+
+func probeHTTP(host string, port int, timeout time.Duration) (string, bool) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return "", false
+	}
+	defer conn.Close()
+	return httpHead(conn, host, timeout)
+}
+
+// httpHead sends HEAD / and reports whether the answer is HTTP, with the
+// Server header when there is one.
+func httpHead(conn net.Conn, host string, timeout time.Duration) (string, bool) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\nUser-Agent: labscan-agent/%s\r\n\r\n", host, agentVersion); err != nil {
+		return "", false
+	}
+	reader := bufio.NewReaderSize(conn, 4096)
+	status, err := reader.ReadSlice('\n')
+	if err != nil || !bytes.HasPrefix(status, []byte("HTTP/")) {
+		return "", false
+	}
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil || len(bytes.TrimSpace(line)) == 0 {
+			return "", true
+		}
+		if name, value, ok := strings.Cut(string(line), ":"); ok && strings.EqualFold(name, "server") {
+			return sanitizeBanner(value), true
+		}
+	}
+}
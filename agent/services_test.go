@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClassifyBanner(t *testing.T) {
+	tests := []struct {
+		banner string
+		port   int
+		want   string
+	}{
+		{"SSH-2.0-OpenSSH_9.6", 2222, "ssh"},
+		{"220 (vsFTPd 3.0.5)", 21, "ftp"},
+		{"220 ProFTPD Server ready.", 2121, "ftp"},
+		{"220 mail.example.com ESMTP Postfix", 25, "smtp"},
+		{"220 welcome", 21, "ftp"},
+		{"+OK Dovecot ready.", 110, "pop3"},
+		{"* OK [CAPABILITY IMAP4rev1] ready", 143, "imap"},
+		{"RFB 003.008", 5901, "vnc"},
+		{"hello", 6379, "redis"},
+		{"hello", 40000, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := classifyBanner(tt.banner, tt.port); got != tt.want {
+			t.Errorf("classifyBanner(%q, %d) = %q, want %q", tt.banner, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestDetectServices(t *testing.T) {
+	greeter, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer greeter.Close()
+	go func() {
+		for {
+			conn, err := greeter.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "SSH-2.0-OpenSSH_9.6\r\n")
+			conn.Close()
+		}
+	}()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "lab-httpd/1.0")
+	}))
+	defer web.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer secure.Close()
+
+	port := func(raw string) int {
+		u, _ := url.Parse(raw)
+		p, _ := strconv.Atoi(u.Port())
+		return p
+	}
+	ports := []int{greeter.Addr().(*net.TCPAddr).Port, port(web.URL), port(secure.URL)}
+	services := detectServices(taskEnv{}, "127.0.0.1", ports, 300*time.Millisecond)
+	want := []struct{ service, method string }{{"ssh", "banner"}, {"http", "probe"}, {"https", "probe"}}
+	for i, w := range want {
+		if services[i].Port != ports[i] || services[i].Service != w.service || services[i].Method != w.method {
+			t.Errorf("services[%d] = %+v, want %s by %s", i, services[i], w.service, w.method)
+		}
+	}
+	if services[1].Detail != "lab-httpd/1.0" {
+		t.Errorf("http detail = %q, want the Server header", services[1].Detail)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+// Ports and intervals. Like every flag, each can also be set through a
+// LABSCAN_* environment variable or the config file's "settings" object:
+// the command line wins over the environment, which wins over the file.
+var (
+	provisionUDPPort     = 8870
+	wsPort               = 8148
+	probeInterval        = 30 * time.Second
+	probeThreshold       = 2
+	probeInternet        = strings.Join(netprobe.DefaultTargets().Internet, ",")
+	probeDNSName         = netprobe.DefaultTargets().DNSName
+	probeMethod          = "auto"
+	captivePortalURL     = netprobe.DefaultTargets().PortalURL
+	probeResolvers       = strings.Join(netprobe.DefaultTargets().Resolvers, ",")
+	heartbeatMin         = 5 * time.Second
+	heartbeatMax         = 10 * time.Second
+	networkFactsInterval = 30 * time.Second
+)
+
+// settingsPinned are flags that only make sense on the command line or in
+// the environment: the config file cannot move itself or the working
+// directory it is read from.
+var settingsPinned = map[string]bool{"config": true, "workdir": true}
+
+func settingEnvName(flagName string) string {
+	return "LABSCAN_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func settingJSONName(flagName string) string {
+	return strings.ReplaceAll(flagName, "-", "_")
+}
+
+// applyEnvSettings fills every flag not given on the command line from its
+// LABSCAN_* variable (-admin-port from LABSCAN_ADMIN_PORT). It returns the
+// names of flags that are now set, so the config file layer skips them.
+func applyEnvSettings(fs *flag.FlagSet) (map[string]bool, error) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(settingEnvName(f.Name))
+		if set[f.Name] || !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: %w", settingEnvName(f.Name), setErr)
+			return
+		}
+		set[f.Name] = true
+	})
+	return set, err
+}
+
+// applyFileSettings fills the remaining flags from the "settings" object in
+// the config file, keyed by flag name with dashes as underscores. Durations
+// are strings such as "45s".
+func applyFileSettings(fs *flag.FlagSet, set map[string]bool, path string) error {
+	settings, err := readFileSettings(path)
+	if err != nil || len(settings) == 0 {
+		return err
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		raw, ok := settings[settingJSONName(f.Name)]
+		if set[f.Name] || settingsPinned[f.Name] || !ok || err != nil {
+			return
+		}
+		value := strings.TrimSpace(string(raw))
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			value = text
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: settings.%s: %w", path, settingJSONName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+func readFileSettings(path string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Settings map[string]json.RawMessage `json:"settings"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Settings, nil
+}
+
+func validateSettings() error {
+	for name, port := range map[string]int{"provision-port": provisionUDPPort, "admin-port": wsPort} {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("-%s %d out of range", name, port)
+		}
+	}
+	if probeInterval < time.Second || networkFactsInterval < time.Second {
+		return fmt.Errorf("probe and facts intervals must be at least 1s")
+	}
+	if (staticAdmin == "") != (staticSecret == "") {
+		return fmt.Errorf("-admin and -secret must be given together")
+	}
+	if mdnsInterval < 0 || (mdnsInterval > 0 && mdnsInterval < time.Second) {
+		return fmt.Errorf("-mdns-interval must be 0 or at least 1s")
+	}
+	if arpWatchInterval < 0 || (arpWatchInterval > 0 && arpWatchInterval < time.Second) {
+		return fmt.Errorf("-arp-watch-interval must be 0 or at least 1s")
+	}
+	if certWatchInterval < 0 || (certWatchInterval > 0 && certWatchInterval < time.Minute) {
+		return fmt.Errorf("-cert-watch-interval must be 0 or at least 1m")
+	}
+	if _, err := parseWarnDays(certWarnDays); err != nil {
+		return fmt.Errorf("-cert-warn-days: %w", err)
+	}
+	if _, err := newSyslogForwarder(syslogTarget, syslogFacility, syslogCAFile); err != nil {
+		return fmt.Errorf("-syslog: %w", err)
+	}
+	if _, err := newWebhookDispatcher(splitList(webhookURLs), webhookSecret); err != nil {
+		return fmt.Errorf("-webhook: %w", err)
+	}
+	if webhookOnly && webhookURLs == "" {
+		return fmt.Errorf("-webhook-only needs -webhook")
+	}
+	if _, err := newInfluxExporter(influxURL, influxToken); err != nil {
+		return fmt.Errorf("-influx: %w", err)
+	}
+	if influxInterval < time.Second {
+		return fmt.Errorf("-influx-interval must be at least 1s")
+	}
+	if _, err := newTracer(otlpEndpoint, otlpHeaders); err != nil {
+		return fmt.Errorf("-otlp-endpoint: %w", err)
+	}
+	if probeThreshold < 1 {
+		return fmt.Errorf("-probe-threshold must be at least 1")
+	}
+	if _, err := parseProbeEndpoints(splitList(probeInternet)); err != nil {
+		return fmt.Errorf("-probe-internet: %w", err)
+	}
+	if strings.TrimSpace(probeDNSName) == "" {
+		return fmt.Errorf("-probe-dns-name must not be empty")
+	}
+	for _, resolver := range splitList(probeResolvers) {
+		if resolver == netprobe.ResolverSystem || resolver == netprobe.ResolverGateway || net.ParseIP(resolver) != nil {
+			continue
+		}
+		if _, err := parseProbeEndpoints([]string{resolver}); err != nil {
+			return fmt.Errorf("-probe-resolvers %q: want system, gateway, an IP, or host:port", resolver)
+		}
+	}
+	if captivePortalURL != "" {
+		if u, err := url.Parse(captivePortalURL); err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("-captive-portal-url %q: want an http:// URL, or empty to disable", captivePortalURL)
+		}
+	}
+	switch probeMethod {
+	case "auto", netprobe.MethodICMP, netprobe.MethodTCP:
+	default:
+		return fmt.Errorf("-probe-method %q: want auto, icmp, or tcp", probeMethod)
+	}
+	if heartbeatFullEvery < 1 {
+		return fmt.Errorf("-heartbeat-full-every must be at least 1")
+	}
+	proxy, err := parseProxySetting(proxySetting)
+	if err != nil {
+		return err
+	}
+	adminProxy = proxy
+	if reconnectMin < 100*time.Millisecond || reconnectMax < reconnectMin || reconnectGiveUp < 0 {
+		return fmt.Errorf("reconnect backoff %s-%s invalid", reconnectMin, reconnectMax)
+	}
+	if pingInterval > 0 && pongWait <= pingInterval {
+		return fmt.Errorf("-ws-pong-wait %s must be longer than -ws-ping-interval %s", pongWait, pingInterval)
+	}
+	if heartbeatMin < time.Second || heartbeatMax < heartbeatMin {
+		return fmt.Errorf("heartbeat range %s-%s invalid", heartbeatMin, heartbeatMax)
+	}
+	return nil
+}
+
+// heartbeatJitter picks the wait before the next heartbeat, spread across
+// the configured range so many agents do not report in lockstep.
+func heartbeatJitter() time.Duration {
+	return heartbeatMin + time.Duration(rand.Int63n(int64(heartbeatMax-heartbeatMin)+1))
+}
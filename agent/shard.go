@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+type shardInfo struct {
+	Strategy string `json:"strategy"`
+	Index    int    `json:"index"`
+	Count    int    `json:"count"`
+	Assigned int    `json:"assigned"`
+	Total    int    `json:"total"`
+}
+
+// shardTargets narrows a target list to this agent's share when the task
+// carries a "shard" param. The admin can either pin an explicit slot
+// ({"index": i, "count": n}) or list the agents sharing the range
+// ({"peers": [agent_id, ...]}), in which case each target goes to the peer
+// with the highest rendezvous hash so every agent computes the same split.
+func shardTargets(env taskEnv, params map[string]interface{}, targets []string) ([]string, *shardInfo, error) {
+	spec, ok := params["shard"].(map[string]interface{})
+	if !ok {
+		return targets, nil, nil
+	}
+
+	if peersRaw, ok := spec["peers"].([]interface{}); ok && len(peersRaw) > 0 {
+		peers := make([]string, 0, len(peersRaw))
+		for _, raw := range peersRaw {
+			if peer, ok := raw.(string); ok && peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		sort.Strings(peers)
+		index := sort.SearchStrings(peers, env.AgentID)
+		if index >= len(peers) || peers[index] != env.AgentID {
+			return nil, nil, fmt.Errorf("agent %s is not listed in shard peers", env.AgentID)
+		}
+
+		assigned := make([]string, 0, len(targets)/len(peers)+1)
+		for _, target := range targets {
+			if rendezvousOwner(peers, target) == env.AgentID {
+				assigned = append(assigned, target)
+			}
+		}
+		return assigned, &shardInfo{Strategy: "rendezvous", Index: index, Count: len(peers), Assigned: len(assigned), Total: len(targets)}, nil
+	}
+
+	count := asInt(spec["count"], 0)
+	index := asInt(spec["index"], -1)
+	if count < 1 || index < 0 || index >= count {
+		return nil, nil, fmt.Errorf("invalid shard spec: index=%d count=%d", index, count)
+	}
+	assigned := make([]string, 0, len(targets)/count+1)
+	for _, target := range targets {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(target))
+		if int(h.Sum32()%uint32(count)) == index {
+			assigned = append(assigned, target)
+		}
+	}
+	return assigned, &shardInfo{Strategy: "index", Index: index, Count: count, Assigned: len(assigned), Total: len(targets)}, nil
+}
+
+func rendezvousOwner(peers []string, target string) string {
+	owner := ""
+	var best uint64
+	for _, peer := range peers {
+		sum := sha256.Sum256([]byte(peer + "|" + target))
+		weight := binary.BigEndian.Uint64(sum[:8])
+		if owner == "" || weight > best {
+			owner = peer
+			best = weight
+		}
+	}
+	return owner
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownGrace bounds how long a stopping agent waits for cancelled tasks to
+// report and for the admin to acknowledge the close.
+const shutdownGrace = 5 * time.Second
+
+type GoingOfflinePayload struct {
+	Reason string `json:"reason"`
+}
+
+// shutdownContext is cancelled on the first SIGINT or SIGTERM, with the signal
+// as its cause. A second signal kills the process the default way.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		slog.Info("shutting down", "signal", sig.String())
+		cancel(fmt.Errorf("received %v", sig))
+	}()
+	return ctx
+}
+
+func shutdownReason(ctx context.Context) string {
+	cause := context.Cause(ctx)
+	if cause == nil || errors.Is(cause, context.Canceled) {
+		return "agent stopping"
+	}
+	return cause.Error()
+}
+
+// goOffline cancels queued and running tasks, tells the admin the agent is
+// going away, and closes the websocket with a normal close frame, or ends
+// a broker session: MQTT with DISCONNECT, NATS by publishing offline on the
+// status subject. errCh is the session's readLoop result, which arrives
+// once the admin echoes the close.
+func (c *AgentClient) goOffline(conn sessionConn, errCh <-chan error, reason string) {
+	c.logger().Info("going offline", "reason", reason)
+	c.syslogLifecycle("going_offline", "", reason)
+	deadline := time.Now().Add(shutdownGrace)
+
+	for _, task := range c.pool.drain() {
+		errText := "task cancelled: agent shutting down"
+		c.finishTask(task, TaskResultPayload{TaskID: task.TaskID, ScheduleID: task.ScheduleID, GroupID: task.GroupID, OK: false, Status: taskStatusCancelled, Error: &errText})
+	}
+	c.tasks.cancelAll()
+	for !c.pool.idle() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := c.send("going_offline", GoingOfflinePayload{Reason: reason}); err != nil {
+		c.logger().Warn("going_offline not delivered", "err", err)
+	}
+	if ws, ok := conn.(*websocket.Conn); ok {
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "going offline")
+		if err := ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeTimeout)); err != nil {
+			return
+		}
+	} else {
+		// An MQTT session ends with DISCONNECT and a NATS one with offline
+		// on its status subject; there is no close to echo.
+		_ = conn.Close()
+	}
+	select {
+	case <-errCh:
+	case <-time.After(max(time.Until(deadline), time.Second)):
+	}
+}
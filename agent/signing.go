@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	noncesPath = "agent_nonces.json"
+	// signedClockSkew is how far the admin's clock may be off when judging
+	// issued_at and expires_at.
+	signedClockSkew = 2 * time.Minute
+	// maxSignedLifetime caps expires_at - issued_at, which bounds how long
+	// a nonce has to be remembered.
+	maxSignedLifetime = 24 * time.Hour
+	maxNonces         = 65536
+)
+
+var (
+	errTaskSignature  = errors.New("task signature verification failed")
+	errSignedExpired  = errors.New("signed message is expired or not yet valid")
+	errSignedReplayed = errors.New("signed message was already received")
+	errTooManyNonces  = errors.New("too many unexpired signed messages")
+	errSignedLifetime = fmt.Errorf("signed message lifetime exceeds %s", maxSignedLifetime)
+)
+
+func parseAdminPublicKey(encoded string) (ed25519.PublicKey, error) {
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid admin public key length %d", len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// signedMessage is the part of a control message the admin key signs. The
+// message type and agent ID keep a signed payload from being replayed as
+// another type or against another agent; the validity window and nonce
+// keep it from being replayed at all.
+type signedMessage struct {
+	Type      string
+	AgentID   string
+	IssuedAt  int64
+	ExpiresAt int64
+	Nonce     string
+	Payload   []byte
+}
+
+// signingString is "type|agent_id|issued_at|expires_at|nonce|payload", with
+// the times in Unix milliseconds.
+func (m signedMessage) signingString() []byte {
+	prefix := m.Type + "|" + m.AgentID + "|" + strconv.FormatInt(m.IssuedAt, 10) + "|" + strconv.FormatInt(m.ExpiresAt, 10) + "|" + m.Nonce + "|"
+	return append([]byte(prefix), m.Payload...)
+}
+
+// verifySignedMessage checks the signature, the validity window, and that
+// the nonce is new, and then records the nonce. Without a key nothing is
+// checked.
+func verifySignedMessage(key ed25519.PublicKey, message signedMessage, signature string, now time.Time, nonces *nonceStore) error {
+	if key == nil {
+		return nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(sig) != ed25519.SignatureSize || message.Nonce == "" {
+		return errTaskSignature
+	}
+	if !ed25519.Verify(key, message.signingString(), sig) {
+		return errTaskSignature
+	}
+	issued, expires := time.UnixMilli(message.IssuedAt), time.UnixMilli(message.ExpiresAt)
+	if message.IssuedAt <= 0 || expires.Before(issued) || issued.After(now.Add(signedClockSkew)) || now.After(expires.Add(signedClockSkew)) {
+		return errSignedExpired
+	}
+	if expires.Sub(issued) > maxSignedLifetime {
+		return errSignedLifetime
+	}
+	return nonces.use(message.Nonce, message.ExpiresAt, now)
+}
+
+// adminMessage is a message from the admin as the read loop decodes it.
+type adminMessage struct {
+	Type      string          `json:"type"`
+	Encoding  string          `json:"encoding,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"sig,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	IssuedAt  int64           `json:"issued_at,omitempty"`
+	ExpiresAt int64           `json:"expires_at,omitempty"`
+	Nonce     string          `json:"nonce,omitempty"`
+}
+
+// verifySigned checks a control message against the admin key the agent
+// was provisioned with.
+func (c *AgentClient) verifySigned(message adminMessage) error {
+	signed := signedMessage{
+		Type:      message.Type,
+		AgentID:   c.profile.AgentID,
+		IssuedAt:  message.IssuedAt,
+		ExpiresAt: message.ExpiresAt,
+		Nonce:     message.Nonce,
+		Payload:   message.Payload,
+	}
+	return verifySignedMessage(c.taskKey, signed, message.Signature, time.Now(), c.nonces)
+}
+
+// nonceStore remembers the nonces of signed messages until they expire,
+// persisted so a restart does not reopen the replay window.
+type nonceStore struct {
+	mu   sync.Mutex
+	path string
+	seen map[string]int64
+}
+
+// loadNonceStore reads path; an empty path keeps the nonces in memory.
+func loadNonceStore(path string) *nonceStore {
+	s := &nonceStore{path: path, seen: make(map[string]int64)}
+	if path == "" {
+		return s
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(data, &s.seen)
+	}
+	return s
+}
+
+// use records nonce, which is valid until expiresAt, or reports that it
+// was seen before. A nonce that cannot be persisted is refused.
+func (s *nonceStore) use(nonce string, expiresAt int64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]int64)
+	}
+	if _, ok := s.seen[nonce]; ok {
+		return errSignedReplayed
+	}
+	cutoff := now.Add(-signedClockSkew).UnixMilli()
+	for seen, expires := range s.seen {
+		if expires < cutoff {
+			delete(s.seen, seen)
+		}
+	}
+	if len(s.seen) >= maxNonces {
+		return errTooManyNonces
+	}
+	s.seen[nonce] = expiresAt
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.seen)
+	if err == nil {
+		err = writeFileAtomic(s.path, data, 0o600)
+	}
+	if err != nil {
+		delete(s.seen, nonce)
+		return fmt.Errorf("cannot persist nonce: %w", err)
+	}
+	return nil
+}
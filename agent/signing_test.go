@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signForTest(key ed25519.PrivateKey, message signedMessage) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message.signingString()))
+}
+
+func TestVerifySignedMessage(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	now := time.UnixMilli(1_700_000_000_000)
+	valid := signedMessage{
+		Type:      "task",
+		AgentID:   "agent-1",
+		IssuedAt:  now.UnixMilli(),
+		ExpiresAt: now.Add(10 * time.Minute).UnixMilli(),
+		Nonce:     "n1",
+		Payload:   []byte(`{"task_id":"t1","kind":"ping"}`),
+	}
+
+	tests := []struct {
+		name     string
+		signed   signedMessage
+		received func(signedMessage) signedMessage
+		key      ed25519.PrivateKey
+		now      time.Time
+		want     error
+	}{
+		{name: "valid", signed: valid, now: now},
+		{name: "clock skew tolerated", signed: valid, now: now.Add(-time.Minute)},
+		{name: "task replayed as policy", signed: valid, now: now, want: errTaskSignature,
+			received: func(m signedMessage) signedMessage { m.Type = "policy"; return m }},
+		{name: "other agent", signed: valid, now: now, want: errTaskSignature,
+			received: func(m signedMessage) signedMessage { m.AgentID = "agent-2"; return m }},
+		{name: "extended expiry", signed: valid, now: now, want: errTaskSignature,
+			received: func(m signedMessage) signedMessage { m.ExpiresAt += int64(time.Hour / time.Millisecond); return m }},
+		{name: "swapped nonce", signed: valid, now: now, want: errTaskSignature,
+			received: func(m signedMessage) signedMessage { m.Nonce = "n2"; return m }},
+		{name: "tampered payload", signed: valid, now: now, want: errTaskSignature,
+			received: func(m signedMessage) signedMessage { m.Payload = []byte(`{"task_id":"t1","kind":"wol"}`); return m }},
+		{name: "wrong key", signed: valid, key: otherKey, now: now, want: errTaskSignature},
+		{name: "expired", signed: valid, now: now.Add(15 * time.Minute), want: errSignedExpired},
+		{name: "not yet valid", signed: valid, now: now.Add(-5 * time.Minute), want: errSignedExpired},
+		{name: "no issued_at", signed: func() signedMessage { m := valid; m.IssuedAt = 0; return m }(), now: now, want: errSignedExpired},
+		{name: "expires before issued", signed: func() signedMessage { m := valid; m.ExpiresAt = m.IssuedAt - 1; return m }(), now: now, want: errSignedExpired},
+		{name: "lifetime too long", signed: func() signedMessage { m := valid; m.ExpiresAt = now.Add(48 * time.Hour).UnixMilli(); return m }(), now: now, want: errSignedLifetime},
+		{name: "no nonce", signed: func() signedMessage { m := valid; m.Nonce = ""; return m }(), now: now, want: errTaskSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := private
+			if tt.key != nil {
+				key = tt.key
+			}
+			signature := signForTest(key, tt.signed)
+			received := tt.signed
+			if tt.received != nil {
+				received = tt.received(received)
+			}
+			err := verifySignedMessage(public, received, signature, tt.now, loadNonceStore(""))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("verifySignedMessage() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignedMessageWithoutKey(t *testing.T) {
+	if err := verifySignedMessage(nil, signedMessage{Type: "task"}, "", time.Now(), loadNonceStore("")); err != nil {
+		t.Fatalf("unsigned agent rejected message: %v", err)
+	}
+}
+
+func TestSignedMessageReplay(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	message := signedMessage{
+		Type:      "task",
+		AgentID:   "agent-1",
+		IssuedAt:  now.UnixMilli(),
+		ExpiresAt: now.Add(time.Minute).UnixMilli(),
+		Nonce:     "once",
+		Payload:   []byte(`{}`),
+	}
+	signature := signForTest(private, message)
+	path := filepath.Join(t.TempDir(), "nonces.json")
+
+	nonces := loadNonceStore(path)
+	if err := verifySignedMessage(public, message, signature, now, nonces); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	if err := verifySignedMessage(public, message, signature, now, nonces); !errors.Is(err, errSignedReplayed) {
+		t.Fatalf("replay = %v, want %v", err, errSignedReplayed)
+	}
+	// A restarted agent reads the nonces back.
+	if err := verifySignedMessage(public, message, signature, now, loadNonceStore(path)); !errors.Is(err, errSignedReplayed) {
+		t.Fatalf("replay after restart = %v, want %v", err, errSignedReplayed)
+	}
+}
+
+func TestNonceStorePrunesExpired(t *testing.T) {
+	nonces := loadNonceStore("")
+	now := time.Now()
+	if err := nonces.use("old", now.UnixMilli(), now); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(signedClockSkew + time.Minute)
+	if err := nonces.use("new", later.Add(time.Minute).UnixMilli(), later); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nonces.seen["old"]; ok {
+		t.Fatal("expired nonce was kept")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+type smbHostInfo struct {
+	IP              string   `json:"ip"`
+	NetBIOSName     string   `json:"netbios_name,omitempty"`
+	Workgroup       string   `json:"workgroup,omitempty"`
+	MAC             string   `json:"mac,omitempty"`
+	Names           []string `json:"names,omitempty"`
+	SMBDialect      string   `json:"smb_dialect,omitempty"`
+	SigningEnabled  *bool    `json:"signing_enabled,omitempty"`
+	SigningRequired *bool    `json:"signing_required,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+type netbiosName struct {
+	name   string
+	suffix byte
+	group  bool
+}
+
+var smb2Dialects = map[uint16]string{
+	0x0202: "2.0.2",
+	0x0210: "2.1",
+	0x0300: "3.0",
+	0x0302: "3.0.2",
+	0x0311: "3.1.1",
+}
+
+func runSMBEnum(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	targets, shard, err := taskTargets(env, params)
+	if err != nil {
+		return nil, err
+	}
+	targets, excluded := env.Exclude.filterHosts(targets)
+	timeout := time.Duration(asInt(params["timeout_ms"], 1500)) * time.Millisecond
+
+	env.Progress.setTotal(len(targets))
+	hosts := make([]smbHostInfo, 0)
+	var mu sync.Mutex
+	sem := make(chan struct{}, 32)
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		if env.cancelled() {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			info, ok := enumerateSMBHost(ip, timeout)
+			env.Progress.step(ip)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			hosts = append(hosts, info)
+			mu.Unlock()
+		}(target)
+	}
+	wg.Wait()
+
+	sort.Slice(hosts, func(i, j int) bool { return ipLess(hosts[i].IP, hosts[j].IP) })
+	result := map[string]interface{}{"hosts": hosts, "count": len(hosts), "scanned": len(targets)}
+	if shard != nil {
+		result["shard"] = shard
+	}
+	if excluded > 0 {
+		result["excluded"] = excluded
+	}
+	return result, nil
+}
+
+// taskTargets resolves the target set of multi-host tasks from "cidr",
+// "targets" or "target" and applies any shard hint.
+func taskTargets(env taskEnv, params map[string]interface{}) ([]string, *shardInfo, error) {
+	targets := make([]string, 0)
+	if cidr := asString(params["cidr"], ""); cidr != "" {
+		ips, err := expandCIDR(cidr, maxSweepAddresses)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, ips...)
+	}
+	if list, ok := params["targets"].([]interface{}); ok {
+		for _, raw := range list {
+			if target, ok := raw.(string); ok && strings.TrimSpace(target) != "" {
+				targets = append(targets, strings.TrimSpace(target))
+			}
+		}
+	}
+	if target := asString(params["target"], ""); target != "" {
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, nil, errors.New("task requires cidr, targets or target")
+	}
+	return shardTargets(env, params, targets)
+}
+
+func enumerateSMBHost(ip string, timeout time.Duration) (smbHostInfo, bool) {
+	info := smbHostInfo{IP: ip}
+	found := false
+
+	names, mac, err := queryNetBIOSNodeStatus(ip, timeout)
+	if err == nil {
+		found = true
+		info.MAC = mac
+		for _, n := range names {
+			kind := "unique"
+			if n.group {
+				kind = "group"
+			}
+			info.Names = append(info.Names, fmt.Sprintf("%s<%02X> %s", n.name, n.suffix, kind))
+			if n.suffix == 0x00 && !n.group && info.NetBIOSName == "" {
+				info.NetBIOSName = n.name
+			}
+			if n.suffix == 0x00 && n.group && info.Workgroup == "" {
+				info.Workgroup = n.name
+			}
+		}
+	} else if !isTimeout(err) && !netprobe.IsConnectionRefused(err) {
+		info.Errors = append(info.Errors, "netbios: "+err.Error())
+	}
+
+	dialect, enabled, required, err := negotiateSMB(ip, timeout)
+	if err == nil {
+		found = true
+		info.SMBDialect = dialect
+		info.SigningEnabled = &enabled
+		info.SigningRequired = &required
+	} else if !isTimeout(err) && !netprobe.IsConnectionRefused(err) {
+		info.Errors = append(info.Errors, "smb: "+err.Error())
+	}
+	return info, found
+}
+
+func queryNetBIOSNodeStatus(ip string, timeout time.Duration) ([]netbiosName, string, error) {
+	conn, err := net.DialTimeout("udp4", net.JoinHostPort(ip, "137"), timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	txID := make([]byte, 2)
+	_, _ = rand.Read(txID)
+	query := make([]byte, 0, 50)
+	query = append(query, txID...)
+	query = append(query, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	query = append(query, 0x20)
+	wildcard := append([]byte{'*'}, make([]byte, 15)...)
+	for _, b := range wildcard {
+		query = append(query, 'A'+(b>>4), 'A'+(b&0x0F))
+	}
+	query = append(query, 0x00, 0x00, 0x21, 0x00, 0x01)
+	if _, err := conn.Write(query); err != nil {
+		return nil, "", err
+	}
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, "", err
+	}
+	return parseNodeStatus(buf[:n], txID)
+}
+
+func parseNodeStatus(resp []byte, txID []byte) ([]netbiosName, string, error) {
+	if len(resp) < 12 || resp[0] != txID[0] || resp[1] != txID[1] {
+		return nil, "", errors.New("invalid node status response")
+	}
+	offset := 12
+	for offset < len(resp) {
+		if resp[offset]&0xC0 == 0xC0 {
+			offset += 2
+			break
+		}
+		if resp[offset] == 0 {
+			offset++
+			break
+		}
+		offset += int(resp[offset]) + 1
+	}
+	offset += 10
+	if offset >= len(resp) {
+		return nil, "", errors.New("truncated node status response")
+	}
+	count := int(resp[offset])
+	offset++
+
+	names := make([]netbiosName, 0, count)
+	for i := 0; i < count && offset+18 <= len(resp); i++ {
+		entry := resp[offset : offset+18]
+		flags := binary.BigEndian.Uint16(entry[16:18])
+		names = append(names, netbiosName{
+			name:   strings.TrimRight(string(entry[:15]), " \x00"),
+			suffix: entry[15],
+			group:  flags&0x8000 != 0,
+		})
+		offset += 18
+	}
+
+	mac := ""
+	if offset+6 <= len(resp) {
+		hw := net.HardwareAddr(resp[offset : offset+6])
+		if hw.String() != "00:00:00:00:00:00" {
+			mac = hw.String()
+		}
+	}
+	return names, mac, nil
+}
+
+func negotiateSMB(ip string, timeout time.Duration) (string, bool, bool, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, "445"), timeout)
+	if err != nil {
+		return "", false, false, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(buildSMB2Negotiate()); err != nil {
+		return "", false, false, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", false, false, err
+	}
+	size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	if size < 4 || size > 65536 {
+		return "", false, false, fmt.Errorf("invalid smb response length %d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return "", false, false, err
+	}
+
+	if resp[0] == 0xFF && string(resp[1:4]) == "SMB" {
+		return "1.0", false, false, nil
+	}
+	if len(resp) < 64+6 || resp[0] != 0xFE || string(resp[1:4]) != "SMB" {
+		return "", false, false, errors.New("unexpected smb response")
+	}
+	status := binary.LittleEndian.Uint32(resp[8:12])
+	if status != 0 {
+		return "", false, false, fmt.Errorf("smb negotiate failed with status 0x%08x", status)
+	}
+	body := resp[64:]
+	securityMode := binary.LittleEndian.Uint16(body[2:4])
+	revision := binary.LittleEndian.Uint16(body[4:6])
+	dialect, ok := smb2Dialects[revision]
+	if !ok {
+		dialect = fmt.Sprintf("0x%04x", revision)
+	}
+	return dialect, securityMode&0x01 != 0, securityMode&0x02 != 0, nil
+}
+
+func buildSMB2Negotiate() []byte {
+	dialects := []uint16{0x0202, 0x0210, 0x0300, 0x0302, 0x0311}
+
+	header := make([]byte, 64)
+	copy(header[0:4], []byte{0xFE, 'S', 'M', 'B'})
+	binary.LittleEndian.PutUint16(header[4:6], 64)
+	binary.LittleEndian.PutUint16(header[14:16], 1)
+
+	body := make([]byte, 36)
+	binary.LittleEndian.PutUint16(body[0:2], 36)
+	binary.LittleEndian.PutUint16(body[2:4], uint16(len(dialects)))
+	binary.LittleEndian.PutUint16(body[4:6], 0x0001)
+	_, _ = rand.Read(body[12:28])
+	for _, d := range dialects {
+		body = binary.LittleEndian.AppendUint16(body, d)
+	}
+	for (64+len(body))%8 != 0 {
+		body = append(body, 0)
+	}
+
+	// SMB 3.1.1 requires a pre-auth integrity negotiate context.
+	binary.LittleEndian.PutUint32(body[28:32], uint32(64+len(body)))
+	binary.LittleEndian.PutUint16(body[32:34], 1)
+	salt := make([]byte, 32)
+	_, _ = rand.Read(salt)
+	ctxData := []byte{0x01, 0x00, 0x20, 0x00, 0x01, 0x00}
+	ctxData = append(ctxData, salt...)
+	body = binary.LittleEndian.AppendUint16(body, 0x0001)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(ctxData)))
+	body = append(body, 0, 0, 0, 0)
+	body = append(body, ctxData...)
+
+	message := append(header, body...)
+	frame := []byte{0x00, byte(len(message) >> 16), byte(len(message) >> 8), byte(len(message))}
+	return append(frame, message...)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	speedTestDownloadURL = "https://speed.cloudflare.com/__down?bytes=100000000"
+	speedTestUploadURL   = "https://speed.cloudflare.com/__up"
+)
+
+func runSpeedTest(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	downloadURL := asString(params["download_url"], speedTestDownloadURL)
+	uploadURL := asString(params["upload_url"], speedTestUploadURL)
+	if useAdmin, _ := params["use_admin"].(bool); useAdmin {
+		if env.AdminIP == "" {
+			return nil, errors.New("speed_test use_admin requires a provisioned admin")
+		}
+		base := "http://" + net.JoinHostPort(env.AdminIP, strconv.Itoa(wsPort))
+		downloadURL = base + "/speedtest/download"
+		uploadURL = base + "/speedtest/upload"
+	}
+	duration := time.Duration(asInt(params["duration_s"], 10)) * time.Second
+	if duration > throughputMaxDuration*time.Second {
+		duration = throughputMaxDuration * time.Second
+	}
+	uploadBytes := asInt(params["upload_bytes"], 10*1024*1024)
+
+	probeAddr, err := latencyProbeAddr(downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	probeAddr = env.Pins.hostPort(probeAddr)
+	idle := medianLatency(sampleConnectLatency(env.context(), probeAddr, 5, 200*time.Millisecond))
+
+	client := env.Pins.httpClient(duration + 15*time.Second)
+	result := map[string]interface{}{
+		"download_url": downloadURL,
+		"upload_url":   uploadURL,
+	}
+	if idle >= 0 {
+		result["idle_latency_ms"] = idle
+	}
+
+	loadCtx, stopLoad := context.WithCancel(env.context())
+	var loaded []int64
+	var loadedWG sync.WaitGroup
+	loadedWG.Add(1)
+	go func() {
+		defer loadedWG.Done()
+		loaded = sampleConnectLatency(loadCtx, probeAddr, 0, 250*time.Millisecond)
+	}()
+	downBytes, downElapsed, downErr := speedTestDownload(env.context(), client, downloadURL, duration)
+	stopLoad()
+	loadedWG.Wait()
+
+	if downErr != nil {
+		result["download_error"] = downErr.Error()
+	} else {
+		result["download_bytes"] = downBytes
+		result["download_mbps"] = mbps(downBytes, downElapsed)
+	}
+	if median := medianLatency(loaded); median >= 0 {
+		result["loaded_latency_ms"] = median
+	}
+
+	upBytes, upElapsed, upErr := speedTestUpload(env.context(), client, uploadURL, uploadBytes)
+	if upErr != nil {
+		result["upload_error"] = upErr.Error()
+	} else {
+		result["upload_bytes"] = upBytes
+		result["upload_mbps"] = mbps(upBytes, upElapsed)
+	}
+
+	if downErr != nil && upErr != nil {
+		return result, fmt.Errorf("speed test failed: %v", downErr)
+	}
+	return result, nil
+}
+
+func speedTestDownload(parent context.Context, client *http.Client, target string, duration time.Duration) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(parent, duration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", "labscan-agent/"+agentVersion)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("download returned %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return n, elapsed, err
+	}
+	return n, elapsed, nil
+}
+
+func speedTestUpload(ctx context.Context, client *http.Client, target string, size int) (int64, time.Duration, error) {
+	body := make([]byte, size)
+	_, _ = rand.Read(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.ContentLength = int64(size)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", "labscan-agent/"+agentVersion)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	elapsed := time.Since(start)
+	if resp.StatusCode >= 300 {
+		return 0, elapsed, fmt.Errorf("upload returned %s", resp.Status)
+	}
+	return int64(size), elapsed, nil
+}
+
+func latencyProbeAddr(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "", fmt.Errorf("invalid speed test url %q", rawURL)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(parsed.Hostname(), port), nil
+}
+
+// sampleConnectLatency measures TCP connect times to addr every interval,
+// stopping after count samples (0 = until ctx is done).
+func sampleConnectLatency(ctx context.Context, addr string, count int, interval time.Duration) []int64 {
+	samples := make([]int64, 0)
+	for count == 0 || len(samples) < count {
+		start := time.Now()
+		dialer := net.Dialer{Timeout: 2 * time.Second}
+		if conn, err := dialer.DialContext(ctx, "tcp", addr); err == nil {
+			samples = append(samples, time.Since(start).Milliseconds())
+			_ = conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return samples
+		case <-time.After(interval):
+		}
+	}
+	return samples
+}
+
+func medianLatency(samples []int64) int64 {
+	if len(samples) == 0 {
+		return -1
+	}
+	sorted := append([]int64(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var (
+	staticAdmin  string
+	staticSecret string
+)
+
+// staticConfig returns the admin to connect to without waiting for a
+// provisioning broadcast: -admin and -secret when given, or an
+// agent_config.json with admin_ip and secret that provisioning never wrote,
+// as dropped in place by an imaging or MDM pipeline. Anything else in the
+// file, such as TLS settings or admin_public_key, is kept either way.
+func staticConfig() (*PersistedConfig, error) {
+	cfg, err := loadConfig()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		if staticAdmin == "" {
+			return nil, err
+		}
+		slog.Warn("ignoring unreadable config for -admin", "path", configPath, "err", err)
+		cfg = nil
+	}
+	if staticAdmin != "" {
+		if cfg == nil {
+			cfg = &PersistedConfig{}
+		}
+		cfg.AdminIP, cfg.Secret = unbracket(strings.TrimSpace(staticAdmin)), staticSecret
+		return cfg, nil
+	}
+	if cfg != nil && cfg.ProvisionedAt == 0 && strings.TrimSpace(cfg.AdminIP) != "" && cfg.Secret != "" {
+		return cfg, nil
+	}
+	return nil, nil
+}
+
+// nextConfig returns the static admin if there is one, and otherwise waits
+// for provisioning.
+func nextConfig(ctx context.Context, agentID, hostname string, guard *provisionGuard) (*PersistedConfig, error) {
+	cfg, err := staticConfig()
+	if err != nil {
+		slog.Warn("cannot use static config, waiting for provisioning", "err", err)
+	}
+	if cfg != nil {
+		slog.Info("using static admin, skipping provisioning", "admin_ip", cfg.AdminIP, "port", wsPort)
+		return cfg, nil
+	}
+	return waitForProvision(ctx, agentID, hostname, guard)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var statusAddr = "127.0.0.1:8149"
+
+var processStarted = time.Now()
+
+// agentStatus tracks the clients running in this process (one normally,
+// fakeAgentCount in fake mode) for the local status endpoint.
+var agentStatus = &statusRegistry{clients: make(map[*AgentClient]struct{})}
+
+type statusRegistry struct {
+	mu      sync.Mutex
+	clients map[*AgentClient]struct{}
+}
+
+func (r *statusRegistry) track(c *AgentClient) func() {
+	r.mu.Lock()
+	r.clients[c] = struct{}{}
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		delete(r.clients, c)
+		r.mu.Unlock()
+	}
+}
+
+func (r *statusRegistry) snapshot() []*AgentClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]*AgentClient, 0, len(r.clients))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].profile.Hostname < clients[j].profile.Hostname })
+	return clients
+}
+
+// sessionState is what the status endpoint reports about a client's
+// connection; runSession and heartbeatLoop keep it current.
+type sessionState struct {
+	connected       atomic.Bool
+	session         atomic.Value // string
+	connectedAtMS   atomic.Int64
+	lastHeartbeatMS atomic.Int64
+}
+
+type StatusResponse struct {
+	Version   string        `json:"version"`
+	PID       int           `json:"pid"`
+	UptimeS   int64         `json:"uptime_s"`
+	Fake      bool          `json:"fake"`
+	Agents    []AgentStatus `json:"agents"`
+	Timestamp int64         `json:"ts"`
+
+	Sandbox *sandboxStatus `json:"sandbox,omitempty"`
+}
+
+type AgentStatus struct {
+	AgentID         string                 `json:"agent_id"`
+	Hostname        string                 `json:"hostname"`
+	AdminIP         string                 `json:"admin_ip"`
+	Connected       bool                   `json:"connected"`
+	Session         string                 `json:"session,omitempty"`
+	ConnectedAt     int64                  `json:"connected_at,omitempty"`
+	LastHeartbeatAt int64                  `json:"last_heartbeat_at,omitempty"`
+	RunningTasks    []string               `json:"running_tasks"`
+	QueuedTasks     int                    `json:"queued_tasks"`
+	ClockSkewMS     *int64                 `json:"clock_skew_ms,omitempty"`
+	Probe           map[string]interface{} `json:"probe"`
+}
+
+func (c *AgentClient) status() AgentStatus {
+	session, _ := c.state.session.Load().(string)
+	probe := c.probes.Snapshot()
+	var skewMS *int64
+	if skew, _, ok := c.clock.current(); ok {
+		ms := skew.Milliseconds()
+		skewMS = &ms
+	}
+	return AgentStatus{
+		AgentID:         c.profile.AgentID,
+		Hostname:        c.currentHost().Hostname,
+		AdminIP:         c.adminIP,
+		Connected:       c.state.connected.Load(),
+		Session:         session,
+		ConnectedAt:     c.state.connectedAtMS.Load(),
+		LastHeartbeatAt: c.state.lastHeartbeatMS.Load(),
+		RunningTasks:    c.tasks.ids(),
+		QueuedTasks:     c.pool.queued(),
+		ClockSkewMS:     skewMS,
+		Probe: map[string]interface{}{
+			"internet_reachable": probe.Internet,
+			"dns_ok":             probe.DNS,
+			"gateway_reachable":  probe.Gateway,
+			"latency_ms":         probe.LatencyMS,
+			"jitter_ms":          probe.JitterMS,
+			"internet_method":    probe.InternetMethod,
+			"gateway_method":     probe.GatewayMethod,
+			"captive_portal":     probe.CaptivePortal,
+			"dns_resolvers":      resolverMetrics(probe.Resolvers),
+		},
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	response := StatusResponse{
+		Version:   agentVersion,
+		PID:       os.Getpid(),
+		UptimeS:   int64(time.Since(processStarted).Seconds()),
+		Agents:    []AgentStatus{},
+		Timestamp: nowMS(),
+		Sandbox:   sandboxReport(),
+	}
+	for _, c := range agentStatus.snapshot() {
+		response.Fake = response.Fake || c.profile.IsFake
+		response.Agents = append(response.Agents, c.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// serveLocalHTTP starts the /status and /metrics endpoints. They share a
+// listener when given the same address. Status defaults to loopback so it is
+// not reachable from the lab network; metrics are off unless -metrics-addr
+// is set.
+func serveLocalHTTP(statusAddr, metricsAddr string) {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if statusAddr != "" {
+		mux(statusAddr).HandleFunc("GET /status", statusHandler)
+	}
+	if metricsAddr != "" {
+		mux(metricsAddr).HandleFunc("GET /metrics", metricsHandler)
+	}
+	for addr, handler := range muxes {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			slog.Warn("local HTTP endpoint unavailable", "addr", addr, "err", err)
+			continue
+		}
+		slog.Info("local HTTP endpoint listening", "addr", listener.Addr().String())
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Warn("local HTTP endpoint stopped", "addr", addr, "err", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// errSYNUnavailable means this agent cannot send raw TCP segments, so a
+// SYN scan falls back to connect.
+var errSYNUnavailable = errors.New("syn scan needs raw sockets (Linux, as root or with CAP_NET_RAW)")
+
+// synRetries is how many times a SYN that got no answer is sent again
+// before the port counts as filtered.
+const synRetries = 1
+
+// synScanResult is what a SYN scan learned about each port.
+type synScanResult struct {
+	Open     []int
+	Closed   int
+	Filtered int
+}
+
+// synSegment builds a bare SYN from srcPort to dstPort with its checksum
+// computed over the IPv4 or IPv6 pseudo-header.
+func synSegment(src, dst net.IP, srcPort, dstPort int, seq uint32) ([]byte, error) {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		SYN:     true,
+		Window:  64240,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}},
+	}
+	var network gopacket.NetworkLayer = &layers.IPv4{SrcIP: src, DstIP: dst, Protocol: layers.IPProtocolTCP}
+	if dst.To4() == nil {
+		network = &layers.IPv6{SrcIP: src, DstIP: dst, NextHeader: layers.IPProtocolTCP}
+	}
+	if err := tcp.SetNetworkLayerForChecksum(network); err != nil {
+		return nil, err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, tcp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseSYNReply reads a TCP segment sent to srcPort in answer to a SYN
+// with sequence number seq. A SYN-ACK means open and a reset closed.
+func parseSYNReply(data []byte, srcPort int, seq uint32) (port int, open, ok bool) {
+	var tcp layers.TCP
+	if err := tcp.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return 0, false, false
+	}
+	if int(tcp.DstPort) != srcPort || !tcp.ACK || tcp.Ack != seq+1 {
+		return 0, false, false
+	}
+	switch {
+	case tcp.SYN:
+		return int(tcp.SrcPort), true, true
+	case tcp.RST:
+		return int(tcp.SrcPort), false, true
+	}
+	return 0, false, false
+}
+
+// localSourceIP returns the address the kernel would send from to reach
+// dst. Connecting a UDP socket sends nothing.
+func localSourceIP(dst net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// scanSYN sends a SYN to each port and waits for SYN-ACKs and resets,
+// without completing a handshake: the kernel answers each SYN-ACK with a
+// reset because no socket owns the source port. Ports that stay silent get
+// synRetries more SYNs. Each round waits for the estimator's timeout, or
+// fixed when set, and replies feed the estimator.
+func scanSYN(env taskEnv, target string, ports []int, fixed time.Duration, estimator *rttEstimator) (synScanResult, error) {
+	var result synScanResult
+	dstAddr, err := net.ResolveIPAddr("ip", target)
+	if err != nil {
+		return result, err
+	}
+	dst := dstAddr.IP
+	src, err := localSourceIP(dst)
+	if err != nil {
+		return result, err
+	}
+	network := "ip4:tcp"
+	if dst.To4() == nil {
+		network = "ip6:tcp"
+	} else {
+		dst = dst.To4()
+	}
+	conn, err := listenRawTCP(network, src.String())
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+
+	srcPort := 32768 + rand.Intn(28000)
+	seq := rand.Uint32()
+	var mu sync.Mutex
+	sentAt := make(map[int]time.Time, len(ports))
+	answered := make(map[int]bool, len(ports))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if ip, ok := from.(*net.IPAddr); !ok || !ip.IP.Equal(dst) {
+				continue
+			}
+			port, open, ok := parseSYNReply(buf[:n], srcPort, seq)
+			if !ok {
+				continue
+			}
+			mu.Lock()
+			if sent, asked := sentAt[port]; asked && !answered[port] {
+				answered[port] = true
+				estimator.observe(time.Since(sent))
+				if open {
+					result.Open = append(result.Open, port)
+				} else {
+					result.Closed++
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	env.Progress.setTotal(len(ports))
+	pending := ports
+	for round := 0; round <= synRetries && len(pending) > 0 && !env.cancelled(); round++ {
+		for _, port := range pending {
+			if env.cancelled() {
+				break
+			}
+			segment, err := synSegment(src, dst, srcPort, port, seq)
+			if err != nil {
+				return result, err
+			}
+			mu.Lock()
+			sentAt[port] = time.Now()
+			mu.Unlock()
+			if _, err := conn.WriteTo(segment, &net.IPAddr{IP: dst}); err != nil {
+				return result, fmt.Errorf("send SYN to port %d: %w", port, err)
+			}
+			if round == 0 {
+				env.Progress.step(net.JoinHostPort(target, fmt.Sprint(port)))
+			}
+		}
+		wait := fixed
+		if wait <= 0 {
+			wait = estimator.timeout()
+		}
+		select {
+		case <-env.context().Done():
+		case <-time.After(wait):
+		}
+		mu.Lock()
+		var silent []int
+		for _, port := range pending {
+			if !answered[port] {
+				silent = append(silent, port)
+			}
+		}
+		mu.Unlock()
+		pending = silent
+	}
+	_ = conn.Close()
+	<-done
+	slices.Sort(result.Open)
+	result.Filtered = len(pending)
+	return result, nil
+}
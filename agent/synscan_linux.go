@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenRawTCP opens a raw TCP socket bound to addr. The kernel adds the
+// IP header to what is written and strips it from what is read.
+func listenRawTCP(network, addr string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSYNUnavailable, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// listenRawTCP reports the SYN scan unavailable: Windows refuses to send TCP
+// on raw sockets and BSD kernels, macOS included, never deliver TCP to them.
+func listenRawTCP(string, string) (net.PacketConn, error) {
+	return nil, errSYNUnavailable
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSYNSegment(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.2").To4(), net.ParseIP("10.0.0.9").To4()
+	segment, err := synSegment(src, dst, 40000, 443, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(segment, layers.LayerTypeTCP, gopacket.Default)
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || !tcp.SYN || tcp.ACK || tcp.SrcPort != 40000 || tcp.DstPort != 443 || tcp.Seq != 1000 || tcp.Checksum == 0 {
+		t.Fatalf("segment = %+v", tcp)
+	}
+	if _, err := synSegment(net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::9"), 40000, 443, 1000); err != nil {
+		t.Fatalf("IPv6 segment: %v", err)
+	}
+}
+
+func TestParseSYNReply(t *testing.T) {
+	reply := func(tcp *layers.TCP) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, tcp); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name           string
+		tcp            *layers.TCP
+		port           int
+		open, accepted bool
+	}{
+		{"syn-ack", &layers.TCP{SrcPort: 443, DstPort: 40000, SYN: true, ACK: true, Ack: 1001}, 443, true, true},
+		{"reset", &layers.TCP{SrcPort: 23, DstPort: 40000, RST: true, ACK: true, Ack: 1001}, 23, false, true},
+		{"wrong ack", &layers.TCP{SrcPort: 443, DstPort: 40000, SYN: true, ACK: true, Ack: 7}, 0, false, false},
+		{"other source port", &layers.TCP{SrcPort: 443, DstPort: 40001, SYN: true, ACK: true, Ack: 1001}, 0, false, false},
+		{"our own syn", &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, Seq: 1000}, 0, false, false},
+	}
+	for _, tt := range tests {
+		port, open, ok := parseSYNReply(reply(tt.tcp), 40000, 1000)
+		if port != tt.port || open != tt.open || ok != tt.accepted {
+			t.Errorf("%s: parseSYNReply() = %d, %v, %v", tt.name, port, open, ok)
+		}
+	}
+}
+
+func TestScanSYNLoopback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	open := listener.Addr().(*net.TCPAddr).Port
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	var estimator rttEstimator
+	result, err := scanSYN(taskEnv{Progress: &taskProgress{}}, "127.0.0.1", []int{open, closedPort}, 0, &estimator)
+	if errors.Is(err, errSYNUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Open, []int{open}) || result.Closed != 1 || result.Filtered != 0 {
+		t.Fatalf("scanSYN() = %+v, want %d open and 1 closed", result, open)
+	}
+}
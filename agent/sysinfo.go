@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// cpuSampler turns the cumulative CPU counters into a busy percentage over
+// the time since the previous heartbeat.
+type cpuSampler struct {
+	mu                sync.Mutex
+	lastIdle, lastAll uint64
+}
+
+var hostCPU cpuSampler
+
+func (s *cpuSampler) percent() (float64, bool) {
+	idle, total, err := readCPUTimes()
+	if err != nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prevIdle, prevAll := s.lastIdle, s.lastAll
+	s.lastIdle, s.lastAll = idle, total
+	if prevAll == 0 || total <= prevAll || idle < prevIdle {
+		return 0, false
+	}
+	busy := 1 - float64(idle-prevIdle)/float64(total-prevAll)
+	return roundTo(math.Max(0, busy)*100, 1), true
+}
+
+// systemMetrics reports how loaded the machine itself is. Each reading is
+// left out when the platform cannot provide it.
+func systemMetrics() map[string]interface{} {
+	metrics := make(map[string]interface{})
+	if cpu, ok := hostCPU.percent(); ok {
+		metrics["cpu_percent"] = cpu
+	}
+	if load, err := readLoadAvg(); err == nil {
+		metrics["load_1m"] = roundTo(load, 2)
+	}
+	if total, available, err := readMemory(); err == nil && total > 0 {
+		metrics["mem_total_mb"] = total >> 20
+		metrics["mem_used_percent"] = roundTo(float64(total-min(available, total))*100/float64(total), 1)
+	}
+	if free, total, err := readDiskFree(systemDiskPath()); err == nil && total > 0 {
+		metrics["disk_free_percent"] = roundTo(float64(free)*100/float64(total), 1)
+	}
+	if uptime, err := readUptime(); err == nil {
+		metrics["uptime_s"] = int64(uptime.Seconds())
+	}
+	return metrics
+}
+
+func roundTo(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CPU tick counters need the Mach host API, which is not reachable without
+// cgo; macOS heartbeats report load_1m instead of cpu_percent.
+func readCPUTimes() (idle, total uint64, err error) {
+	return 0, 0, errors.New("cpu times unavailable on darwin")
+}
+
+// readLoadAvg decodes vm.loadavg: three uint32 fixpt_t values, padding, and
+// a 64-bit fscale at offset 16.
+func readLoadAvg() (float64, error) {
+	raw, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) < 24 {
+		return 0, errors.New("short vm.loadavg")
+	}
+	load := binary.LittleEndian.Uint32(raw[0:4])
+	scale := binary.LittleEndian.Uint64(raw[16:24])
+	if scale == 0 {
+		return 0, errors.New("zero fscale in vm.loadavg")
+	}
+	return float64(load) / float64(scale), nil
+}
+
+// readMemory counts free, speculative, and file-backed pages as available,
+// since the kernel drops file cache as soon as memory is needed.
+func readMemory() (total, available uint64, err error) {
+	if total, err = unix.SysctlUint64("hw.memsize"); err != nil {
+		return 0, 0, err
+	}
+	pageSize, err := unix.SysctlUint32("hw.pagesize")
+	if err != nil {
+		return 0, 0, err
+	}
+	free, err := unix.SysctlUint32("vm.page_free_count")
+	if err != nil {
+		return 0, 0, err
+	}
+	speculative, _ := unix.SysctlUint32("vm.page_speculative_count")
+	fileBacked, _ := unix.SysctlUint32("vm.page_pageable_external_count")
+	return total, (uint64(free) + uint64(speculative) + uint64(fileBacked)) * uint64(pageSize), nil
+}
+
+func readDiskFree(path string) (free, total uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+func readUptime() (time.Duration, error) {
+	boot, err := unix.SysctlTimeval("kern.boottime")
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(time.Unix(boot.Unix())), nil
+}
+
+func systemDiskPath() string {
+	return "/"
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errSysinfoUnsupported = errors.New("system metrics unsupported on this platform")
+
+func readCPUTimes() (idle, total uint64, err error) { return 0, 0, errSysinfoUnsupported }
+
+func readLoadAvg() (float64, error) { return 0, errSysinfoUnsupported }
+
+func readMemory() (total, available uint64, err error) { return 0, 0, errSysinfoUnsupported }
+
+func readDiskFree(path string) (free, total uint64, err error) { return 0, 0, errSysinfoUnsupported }
+
+func readUptime() (time.Duration, error) { return 0, errSysinfoUnsupported }
+
+func systemDiskPath() string { return "/" }
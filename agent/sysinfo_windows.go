@@ -0,0 +1,79 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procGetSystemTimes       = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetSystemTimes")
+	procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+)
+
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+func filetimeTicks(ft windows.Filetime) uint64 {
+	return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+}
+
+// readCPUTimes uses GetSystemTimes; kernel time already includes idle time.
+func readCPUTimes() (idle, total uint64, err error) {
+	var idleFT, kernelFT, userFT windows.Filetime
+	r, _, callErr := procGetSystemTimes.Call(uintptr(unsafe.Pointer(&idleFT)), uintptr(unsafe.Pointer(&kernelFT)), uintptr(unsafe.Pointer(&userFT)))
+	if r == 0 {
+		return 0, 0, callErr
+	}
+	return filetimeTicks(idleFT), filetimeTicks(kernelFT) + filetimeTicks(userFT), nil
+}
+
+func readLoadAvg() (float64, error) {
+	return 0, errors.New("load average unavailable on windows")
+}
+
+func readMemory() (total, available uint64, err error) {
+	status := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	r, _, callErr := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if r == 0 {
+		return 0, 0, callErr
+	}
+	return status.TotalPhys, status.AvailPhys, nil
+}
+
+func readDiskFree(path string) (free, total uint64, err error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, &total, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+func readUptime() (time.Duration, error) {
+	return windows.DurationSinceBoot(), nil
+}
+
+func systemDiskPath() string {
+	if drive := os.Getenv("SystemDrive"); drive != "" {
+		return drive + `\`
+	}
+	return `C:\`
+}
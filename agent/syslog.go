@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syslogAppName     = "labscan-agent"
+	syslogQueue       = 512
+	syslogDialTimeout = 5 * time.Second
+	syslogRetry       = 5 * time.Second
+	// syslogSDID names the structured data element. 32473 is the private
+	// enterprise number RFC 5612 reserves for documentation and examples.
+	syslogSDID = "labscan@32473"
+)
+
+// -syslog sends agent events, task outcomes, and connection changes to a
+// syslog collector as udp://host:port, tcp://host:port, or tls://host:port.
+var (
+	syslogTarget   string
+	syslogFacility = "local0"
+	syslogCAFile   string
+	agentSyslog    *syslogForwarder
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities maps event and log severities to RFC 5424 severities.
+var syslogSeverities = map[string]int{
+	"critical": 2,
+	"error":    3,
+	"warning":  4,
+	"notice":   5,
+	"info":     6,
+	"debug":    7,
+}
+
+// syslogForwarder writes RFC 5424 messages to one collector from a single
+// goroutine. Messages are queued without blocking the caller; when the
+// queue is full or the collector is down they are dropped and counted, so a
+// dead collector never holds up the agent. A nil *syslogForwarder forwards
+// nothing.
+type syslogForwarder struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	queue     chan []byte
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Int64
+}
+
+// newSyslogForwarder parses a -syslog target; an empty target disables
+// forwarding and returns nil.
+func newSyslogForwarder(target, facility, caFile string) (*syslogForwarder, error) {
+	if strings.TrimSpace(target) == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%q: want udp://, tcp://, or tls://host:port", target)
+	}
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	hostname, _ := os.Hostname()
+	f := &syslogForwarder{network: parsed.Scheme, addr: parsed.Host, facility: code, hostname: hostname}
+	defaultPort := "514"
+	switch parsed.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		defaultPort = "6514"
+		f.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: parsed.Hostname()}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("read syslog CA: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("syslog CA file contains no certificates")
+			}
+			f.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport %q; use udp, tcp, or tls", parsed.Scheme)
+	}
+	if parsed.Port() == "" {
+		f.addr = net.JoinHostPort(parsed.Hostname(), defaultPort)
+	}
+	return f, nil
+}
+
+// startSyslog sets up -syslog for the process; clients pick it up when
+// they are created.
+func startSyslog() error {
+	forwarder, err := newSyslogForwarder(syslogTarget, syslogFacility, syslogCAFile)
+	if err != nil || forwarder == nil {
+		return err
+	}
+	agentSyslog = forwarder.start()
+	slog.Info("forwarding to syslog", "network", forwarder.network, "addr", forwarder.addr)
+	return nil
+}
+
+func (f *syslogForwarder) start() *syslogForwarder {
+	f.queue = make(chan []byte, syslogQueue)
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+	go f.run()
+	return f
+}
+
+// send queues one message. hostname is the agent's, which differs from the
+// process's for fake agents; msgID names what happened and params become
+// the structured data.
+func (f *syslogForwarder) send(severity, hostname, msgID, message string, params map[string]string) {
+	if f == nil || f.queue == nil {
+		return
+	}
+	if hostname == "" {
+		hostname = f.hostname
+	}
+	level, ok := syslogSeverities[severity]
+	if !ok {
+		level = syslogSeverities["info"]
+	}
+	msg := formatSyslog(f.facility*8+level, time.Now(), hostname, os.Getpid(), msgID, params, message)
+	select {
+	case f.queue <- msg:
+	default:
+		f.dropped.Add(1)
+	}
+}
+
+// close stops the forwarder after the queued messages are written or
+// timeout passes.
+func (f *syslogForwarder) close(timeout time.Duration) {
+	if f == nil || f.queue == nil {
+		return
+	}
+	f.closeOnce.Do(func() { close(f.stop) })
+	select {
+	case <-f.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (f *syslogForwarder) run() {
+	defer close(f.done)
+	var conn net.Conn
+	var retryAt time.Time
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	for {
+		var msg []byte
+		select {
+		case msg = <-f.queue:
+		case <-f.stop:
+			// Write what is already queued, then stop.
+			select {
+			case msg = <-f.queue:
+			default:
+				return
+			}
+		}
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				f.dropped.Add(1)
+				continue
+			}
+			var err error
+			if conn, err = f.dial(); err != nil {
+				slog.Debug("syslog collector unreachable", "addr", f.addr, "err", err)
+				retryAt = time.Now().Add(syslogRetry)
+				f.dropped.Add(1)
+				continue
+			}
+			if dropped := f.dropped.Swap(0); dropped > 0 {
+				slog.Warn("syslog messages dropped", "addr", f.addr, "count", dropped)
+			}
+		}
+		if f.network != "udp" {
+			// RFC 6587 octet counting, which RFC 5425 requires over TLS.
+			msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+		if _, err := conn.Write(msg); err != nil {
+			slog.Debug("syslog write failed", "addr", f.addr, "err", err)
+			_ = conn.Close()
+			conn = nil
+			f.dropped.Add(1)
+		}
+	}
+}
+
+func (f *syslogForwarder) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if f.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", f.addr, f.tlsConfig)
+	}
+	return dialer.Dial(f.network, f.addr)
+}
+
+// formatSyslog renders an RFC 5424 message. Params become one
+// structured data element, sorted by name so output is stable.
+func formatSyslog(priority int, ts time.Time, hostname string, pid int, msgID string, params map[string]string, message string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ", priority, ts.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		syslogHeaderField(hostname, 255), syslogAppName, pid, syslogHeaderField(msgID, 32))
+	if len(params) == 0 {
+		b.WriteString("-")
+	} else {
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString("[" + syslogSDID)
+		for _, name := range names {
+			fmt.Fprintf(&b, " %s=\"%s\"", syslogHeaderField(name, 32), syslogParamEscaper.Replace(params[name]))
+		}
+		b.WriteString("]")
+	}
+	if message != "" {
+		b.WriteString(" " + message)
+	}
+	return []byte(b.String())
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField keeps the printable ASCII of a header field, which may
+// not contain spaces, up to limit characters; an empty field is "-".
+func syslogHeaderField(value string, limit int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, value)
+	if len(field) > limit {
+		field = field[:limit]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// syslogEvent forwards an event sent to the admin.
+func (c *AgentClient) syslogEvent(event EventPayload) {
+	if c.syslog == nil {
+		return
+	}
+	params := map[string]string{"agent_id": c.profile.AgentID}
+	for key, value := range event.Data {
+		params[key] = fmt.Sprint(value)
+	}
+	c.syslog.send(event.Severity, c.currentHost().Hostname, event.Kind, event.Message, params)
+}
+
+// syslogLifecycle forwards a connection change: connected, disconnected,
+// or going_offline.
+func (c *AgentClient) syslogLifecycle(msgID, session, reason string) {
+	if c.syslog == nil {
+		return
+	}
+	params := map[string]string{"agent_id": c.profile.AgentID, "admin": c.adminIP}
+	if session != "" {
+		params["session"] = session
+	}
+	severity, message := "info", "agent "+strings.ReplaceAll(msgID, "_", " ")
+	if reason != "" {
+		params["reason"] = reason
+		message += ": " + reason
+		if msgID == "disconnected" {
+			severity = "warning"
+		}
+	}
+	c.syslog.send(severity, c.currentHost().Hostname, msgID, message, params)
+}
+
+// syslogTask forwards a task outcome, as recorded in the audit log.
+func (c *AgentClient) syslogTask(entry auditEntry) {
+	if c.syslog == nil {
+		return
+	}
+	params := map[string]string{
+		"agent_id":    c.profile.AgentID,
+		"task_id":     entry.TaskID,
+		"kind":        entry.Kind,
+		"status":      entry.Status,
+		"duration_ms": strconv.FormatInt(entry.DurationMS, 10),
+	}
+	if entry.ScheduleID != "" {
+		params["schedule_id"] = entry.ScheduleID
+	}
+	if entry.ErrorCode != "" {
+		params["error_code"] = entry.ErrorCode
+	}
+	severity := "info"
+	switch entry.Status {
+	case taskStatusFailed, taskStatusTimedOut:
+		severity = "warning"
+	case taskStatusRejected:
+		severity = "notice"
+	}
+	c.syslog.send(severity, c.currentHost().Hostname, "task_result", fmt.Sprintf("task %s %s %s", entry.TaskID, entry.Kind, entry.Status), params)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatSyslog(t *testing.T) {
+	ts := time.Date(2026, 10, 16, 8, 30, 0, 123456000, time.UTC)
+	got := string(formatSyslog(16*8+4, ts, "lab pc-07", 4242, "cert_expiring", map[string]string{
+		"endpoint": "wiki.lab:443",
+		"subject":  `CN="wiki" [lab]`,
+		"agent_id": `a\b`,
+	}, "certificate of wiki.lab:443 expires in under 14 days"))
+	want := `<132>1 2026-10-16T08:30:00.123456Z labpc-07 labscan-agent 4242 cert_expiring ` +
+		`[labscan@32473 agent_id="a\\b" endpoint="wiki.lab:443" subject="CN=\"wiki\" [lab\]"] ` +
+		`certificate of wiki.lab:443 expires in under 14 days`
+	if got != want {
+		t.Fatalf("formatSyslog =\n%s\nwant\n%s", got, want)
+	}
+	if got := string(formatSyslog(134, ts, "", 1, "", nil, "")); got != "<134>1 2026-10-16T08:30:00.123456Z - labscan-agent 1 - -" {
+		t.Fatalf("empty fields = %q", got)
+	}
+}
+
+func TestNewSyslogForwarder(t *testing.T) {
+	tests := []struct {
+		target, facility, network, addr string
+	}{
+		{"udp://collector.lab", "local0", "udp", "collector.lab:514"},
+		{"tcp://10.0.0.9:1514", "daemon", "tcp", "10.0.0.9:1514"},
+		{"tls://[2001:db8::9]", "LOCAL7", "tls", "[2001:db8::9]:6514"},
+	}
+	for _, tt := range tests {
+		f, err := newSyslogForwarder(tt.target, tt.facility, "")
+		if err != nil || f.network != tt.network || f.addr != tt.addr || (f.tlsConfig != nil) != (tt.network == "tls") {
+			t.Errorf("newSyslogForwarder(%q) = %+v, %v", tt.target, f, err)
+		}
+	}
+	if f, err := newSyslogForwarder("", "local0", ""); f != nil || err != nil {
+		t.Errorf("empty target = %v, %v, want disabled", f, err)
+	}
+	for _, target := range []string{"collector.lab:514", "http://collector.lab", "udp://"} {
+		if _, err := newSyslogForwarder(target, "local0", ""); err == nil {
+			t.Errorf("newSyslogForwarder(%q) succeeded", target)
+		}
+	}
+	if _, err := newSyslogForwarder("udp://collector.lab", "local9", ""); err == nil {
+		t.Error("unknown facility accepted")
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f, err := newSyslogForwarder("udp://"+conn.LocalAddr().String(), "local0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.start()
+	f.send("warning", "pc-07", "task_result", "task t1 ping failed", map[string]string{"task_id": "t1"})
+	f.close(time.Second)
+
+	buf := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<132>1 ") || !strings.Contains(msg, ` pc-07 labscan-agent `) || !strings.HasSuffix(msg, `[labscan@32473 task_id="t1"] task t1 ping failed`) {
+		t.Fatalf("datagram = %q", msg)
+	}
+}
+
+func TestSyslogTCPFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	f, err := newSyslogForwarder("tcp://"+listener.Addr().String(), "local0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.start()
+	f.send("info", "pc-07", "connected", "agent connected", nil)
+	f.send("info", "pc-07", "disconnected", "agent disconnected", nil)
+	defer f.close(time.Second)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"connected", "disconnected"} {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatalf("frame length %q: %v", length, err)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(frame), " "+want+" - agent "+want) {
+			t.Fatalf("frame = %q", frame)
+		}
+	}
+}
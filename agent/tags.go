@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	maxTags        = 32
+	maxTagValueLen = 128
+)
+
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// localTags is the -tags setting.
+var localTags = tagsValue{}
+
+// tagsValue is a flag holding key=value tags, given as "room=lab-b,vlan=20"
+// or, from the config file, as a JSON object.
+type tagsValue map[string]string
+
+func (v tagsValue) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v tagsValue) Set(s string) error {
+	tags := map[string]string{}
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		if err := json.Unmarshal([]byte(s), &tags); err != nil {
+			return err
+		}
+	} else {
+		for _, pair := range splitList(s) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("tag %q is not key=value", pair)
+			}
+			tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if err := validateTags(tags); err != nil {
+		return err
+	}
+	for key := range v {
+		delete(v, key)
+	}
+	for key, value := range tags {
+		v[key] = value
+	}
+	return nil
+}
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags", maxTags)
+	}
+	for key, value := range tags {
+		if !tagKeyPattern.MatchString(key) {
+			return fmt.Errorf("tag key %q must be 1-63 letters, digits, '.', '_' or '-'", key)
+		}
+		if len(value) > maxTagValueLen || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("tag %s: value must be at most %d printable characters", key, maxTagValueLen)
+		}
+	}
+	return nil
+}
+
+// agentTags are the labels an agent registers with: the -tags setting (and
+// a fake agent's scenario tags), overlaid with the ones set by the tags
+// task, which are kept in the provisioning config.
+type agentTags struct {
+	mu   sync.Mutex
+	base map[string]string
+	set  map[string]string
+	// save persists the task-set tags; changed tells the admin.
+	save    func(map[string]string) error
+	changed func(map[string]string)
+}
+
+func newAgentTags(base, set map[string]string) *agentTags {
+	t := &agentTags{base: map[string]string{}, set: map[string]string{}}
+	for key, value := range base {
+		t.base[key] = value
+	}
+	for key, value := range set {
+		t.set[key] = value
+	}
+	return t
+}
+
+func (t *agentTags) current() map[string]string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.currentLocked()
+}
+
+func (t *agentTags) currentLocked() map[string]string {
+	if len(t.base)+len(t.set) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(t.base)+len(t.set))
+	for key, value := range t.base {
+		tags[key] = value
+	}
+	for key, value := range t.set {
+		tags[key] = value
+	}
+	return tags
+}
+
+// manage implements the "tags" task kind: action "list" (the default),
+// "set" to add or change tags (an empty value removes one), "remove" with
+// keys, or "replace" to swap every task-set tag for tags. Tags from the
+// -tags setting can be overridden but not removed.
+func (t *agentTags) manage(params map[string]interface{}) (interface{}, error) {
+	if t == nil {
+		return nil, errors.New("tags are not available")
+	}
+	action := asString(params["action"], "list")
+	t.mu.Lock()
+	if action == "list" {
+		defer t.mu.Unlock()
+		return map[string]interface{}{"tags": nonNilTags(t.currentLocked())}, nil
+	}
+	next := make(map[string]string, len(t.set))
+	for key, value := range t.set {
+		next[key] = value
+	}
+	switch action {
+	case "set", "replace":
+		given, ok := params["tags"].(map[string]interface{})
+		if !ok {
+			t.mu.Unlock()
+			return nil, fmt.Errorf("%s needs a tags object", action)
+		}
+		if action == "replace" {
+			next = map[string]string{}
+		}
+		for key, raw := range given {
+			value := strings.TrimSpace(fmt.Sprint(raw))
+			if raw == nil || value == "" {
+				delete(next, key)
+				continue
+			}
+			next[key] = value
+		}
+	case "remove":
+		for _, key := range asStringSlice(params["keys"], nil) {
+			delete(next, key)
+		}
+	default:
+		t.mu.Unlock()
+		return nil, fmt.Errorf("unknown tags action %q", action)
+	}
+	// The limits apply to what the agent registers with: the -tags
+	// setting overlaid with the task-set tags.
+	merged := make(map[string]string, len(t.base)+len(next))
+	for key, value := range t.base {
+		merged[key] = value
+	}
+	for key, value := range next {
+		merged[key] = value
+	}
+	if err := validateTags(merged); err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	t.set = next
+	tags := t.currentLocked()
+	// Saved under the lock so concurrent tags tasks persist in order.
+	var saveErr error
+	if t.save != nil {
+		saveErr = t.save(next)
+	}
+	t.mu.Unlock()
+
+	if saveErr != nil {
+		return nil, fmt.Errorf("tags changed but not saved: %w", saveErr)
+	}
+	if t.changed != nil {
+		t.changed(tags)
+	}
+	return map[string]interface{}{"tags": nonNilTags(tags)}, nil
+}
+
+func nonNilTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return map[string]string{}
+	}
+	return tags
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTagsLimitCountsBaseTags(t *testing.T) {
+	base := map[string]string{}
+	for i := 0; i < maxTags-1; i++ {
+		base[fmt.Sprintf("base%d", i)] = "x"
+	}
+	tests := []struct {
+		name string
+		tags map[string]interface{}
+		ok   bool
+	}{
+		{name: "one more fits", tags: map[string]interface{}{"room": "lab-b"}, ok: true},
+		{name: "override a base tag", tags: map[string]interface{}{"base0": "y", "room": "lab-b"}, ok: true},
+		{name: "two more exceed", tags: map[string]interface{}{"room": "lab-b", "role": "pc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := newAgentTags(base, nil)
+			_, err := tags.manage(map[string]interface{}{"action": "set", "tags": tt.tags})
+			if tt.ok != (err == nil) {
+				t.Fatalf("manage(set) = %v", err)
+			}
+			if !tt.ok && len(tags.current()) != len(base) {
+				t.Fatal("refused change was applied")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// multiTargetKinds take a CIDR, a comma-separated list, or a JSON list of
+// hosts in target, and run once per host.
+var multiTargetKinds = map[string]bool{"ping": true, "port_scan": true}
+
+// targetResult is one host's outcome in a multi-target task.
+type targetResult struct {
+	Target string      `json:"target"`
+	OK     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// splitTargets returns the hosts and ranges named by a target param: a
+// string, split on commas, or a list of strings.
+func splitTargets(value interface{}) []string {
+	var items []string
+	switch value := value.(type) {
+	case string:
+		items = strings.Split(value, ",")
+	case []interface{}:
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				items = append(items, text)
+			}
+		}
+	}
+	targets := make([]string, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			targets = append(targets, item)
+		}
+	}
+	return targets
+}
+
+// expandTargets turns target into a list of hosts, expanding CIDRs and
+// dropping repeats, up to maxSweepAddresses in all. multi is false for a
+// single host given as a string, or none, which runs as before.
+func expandTargets(value interface{}) (targets []string, multi bool, err error) {
+	items := splitTargets(value)
+	if _, isList := value.([]interface{}); !isList && len(items) <= 1 {
+		if len(items) == 0 {
+			if text, _ := value.(string); strings.TrimSpace(text) != "" {
+				return nil, false, errors.New("target names no hosts")
+			}
+			return nil, false, nil
+		}
+		if _, err := netip.ParsePrefix(items[0]); err != nil {
+			return items, false, nil
+		}
+	}
+	seen := make(map[string]bool)
+	for _, item := range items {
+		hosts := []string{item}
+		if _, err := netip.ParsePrefix(item); err == nil {
+			if hosts, err = expandCIDR(item, maxSweepAddresses); err != nil {
+				return nil, false, err
+			}
+		}
+		for _, host := range hosts {
+			if seen[host] {
+				continue
+			}
+			if len(seen) == maxSweepAddresses {
+				return nil, false, fmt.Errorf("target names more than %d hosts", maxSweepAddresses)
+			}
+			seen[host] = true
+			targets = append(targets, host)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, false, errors.New("target names no hosts")
+	}
+	return targets, true, nil
+}
+
+// runEachTarget runs one task per host with target set to it, up to
+// concurrency at a time, and collects the per-host results in order.
+// Progress counts hosts; each run gets its own progress, which is not
+// reported.
+func runEachTarget(env taskEnv, params map[string]interface{}, targets []string, run func(taskEnv, map[string]interface{}) (interface{}, error)) (interface{}, error) {
+	targets, shard, err := shardTargets(env, params, targets)
+	if err != nil {
+		return nil, err
+	}
+	targets, excluded := env.Exclude.filterHosts(targets)
+	concurrency := taskConcurrency(params, 32)
+	env.Progress.setTotal(len(targets))
+	results := make([]targetResult, len(targets))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				target := targets[index]
+				sub := env
+				sub.Progress = &taskProgress{}
+				subParams := make(map[string]interface{}, len(params))
+				for key, value := range params {
+					subParams[key] = value
+				}
+				subParams["target"] = target
+				delete(subParams, "shard")
+				out, err := run(sub, subParams)
+				results[index] = targetResult{Target: target, OK: err == nil, Result: out}
+				if err != nil {
+					results[index].Error = err.Error()
+				}
+				env.Progress.step(target)
+			}
+		}()
+	}
+	scanned := 0
+	for index := range targets {
+		if env.cancelled() {
+			break
+		}
+		jobs <- index
+		scanned++
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := map[string]interface{}{"results": results[:scanned], "count": len(targets), "scanned": scanned}
+	if shard != nil {
+		result["shard"] = shard
+	}
+	if excluded > 0 {
+		result["excluded"] = excluded
+	}
+	return result, nil
+}
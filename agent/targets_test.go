@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestExpandTargets(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []string
+		multi bool
+	}{
+		{name: "missing"},
+		{name: "single host", value: "10.0.0.1", want: []string{"10.0.0.1"}},
+		{name: "hostname", value: " nas.lab ", want: []string{"nas.lab"}},
+		{name: "comma list", value: "10.0.0.1, nas.lab,10.0.0.1", want: []string{"10.0.0.1", "nas.lab"}, multi: true},
+		{name: "cidr", value: "10.0.0.0/30", want: []string{"10.0.0.1", "10.0.0.2"}, multi: true},
+		{name: "json list", value: []interface{}{"nas.lab"}, want: []string{"nas.lab"}, multi: true},
+		{name: "mixed", value: []interface{}{"10.0.0.0/31", "printer.lab"}, want: []string{"10.0.0.0", "10.0.0.1", "printer.lab"}, multi: true},
+	}
+	for _, tt := range tests {
+		got, multi, err := expandTargets(tt.value)
+		if err != nil || multi != tt.multi || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expandTargets() = %v, %v, %v, want %v, %v", tt.name, got, multi, err, tt.want, tt.multi)
+		}
+	}
+	for _, bad := range []interface{}{"10.0.0.0/8", ",,", []interface{}{}} {
+		if _, _, err := expandTargets(bad); err == nil {
+			t.Errorf("expandTargets(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestMultiTargetTask(t *testing.T) {
+	env := taskEnv{Ctx: context.Background(), Progress: &taskProgress{}}
+	out, err := runTask(true, env, "port_scan", map[string]interface{}{"target": "10.0.0.0/30", "ports": []interface{}{22.0, 443.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := out.(map[string]interface{})
+	results := result["results"].([]targetResult)
+	if result["count"] != 2 || result["scanned"] != 2 || len(results) != 2 {
+		t.Fatalf("result = %v, want two hosts", result)
+	}
+	for i, want := range []string{"10.0.0.1", "10.0.0.2"} {
+		if results[i].Target != want || !results[i].OK || results[i].Result == nil {
+			t.Errorf("results[%d] = %+v, want a result for %s", i, results[i], want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+type taskPoolLimits struct {
+	Workers   int
+	QueueSize int
+}
+
+var taskPoolDefaults = taskPoolLimits{
+	Workers:   4,
+	QueueSize: 32,
+}
+
+var errTaskQueueFull = errors.New("task queue full")
+
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+func taskPriority(task TaskPayload) int {
+	switch task.Priority {
+	case "low":
+		return priorityLow
+	case "high":
+		return priorityHigh
+	default:
+		return priorityNormal
+	}
+}
+
+type TaskQueuedPayload struct {
+	TaskID   string `json:"task_id"`
+	Position int    `json:"position"`
+	Workers  int    `json:"workers"`
+}
+
+// taskPool runs at most Workers tasks at a time and holds up to QueueSize
+// more, ordered by priority and FIFO within a priority. One extra worker is
+// reserved for high priority tasks so an interactive request never waits
+// behind a pool full of bulk scans. Workers are started on demand and exit
+// when the queue drains, so an idle agent keeps no goroutines around.
+type taskPool struct {
+	mu        sync.Mutex
+	limits    taskPoolLimits
+	active    int
+	queue     []TaskPayload
+	run       func(TaskPayload)
+	onPreempt func(queued TaskPayload, position int, by TaskPayload)
+}
+
+func newTaskPool(limits taskPoolLimits, run func(TaskPayload)) *taskPool {
+	if limits.Workers < 1 {
+		limits.Workers = 1
+	}
+	if limits.QueueSize < 0 {
+		limits.QueueSize = 0
+	}
+	return &taskPool{limits: limits, run: run}
+}
+
+// submit starts the task or queues it, returning its 1-based queue position
+// (0 when it started immediately).
+func (p *taskPool) submit(task TaskPayload) (int, error) {
+	p.mu.Lock()
+	priority := taskPriority(task)
+	if p.active < p.workerLimit(priority) {
+		p.active++
+		p.mu.Unlock()
+		go p.work(task)
+		return 0, nil
+	}
+	if len(p.queue) >= p.limits.QueueSize {
+		p.mu.Unlock()
+		return 0, errTaskQueueFull
+	}
+
+	index := len(p.queue)
+	for index > 0 && taskPriority(p.queue[index-1]) < priority {
+		index--
+	}
+	p.queue = append(p.queue, TaskPayload{})
+	copy(p.queue[index+1:], p.queue[index:])
+	p.queue[index] = task
+	displaced := append([]TaskPayload(nil), p.queue[index+1:]...)
+	p.mu.Unlock()
+
+	if p.onPreempt != nil {
+		for i, queued := range displaced {
+			p.onPreempt(queued, index+2+i, task)
+		}
+	}
+	return index + 1, nil
+}
+
+func (p *taskPool) workerLimit(priority int) int {
+	if priority == priorityHigh {
+		return p.limits.Workers + 1
+	}
+	return p.limits.Workers
+}
+
+func (p *taskPool) work(task TaskPayload) {
+	for {
+		p.run(task)
+
+		p.mu.Lock()
+		if len(p.queue) == 0 || p.active > p.workerLimit(taskPriority(p.queue[0])) {
+			p.active--
+			p.mu.Unlock()
+			return
+		}
+		task = p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+	}
+}
+
+// remove drops a task that is still waiting in the queue.
+func (p *taskPool) remove(taskID string) (TaskPayload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, queued := range p.queue {
+		if queued.TaskID == taskID {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return queued, true
+		}
+	}
+	return TaskPayload{}, false
+}
+
+// drain empties the queue and returns the tasks that were waiting.
+func (p *taskPool) drain() []TaskPayload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queued := p.queue
+	p.queue = nil
+	return queued
+}
+
+func (p *taskPool) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+func (p *taskPool) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active == 0
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	taskStatusCompleted = "completed"
+	taskStatusFailed    = "failed"
+	taskStatusCancelled = "cancelled"
+	taskStatusTimedOut  = "timed_out"
+	taskStatusRejected  = "rejected"
+)
+
+// defaultTaskDeadline applies when the admin sends no deadline_ms; monitor
+// tasks instead get their own duration plus taskDeadlineSlack.
+const (
+	defaultTaskDeadline = 10 * time.Minute
+	taskDeadlineSlack   = time.Minute
+)
+
+// taskCancelGrace is how long a cancelled task gets to return its partial
+// result before the cancellation is reported without it.
+const taskCancelGrace = 2 * time.Second
+
+// taskProgressInterval is how often executeTask reports progress for tasks
+// that declared a total.
+const taskProgressInterval = 2 * time.Second
+
+type taskEnv struct {
+	AgentID   string
+	AdminIP   string
+	Ctx       context.Context
+	Update    func(result interface{}, err error)
+	Progress  *taskProgress
+	Schedules *scheduleStore
+	Policy    *agentPolicy
+	Audit     *auditLog
+	History   historyStore
+	// Reset asks the session to go offline and factory reset the agent.
+	Reset func()
+	Tags  *agentTags
+	// Responses are a fake agent's canned results by task kind.
+	Responses map[string]fakeResponse
+	// Sim is a fake agent's simulated network.
+	Sim *fakeSim
+	// Pins are the addresses the policy check resolved URL hosts to.
+	Pins pinnedAddrs
+	// Exclude holds the hosts and ports the task must not probe.
+	Exclude *scanExclusions
+}
+
+type TaskProgressPayload struct {
+	TaskID  string  `json:"task_id"`
+	Percent float64 `json:"percent"`
+	Done    int     `json:"done"`
+	Total   int     `json:"total"`
+	Current string  `json:"current,omitempty"`
+	// Queued, Position and PreemptedBy are set instead of the counters when
+	// a waiting task is pushed back by a higher priority one.
+	Queued      bool   `json:"queued,omitempty"`
+	Position    int    `json:"position,omitempty"`
+	PreemptedBy string `json:"preempted_by,omitempty"`
+}
+
+// taskProgress is filled in by handlers that work through a known number of
+// items; all methods are safe on a nil receiver.
+type taskProgress struct {
+	mu      sync.Mutex
+	total   int
+	done    int
+	current string
+}
+
+func (p *taskProgress) setTotal(total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.total, p.done, p.current = total, 0, ""
+	p.mu.Unlock()
+}
+
+func (p *taskProgress) step(current string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.done++
+	p.current = current
+	p.mu.Unlock()
+}
+
+func (p *taskProgress) snapshot(taskID string) (TaskProgressPayload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total <= 0 {
+		return TaskProgressPayload{}, false
+	}
+	return TaskProgressPayload{
+		TaskID:  taskID,
+		Percent: float64(p.done) * 100 / float64(p.total),
+		Done:    p.done,
+		Total:   p.total,
+		Current: p.current,
+	}, true
+}
+
+type TaskCancelPayload struct {
+	TaskID string `json:"task_id"`
+}
+
+func (env taskEnv) context() context.Context {
+	if env.Ctx == nil {
+		return context.Background()
+	}
+	return env.Ctx
+}
+
+func (env taskEnv) cancelled() bool {
+	return env.Ctx != nil && env.Ctx.Err() != nil
+}
+
+func (env taskEnv) update(result interface{}, err error) {
+	if env.Update != nil {
+		env.Update(result, err)
+	}
+}
+
+// runningTasks maps task IDs to the cancel func of their context so a
+// task_cancel from the admin can abort in-flight work.
+type runningTasks struct {
+	mu   sync.Mutex
+	byID map[string]context.CancelFunc
+}
+
+func (r *runningTasks) start(taskID string, deadline time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	r.mu.Lock()
+	if r.byID == nil {
+		r.byID = make(map[string]context.CancelFunc)
+	}
+	r.byID[taskID] = cancel
+	r.mu.Unlock()
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.byID, taskID)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+func taskDeadline(task TaskPayload) time.Duration {
+	if task.DeadlineMS > 0 {
+		return time.Duration(task.DeadlineMS) * time.Millisecond
+	}
+	if task.Kind == "monitor" {
+		if duration := asInt(task.Params["duration_s"], 3600); duration > 0 && time.Duration(duration)*time.Second <= monitorMaxDuration {
+			return time.Duration(duration)*time.Second + taskDeadlineSlack
+		}
+		return monitorMaxDuration + taskDeadlineSlack
+	}
+	return defaultTaskDeadline
+}
+
+// awaitTask runs a task handler and returns its outcome, or gives up shortly
+// after ctx is cancelled so handlers that cannot be interrupted do not hold
+// back the cancellation report.
+func awaitTask(ctx context.Context, run func() (interface{}, error)) (interface{}, error) {
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := run()
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case out := <-done:
+		return out.result, out.err
+	case <-ctx.Done():
+	}
+	select {
+	case out := <-done:
+		return out.result, out.err
+	case <-time.After(taskCancelGrace):
+		return nil, ctx.Err()
+	}
+}
+
+func (r *runningTasks) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.byID))
+	for id := range r.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *runningTasks) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.byID {
+		cancel()
+	}
+}
+
+func (r *runningTasks) cancel(taskID string) bool {
+	r.mu.Lock()
+	cancel, ok := r.byID[taskID]
+	r.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func tcpRetransmits(conn net.Conn) (uint32, bool) {
+	return 0, false
+}
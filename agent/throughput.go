@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	throughputDefaultPort = 5202
+	throughputBlockSize   = 128 * 1024
+	throughputMaxDuration = 60
+)
+
+func runThroughputTest(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	role := asString(params["role"], "client")
+	port := asInt(params["port"], throughputDefaultPort)
+	duration := asInt(params["duration_s"], 10)
+	if duration < 1 {
+		duration = 1
+	}
+	if duration > throughputMaxDuration {
+		duration = throughputMaxDuration
+	}
+
+	switch role {
+	case "server":
+		acceptTimeout := asInt(params["accept_timeout_ms"], 15000)
+		return runThroughputServer(env.context(), port, time.Duration(duration)*time.Second, time.Duration(acceptTimeout)*time.Millisecond)
+	case "client":
+		target := asString(params["target"], "")
+		if target == "" {
+			return nil, errors.New("throughput_test client requires target")
+		}
+		return runThroughputClient(env.context(), target, port, time.Duration(duration)*time.Second)
+	default:
+		return nil, fmt.Errorf("unsupported throughput_test role: %s", role)
+	}
+}
+
+func runThroughputServer(ctx context.Context, port int, duration, acceptTimeout time.Duration) (interface{}, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("throughput listener failed: %w", err)
+	}
+	defer listener.Close()
+	stopListener := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stopListener()
+
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		_ = tcpListener.SetDeadline(time.Now().Add(acceptTimeout))
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("no throughput client connected: %w", err)
+	}
+	defer conn.Close()
+	stopConn := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stopConn()
+	_ = conn.SetReadDeadline(time.Now().Add(duration + 10*time.Second))
+
+	header := make([]byte, 8)
+	block := make([]byte, throughputBlockSize)
+	var total int64
+	var jitter float64
+	var lastTransit int64
+	haveTransit := false
+	start := time.Now()
+	var end time.Time
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			break
+		}
+		sentNS := int64(binary.BigEndian.Uint64(header))
+		n, err := io.ReadFull(conn, block)
+		total += int64(len(header) + n)
+		end = time.Now()
+
+		transit := end.UnixNano() - sentNS
+		if haveTransit {
+			d := math.Abs(float64(transit - lastTransit))
+			jitter += (d - jitter) / 16
+		}
+		lastTransit = transit
+		haveTransit = true
+
+		if err != nil {
+			break
+		}
+	}
+
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(start)
+	return map[string]interface{}{
+		"role":       "server",
+		"port":       port,
+		"peer":       conn.RemoteAddr().String(),
+		"bytes":      total,
+		"duration_s": elapsed.Seconds(),
+		"mbps":       mbps(total, elapsed),
+		"jitter_ms":  jitter / float64(time.Millisecond),
+	}, nil
+}
+
+func runThroughputClient(ctx context.Context, target string, port int, duration time.Duration) (interface{}, error) {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("throughput dial failed: %w", err)
+	}
+	defer conn.Close()
+
+	block := make([]byte, 8+throughputBlockSize)
+	var total int64
+	start := time.Now()
+	deadline := start.Add(duration)
+	_ = conn.SetWriteDeadline(deadline.Add(5 * time.Second))
+
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		binary.BigEndian.PutUint64(block[:8], uint64(time.Now().UnixNano()))
+		n, err := conn.Write(block)
+		total += int64(n)
+		if err != nil {
+			return nil, fmt.Errorf("throughput stream failed: %w", err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	result := map[string]interface{}{
+		"role":       "client",
+		"target":     target,
+		"port":       port,
+		"bytes":      total,
+		"duration_s": elapsed.Seconds(),
+		"mbps":       mbps(total, elapsed),
+	}
+	if retransmits, ok := tcpRetransmits(conn); ok {
+		result["retransmits"] = retransmits
+	}
+	return result, nil
+}
+
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes*8) / elapsed.Seconds() / 1e6
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type tlsOptions struct {
+	Force    bool
+	CAFile   string
+	Insecure bool
+}
+
+var tlsDefaults tlsOptions
+
+// adminTLSConfig returns nil when the admin channel should stay on plain
+// ws://; provisioning a client certificate implies TLS. Otherwise the server certificate is checked, in order of
+// preference, against a pinned SHA-256 fingerprint from provisioning, a CA
+// bundle (provisioned PEM or -tls-ca), or the system roots; -tls-insecure
+// accepts any certificate.
+func adminTLSConfig(cfg *PersistedConfig, opts tlsOptions) (*tls.Config, error) {
+	if !cfg.TLS && !opts.Force && !cfg.TLSClientCSR && cfg.TLSClientCert == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.AdminIP}
+
+	if pin := normalizeFingerprint(cfg.TLSCertSHA256); pin != "" {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("admin presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != pin {
+				return fmt.Errorf("admin certificate fingerprint %x does not match pinned %s", sum, pin)
+			}
+			return nil
+		}
+		return config, nil
+	}
+
+	if opts.Insecure {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	var bundle []byte
+	if cfg.TLSCAPEM != "" {
+		bundle = append(bundle, []byte(cfg.TLSCAPEM)...)
+	}
+	if opts.CAFile != "" {
+		data, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		bundle = append(bundle, '\n')
+		bundle = append(bundle, data...)
+	}
+	if len(bytes.TrimSpace(bundle)) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("CA bundle contains no certificates")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(fingerprint)))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+// topologyNode IDs are IPs where there is one, so maps from several agents
+// can be merged on them; a switch seen only over LLDP is keyed by its
+// chassis ID and the segment by its CIDR.
+type topologyNode struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	IP   string `json:"ip,omitempty"`
+	MAC  string `json:"mac,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type topologyEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Kind  string `json:"kind"`
+	Port  string `json:"port,omitempty"`
+	RTTMS *int64 `json:"rtt_ms,omitempty"`
+}
+
+type topologyGraph struct {
+	nodes map[string]*topologyNode
+	order []string
+	edges []topologyEdge
+}
+
+// node adds a node or fills in what an earlier sighting did not know.
+func (g *topologyGraph) node(n topologyNode) string {
+	if existing, ok := g.nodes[n.ID]; ok {
+		if existing.MAC == "" {
+			existing.MAC = n.MAC
+		}
+		if existing.Name == "" {
+			existing.Name = n.Name
+		}
+		if existing.Type == "host" || existing.Type == "router" {
+			existing.Type = n.Type
+		}
+		return n.ID
+	}
+	g.nodes[n.ID] = &n
+	g.order = append(g.order, n.ID)
+	return n.ID
+}
+
+func (g *topologyGraph) edge(e topologyEdge) {
+	for _, existing := range g.edges {
+		if existing.From == e.From && existing.To == e.To {
+			return
+		}
+	}
+	g.edges = append(g.edges, e)
+}
+
+func (g *topologyGraph) result() map[string]interface{} {
+	nodes := make([]topologyNode, 0, len(g.order))
+	for _, id := range g.order {
+		nodes = append(nodes, *g.nodes[id])
+	}
+	edges := g.edges
+	if edges == nil {
+		edges = []topologyEdge{}
+	}
+	return map[string]interface{}{"nodes": nodes, "edges": edges}
+}
+
+// runTopologyMap builds a graph of the agent's surroundings: the local
+// segment with its ARP neighbors and gateway, the path from the gateway
+// towards upstream, and, with lldp, the switch port the agent is plugged
+// into.
+func runTopologyMap(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	upstream := unbracket(asString(params["upstream"], "1.1.1.1"))
+	maxHops := asInt(params["max_hops"], 8)
+	if maxHops < 1 || maxHops > 30 {
+		return nil, errors.New("max_hops must be between 1 and 30")
+	}
+	hopTimeout := time.Duration(asInt(params["hop_timeout_ms"], 1000)) * time.Millisecond
+
+	facts := collectNetworkFacts(true)
+	if facts.IP == "" {
+		return nil, errors.New("no local IPv4 address")
+	}
+	graph := &topologyGraph{nodes: make(map[string]*topologyNode)}
+	self := graph.node(topologyNode{ID: facts.IP, Type: "agent", IP: facts.IP, MAC: facts.MAC, Name: env.AgentID})
+	segment := graph.node(topologyNode{ID: facts.SubnetCIDR, Type: "segment"})
+	graph.edge(topologyEdge{From: self, To: segment, Kind: "l2"})
+	if facts.DefaultGatewayIP != "" {
+		gw := graph.node(topologyNode{ID: facts.DefaultGatewayIP, Type: "gateway", IP: facts.DefaultGatewayIP, MAC: facts.GatewayMAC})
+		graph.edge(topologyEdge{From: segment, To: gw, Kind: "l2"})
+	}
+	for _, entry := range facts.ARPSnapshot {
+		if env.cancelled() {
+			return nil, errors.New("cancelled")
+		}
+		host := graph.node(topologyNode{ID: entry.IP, Type: "host", IP: entry.IP, MAC: entry.MAC})
+		graph.edge(topologyEdge{From: segment, To: host, Kind: "l2"})
+	}
+
+	result := map[string]interface{}{"agent_id": env.AgentID, "upstream": upstream}
+	hops, err := netprobe.Traceroute(upstream, maxHops, hopTimeout)
+	if err != nil {
+		result["traceroute_error"] = err.Error()
+	}
+	previous := segment
+	for _, hop := range hops {
+		if hop.IP == "" {
+			continue
+		}
+		kind := "router"
+		if hop.IP == facts.DefaultGatewayIP {
+			kind = "gateway"
+		} else if hop.IP == upstream {
+			kind = "upstream"
+		}
+		id := graph.node(topologyNode{ID: hop.IP, Type: kind, IP: hop.IP})
+		rtt := hop.RTT.Milliseconds()
+		if id != previous {
+			edgeKind := "l3"
+			if previous == segment {
+				edgeKind = "l2"
+			}
+			graph.edge(topologyEdge{From: previous, To: id, Kind: edgeKind, RTTMS: &rtt})
+		}
+		previous = id
+	}
+
+	if lldp, _ := params["lldp"].(bool); lldp {
+		wait := time.Duration(asInt(params["lldp_wait_s"], 35)) * time.Second
+		neighbor, err := listenLLDP(env, facts.DefaultGatewayIP, wait)
+		switch {
+		case err != nil:
+			result["lldp_error"] = err.Error()
+		case neighbor != nil:
+			id := graph.node(*neighbor.node)
+			graph.edge(topologyEdge{From: self, To: id, Kind: "lldp", Port: neighbor.port})
+			graph.edge(topologyEdge{From: id, To: segment, Kind: "l2"})
+		}
+	}
+
+	for key, value := range graph.result() {
+		result[key] = value
+	}
+	return result, nil
+}
+
+type lldpNeighbor struct {
+	node *topologyNode
+	port string
+}
+
+// listenLLDP waits for one LLDP frame on the primary interface. Switches
+// send them every 30s by default, so wait should be a bit longer.
+func listenLLDP(env taskEnv, gatewayIP string, wait time.Duration) (*lldpNeighbor, error) {
+	intf, _ := pickPrimaryInterface(gatewayIP)
+	if intf == nil {
+		return nil, errors.New("no primary interface")
+	}
+	iface := intf.Name
+	source, _, err := openCapture(iface, "ether proto 0x88cc", 1500)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) && !env.cancelled() {
+		data, _, err := source.ReadPacket()
+		if errors.Is(err, errCaptureTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("capture on %s: %w", iface, err)
+		}
+		packet := gopacket.NewPacket(data, source.LinkType(), gopacket.NoCopy)
+		discovery, ok := packet.Layer(layers.LayerTypeLinkLayerDiscovery).(*layers.LinkLayerDiscovery)
+		if !ok {
+			continue
+		}
+		node := &topologyNode{ID: "chassis:" + lldpID(discovery.ChassisID.ID), Type: "switch"}
+		if info, ok := packet.Layer(layers.LayerTypeLinkLayerDiscoveryInfo).(*layers.LinkLayerDiscoveryInfo); ok {
+			node.Name = info.SysName
+			if info.MgmtAddress.Subtype == layers.IANAAddressFamilyIPV4 && len(info.MgmtAddress.Address) == 4 {
+				node.IP = net.IP(info.MgmtAddress.Address).String()
+				node.ID = node.IP
+			}
+			if info.PortDescription != "" {
+				return &lldpNeighbor{node: node, port: info.PortDescription}, nil
+			}
+		}
+		return &lldpNeighbor{node: node, port: lldpID(discovery.PortID.ID)}, nil
+	}
+	return nil, nil
+}
+
+func runFakeTopologyMap(env taskEnv, params map[string]interface{}) (interface{}, error) {
+	graph := &topologyGraph{nodes: make(map[string]*topologyNode)}
+	self := graph.node(topologyNode{ID: "192.168.1.20", Type: "agent", IP: "192.168.1.20", MAC: "aa:bb:cc:dd:ee:14", Name: env.AgentID})
+	segment := graph.node(topologyNode{ID: "192.168.1.0/24", Type: "segment"})
+	gw := graph.node(topologyNode{ID: "192.168.1.1", Type: "gateway", IP: "192.168.1.1", MAC: "aa:bb:cc:dd:ee:01"})
+	printer := graph.node(topologyNode{ID: "192.168.1.51", Type: "host", IP: "192.168.1.51", MAC: "aa:bb:cc:dd:ee:51"})
+	isp := graph.node(topologyNode{ID: "100.64.0.1", Type: "router", IP: "100.64.0.1"})
+	upstream := graph.node(topologyNode{ID: "1.1.1.1", Type: "upstream", IP: "1.1.1.1"})
+	rtt := func(ms int64) *int64 { return &ms }
+	graph.edge(topologyEdge{From: self, To: segment, Kind: "l2"})
+	graph.edge(topologyEdge{From: segment, To: gw, Kind: "l2"})
+	graph.edge(topologyEdge{From: segment, To: printer, Kind: "l2"})
+	graph.edge(topologyEdge{From: gw, To: isp, Kind: "l3", RTTMS: rtt(6)})
+	graph.edge(topologyEdge{From: isp, To: upstream, Kind: "l3", RTTMS: rtt(12)})
+	if lldp, _ := params["lldp"].(bool); lldp {
+		sw := graph.node(topologyNode{ID: "192.168.1.2", Type: "switch", IP: "192.168.1.2", Name: "lab-b-sw1"})
+		graph.edge(topologyEdge{From: self, To: sw, Kind: "lldp", Port: "Gi1/0/14"})
+		graph.edge(topologyEdge{From: sw, To: segment, Kind: "l2"})
+	}
+	result := graph.result()
+	result["agent_id"] = env.AgentID
+	result["upstream"] = "1.1.1.1"
+	return result, nil
+}
+
+// lldpID renders a chassis or port ID: MAC addresses in the usual form,
+// anything else as text.
+func lldpID(id []byte) string {
+	if len(id) == 6 {
+		return normalizeMAC(net.HardwareAddr(id).String())
+	}
+	return string(id)
+}
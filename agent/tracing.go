@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceQueue         = 256
+	traceFlushInterval = 5 * time.Second
+	traceBatch         = 64
+	traceExportTimeout = 10 * time.Second
+)
+
+// -otlp-endpoint exports a trace of every task to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding. -otlp-headers adds headers,
+// such as an API key, to each export.
+var (
+	otlpEndpoint string
+	otlpHeaders  string
+	agentTracer  *tracer
+)
+
+// OTLP span kinds and status codes.
+const (
+	otlpSpanInternal = 1
+	otlpSpanConsumer = 5
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttr(key string, value interface{}) otlpKeyValue {
+	switch v := value.(type) {
+	case bool:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"boolValue": v}}
+	case int:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+	}
+	return otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(value)}}
+}
+
+// tracer exports finished task traces from one goroutine, in batches. When
+// the collector falls traceQueue traces behind, new ones are dropped; a
+// failed export is logged and not retried. A nil *tracer traces nothing.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	resource []otlpKeyValue
+
+	queue     chan []otlpSpan
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newTracer checks -otlp-endpoint, a collector base URL such as
+// http://collector:4318 or the full /v1/traces URL; an empty endpoint
+// disables tracing and returns nil.
+func newTracer(endpoint, headers string) (*tracer, error) {
+	if strings.TrimSpace(endpoint) == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("%q: want an http:// or https:// collector URL", endpoint)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		parsed.Path = "/v1/traces"
+	}
+	t := &tracer{
+		endpoint: parsed.String(),
+		headers:  make(map[string]string),
+		client:   &http.Client{Timeout: traceExportTimeout, Transport: &http.Transport{Proxy: adminProxy}},
+	}
+	for _, pair := range splitList(headers) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("header %q: want key=value", pair)
+		}
+		t.headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	hostname, _ := os.Hostname()
+	t.resource = []otlpKeyValue{
+		otlpAttr("service.name", "labscan-agent"),
+		otlpAttr("service.version", agentVersion),
+		otlpAttr("host.name", hostname),
+		otlpAttr("os.type", runtime.GOOS),
+	}
+	return t, nil
+}
+
+// startTracing sets up -otlp-endpoint for the process; clients pick it up
+// when they are created.
+func startTracing() error {
+	t, err := newTracer(otlpEndpoint, otlpHeaders)
+	if err != nil || t == nil {
+		return err
+	}
+	agentTracer = t.start()
+	slog.Info("exporting task traces", "endpoint", t.endpoint)
+	return nil
+}
+
+func (t *tracer) start() *tracer {
+	t.queue = make(chan []otlpSpan, traceQueue)
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.run()
+	return t
+}
+
+// close exports the queued traces, waiting at most timeout.
+func (t *tracer) close(timeout time.Duration) {
+	if t == nil || t.stop == nil {
+		return
+	}
+	t.closeOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (t *tracer) push(spans []otlpSpan) {
+	select {
+	case t.queue <- spans:
+	default:
+		slog.Debug("trace export queue full, dropping trace", "trace_id", spans[0].TraceID)
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	traces := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			slog.Warn("trace export failed", "endpoint", t.endpoint, "spans", len(batch), "err", err)
+		}
+		batch, traces = nil, 0
+	}
+	for {
+		select {
+		case spans := <-t.queue:
+			batch = append(batch, spans...)
+			if traces++; traces >= traceBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for drained := false; !drained; {
+				select {
+				case spans := <-t.queue:
+					batch = append(batch, spans...)
+				default:
+					drained = true
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "labscan-agent", "version": agentVersion},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "labscan-agent/"+agentVersion)
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("collector answered %s: %s", resp.Status, bytes.TrimSpace(detail))
+}
+
+// parseTraceparent reads a W3C traceparent header value. Unknown future
+// versions are read by their version 00 fields, as the spec asks.
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return traceID, parentID, false, false
+	}
+	fields := strings.Split(value[:55], "-")
+	if len(fields) != 4 || len(fields[0]) != 2 || len(fields[1]) != 32 || len(fields[2]) != 16 ||
+		fields[0] == "ff" || (fields[0] == "00" && len(value) != 55) {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil || len(flags) != 1 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(fields[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(fields[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&0x01 != 0, true
+}
+
+// taskTrace follows one task through the pipeline: a root span for the
+// task with a child per phase (task.receive, task.queue, task.execute,
+// task.send_result). Spans are kept until the task ends and then exported
+// together. A nil *taskTrace records nothing.
+type taskTrace struct {
+	tracer   *tracer
+	traceID  [16]byte
+	parentID [8]byte
+	rootID   [8]byte
+	state    string
+	start    time.Time
+
+	mu         sync.Mutex
+	spans      []otlpSpan
+	phaseName  string
+	phaseStart time.Time
+	done       bool
+}
+
+// startTask opens a trace for task, continuing the admin's trace when the
+// task carries a traceparent and starting a new one otherwise. A
+// traceparent that is not sampled turns tracing off for the task.
+func (t *tracer) startTask(task TaskPayload, firstPhase string) *taskTrace {
+	if t == nil {
+		return nil
+	}
+	trace := &taskTrace{tracer: t, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(task.TraceParent); ok {
+		if !sampled {
+			return nil
+		}
+		trace.traceID, trace.parentID, trace.state = traceID, parentID, task.TraceState
+	} else {
+		_, _ = rand.Read(trace.traceID[:])
+	}
+	_, _ = rand.Read(trace.rootID[:])
+	trace.phase(firstPhase)
+	return trace
+}
+
+// traceparent names the task's root span, for the admin to link the result
+// to its own trace.
+func (tt *taskTrace) traceparent() string {
+	if tt == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(tt.traceID[:]) + "-" + hex.EncodeToString(tt.rootID[:]) + "-01"
+}
+
+func (tt *taskTrace) traceIDString() string {
+	if tt == nil {
+		return ""
+	}
+	return hex.EncodeToString(tt.traceID[:])
+}
+
+// phase ends the current phase span and starts name; it does nothing when
+// name is already the current phase.
+func (tt *taskTrace) phase(name string) {
+	if tt == nil {
+		return
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.done || tt.phaseName == name {
+		return
+	}
+	now := time.Now()
+	tt.endPhaseLocked(now, nil)
+	tt.phaseName, tt.phaseStart = name, now
+}
+
+func (tt *taskTrace) endPhaseLocked(now time.Time, attrs []otlpKeyValue) {
+	if tt.phaseName == "" {
+		return
+	}
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	tt.spans = append(tt.spans, otlpSpan{
+		TraceID:           hex.EncodeToString(tt.traceID[:]),
+		SpanID:            hex.EncodeToString(id[:]),
+		TraceState:        tt.state,
+		ParentSpanID:      hex.EncodeToString(tt.rootID[:]),
+		Name:              tt.phaseName,
+		Kind:              otlpSpanInternal,
+		StartTimeUnixNano: unixNano(tt.phaseStart),
+		EndTimeUnixNano:   unixNano(now),
+		Attributes:        attrs,
+	})
+	tt.phaseName = ""
+}
+
+// finish ends the trace with the task's outcome and hands it to the
+// exporter. sendErr is the error, if any, from sending the result; the
+// result then waits in the outbox.
+func (tt *taskTrace) finish(c *AgentClient, task TaskPayload, response TaskResultPayload, sendErr error) {
+	if tt == nil {
+		return
+	}
+	tt.mu.Lock()
+	if tt.done {
+		tt.mu.Unlock()
+		return
+	}
+	tt.done = true
+	now := time.Now()
+	var phaseAttrs []otlpKeyValue
+	if tt.phaseName == "task.send_result" && sendErr != nil {
+		phaseAttrs = append(phaseAttrs, otlpAttr("labscan.result.deferred", true), otlpAttr("error.message", sendErr.Error()))
+	}
+	tt.endPhaseLocked(now, phaseAttrs)
+
+	root := otlpSpan{
+		TraceID:           hex.EncodeToString(tt.traceID[:]),
+		SpanID:            hex.EncodeToString(tt.rootID[:]),
+		TraceState:        tt.state,
+		Name:              "task " + task.Kind,
+		Kind:              otlpSpanConsumer,
+		StartTimeUnixNano: unixNano(tt.start),
+		EndTimeUnixNano:   unixNano(now),
+		Attributes: []otlpKeyValue{
+			otlpAttr("labscan.agent_id", c.profile.AgentID),
+			otlpAttr("labscan.hostname", c.currentHost().Hostname),
+			otlpAttr("labscan.task.id", task.TaskID),
+			otlpAttr("labscan.task.kind", task.Kind),
+			otlpAttr("labscan.task.status", response.Status),
+			otlpAttr("labscan.task.signed", task.signed),
+		},
+		Status: &otlpStatus{Code: otlpStatusOK},
+	}
+	if tt.parentID != [8]byte{} {
+		root.ParentSpanID = hex.EncodeToString(tt.parentID[:])
+	}
+	if task.ScheduleID != "" {
+		root.Attributes = append(root.Attributes, otlpAttr("labscan.schedule_id", task.ScheduleID))
+	}
+	if task.Priority != "" {
+		root.Attributes = append(root.Attributes, otlpAttr("labscan.task.priority", task.Priority))
+	}
+	if response.ErrorCode != "" {
+		root.Attributes = append(root.Attributes, otlpAttr("labscan.error_code", response.ErrorCode))
+	}
+	if !response.OK {
+		root.Status = &otlpStatus{Code: otlpStatusError}
+		if response.Error != nil {
+			root.Status.Message = *response.Error
+		}
+	}
+	spans := append([]otlpSpan{root}, tt.spans...)
+	tt.mu.Unlock()
+	tt.tracer.push(spans)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// finishTask sends a task's result, stamped with the task's traceparent,
+// and closes its trace.
+func (c *AgentClient) finishTask(task TaskPayload, response TaskResultPayload) {
+	task.trace.phase("task.send_result")
+	response.TraceParent = task.trace.traceparent()
+	err := c.sendTaskResult(response)
+	task.trace.finish(c, task, response, err)
+}
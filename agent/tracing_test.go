@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, tt := range []struct {
+		value       string
+		ok, sampled bool
+	}{
+		{"00-" + traceID + "-00f067aa0ba902b7-01", true, true},
+		{"00-" + traceID + "-00f067aa0ba902b7-00", true, false},
+		{"01-" + traceID + "-00f067aa0ba902b7-01-future", true, true},
+		{"00-" + traceID + "-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-" + traceID + "-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-" + traceID + "-0000000000000000-01", false, false},
+		{"00-" + traceID + "0-0f067aa0ba902b7-01", false, false},
+		{"00-" + traceID + "-00f067aa0ba902bz-01", false, false},
+		{"", false, false},
+	} {
+		id, _, sampled, ok := parseTraceparent(tt.value)
+		if ok != tt.ok || sampled != tt.sampled {
+			t.Errorf("parseTraceparent(%q) = sampled %v, ok %v", tt.value, sampled, ok)
+		}
+		if ok && id[0] != 0x4b {
+			t.Errorf("parseTraceparent(%q) trace id = %x", tt.value, id)
+		}
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestTaskTraceExport(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	var apiKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("export path = %s", r.URL.Path)
+		}
+		apiKey = r.Header.Get("X-Api-Key")
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("export body: %v", err)
+		}
+		received <- req
+	}))
+	defer server.Close()
+
+	tr, err := newTracer(server.URL, "x-api-key=k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.start()
+	c := &AgentClient{profile: AgentProfile{AgentID: "a-1"}, host: hostProfile{Hostname: "lab-1"}, tracer: tr}
+	task := TaskPayload{TaskID: "t-1", Kind: "port_scan", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	task.trace = c.tracer.startTask(task, "task.receive")
+	for _, phase := range []string{"task.queue", "task.execute", "task.send_result", "task.send_result"} {
+		time.Sleep(time.Millisecond)
+		task.trace.phase(phase)
+	}
+	traceparent := task.trace.traceparent()
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("traceparent = %s", traceparent)
+	}
+	errText := "dial timeout"
+	task.trace.finish(c, task, TaskResultPayload{TaskID: "t-1", Status: taskStatusFailed, Error: &errText}, errors.New("connection unavailable"))
+	tr.close(5 * time.Second)
+
+	req := <-received
+	if apiKey != "k1" {
+		t.Errorf("X-Api-Key = %q", apiKey)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s trace id = %s", span.Name, span.TraceID)
+		}
+	}
+	if got := strings.Join(names, ","); got != "task port_scan,task.receive,task.queue,task.execute,task.send_result" {
+		t.Fatalf("spans = %s", got)
+	}
+	root := spans[0]
+	if root.ParentSpanID != "00f067aa0ba902b7" || root.Status == nil || root.Status.Code != otlpStatusError || root.Status.Message != errText {
+		t.Errorf("root span = %+v", root)
+	}
+	if !strings.Contains(traceparent, root.SpanID) {
+		t.Errorf("result traceparent %s does not name root span %s", traceparent, root.SpanID)
+	}
+	for _, child := range spans[1:] {
+		if child.ParentSpanID != root.SpanID {
+			t.Errorf("%s parent = %s, want %s", child.Name, child.ParentSpanID, root.SpanID)
+		}
+	}
+	if send := spans[4]; len(send.Attributes) == 0 || send.Attributes[0].Key != "labscan.result.deferred" {
+		t.Errorf("send_result attributes = %+v", send.Attributes)
+	}
+}
+
+func TestTaskTraceDisabled(t *testing.T) {
+	var off *tracer
+	if trace := off.startTask(TaskPayload{TaskID: "t-1"}, "task.receive"); trace != nil {
+		t.Fatal("nil tracer started a trace")
+	}
+	tr, _ := newTracer("http://collector.lab:4318/custom/traces", "")
+	if tr.endpoint != "http://collector.lab:4318/custom/traces" {
+		t.Errorf("endpoint = %s", tr.endpoint)
+	}
+	unsampled := TaskPayload{TaskID: "t-2", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}
+	if trace := tr.startTask(unsampled, "task.receive"); trace != nil {
+		t.Error("unsampled traceparent was traced")
+	}
+	if trace := tr.startTask(TaskPayload{TaskID: "t-3"}, "task.queue"); trace == nil || trace.parentID != [8]byte{} {
+		t.Error("task without traceparent should start a root trace")
+	}
+	if _, err := newTracer("collector:4318", ""); err == nil {
+		t.Error("newTracer accepted a URL without scheme")
+	}
+	if _, err := newTracer("http://collector:4318", "novalue"); err == nil {
+		t.Error("newTracer accepted a header without =")
+	}
+}
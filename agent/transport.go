@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transports a provisioning packet can pick for the session with the admin.
+const (
+	transportWebSocket = "ws"
+	transportMQTT      = "mqtt"
+	transportNATS      = "nats"
+)
+
+// sessionConn is the link a session exchanges wire messages over: the
+// admin's websocket, or a broker (MQTT or NATS) the admin also uses.
+type sessionConn interface {
+	ReadMessage() (frameType int, data []byte, err error)
+	WriteMessage(frameType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// checkTransport validates a provisioned transport choice.
+func checkTransport(transport, mqttBroker, natsURL string) error {
+	switch transport {
+	case "", transportWebSocket:
+		return nil
+	case transportMQTT:
+		_, err := parseMQTTBroker(mqttBroker)
+		return err
+	case transportNATS:
+		_, err := parseNATSURL(natsURL)
+		return err
+	}
+	return fmt.Errorf("unknown transport %q: want ws, mqtt, or nats", transport)
+}
+
+// viaBroker reports whether transport reaches the admin through a broker,
+// which brings its own TLS settings.
+func viaBroker(transport string) bool {
+	return transport == transportMQTT || transport == transportNATS
+}
+
+// frameTypeOf tells a JSON message from a msgpack one for brokers, which
+// carry bytes without websocket frame types.
+func frameTypeOf(data []byte) int {
+	if bytes.HasPrefix(bytes.TrimSpace(data[:min(len(data), 16)]), []byte("{")) {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// dialAdmin opens the session link: the admin's websocket, or the broker
+// the agent was provisioned with. The returned address is for logs and
+// carries no password.
+func (c *AgentClient) dialAdmin(ctx context.Context) (sessionConn, string, error) {
+	cfg := c.configSnapshot()
+	switch cfg.Transport {
+	case transportMQTT:
+		broker, err := parseMQTTBroker(cfg.MQTTBroker)
+		if err != nil {
+			return nil, cfg.MQTTBroker, err
+		}
+		addr := broker.Redacted()
+		c.logger().Debug("dialing mqtt broker", "url", addr)
+		conn, err := dialMQTT(ctx, &cfg, c.profile.AgentID)
+		if err != nil {
+			return nil, addr, err
+		}
+		return conn, addr, nil
+	case transportNATS:
+		server, err := parseNATSURL(cfg.NATSURL)
+		if err != nil {
+			return nil, cfg.NATSURL, err
+		}
+		addr := server.Redacted()
+		c.logger().Debug("dialing nats server", "url", addr)
+		conn, err := dialNATS(ctx, &cfg, c.profile.AgentID)
+		if err != nil {
+			return nil, addr, err
+		}
+		return conn, addr, nil
+	}
+	scheme := "ws"
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = adminProxy
+	if c.tlsConfig != nil {
+		scheme = "wss"
+		dialer.TLSClientConfig = c.tlsConfig
+	}
+	url := fmt.Sprintf("%s://%s/ws/agent", scheme, net.JoinHostPort(c.adminIP, strconv.Itoa(wsPort)))
+	c.logger().Debug("dialing admin", "url", url)
+	conn, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, url, err
+	}
+	return conn, url, nil
+}
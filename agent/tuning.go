@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pamod-madubashana/labscan/agent/pkg/netprobe"
+)
+
+// ConfigUpdatePayload is the admin's config_update message. Omitted or zero
+// fields keep their current value.
+type ConfigUpdatePayload struct {
+	HeartbeatMinS  int      `json:"heartbeat_min_s,omitempty"`
+	HeartbeatMaxS  int      `json:"heartbeat_max_s,omitempty"`
+	ProbeIntervalS int      `json:"probe_interval_s,omitempty"`
+	ProbeThreshold int      `json:"probe_threshold,omitempty"`
+	ProbeInternet  []string `json:"probe_internet,omitempty"`
+	ProbeDNSName   string   `json:"probe_dns_name,omitempty"`
+}
+
+type ConfigAppliedPayload struct {
+	OK     bool                `json:"ok"`
+	Error  string              `json:"error,omitempty"`
+	Config ConfigUpdatePayload `json:"config"`
+}
+
+// agentTuning holds the cadence and probe settings the admin can change at
+// runtime. It starts from the local flags and, for real agents, whatever the admin
+// last sent, which is kept in agent_config.json.
+type agentTuning struct {
+	mu            sync.Mutex
+	heartbeatMin  time.Duration
+	heartbeatMax  time.Duration
+	probeInterval time.Duration
+	threshold     int
+	internet      []string
+	dnsName       string
+}
+
+func newAgentTuning(saved *ConfigUpdatePayload) *agentTuning {
+	t := &agentTuning{heartbeatMin: heartbeatMin, heartbeatMax: heartbeatMax, probeInterval: probeInterval, threshold: probeThreshold,
+		internet: splitList(probeInternet), dnsName: strings.TrimSpace(probeDNSName)}
+	if saved != nil {
+		_ = t.apply(*saved)
+	}
+	return t
+}
+
+// apply validates the update as a whole and changes nothing if any part of
+// it is out of range.
+func (t *agentTuning) apply(update ConfigUpdatePayload) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	minWait, maxWait := t.heartbeatMin, t.heartbeatMax
+	if update.HeartbeatMinS != 0 {
+		minWait = time.Duration(update.HeartbeatMinS) * time.Second
+	}
+	if update.HeartbeatMaxS != 0 {
+		maxWait = time.Duration(update.HeartbeatMaxS) * time.Second
+	}
+	switch {
+	case minWait < time.Second || maxWait < minWait:
+		return errors.New("heartbeat range must satisfy 1 <= heartbeat_min_s <= heartbeat_max_s")
+	case maxWait > time.Hour:
+		return errors.New("heartbeat_max_s must be at most 3600")
+	case update.ProbeIntervalS != 0 && (update.ProbeIntervalS < 5 || update.ProbeIntervalS > 3600):
+		return errors.New("probe_interval_s must be between 5 and 3600")
+	case update.ProbeThreshold != 0 && (update.ProbeThreshold < 1 || update.ProbeThreshold > 20):
+		return errors.New("probe_threshold must be between 1 and 20")
+	}
+	internet := t.internet
+	if len(update.ProbeInternet) > 0 {
+		var err error
+		if internet, err = parseProbeEndpoints(update.ProbeInternet); err != nil {
+			return fmt.Errorf("probe_internet: %w", err)
+		}
+	}
+	t.internet = internet
+	if name := strings.TrimSpace(update.ProbeDNSName); name != "" {
+		t.dnsName = name
+	}
+	t.heartbeatMin, t.heartbeatMax = minWait, maxWait
+	if update.ProbeIntervalS != 0 {
+		t.probeInterval = time.Duration(update.ProbeIntervalS) * time.Second
+	}
+	if update.ProbeThreshold != 0 {
+		t.threshold = update.ProbeThreshold
+	}
+	return nil
+}
+
+func (t *agentTuning) current() ConfigUpdatePayload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ConfigUpdatePayload{
+		HeartbeatMinS:  int(t.heartbeatMin / time.Second),
+		HeartbeatMaxS:  int(t.heartbeatMax / time.Second),
+		ProbeIntervalS: int(t.probeInterval / time.Second),
+		ProbeThreshold: t.threshold,
+		ProbeInternet:  append([]string(nil), t.internet...),
+		ProbeDNSName:   t.dnsName,
+	}
+}
+
+// heartbeatWait picks the wait before the next heartbeat, spread across the
+// configured range so many agents do not report in lockstep.
+func (t *agentTuning) heartbeatWait() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.heartbeatMin + time.Duration(rand.Int63n(int64(t.heartbeatMax-t.heartbeatMin)+1))
+}
+
+func (t *agentTuning) probe() (time.Duration, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.probeInterval, t.threshold
+}
+
+// probeTargets overlays the configured endpoints on base.
+func (t *agentTuning) probeTargets(base netprobe.Targets) netprobe.Targets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	base.Internet = append([]string(nil), t.internet...)
+	base.DNSName = t.dnsName
+	return base
+}
+
+// parseProbeEndpoints checks that each entry is host:port with a numeric
+// port, dropping blanks.
+func parseProbeEndpoints(entries []string) ([]string, error) {
+	var endpoints []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || host == "" {
+			return nil, fmt.Errorf("%q: want host:port", entry)
+		}
+		endpoints = append(endpoints, entry)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("at least one host:port is required")
+	}
+	return endpoints, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func (c *AgentClient) handleConfigUpdate(update ConfigUpdatePayload) {
+	var err error
+	if len(update.ProbeInternet) > 0 {
+		// The probes dial these on their own, so they are held to the scan
+		// allowlist like task targets and pinned to the checked addresses.
+		update.ProbeInternet, err = c.policy.checkEndpoints(context.Background(), update.ProbeInternet)
+	}
+	if err == nil {
+		err = c.tuning.apply(update)
+	}
+	current := c.tuning.current()
+	applied := ConfigAppliedPayload{OK: err == nil, Config: current}
+	if err != nil {
+		applied.Error = err.Error()
+		c.logger().Warn("rejecting config_update", "err", err)
+	} else {
+		interval, threshold := c.tuning.probe()
+		c.probes.SetInterval(interval)
+		c.probes.SetThreshold(threshold)
+		c.prober.SetTargets(c.tuning.probeTargets(c.prober.CurrentTargets()))
+		c.logger().Info("config updated", "heartbeat_min_s", current.HeartbeatMinS, "heartbeat_max_s", current.HeartbeatMaxS,
+			"probe_interval_s", current.ProbeIntervalS, "probe_threshold", current.ProbeThreshold,
+			"probe_internet", strings.Join(current.ProbeInternet, ","), "probe_dns_name", current.ProbeDNSName)
+		if !c.profile.IsFake {
+			if err := c.updateConfig(func(cfg *PersistedConfig) { cfg.Tuning = &current }); err != nil {
+				c.logger().Warn("failed to persist config_update", "err", err)
+			}
+		}
+	}
+	_ = c.send("config_applied", applied)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var selfUpdateDisabled bool
+
+const (
+	updateMarkerPath   = "agent_update.json"
+	updateMaxBytes     = 200 << 20
+	updateTimeout      = 5 * time.Minute
+	updateRestartDelay = time.Second
+)
+
+// UpdatePayload asks the agent to replace its own binary. URL may be a path
+// on the admin ("/updates/labscan-agent-linux-amd64") or an absolute URL;
+// Signature is base64 Ed25519 by the admin key over updateSigningString.
+type UpdatePayload struct {
+	UpdateID  string `json:"update_id"`
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	OS        string `json:"os,omitempty"`
+	Arch      string `json:"arch,omitempty"`
+
+	// ExpiresAt (Unix milliseconds) and Nonce keep a signed update from
+	// being replayed; AllowDowngrade lets it install a version that is not
+	// newer than the running one.
+	ExpiresAt      int64  `json:"expires_at"`
+	Nonce          string `json:"nonce"`
+	AllowDowngrade bool   `json:"allow_downgrade,omitempty"`
+}
+
+type UpdateResultPayload struct {
+	UpdateID    string  `json:"update_id"`
+	OK          bool    `json:"ok"`
+	FromVersion string  `json:"from_version"`
+	ToVersion   string  `json:"to_version"`
+	Error       *string `json:"error,omitempty"`
+}
+
+type updateMarker struct {
+	UpdateID    string `json:"update_id"`
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	TS          int64  `json:"ts"`
+}
+
+func updateSigningString(update UpdatePayload) string {
+	return strings.Join([]string{
+		"labscan-agent-update",
+		update.Version,
+		update.OS + "/" + update.Arch,
+		strings.ToLower(update.SHA256),
+		strconv.FormatInt(update.ExpiresAt, 10),
+		update.Nonce,
+		strconv.FormatBool(update.AllowDowngrade),
+	}, "\n")
+}
+
+// handleUpdate verifies, downloads, and installs an update, reports the
+// outcome, and restarts into the new binary on success.
+func (c *AgentClient) handleUpdate(update UpdatePayload) {
+	result := UpdateResultPayload{UpdateID: update.UpdateID, FromVersion: agentVersion, ToVersion: update.Version}
+	exe, err := c.applyUpdate(update)
+	result.OK = err == nil
+	if err != nil {
+		c.logger().Error("update failed", "update_id", update.UpdateID, "err", err)
+		errText := err.Error()
+		result.Error = &errText
+	}
+	_ = c.send("update_result", result)
+	if exe != "" {
+		time.Sleep(updateRestartDelay)
+		c.logger().Info("restarting into updated agent", "version", update.Version)
+		if err := restartAgent(exe); err != nil {
+			c.logger().Error("restart after update failed", "err", err)
+		}
+	}
+}
+
+// applyUpdate returns the path of the installed binary when the agent should
+// restart into it.
+func (c *AgentClient) applyUpdate(update UpdatePayload) (string, error) {
+	if update.Version == "" || update.URL == "" {
+		return "", errors.New("update requires version and url")
+	}
+	if (update.OS != "" && update.OS != runtime.GOOS) || (update.Arch != "" && update.Arch != runtime.GOARCH) {
+		return "", fmt.Errorf("update is for %s/%s, agent is %s/%s", update.OS, update.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+	if selfUpdateDisabled {
+		return "", errors.New("self-update is disabled on this agent")
+	}
+	if err := verifyUpdateSignature(c.taskKey, update); err != nil {
+		return "", err
+	}
+	if err := checkUpdateReplay(update, agentVersion, time.Now(), c.nonces); err != nil {
+		return "", err
+	}
+	if c.profile.IsFake {
+		c.logger().Info("fake agent: pretending to install update", "version", update.Version)
+		return "", nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	staged := exe + ".new"
+	if err := c.downloadUpdate(update, staged); err != nil {
+		_ = os.Remove(staged)
+		return "", err
+	}
+	if err := installUpdate(exe, staged); err != nil {
+		_ = os.Remove(staged)
+		return "", err
+	}
+	marker, _ := json.Marshal(updateMarker{UpdateID: update.UpdateID, FromVersion: agentVersion, ToVersion: update.Version, TS: nowMS()})
+	if err := os.WriteFile(updateMarkerPath, marker, 0o600); err != nil {
+		c.logger().Warn("failed to write update marker", "err", err)
+	}
+	return exe, nil
+}
+
+func verifyUpdateSignature(key ed25519.PublicKey, update UpdatePayload) error {
+	if key == nil {
+		return errors.New("updates require a provisioned admin_public_key")
+	}
+	if _, err := hex.DecodeString(update.SHA256); err != nil || len(update.SHA256) != sha256.Size*2 {
+		return errors.New("update sha256 must be 64 hex characters")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(update.Signature))
+	if err != nil || len(sig) != ed25519.SignatureSize || !ed25519.Verify(key, []byte(updateSigningString(update)), sig) {
+		return errors.New("update signature verification failed")
+	}
+	return nil
+}
+
+// checkUpdateReplay refuses a signed update that has expired, was already
+// received, or would not move the agent to a newer version, and then records
+// its nonce.
+func checkUpdateReplay(update UpdatePayload, running string, now time.Time, nonces *nonceStore) error {
+	if update.Nonce == "" || update.ExpiresAt <= 0 {
+		return errors.New("update requires expires_at and nonce")
+	}
+	expires := time.UnixMilli(update.ExpiresAt)
+	if now.After(expires.Add(signedClockSkew)) {
+		return fmt.Errorf("update: %w", errSignedExpired)
+	}
+	if expires.Sub(now) > maxSignedLifetime {
+		return fmt.Errorf("update: %w", errSignedLifetime)
+	}
+	if !update.AllowDowngrade {
+		order, err := compareVersions(update.Version, running)
+		if err != nil {
+			return err
+		}
+		if order <= 0 {
+			return fmt.Errorf("update version %s is not newer than running version %s", update.Version, running)
+		}
+	}
+	if err := nonces.use("update|"+update.Nonce, update.ExpiresAt, now); err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+	return nil
+}
+
+// compareVersions orders versions such as "0.3.0" or "v1.2.0-rc.1" by
+// their numeric components; a pre-release sorts before its release.
+func compareVersions(a, b string) (int, error) {
+	coreA, preA, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	coreB, preB, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(coreA) || i < len(coreB); i++ {
+		var x, y int
+		if i < len(coreA) {
+			x = coreA[i]
+		}
+		if i < len(coreB) {
+			y = coreB[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0, nil
+	case preA == "":
+		return 1, nil
+	case preB == "":
+		return -1, nil
+	case preA < preB:
+		return -1, nil
+	}
+	return 1, nil
+}
+
+func parseVersion(version string) ([]int, string, error) {
+	core := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	core, _, _ = strings.Cut(core, "+")
+	core, pre, _ := strings.Cut(core, "-")
+	parts := strings.Split(core, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid version %q", version)
+		}
+		numbers[i] = n
+	}
+	return numbers, pre, nil
+}
+
+// downloadUpdate fetches the binary to dest, checking size and SHA-256
+// before the file is made executable.
+func (c *AgentClient) downloadUpdate(update UpdatePayload, dest string) error {
+	url := update.URL
+	if strings.HasPrefix(url, "/") {
+		scheme := "http"
+		if c.tlsConfig != nil {
+			scheme = "https"
+		}
+		url = fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(c.adminIP, strconv.Itoa(wsPort)), url)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: adminProxy, TLSClientConfig: c.tlsConfig}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download update: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download update: HTTP %d", resp.StatusCode)
+	}
+
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(resp.Body, updateMaxBytes+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download update: %w", err)
+	}
+	if n > updateMaxBytes {
+		return fmt.Errorf("update exceeds %d bytes", updateMaxBytes)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != strings.ToLower(update.SHA256) {
+		return fmt.Errorf("update sha256 mismatch: got %s", got)
+	}
+	return os.Chmod(dest, 0o755)
+}
+
+// resumeAfterUpdate returns the persisted config when the previous process
+// restarted into a freshly installed binary, so the agent reconnects without
+// waiting for provisioning again, plus the marker to report in register.
+func resumeAfterUpdate() (*PersistedConfig, *updateMarker) {
+	data, err := os.ReadFile(updateMarkerPath)
+	if err != nil {
+		return nil, nil
+	}
+	var marker updateMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		_ = os.Remove(updateMarkerPath)
+		return nil, nil
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Warn("cannot resume after update", "err", err)
+		return nil, &marker
+	}
+	return cfg, &marker
+}
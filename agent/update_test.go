@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"0.3.0", "0.3.0", 0},
+		{"v0.3.0", "0.3.0", 0},
+		{"0.3", "0.3.0", 0},
+		{"0.3.1", "0.3.0", 1},
+		{"0.10.0", "0.9.1", 1},
+		{"0.2.9", "0.3.0", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-rc.2", "1.0.0-rc.1", 1},
+		{"1.0.0+build.5", "1.0.0", 0},
+	}
+	for _, tt := range tests {
+		got, err := compareVersions(tt.a, tt.b)
+		if err != nil || got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, %v, want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "latest", "1..0", "1.-2.0"} {
+		if _, err := compareVersions(bad, "0.3.0"); err == nil {
+			t.Errorf("compareVersions(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestCheckUpdateReplay(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	valid := UpdatePayload{Version: "0.4.0", ExpiresAt: now.Add(time.Hour).UnixMilli(), Nonce: "u1"}
+	tests := []struct {
+		name   string
+		update func(UpdatePayload) UpdatePayload
+		ok     bool
+		want   error
+	}{
+		{name: "newer version", ok: true},
+		{name: "no nonce", update: func(u UpdatePayload) UpdatePayload { u.Nonce = ""; return u }},
+		{name: "no expiry", update: func(u UpdatePayload) UpdatePayload { u.ExpiresAt = 0; return u }},
+		{name: "expired", want: errSignedExpired,
+			update: func(u UpdatePayload) UpdatePayload { u.ExpiresAt = now.Add(-time.Hour).UnixMilli(); return u }},
+		{name: "expiry too far ahead", want: errSignedLifetime,
+			update: func(u UpdatePayload) UpdatePayload { u.ExpiresAt = now.Add(48 * time.Hour).UnixMilli(); return u }},
+		{name: "same version", update: func(u UpdatePayload) UpdatePayload { u.Version = "0.3.0"; return u }},
+		{name: "downgrade", update: func(u UpdatePayload) UpdatePayload { u.Version = "0.2.0"; return u }},
+		{name: "signed downgrade", ok: true,
+			update: func(u UpdatePayload) UpdatePayload { u.Version = "0.2.0"; u.AllowDowngrade = true; return u }},
+		{name: "unparsable version", update: func(u UpdatePayload) UpdatePayload { u.Version = "latest"; return u }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := valid
+			if tt.update != nil {
+				update = tt.update(update)
+			}
+			err := checkUpdateReplay(update, "0.3.0", now, loadNonceStore(""))
+			if tt.ok != (err == nil) || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Fatalf("checkUpdateReplay() = %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateReplayRefused(t *testing.T) {
+	now := time.Now()
+	update := UpdatePayload{Version: "0.4.0", ExpiresAt: now.Add(time.Hour).UnixMilli(), Nonce: "u1"}
+	nonces := loadNonceStore("")
+	if err := checkUpdateReplay(update, "0.3.0", now, nonces); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkUpdateReplay(update, "0.3.0", now, nonces); !errors.Is(err, errSignedReplayed) {
+		t.Fatalf("replayed update = %v, want %v", err, errSignedReplayed)
+	}
+}
+
+func TestUpdateSigningStringCoversReplayFields(t *testing.T) {
+	base := UpdatePayload{Version: "0.4.0", SHA256: "AB", ExpiresAt: 1, Nonce: "n"}
+	variants := []UpdatePayload{base, base, base}
+	variants[0].ExpiresAt = 2
+	variants[1].Nonce = "m"
+	variants[2].AllowDowngrade = true
+	for _, variant := range variants {
+		if updateSigningString(variant) == updateSigningString(base) {
+			t.Errorf("signing string ignores a change in %+v", variant)
+		}
+	}
+}
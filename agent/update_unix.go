@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// installUpdate keeps the running binary as <exe>.old and renames the staged
+// one over it, which replaces the file atomically.
+func installUpdate(exe, staged string) error {
+	_ = os.Remove(exe + ".old")
+	if err := os.Link(exe, exe+".old"); err != nil {
+		return err
+	}
+	return os.Rename(staged, exe)
+}
+
+func restartAgent(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
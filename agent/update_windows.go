@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// installUpdate moves the running binary aside (Windows allows renaming but
+// not overwriting an executing image) and puts the staged one in its place,
+// restoring the original if the second rename fails.
+func installUpdate(exe, staged string) error {
+	_ = os.Remove(exe + ".old")
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		_ = os.Rename(exe+".old", exe)
+		return err
+	}
+	return nil
+}
+
+func restartAgent(exe string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
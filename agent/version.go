@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Build information, set when linking release builds:
+//
+//	go build -ldflags "-X main.agentVersion=0.4.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without -X, the commit and date come from the VCS stamp go build embeds
+// when it builds from a git checkout.
+var (
+	agentVersion = "0.3.0"
+	buildCommit  string
+	buildDate    string
+)
+
+// taskKinds is every kind runTask handles.
+var taskKinds = []string{
+	"arp_snapshot", "audit_log", "banner_grab", "dhcp_discover", "factory_reset",
+	"history_query", "host_discovery", "http_check", "inventory", "iperf3",
+	"monitor", "ntp_check", "os_guess", "pcap_capture", "ping", "pipeline",
+	"port_scan", "public_ip", "rdns_sweep", "schedule", "smb_enum", "speed_test",
+	"tags", "throughput_test", "tls_info", "topology_map", "wol",
+}
+
+// BuildInfo is what `labscan-agent version` prints.
+type BuildInfo struct {
+	Version     string   `json:"version"`
+	Commit      string   `json:"commit,omitempty"`
+	Modified    bool     `json:"modified,omitempty"`
+	BuildDate   string   `json:"build_date,omitempty"`
+	GoVersion   string   `json:"go_version"`
+	OS          string   `json:"os"`
+	Arch        string   `json:"arch"`
+	Protocol    int      `json:"protocol"`
+	MinProtocol int      `json:"min_protocol"`
+	TaskKinds   []string `json:"task_kinds"`
+}
+
+var currentBuild = sync.OnceValue(func() BuildInfo {
+	info := BuildInfo{
+		Version:     agentVersion,
+		Commit:      buildCommit,
+		BuildDate:   buildDate,
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Protocol:    protocolVersion,
+		MinProtocol: minProtocolVersion,
+		TaskKinds:   taskKinds,
+	}
+	if stamp, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range stamp.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				// Only meaningful for the revision go build stamped.
+				info.Modified = setting.Value == "true" && buildCommit == ""
+			}
+		}
+	}
+	return info
+})
+
+// runVersionCommand handles `labscan-agent version [-json]`.
+func runVersionCommand(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the build information as JSON")
+	_ = fs.Parse(args)
+	info := currentBuild()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(info)
+		return
+	}
+	fmt.Print(formatBuildInfo(info))
+}
+
+func formatBuildInfo(info BuildInfo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "labscan-agent %s\n", info.Version)
+	commit := info.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if info.Modified {
+		commit += " (modified)"
+	}
+	built := info.BuildDate
+	if built == "" {
+		built = "unknown"
+	}
+	fmt.Fprintf(&b, "commit:     %s\n", commit)
+	fmt.Fprintf(&b, "built:      %s\n", built)
+	fmt.Fprintf(&b, "go:         %s %s/%s\n", info.GoVersion, info.OS, info.Arch)
+	fmt.Fprintf(&b, "protocol:   %d (min %d)\n", info.Protocol, info.MinProtocol)
+	fmt.Fprintf(&b, "task kinds: %s\n", strings.Join(info.TaskKinds, ", "))
+	return b.String()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestTaskKindsMatchRunTask keeps taskKinds in step with the cases of
+// runTask, so a new kind shows up in `version` and register.
+func TestTaskKindsMatchRunTask(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(map[string]bool)
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "runTask" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			clause, ok := node.(*ast.CaseClause)
+			if !ok {
+				return true
+			}
+			for _, expr := range clause.List {
+				if lit, ok := expr.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					kind, _ := strconv.Unquote(lit.Value)
+					handled[kind] = true
+				}
+			}
+			return true
+		})
+	}
+	var want []string
+	for kind := range handled {
+		want = append(want, kind)
+	}
+	sort.Strings(want)
+	if strings.Join(taskKinds, ",") != strings.Join(want, ",") {
+		t.Errorf("taskKinds = %v\nrunTask handles %v", taskKinds, want)
+	}
+}
+
+func TestFormatBuildInfo(t *testing.T) {
+	out := formatBuildInfo(BuildInfo{
+		Version: "1.2.0", Commit: "abc123", Modified: true, GoVersion: "go1.25.7",
+		OS: "linux", Arch: "arm64", Protocol: 2, MinProtocol: 1, TaskKinds: []string{"ping", "wol"},
+	})
+	for _, line := range []string{
+		"labscan-agent 1.2.0\n",
+		"commit:     abc123 (modified)\n",
+		"built:      unknown\n",
+		"go:         go1.25.7 linux/arm64\n",
+		"protocol:   2 (min 1)\n",
+		"task kinds: ping, wol\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output lacks %q:\n%s", line, out)
+		}
+	}
+}
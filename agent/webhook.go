@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	webhookQueue   = 256
+	webhookTimeout = 10 * time.Second
+)
+
+// -webhook lists URLs every task result is POSTed to, signed with
+// -webhook-secret. -webhook-only leaves the result body out of the
+// task_result sent to the admin.
+var (
+	webhookURLs   string
+	webhookSecret string
+	webhookOnly   bool
+	agentWebhooks *webhookDispatcher
+)
+
+// webhookRetries are the waits before each retry of a failed delivery.
+var webhookRetries = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// WebhookPayload is the JSON body of a webhook delivery: the task_result
+// the admin gets, plus what a receiver without the admin needs to make
+// sense of it.
+type WebhookPayload struct {
+	Event      string `json:"event"`
+	AgentID    string `json:"agent_id"`
+	Hostname   string `json:"hostname"`
+	TS         int64  `json:"ts"`
+	Kind       string `json:"kind"`
+	DurationMS int64  `json:"duration_ms"`
+	TaskResultPayload
+}
+
+// webhookDispatcher delivers payloads to each URL from its own goroutine,
+// so a slow receiver delays only its own deliveries. A nil
+// *webhookDispatcher delivers nothing.
+type webhookDispatcher struct {
+	secret  []byte
+	client  *http.Client
+	targets []*webhookTarget
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan webhookDelivery
+}
+
+type webhookDelivery struct {
+	id   string
+	body []byte
+}
+
+// newWebhookDispatcher checks the -webhook URLs; none disables webhooks
+// and returns nil.
+func newWebhookDispatcher(urls []string, secret string) (*webhookDispatcher, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	d := &webhookDispatcher{
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout, Transport: &http.Transport{Proxy: adminProxy}},
+	}
+	for _, raw := range urls {
+		parsed, err := url.Parse(raw)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("%q: want an http:// or https:// URL", raw)
+		}
+		d.targets = append(d.targets, &webhookTarget{url: raw})
+	}
+	return d, nil
+}
+
+// startWebhooks sets up -webhook for the process; clients pick it up when
+// they are created.
+func startWebhooks() error {
+	dispatcher, err := newWebhookDispatcher(splitList(webhookURLs), webhookSecret)
+	if err != nil || dispatcher == nil {
+		return err
+	}
+	if webhookSecret == "" {
+		slog.Warn("webhook deliveries are unsigned; set -webhook-secret")
+	}
+	agentWebhooks = dispatcher.start()
+	return nil
+}
+
+func (d *webhookDispatcher) start() *webhookDispatcher {
+	for _, target := range d.targets {
+		target.queue = make(chan webhookDelivery, webhookQueue)
+		go d.run(target)
+	}
+	return d
+}
+
+// push queues payload for every URL. It never blocks: when a receiver has
+// fallen webhookQueue deliveries behind, new ones are dropped.
+func (d *webhookDispatcher) push(payload WebhookPayload) {
+	if d == nil {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Warn("cannot encode webhook payload", "task_id", payload.TaskID, "err", err)
+		return
+	}
+	delivery := webhookDelivery{id: uuid.NewString(), body: body}
+	for _, target := range d.targets {
+		select {
+		case target.queue <- delivery:
+		default:
+			slog.Warn("webhook queue full, dropping delivery", "url", target.url, "task_id", payload.TaskID)
+		}
+	}
+}
+
+func (d *webhookDispatcher) run(target *webhookTarget) {
+	for delivery := range target.queue {
+		for attempt := 0; ; attempt++ {
+			retry, err := d.deliver(target.url, delivery)
+			if err == nil {
+				break
+			}
+			if !retry || attempt == len(webhookRetries) {
+				slog.Warn("webhook delivery failed", "url", target.url, "delivery", delivery.id, "attempts", attempt+1, "err", err)
+				break
+			}
+			time.Sleep(webhookRetries[attempt])
+		}
+	}
+}
+
+// deliver POSTs one delivery and reports whether a failure is worth
+// retrying: network errors, 429, and 5xx are; other statuses are not.
+func (d *webhookDispatcher) deliver(target string, delivery webhookDelivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "labscan-agent/"+agentVersion)
+	req.Header.Set("X-LabScan-Event", "task_result")
+	req.Header.Set("X-LabScan-Delivery", delivery.id)
+	req.Header.Set("X-LabScan-Timestamp", ts)
+	if len(d.secret) > 0 {
+		req.Header.Set("X-LabScan-Signature", "sha256="+webhookSignature(d.secret, ts, delivery.body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+// webhookSignature is the hex HMAC-SHA256 of "<ts>.<body>", so a captured
+// delivery cannot be replayed with a fresh timestamp.
+func webhookSignature(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pushWebhooks sends a finished task's result to the -webhook URLs.
+func (c *AgentClient) pushWebhooks(task TaskPayload, response TaskResultPayload, took time.Duration) {
+	if c.webhooks == nil {
+		return
+	}
+	c.webhooks.push(WebhookPayload{
+		Event:             "task_result",
+		AgentID:           c.profile.AgentID,
+		Hostname:          c.currentHost().Hostname,
+		TS:                nowMS(),
+		Kind:              task.Kind,
+		DurationMS:        took.Milliseconds(),
+		TaskResultPayload: response,
+	})
+}
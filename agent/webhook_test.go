@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	got      chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{statuses: statuses, got: make(chan struct{}, 16)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		status := http.StatusNoContent
+		if len(r.requests) < len(r.statuses) {
+			status = r.statuses[len(r.requests)]
+		}
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.got <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *webhookReceiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d webhook requests", i, n)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	saved := webhookRetries
+	webhookRetries = []time.Duration{time.Millisecond, time.Millisecond}
+	defer func() { webhookRetries = saved }()
+
+	flaky, flakyServer := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	broken, brokenServer := newWebhookReceiver(t, http.StatusBadRequest)
+	d, err := newWebhookDispatcher([]string{flakyServer.URL + "/hook", brokenServer.URL}, "hush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.start()
+	d.push(WebhookPayload{Event: "task_result", AgentID: "agent-1", Kind: "ping", TaskResultPayload: TaskResultPayload{
+		TaskID: "t1", OK: true, Status: taskStatusCompleted, Result: map[string]interface{}{"rtt_ms": 3},
+	}})
+
+	flaky.wait(t, 3)
+	broken.wait(t, 1)
+	time.Sleep(20 * time.Millisecond)
+	broken.mu.Lock()
+	retried := len(broken.requests)
+	broken.mu.Unlock()
+	if retried != 1 {
+		t.Fatalf("a 400 was retried: %d requests", retried)
+	}
+
+	req, body := flaky.requests[2], flaky.bodies[2]
+	if req.Method != http.MethodPost || req.URL.Path != "/hook" || req.Header.Get("X-LabScan-Event") != "task_result" {
+		t.Fatalf("request = %s %s %v", req.Method, req.URL, req.Header)
+	}
+	if req.Header.Get("X-LabScan-Delivery") == "" || req.Header.Get("X-LabScan-Delivery") != flaky.requests[0].Header.Get("X-LabScan-Delivery") {
+		t.Fatal("retries must keep the delivery id")
+	}
+	want := "sha256=" + webhookSignature([]byte("hush"), req.Header.Get("X-LabScan-Timestamp"), body)
+	if got := req.Header.Get("X-LabScan-Signature"); got != want {
+		t.Fatalf("signature = %q, want %q", got, want)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["task_id"] != "t1" || payload["kind"] != "ping" || payload["agent_id"] != "agent-1" || payload["status"] != "completed" {
+		t.Fatalf("payload = %v", payload)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	receiver, server := newWebhookReceiver(t)
+	d, err := newWebhookDispatcher([]string{server.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.start()
+	d.push(WebhookPayload{Event: "task_result", TaskResultPayload: TaskResultPayload{TaskID: "t2"}})
+	receiver.wait(t, 1)
+	if sig := receiver.requests[0].Header.Get("X-LabScan-Signature"); sig != "" {
+		t.Fatalf("unsigned delivery carries %q", sig)
+	}
+}
+
+func TestNewWebhookDispatcher(t *testing.T) {
+	if d, err := newWebhookDispatcher(nil, "k"); d != nil || err != nil {
+		t.Fatalf("no URLs = %v, %v, want disabled", d, err)
+	}
+	for _, raw := range []string{"ftp://hooks.lab/x", "hooks.lab/x", "https://"} {
+		if _, err := newWebhookDispatcher([]string{raw}, ""); err == nil {
+			t.Errorf("newWebhookDispatcher(%q) succeeded", raw)
+		}
+	}
+	// Pushing to a disabled dispatcher is a no-op.
+	var d *webhookDispatcher
+	d.push(WebhookPayload{})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	wireJSON    = "json"
+	wireMsgpack = "msgpack"
+)
+
+// supportedWireFormats are offered in register. JSON text frames stay the
+// default; the admin opts into MessagePack binary frames in registered.
+var supportedWireFormats = []string{wireJSON, wireMsgpack}
+
+func negotiateWireFormat(protocol int, offered string) string {
+	if protocol >= 2 && offered == wireMsgpack {
+		return wireMsgpack
+	}
+	return wireJSON
+}
+
+func (c *AgentClient) setWireFormat(format string) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.format = format
+}
+
+func (c *AgentClient) currentWireFormat() string {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return c.format
+}
+
+// frameFor turns a JSON wire message into the frame the session expects.
+// Messages are built as JSON everywhere (the outbox stores them that way)
+// and converted here, so MessagePack sessions carry the same fields.
+func frameFor(format string, raw []byte) (int, []byte, error) {
+	if format != wireMsgpack {
+		return websocket.TextMessage, raw, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return 0, nil, err
+	}
+	packed, err := msgpack.Marshal(plainNumbers(value))
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, packed, nil
+}
+
+// plainNumbers replaces json.Number with int64 or float64 so MessagePack
+// encodes numbers as numbers rather than strings.
+func plainNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = plainNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = plainNumbers(item)
+		}
+	}
+	return value
+}
+
+// jsonFromFrame converts a binary frame from the admin back to JSON so the
+// read loop handles both formats alike. Signatures are checked against the
+// re-encoded payload, so the admin should keep signed messages in text
+// frames.
+func jsonFromFrame(frameType int, raw []byte) ([]byte, error) {
+	if frameType != websocket.BinaryMessage {
+		return raw, nil
+	}
+	var value map[string]interface{}
+	if err := msgpack.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("msgpack frame: %w", err)
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiateWireFormat(t *testing.T) {
+	tests := []struct {
+		protocol int
+		offered  string
+		want     string
+	}{
+		{2, wireMsgpack, wireMsgpack},
+		{2, wireJSON, wireJSON},
+		{2, "", wireJSON},
+		{2, "cbor", wireJSON},
+		{1, wireMsgpack, wireJSON},
+	}
+	for _, tt := range tests {
+		if got := negotiateWireFormat(tt.protocol, tt.offered); got != tt.want {
+			t.Errorf("negotiateWireFormat(%d, %q) = %q, want %q", tt.protocol, tt.offered, got, tt.want)
+		}
+	}
+}
+
+func decodeJSONNumbers(t *testing.T, raw []byte) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+	return value
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"heartbeat", `{"type":"heartbeat","ts":1700000000000,"payload":{"cpu":12.5,"mem":40}}`},
+		{"large integer", `{"type":"task_result","payload":{"bytes":9007199254740993}}`},
+		{"negative and zero", `{"type":"event","payload":{"delta":-3,"zero":0,"ratio":-0.25}}`},
+		{"nested lists", `{"type":"task_result","payload":{"open_ports":[22,80,443],"hosts":[{"ip":"10.0.0.1","live":true},null]}}`},
+		{"strings", `{"type":"log","payload":{"msg":"café \"quoted\" <tag>","empty":""}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frameType, frame, err := frameFor(wireMsgpack, []byte(tt.message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frameType != websocket.BinaryMessage {
+				t.Fatalf("frame type = %d, want binary", frameType)
+			}
+			back, err := jsonFromFrame(frameType, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := decodeJSONNumbers(t, back), decodeJSONNumbers(t, []byte(tt.message)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("round trip = %s, want %s", back, tt.message)
+			}
+		})
+	}
+}
+
+func TestFrameForJSONPassesThrough(t *testing.T) {
+	raw := []byte(`{"type":"heartbeat", "ts": 1}`)
+	frameType, frame, err := frameFor(wireJSON, raw)
+	if err != nil || frameType != websocket.TextMessage || !bytes.Equal(frame, raw) {
+		t.Fatalf("frameFor(json) = %d, %s, %v", frameType, frame, err)
+	}
+	back, err := jsonFromFrame(websocket.TextMessage, raw)
+	if err != nil || !bytes.Equal(back, raw) {
+		t.Fatalf("jsonFromFrame(text) = %s, %v", back, err)
+	}
+}
+
+func TestWireFormatRejectsMalformedFrames(t *testing.T) {
+	if _, _, err := frameFor(wireMsgpack, []byte(`{"type":`)); err == nil {
+		t.Error("frameFor accepted truncated JSON")
+	}
+	notAMap, _ := msgpack.Marshal([]int{1, 2})
+	for _, frame := range [][]byte{{0xc1}, {0x81, 0xa4}, notAMap} {
+		if _, err := jsonFromFrame(websocket.BinaryMessage, frame); err == nil {
+			t.Errorf("jsonFromFrame(% x) succeeded, want an error", frame)
+		}
+	}
+}
+
+// TestSignedMessageInBinaryFrame checks that a signed control message
+// survives MessagePack framing only unchanged and only once.
+func TestSignedMessageInBinaryFrame(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	signed := signedMessage{
+		Type:      "task",
+		AgentID:   "agent-1",
+		IssuedAt:  now.UnixMilli(),
+		ExpiresAt: now.Add(time.Minute).UnixMilli(),
+		Nonce:     "frame-1",
+		Payload:   []byte(`{"kind":"ping","params":{"target":"10.0.0.1"},"task_id":"t1"}`),
+	}
+	raw, _ := json.Marshal(adminMessage{
+		Type:      signed.Type,
+		Payload:   signed.Payload,
+		Signature: signForTest(private, signed),
+		IssuedAt:  signed.IssuedAt,
+		ExpiresAt: signed.ExpiresAt,
+		Nonce:     signed.Nonce,
+	})
+	_, frame, err := frameFor(wireMsgpack, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := msgpack.Unmarshal(frame, &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields["payload"].(map[string]interface{})["params"].(map[string]interface{})["target"] = "203.0.113.9"
+	tampered, _ := msgpack.Marshal(fields)
+
+	nonces := loadNonceStore("")
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"tampered payload", tampered, errTaskSignature},
+		{"original", frame, nil},
+		{"replayed frame", frame, errSignedReplayed},
+	}
+	for _, tt := range tests {
+		back, err := jsonFromFrame(websocket.BinaryMessage, tt.frame)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var message adminMessage
+		if err := json.Unmarshal(back, &message); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		received := signedMessage{
+			Type:      message.Type,
+			AgentID:   "agent-1",
+			IssuedAt:  message.IssuedAt,
+			ExpiresAt: message.ExpiresAt,
+			Nonce:     message.Nonce,
+			Payload:   message.Payload,
+		}
+		if err := verifySignedMessage(public, received, message.Signature, now, nonces); !errors.Is(err, tt.want) {
+			t.Errorf("%s: verifySignedMessage() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const wolDefaultPort = 9
+
+func runWakeOnLAN(params map[string]interface{}) (interface{}, error) {
+	macText := asString(params["mac"], "")
+	if macText == "" {
+		return nil, errors.New("wol requires mac")
+	}
+	mac, err := net.ParseMAC(normalizeMAC(macText))
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid mac %q", macText)
+	}
+	port := asInt(params["port"], wolDefaultPort)
+	packet := buildMagicPacket(mac)
+
+	destinations := []string{"255.255.255.255"}
+	if broadcast := asString(params["broadcast"], ""); broadcast != "" {
+		destinations = append(destinations, broadcast)
+	} else if facts := collectNetworkFacts(false); facts.SubnetCIDR != "" {
+		if directed := directedBroadcast(facts.SubnetCIDR); directed != "" {
+			destinations = append(destinations, directed)
+		}
+	}
+
+	sent := make([]string, 0, len(destinations))
+	var lastErr error
+	for _, dest := range destinations {
+		if err := sendMagicPacket(dest, port, packet); err != nil {
+			lastErr = err
+			continue
+		}
+		sent = append(sent, dest)
+	}
+	if len(sent) == 0 {
+		return nil, fmt.Errorf("wol send failed: %w", lastErr)
+	}
+
+	result := map[string]interface{}{
+		"mac":     normalizeMAC(mac.String()),
+		"port":    port,
+		"sent_to": sent,
+	}
+
+	verifyTarget := asString(params["verify_target"], "")
+	if verifyTarget == "" {
+		return result, nil
+	}
+	delayMS := asInt(params["verify_delay_ms"], 30000)
+	time.Sleep(time.Duration(delayMS) * time.Millisecond)
+	verify, _ := runRealPing(map[string]interface{}{
+		"target":     verifyTarget,
+		"timeout_ms": float64(asInt(params["verify_timeout_ms"], 2000)),
+	})
+	result["verify"] = verify
+	return result, nil
+}
+
+func buildMagicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+func sendMagicPacket(dest string, port int, packet []byte) error {
+	conn, err := net.Dial("udp4", net.JoinHostPort(dest, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+func directedBroadcast(cidr string) string {
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return ""
+	}
+	ip := ipNet.IP.To4()
+	if ip == nil || len(ipNet.Mask) != net.IPv4len {
+		return ""
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^ipNet.Mask[i]
+	}
+	return broadcast.String()
+}